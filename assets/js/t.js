@@ -10,6 +10,7 @@
   }
 
   var TRACK_URL = getTrackerURL();
+  var BATCH_URL = TRACK_URL + "/batch";
 
   var sessionData = {
     url: window.location.href,
@@ -20,11 +21,18 @@
     maxScroll: 0,
     isActive: true,
     sent: false,
+    reported: false,
     lastSendTime: 0,
   };
 
+  // events wait here until the next flush
+  var queue = [];
+  var FLUSH_INTERVAL = 10000; // 10 secs
+  var MAX_QUEUE = 20;
+
   var inactivityTimer;
   var INACTIVITY_THRESHOLD = 30000; // 30 secs
+  var HEARTBEAT_INTERVAL = 30000; // set by the server from tracking.heartbeat_interval
 
   function markActive() {
     var now = Date.now();
@@ -92,35 +100,29 @@
     }, 100);
   }
 
-  // use beacon API to send data
-  function sendData(final) {
-    if (sessionData.sent && !final) return;
-
-    // Prevent duplicate sends within 1 second
-    var now = Date.now();
-    if (now - sessionData.lastSendTime < 1000 && !final) return;
-
-    updateActiveTime();
-
-    var dwellTime = Math.floor((now - sessionData.startTime) / 1000);
+  function enqueue(event) {
+    if (event.type !== "event") {
+      // only the latest state of a page matters
+      queue = queue.filter(function (queued) {
+        return queued.type === "event" || queued.url !== event.url;
+      });
+    }
+    queue.push(event);
+    if (queue.length >= MAX_QUEUE) flush();
+  }
 
-    var payload = {
-      url: sessionData.url,
-      referrer: sessionData.referrer,
-      dwellTime: dwellTime,
-      activeTime: sessionData.activeTime,
-      scrollDepth: sessionData.maxScroll,
-      final: final || false,
-    };
+  // use beacon API to send queued events in one request
+  function flush() {
+    if (queue.length === 0) return;
 
-    var payloadStr = JSON.stringify(payload);
+    var payloadStr = JSON.stringify(queue);
+    queue = [];
     var sent = false;
 
     // Try sendBeacon first (more reliable on page unload)
     if (navigator.sendBeacon) {
       try {
-        var blob = new Blob([payloadStr], { type: "application/json" });
-        sent = navigator.sendBeacon(TRACK_URL, payloadStr);
+        sent = navigator.sendBeacon(BATCH_URL, payloadStr);
       } catch (e) {
         sent = false;
       }
@@ -128,7 +130,7 @@
 
     // Fallback to fetch
     if (!sent) {
-      fetch(TRACK_URL, {
+      fetch(BATCH_URL, {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: payloadStr,
@@ -138,7 +140,31 @@
         // silently fail
       });
     }
+  }
 
+  function sendData(final) {
+    if (sessionData.sent && !final) return;
+
+    // Prevent duplicate sends within 1 second
+    var now = Date.now();
+    if (now - sessionData.lastSendTime < 1000 && !final) return;
+
+    updateActiveTime();
+
+    var dwellTime = Math.floor((now - sessionData.startTime) / 1000);
+
+    enqueue({
+      v: 2,
+      type: sessionData.reported ? "heartbeat" : "pageview",
+      url: sessionData.url,
+      referrer: sessionData.referrer,
+      dwellTime: dwellTime,
+      activeTime: sessionData.activeTime,
+      scrollDepth: sessionData.maxScroll,
+      final: final || false,
+    });
+
+    sessionData.reported = true;
     sessionData.lastSendTime = now;
 
     if (final) {
@@ -146,18 +172,35 @@
     }
   }
 
-  // heartbeat (30s while active)
+  // custom events: doorman.track("signup", { plan: "pro" })
+  window.doorman = {
+    track: function (name, props) {
+      var event = { v: 2, type: "event", url: window.location.href, name: String(name) };
+      if (props) {
+        event.props = {};
+        Object.keys(props).forEach(function (key) {
+          event.props[key] = String(props[key]);
+        });
+      }
+      enqueue(event);
+    },
+  };
+
+  setInterval(flush, FLUSH_INTERVAL);
+
+  // heartbeat while active
   setInterval(function () {
     if (sessionData.isActive || sessionData.activeTime > 0) {
       sendData(false);
     }
-  }, 30000);
+  }, HEARTBEAT_INTERVAL);
 
   // send on visibility change
   document.addEventListener("visibilitychange", function () {
     if (document.hidden) {
       updateActiveTime();
       sendData(false);
+      flush();
     } else {
       sessionData.lastActiveCheck = Date.now();
       markActive();
@@ -166,10 +209,12 @@
 
   window.addEventListener("beforeunload", function () {
     sendData(true);
+    flush();
   });
 
   window.addEventListener("pagehide", function () {
     sendData(true);
+    flush();
   });
 
   // activity liteners
@@ -214,6 +259,7 @@
       sessionData.maxScroll = calculateScrollDepth();
       sessionData.isActive = true;
       sessionData.sent = false;
+      sessionData.reported = false;
       markActive();
     }, 100);
   }
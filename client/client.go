@@ -0,0 +1,235 @@
+// Package client reports page views to Doorman from Go web servers, for
+// sites that don't want to ship the tracker script or want to count
+// readers without JavaScript as well.
+//
+//	dm := client.New("https://doorman.example.com", os.Getenv("DOORMAN_API_KEY"))
+//	defer dm.Close()
+//	http.ListenAndServe(":8080", dm.Middleware(mux))
+//
+// Page views go to /event like the tracker's, authenticated with an API
+// key from `doorman apikey create`, and name the visitor's IP address and
+// user agent in headers. The middleware sends them in the background and
+// drops them, rather than slowing the site down, when Doorman can't keep
+// up.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers naming the visitor, read by Doorman only along with an API key.
+const (
+	HeaderVisitorIP        = "X-Doorman-Visitor-IP"
+	HeaderVisitorUserAgent = "X-Doorman-Visitor-User-Agent"
+)
+
+// queueSize bounds the page views waiting to be sent by the middleware.
+const queueSize = 256
+
+// Client reports page views to one Doorman server. Set its fields before
+// first use.
+type Client struct {
+	// Endpoint is the Doorman server's base URL.
+	Endpoint string
+	APIKey   string
+	// HTTPClient sends reports; nil uses one with a 5 second timeout.
+	HTTPClient *http.Client
+	// ClientIP returns the visitor's address; nil uses the request's
+	// RemoteAddr. Set it when the site runs behind a proxy.
+	ClientIP func(*http.Request) string
+	// PageURL returns the URL reported for a request; nil uses the
+	// request's host and path, over https if the request came over TLS.
+	PageURL func(*http.Request) string
+	// ErrorLog receives failed reports; nil uses the standard logger.
+	ErrorLog *log.Logger
+
+	once   sync.Once
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Pageview
+	wg     sync.WaitGroup
+}
+
+// Pageview is one page view of a visitor.
+type Pageview struct {
+	URL       string
+	Referrer  string
+	IP        string
+	UserAgent string
+}
+
+func New(endpoint, apiKey string) *Client {
+	return &Client{Endpoint: strings.TrimSuffix(endpoint, "/"), APIKey: apiKey}
+}
+
+// PageviewFor describes the page view a request is.
+func (c *Client) PageviewFor(r *http.Request) Pageview {
+	pv := Pageview{Referrer: r.Referer(), UserAgent: r.UserAgent()}
+
+	if c.PageURL != nil {
+		pv.URL = c.PageURL(r)
+	} else {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		pv.URL = scheme + "://" + r.Host + r.URL.RequestURI()
+	}
+
+	if c.ClientIP != nil {
+		pv.IP = c.ClientIP(r)
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		pv.IP = host
+	} else {
+		pv.IP = r.RemoteAddr
+	}
+	return pv
+}
+
+// Send reports a page view and waits for Doorman to accept it.
+func (c *Client) Send(ctx context.Context, pv Pageview) error {
+	body, err := json.Marshal(map[string]any{"v": 2, "type": "pageview", "url": pv.URL, "referrer": pv.Referrer})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint+"/event", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	req.Header.Set(HeaderVisitorIP, pv.IP)
+	req.Header.Set(HeaderVisitorUserAgent, pv.UserAgent)
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var refused struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&refused)
+		return fmt.Errorf("doorman refused the page view of %s: %s %s", pv.URL, resp.Status, refused.Error)
+	}
+	return nil
+}
+
+// Middleware reports every successful GET of an HTML page served by next.
+func (c *Client) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if r.Method != http.MethodGet || rec.status != http.StatusOK {
+			return
+		}
+		if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+			return
+		}
+		c.enqueue(c.PageviewFor(r))
+	})
+}
+
+// Close sends the page views still queued by the middleware and stops
+// taking new ones.
+func (c *Client) Close() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.start()
+		close(c.queue)
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
+
+func (c *Client) enqueue(pv Pageview) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+
+	c.start()
+	select {
+	case c.queue <- pv:
+	default:
+		c.logf("doorman: too many page views waiting, dropped %s", pv.URL)
+	}
+}
+
+// start runs the sender the first time it's needed.
+func (c *Client) start() {
+	c.once.Do(func() {
+		c.queue = make(chan Pageview, queueSize)
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			for pv := range c.queue {
+				if err := c.Send(context.Background(), pv); err != nil {
+					c.logf("doorman: %v", err)
+				}
+			}
+		}()
+	})
+}
+
+func (c *Client) logf(format string, args ...any) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// statusRecorder notes the status a handler answers with, and sets the
+// Content-Type net/http would sniff when the handler leaves it out.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	wroteBody   bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if !r.wroteBody {
+		r.wroteBody = true
+		h := r.Header()
+		if _, ok := h["Content-Type"]; !ok && h.Get("Content-Encoding") == "" {
+			h.Set("Content-Type", http.DetectContentType(b))
+		}
+	}
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
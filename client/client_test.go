@@ -0,0 +1,136 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type received struct {
+	auth, ip, userAgent string
+	event               map[string]any
+}
+
+func newDoorman(t *testing.T, status int) (*httptest.Server, func() []received) {
+	t.Helper()
+	var mu sync.Mutex
+	var got []received
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/event" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		rec := received{auth: r.Header.Get("Authorization"), ip: r.Header.Get(HeaderVisitorIP), userAgent: r.Header.Get(HeaderVisitorUserAgent)}
+		if err := json.NewDecoder(r.Body).Decode(&rec.event); err != nil {
+			t.Errorf("invalid event: %v", err)
+		}
+		mu.Lock()
+		got = append(got, rec)
+		mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":"Unknown site"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	srv, reports := newDoorman(t, http.StatusOK)
+	dm := New(srv.URL+"/", "dm_test")
+
+	site := http.NewServeMux()
+	site.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<p>hello</p>"))
+	})
+	site.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+	})
+	site.HandleFunc("/gone", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := dm.Middleware(site)
+
+	serve := func(method, target string) {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = "192.168.1.9:4000"
+		req.Header.Set("User-Agent", "Lynx/2.9.0")
+		req.Header.Set("Referer", "https://news.example.org/")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(http.MethodGet, "http://blog.example.com/post?page=2")
+	serve(http.MethodGet, "http://blog.example.com/feed.xml")
+	serve(http.MethodGet, "http://blog.example.com/gone")
+	serve(http.MethodPost, "http://blog.example.com/post")
+	dm.Close()
+
+	got := reports()
+	if len(got) != 1 {
+		t.Fatalf("expected only the HTML page view to be reported, got %+v", got)
+	}
+	r := got[0]
+	if r.auth != "Bearer dm_test" || r.ip != "192.168.1.9" || r.userAgent != "Lynx/2.9.0" {
+		t.Fatalf("unexpected headers %+v", r)
+	}
+	if r.event["url"] != "http://blog.example.com/post?page=2" || r.event["referrer"] != "https://news.example.org/" || r.event["type"] != "pageview" {
+		t.Fatalf("unexpected event %v", r.event)
+	}
+
+	serve(http.MethodGet, "http://blog.example.com/")
+	if len(reports()) != 1 {
+		t.Fatal("expected nothing to be reported after Close")
+	}
+}
+
+func TestMiddleware_SniffedType(t *testing.T) {
+	srv, reports := newDoorman(t, http.StatusOK)
+	dm := New(srv.URL, "dm_test")
+
+	site := http.NewServeMux()
+	site.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<!DOCTYPE html><p>hello</p>"))
+	})
+	site.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User-agent: *\n"))
+	})
+	handler := dm.Middleware(site)
+
+	for _, target := range []string{"http://blog.example.com/", "http://blog.example.com/robots.txt"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Header().Get("Content-Type") == "" {
+			t.Fatalf("%s: expected the sniffed Content-Type to be set", target)
+		}
+	}
+	dm.Close()
+
+	got := reports()
+	if len(got) != 1 || got[0].event["url"] != "http://blog.example.com/" {
+		t.Fatalf("expected only the sniffed HTML page to be reported, got %+v", got)
+	}
+}
+
+func TestSend_Refused(t *testing.T) {
+	srv, _ := newDoorman(t, http.StatusForbidden)
+	dm := New(srv.URL, "dm_test")
+	dm.PageURL = func(r *http.Request) string { return "https://blog.example.com" + r.URL.Path }
+	dm.ClientIP = func(r *http.Request) string { return r.Header.Get("X-Real-IP") }
+
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/post", nil)
+	req.Header.Set("X-Real-IP", "192.168.1.10")
+	pv := dm.PageviewFor(req)
+	if pv.URL != "https://blog.example.com/post" || pv.IP != "192.168.1.10" {
+		t.Fatalf("expected the hooks to be used, got %+v", pv)
+	}
+
+	err := dm.Send(req.Context(), pv)
+	if err == nil || err.Error() != "doorman refused the page view of https://blog.example.com/post: 403 Forbidden Unknown site" {
+		t.Fatalf("expected the refusal to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+const apikeyUsage = `usage:
+  doorman apikey create --name name [--site domain]
+  doorman apikey list
+  doorman apikey revoke <id|prefix>`
+
+func runAPIKey(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(apikeyUsage)
+	}
+
+	fs := flag.NewFlagSet("apikey "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "what the key is for")
+	siteRef := fs.String("site", "", "restrict the key to one site (domain or id)")
+	positional, err := parseFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	keys := services.NewAPIKeyService(db)
+
+	switch args[0] {
+	case "create":
+		var siteID *uint
+		if *siteRef != "" {
+			site, err := services.NewSiteService(db).Find(*siteRef)
+			if err != nil {
+				return err
+			}
+			siteID = &site.ID
+		}
+
+		apiKey, key, err := keys.Create(*name, siteID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %d (%s). Store it now, it won't be shown again:\n\n%s\n", apiKey.ID, apiKey.Name, key)
+
+	case "list":
+		list, err := keys.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPREFIX\tNAME\tSITE\tLAST USED\tSTATUS")
+		for _, k := range list {
+			site, lastUsed, status := "all", "never", "active"
+			if k.Site != nil {
+				site = k.Site.Domain
+			}
+			if k.LastUsedAt != nil {
+				lastUsed = k.LastUsedAt.Format("2006-01-02 15:04")
+			}
+			if k.RevokedAt != nil {
+				status = "revoked"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Prefix, k.Name, site, lastUsed, status)
+		}
+		return w.Flush()
+
+	case "revoke":
+		if len(positional) != 1 {
+			return errors.New(apikeyUsage)
+		}
+		if err := keys.Revoke(positional[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %s\n", positional[0])
+
+	default:
+		return errors.New(apikeyUsage)
+	}
+
+	return nil
+}
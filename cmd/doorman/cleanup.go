@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	database "github.com/webbesoft/doorman/internal/database"
+)
+
+func runCleanup(configPath string, args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	days := fs.Int("days", 0, "retention period in days (defaults to retention.days)")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	db, cfg, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+
+	retention := cfg.Retention.Days
+	if *days > 0 {
+		retention = *days
+	}
+
+	if *dryRun {
+		count, err := database.CountOldData(db, retention)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Would delete %d page views older than %d days\n", count, retention)
+		return nil
+	}
+
+	deleted, err := database.CleanupOldData(db, retention)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d page views older than %d days\n", deleted, retention)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	database "github.com/webbesoft/doorman/internal/database"
+)
+
+// openDB connects with only the database settings validated, so admin
+// commands work without the server-only configuration.
+func openDB(configPath string) (*gorm.DB, *config.Config, error) {
+	cfg, err := config.Resolve(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cfg.ValidateDatabase(); err != nil {
+		return nil, nil, err
+	}
+
+	db, err := database.InitDB(cfg.Database)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return db, cfg, nil
+}
+
+// parseFlags parses flags that may appear before or after positional
+// arguments and returns the positional ones.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// readPassword reads a password from stdin, prompting when interactive.
+func readPassword(prompt string) (string, error) {
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, prompt)
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("no password given")
+	}
+	return password, nil
+}
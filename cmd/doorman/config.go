@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+func runConfig(configPath string, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: doorman config print")
+	}
+
+	cfg, err := config.Resolve(configPath)
+	if err != nil {
+		return err
+	}
+
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+
+	// Still print an invalid config so operators can see what was resolved
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errors.New("configuration is invalid")
+	}
+
+	return nil
+}
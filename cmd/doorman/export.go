@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/export"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+var exportUsage = `usage:
+  doorman export <dataset> [--site domain] [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--format csv|ndjson|parquet]
+                 [--bots] [--visitors omit|salted] [--salt text] [--output file]
+
+datasets: ` + strings.Join(services.ExportDatasets, ", ")
+
+func runExport(configPath string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	siteRef := fs.String("site", "", "site domain or id (default: all sites)")
+	from := fs.String("from", "", "first day, YYYY-MM-DD (default: the first data)")
+	to := fs.String("to", "", "last day, YYYY-MM-DD (default: today)")
+	format := fs.String("format", export.CSV, "output format: csv, ndjson or parquet")
+	bots := fs.Bool("bots", false, "include traffic flagged as bots")
+	visitors := fs.String("visitors", "omit", "visitor IDs: omit, or salted to tell visitors apart without the stored hashes")
+	salt := fs.String("salt", "", "salt for visitor IDs, to match them across exports (default: random)")
+	output := fs.String("output", "-", "file to write, - for stdout")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || !services.ValidDataset(positional[0]) {
+		return errors.New(exportUsage)
+	}
+	dataset := positional[0]
+	if !export.ValidFormat(*format) {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	filter := types.StatsFilter{}
+	if *bots {
+		filter.Bots = types.IncludeBots
+	}
+	if *from != "" {
+		if filter.From, err = time.Parse(dateLayout, *from); err != nil {
+			return fmt.Errorf("invalid --from: %w", err)
+		}
+	}
+	if *to != "" {
+		t, err := time.Parse(dateLayout, *to)
+		if err != nil {
+			return fmt.Errorf("invalid --to: %w", err)
+		}
+		filter.To = t.AddDate(0, 0, 1)
+	}
+
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	if *siteRef != "" {
+		site, err := services.NewSiteService(db).Find(*siteRef)
+		if err != nil {
+			return err
+		}
+		filter.SiteID = &site.ID
+	}
+
+	exports := services.NewExportService(db)
+	switch {
+	case *salt != "":
+		exports.VisitorSalt = []byte(*salt)
+	case *visitors == "salted":
+		exports.VisitorSalt = make([]byte, 32)
+		if _, err := rand.Read(exports.VisitorSalt); err != nil {
+			return err
+		}
+	case *visitors != "omit":
+		return fmt.Errorf("--visitors must be omit or salted")
+	}
+
+	if *output == "-" {
+		return writeExport(os.Stdout, exports, *format, dataset, filter)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeExport(f, exports, *format, dataset, filter); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeExport(w io.Writer, exports *services.ExportService, format, dataset string, filter types.StatsFilter) error {
+	buf := bufio.NewWriter(w)
+	if err := exports.Export(buf, format, dataset, filter); err != nil {
+		return err
+	}
+	return buf.Flush()
+}
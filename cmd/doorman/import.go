@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/importer"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+const importUsage = `usage:
+  doorman import logs [--format auto|combined|caddy] [--site domain] [--scheme https] [--geo] [--dry-run] <file|->...
+  doorman import plausible --site domain [--scheme https] [--until YYYY-MM-DD] [--dry-run] <export.zip|dir|file.csv>...
+  doorman import ga --site domain [--scheme https] [--until YYYY-MM-DD] [--dry-run] <report.csv|->...
+  doorman import umami [--site domain] [--scheme https] [--until YYYY-MM-DD] [--dry-run] <dump.sql|table.csv>...`
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+func runImport(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(importUsage)
+	}
+
+	switch args[0] {
+	case "logs":
+		return runImportLogs(configPath, args[1:])
+	case "plausible", "ga":
+		return runImportAggregates(configPath, args[0], args[1:])
+	case "umami":
+		return runImportUmami(configPath, args[1:])
+	default:
+		return errors.New(importUsage)
+	}
+}
+
+// importTx runs fn in a transaction that is rolled back for a dry run.
+// Otherwise fn gets db, so importers can commit as they go.
+func importTx(db *gorm.DB, dryRun bool, fn func(tx *gorm.DB) error) error {
+	if !dryRun {
+		return fn(db)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return errDryRun
+	})
+	if errors.Is(err, errDryRun) {
+		fmt.Println("Dry run: nothing was stored.")
+		return nil
+	}
+	return err
+}
+
+func runImportLogs(configPath string, args []string) error {
+	fs := flag.NewFlagSet("import logs", flag.ContinueOnError)
+	format := fs.String("format", importer.FormatAuto, "log format: auto, combined or caddy")
+	siteRef := fs.String("site", "", "site the log is for (domain or id); required for logs without hosts")
+	scheme := fs.String("scheme", "https", "scheme of page URLs in logs that don't record it")
+	geo := fs.Bool("geo", false, "look up visitors' countries, one request per new address")
+	dryRun := fs.Bool("dry-run", false, "read everything but store nothing")
+	files, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New(importUsage)
+	}
+
+	db, cfg, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	bots, err := botdetect.New(cfg.Bots, cfg.Tracking.BotScoreThreshold)
+	if err != nil {
+		return err
+	}
+
+	return importTx(db, *dryRun, func(tx *gorm.DB) error {
+		im := &importer.LogImporter{
+			DB:                tx,
+			Bots:              bots,
+			HeartbeatInterval: cfg.Tracking.HeartbeatInterval,
+			Scheme:            *scheme,
+			Since:             time.Now().AddDate(0, 0, -cfg.Retention.Days),
+		}
+		if *siteRef != "" {
+			site, err := services.NewSiteService(tx).Find(*siteRef)
+			if err != nil {
+				return err
+			}
+			im.Host = site.Domain
+		}
+		if *geo {
+			im.Geo = services.NewGeoService(tx)
+		}
+
+		for _, name := range files {
+			sum, err := importLogFile(im, name, *format)
+			if errors.Is(err, importer.ErrNoHost) {
+				return fmt.Errorf("%s: %w; pass --site", name, err)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			printViewSummary(name, sum, cfg)
+		}
+		return nil
+	})
+}
+
+// importLogFile imports one log, "-" for stdin.
+func importLogFile(im *importer.LogImporter, name, format string) (importer.Summary, error) {
+	r, done, err := openImport(name)
+	if err != nil {
+		return importer.Summary{}, err
+	}
+	defer done()
+
+	logs, err := importer.NewReader(r, format)
+	if err != nil {
+		return importer.Summary{}, err
+	}
+	return im.Import(logs)
+}
+
+func printViewSummary(name string, sum importer.Summary, cfg *config.Config) {
+	fmt.Printf("%s: %d lines, %d page views imported, %d already recorded\n", name, sum.Lines, sum.Imported, sum.Duplicates)
+	fmt.Printf("  skipped %d other requests, %d unreadable lines, %d for unknown sites, %d older than %d days",
+		sum.NotPageviews, sum.Invalid, sum.UnknownSite, sum.TooOld, cfg.Retention.Days)
+	if sum.Overlapping > 0 {
+		fmt.Printf(", %d from days Doorman tracked", sum.Overlapping)
+	}
+	fmt.Println()
+}
+
+// parseUntil reads --until, defaulting to the first day Doorman tracked
+// the site, or any site when site is nil. The zero time means there's no
+// such day.
+func parseUntil(db *gorm.DB, until string, site *models.Site) (time.Time, error) {
+	if until != "" {
+		t, err := time.Parse(time.DateOnly, until)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid --until %q, want YYYY-MM-DD", until)
+		}
+		return t, nil
+	}
+
+	query := db.Model(&models.Analytics{}).Where("source != ?", models.SourceImport)
+	if site != nil {
+		query = query.Where("site_id = ?", site.ID)
+	}
+	var first models.Analytics
+	if err := query.Order("created_at ASC").Select("created_at").Limit(1).Find(&first).Error; err != nil {
+		return time.Time{}, err
+	}
+	if first.CreatedAt.IsZero() {
+		return time.Time{}, nil
+	}
+	day := first.CreatedAt.UTC()
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+func runImportAggregates(configPath, source string, args []string) error {
+	fs := flag.NewFlagSet("import "+source, flag.ContinueOnError)
+	siteRef := fs.String("site", "", "site the export is for (domain or id)")
+	scheme := fs.String("scheme", "https", "scheme of page URLs")
+	until := fs.String("until", "", "skip figures from this day on (defaults to the first day Doorman tracked the site)")
+	dryRun := fs.Bool("dry-run", false, "read everything but store nothing")
+	files, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 || *siteRef == "" {
+		return errors.New(importUsage)
+	}
+
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	site, err := services.NewSiteService(db).Find(*siteRef)
+	if err != nil {
+		return err
+	}
+	cutoff, err := parseUntil(db, *until, site)
+	if err != nil {
+		return err
+	}
+
+	agg := importer.NewAggregates(source, site.ID, cutoff)
+	for _, name := range files {
+		if source == importer.SourcePlausible {
+			err = readPlausible(name, agg, site.Domain, *scheme)
+		} else {
+			err = readGA(name, agg, site.Domain, *scheme)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sum := agg.Summary
+	fmt.Printf("%s: %d rows read into %d daily figures\n", site.Domain, sum.Imported+sum.Overlapping+sum.Invalid, agg.Len())
+	fmt.Printf("  skipped %d unreadable rows", sum.Invalid)
+	if !cutoff.IsZero() {
+		fmt.Printf(", %d from %s on, which Doorman tracked", sum.Overlapping, cutoff.Format(time.DateOnly))
+	}
+	fmt.Println()
+
+	return importTx(db, *dryRun, func(tx *gorm.DB) error {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			return agg.Save(tx)
+		})
+	})
+}
+
+// readPlausible reads a Plausible export: the zip file it comes as, a
+// directory it was unpacked to, or some of its CSV files.
+func readPlausible(name string, agg *importer.Aggregates, host, scheme string) error {
+	read := func(file string, r io.Reader) error {
+		err := importer.ReadPlausible(file, r, agg, host, scheme)
+		if errors.Is(err, importer.ErrUnknownExport) {
+			fmt.Printf("%s: skipped, Doorman has no such stats\n", file)
+			return nil
+		}
+		return err
+	}
+
+	if stat, err := os.Stat(name); err == nil && stat.IsDir() {
+		entries, err := os.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				if err := readPlausibleFile(filepath.Join(name, e.Name()), read); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if strings.HasSuffix(name, ".zip") {
+		archive, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = read(f.Name, withProgress(r, f.Name, int64(f.UncompressedSize64)))
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return readPlausibleFile(name, read)
+}
+
+func readPlausibleFile(name string, read func(string, io.Reader) error) error {
+	r, done, err := openImport(name)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return read(strings.TrimSuffix(name, ".gz"), r)
+}
+
+func readGA(name string, agg *importer.Aggregates, host, scheme string) error {
+	r, done, err := openImport(name)
+	if err != nil {
+		return err
+	}
+	defer done()
+	if err := importer.ReadGA(r, agg, host, scheme); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// umamiTableOrder is the order Umami tables exported as CSV are read in,
+// sessions before the events that refer to them.
+var umamiTableOrder = map[string]int{importer.UmamiSessions: 0, importer.UmamiWebsites: 1, importer.UmamiEvents: 2}
+
+// umamiTable is the table a CSV file holds, by its name: session.csv,
+// website_event.csv.gz and so on.
+func umamiTable(name string) string {
+	base := filepath.Base(name)
+	base = strings.TrimSuffix(base, ".gz")
+	return strings.TrimSuffix(base, ".csv")
+}
+
+func runImportUmami(configPath string, args []string) error {
+	fs := flag.NewFlagSet("import umami", flag.ContinueOnError)
+	siteRef := fs.String("site", "", "site for events whose host is unknown (domain or id)")
+	scheme := fs.String("scheme", "https", "scheme of page URLs")
+	until := fs.String("until", "", "skip events from this day on (defaults to the first day Doorman tracked the site)")
+	dryRun := fs.Bool("dry-run", false, "read everything but store nothing")
+	files, err := parseFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New(importUsage)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return umamiTableOrder[umamiTable(files[i])] < umamiTableOrder[umamiTable(files[j])]
+	})
+
+	db, cfg, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	bots, err := botdetect.New(cfg.Bots, cfg.Tracking.BotScoreThreshold)
+	if err != nil {
+		return err
+	}
+
+	var site *models.Site
+	if *siteRef != "" {
+		if site, err = services.NewSiteService(db).Find(*siteRef); err != nil {
+			return err
+		}
+	}
+	cutoff, err := parseUntil(db, *until, site)
+	if err != nil {
+		return err
+	}
+
+	return importTx(db, *dryRun, func(tx *gorm.DB) error {
+		im := &importer.UmamiImporter{
+			DB:                tx,
+			Bots:              bots,
+			HeartbeatInterval: cfg.Tracking.HeartbeatInterval,
+			Scheme:            *scheme,
+			Since:             time.Now().AddDate(0, 0, -cfg.Retention.Days),
+			Until:             cutoff,
+		}
+		if site != nil {
+			im.Host = site.Domain
+		}
+
+		for _, name := range files {
+			r, done, err := openImport(name)
+			if err != nil {
+				return err
+			}
+			if strings.Contains(filepath.Base(name), ".csv") {
+				err = im.ReadCSV(umamiTable(name), r)
+			} else {
+				err = im.ReadDump(r)
+			}
+			done()
+			if errors.Is(err, importer.ErrNoHost) {
+				return fmt.Errorf("%s: %w; pass --site", name, err)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+
+		sum, err := im.Finish()
+		if err != nil {
+			return err
+		}
+		printViewSummary("umami", sum, cfg)
+		return nil
+	})
+}
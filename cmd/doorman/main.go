@@ -1,82 +1,90 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
 	"os"
-
-	"github.com/gorilla/sessions"
-	"github.com/labstack/echo-contrib/session"
-	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	"gorm.io/gorm"
-
-	assets "github.com/webbesoft/doorman"
-	database "github.com/webbesoft/doorman/internal/database"
-	"github.com/webbesoft/doorman/internal/handlers"
-	authMiddleware "github.com/webbesoft/doorman/internal/middleware"
-	"github.com/webbesoft/doorman/internal/services"
 )
 
-type App struct {
-	DB *gorm.DB
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: doorman [-config file] <command> [args]
+
+Commands:
+  serve                 start the analytics server (default)
+  config print          show the effective configuration with secrets redacted
+  migrate up            apply pending schema migrations
+  migrate down [steps]  roll back the last migration(s)
+  migrate status        list migrations and whether they are applied
+  user create|list|reset-password|delete
+                        manage dashboard users
+  site add|list         manage tracked sites
+  apikey create|list|revoke
+                        manage API keys
+  cleanup [--dry-run]   delete data older than the retention period
+  import logs [--format auto|combined|caddy] [--site s] [--dry-run] <file>...
+                        import page views from web server access logs
+  import plausible|ga --site s [--until YYYY-MM-DD] [--dry-run] <file>...
+                        import daily stats exported from Plausible or Google Analytics
+  import umami [--site s] [--until YYYY-MM-DD] [--dry-run] <file>...
+                        import page views from an Umami database dump
+  export <dataset> [--site s] [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--format csv|ndjson|parquet]
+                        export raw or aggregated data
+  sink list|replay [--limit n]
+                        list or resend event batches the sink couldn't deliver
+  stats [--site s] [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--format table|json]
+                        print aggregated statistics
+  vacuum                reclaim database space
+
+The config file may also be set with DOORMAN_CONFIG.
+`)
 }
 
 func main() {
-	db, err := database.InitDB()
-	if err != nil {
-		log.Fatalf("failed to connect to database: %v", err)
+	configPath := flag.String("config", os.Getenv("DOORMAN_CONFIG"), "path to YAML config file")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	command := "serve"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
 	}
 
-	app := &App{DB: db}
-
-	// Create default admin user if doesn't exist
-	if err := database.EnsureDefaultAdmin(app.DB); err != nil {
-		log.Fatalf("failed to ensure default admin: %v", err)
+	var err error
+	switch command {
+	case "serve":
+		err = runServe(*configPath)
+	case "config":
+		err = runConfig(*configPath, args)
+	case "migrate":
+		err = runMigrate(*configPath, args)
+	case "user":
+		err = runUser(*configPath, args)
+	case "site":
+		err = runSite(*configPath, args)
+	case "apikey":
+		err = runAPIKey(*configPath, args)
+	case "cleanup":
+		err = runCleanup(*configPath, args)
+	case "import":
+		err = runImport(*configPath, args)
+	case "export":
+		err = runExport(*configPath, args)
+	case "sink":
+		err = runSink(*configPath, args)
+	case "stats":
+		err = runStats(*configPath, args)
+	case "vacuum":
+		err = runVacuum(*configPath)
+	case "help", "-h", "--help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
 	}
 
-	// Initialize Echo
-	e := echo.New()
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-	}))
-
-	// Session middleware
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte(os.Getenv("DOORMAN_SESSION_SECRET")))))
-
-	// extract real IP
-	e.IPExtractor = echo.ExtractIPFromXFFHeader()
-
-	h := &handlers.Handler{DB: app.DB}
-	a := &handlers.AuthHandler{DB: app.DB}
-
-	e.POST("/event", h.Track)
-
-	// Auth routes
-	e.GET("/login", a.LoginPage)
-	e.POST("/login", a.Login)
-	e.POST("/logout", a.Logout)
-
-	e.StaticFS("/assets", echo.MustSubFS(&assets.Assets, "assets"))
-
-	// Protected routes
-	protected := e.Group("")
-	protected.Use(authMiddleware.RequireAuth)
-	protected.GET("/", h.Dashboard)
-	protected.GET("/dashboard", h.Dashboard)
-
-	// Static files
-	e.Static("/static", "static")
-
-	go services.StartCleanupRoutine(db)
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "doorman:", err)
+		os.Exit(1)
 	}
-
-	log.Printf("Server starting on port %s", port)
-	e.Logger.Fatal(e.Start(":" + port))
-
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/webbesoft/doorman/internal/config"
+	database "github.com/webbesoft/doorman/internal/database"
+)
+
+func runMigrate(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: doorman migrate up|down [steps]|status")
+	}
+
+	cfg, err := config.Resolve(configPath)
+	if err != nil {
+		return err
+	}
+	if err := cfg.ValidateDatabase(); err != nil {
+		return err
+	}
+
+	db, err := database.Open(cfg.Database)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := database.MigrateUp(db)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return nil
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid steps %q", args[1])
+			}
+		}
+		_, err := database.MigrateDown(db, steps)
+		return err
+
+	case "status":
+		statuses, err := database.MigrationStatuses(db)
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d  %-30s  %s\n", s.Version, s.Name, applied)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
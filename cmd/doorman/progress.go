@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// progressInterval is how often progress is redrawn.
+const progressInterval = 250 * time.Millisecond
+
+// progressReader shows on stderr how much of a file has been read.
+type progressReader struct {
+	r     io.Reader
+	name  string
+	size  int64
+	read  int64
+	shown time.Time
+	done  bool
+}
+
+// withProgress shows the progress of reading r, size bytes long or 0 when
+// unknown, when stderr is a terminal.
+func withProgress(r io.Reader, name string, size int64) io.Reader {
+	if stat, err := os.Stderr.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return r
+	}
+	return &progressReader{r: r, name: name, size: size}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if err == io.EOF && !p.done {
+		p.done = true
+		p.show()
+		fmt.Fprintln(os.Stderr)
+	} else if time.Since(p.shown) >= progressInterval {
+		p.show()
+	}
+	return n, err
+}
+
+func (p *progressReader) show() {
+	p.shown = time.Now()
+	if p.size > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s: %s of %s (%d%%)", p.name, byteSize(p.read), byteSize(p.size), p.read*100/p.size)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r%s: %s", p.name, byteSize(p.read))
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// openImport opens a file to import, "-" for stdin, showing progress as
+// it's read. Gzipped files are decompressed.
+func openImport(name string) (io.Reader, func(), error) {
+	var r io.Reader = os.Stdin
+	closers := []func() error{}
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, f.Close)
+		var size int64
+		if stat, err := f.Stat(); err == nil {
+			size = stat.Size()
+		}
+		r = withProgress(f, name, size)
+	}
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, gz.Close)
+		r = gz
+	}
+	return r, closeAll, nil
+}
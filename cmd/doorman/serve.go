@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"gorm.io/gorm"
+
+	assets "github.com/webbesoft/doorman"
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/config"
+	database "github.com/webbesoft/doorman/internal/database"
+	"github.com/webbesoft/doorman/internal/handlers"
+	"github.com/webbesoft/doorman/internal/mailer"
+	authMiddleware "github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/sessionstore"
+	"github.com/webbesoft/doorman/templates/emails"
+)
+
+// shutdownTimeout is how long requests in flight get to finish on
+// SIGINT or SIGTERM.
+const shutdownTimeout = 30 * time.Second
+
+type App struct {
+	DB *gorm.DB
+}
+
+func runServe(configPath string) error {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.InitDB(cfg.Database)
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+
+	app := &App{DB: db}
+
+	// Create default admin user if doesn't exist
+	if err := database.EnsureDefaultAdmin(app.DB, cfg.Admin); err != nil {
+		log.Fatalf("failed to ensure default admin: %v", err)
+	}
+
+	// Initialize Echo
+	e := echo.New()
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+
+	// Only the tracker posts cross-origin; the dashboard is same-origin.
+	e.Use(authMiddleware.IngestCORS())
+
+	// Only trusted proxies may say who the client is
+	ipExtractor, err := authMiddleware.NewIPExtractor(cfg.Proxy)
+	if err != nil {
+		return err
+	}
+	e.IPExtractor = ipExtractor
+
+	// Session middleware
+	store := sessionstore.New(app.DB, cfg.Session)
+	store.IPExtractor = e.IPExtractor
+	e.Use(session.Middleware(store))
+	e.Use(authMiddleware.CSRF(cfg.Session))
+
+	bots, err := botdetect.New(cfg.Bots, cfg.Tracking.BotScoreThreshold)
+	if err != nil {
+		return err
+	}
+
+	h := &handlers.Handler{
+		DB:                app.DB,
+		Bots:              bots,
+		HeartbeatInterval: cfg.Tracking.HeartbeatInterval,
+		Ingest:            cfg.Ingest,
+		Limiter:           services.NewIngestLimiter(cfg.Ingest),
+	}
+	if cfg.Sink.Enabled() {
+		h.Sink = services.NewEventSink(app.DB, cfg.Sink)
+	}
+	proxyAuth, err := authMiddleware.NewProxyAuth(cfg.Proxy)
+	if err != nil {
+		return err
+	}
+
+	a := &handlers.AuthHandler{DB: app.DB, Limits: cfg.Login, Proxy: proxyAuth}
+	if cfg.OIDC.Enabled() {
+		a.OIDC = services.NewOIDCService(cfg.OIDC)
+	}
+	// Scheduled reports are only sent once an SMTP server is configured
+	var mail mailer.Mailer
+	if cfg.Mail.Enabled() {
+		smtp, err := mailer.NewSMTP(cfg.Mail)
+		if err != nil {
+			return err
+		}
+		mail = smtp
+	}
+
+	hh := &handlers.HealthHandler{DB: app.DB}
+	uh := &handlers.UserHandler{DB: app.DB}
+	ah := &handlers.AccountHandler{DB: app.DB}
+	rh := &handlers.ReportHandler{DB: app.DB, Mailer: mail, BaseURL: cfg.Mail.BaseURL}
+	alh := &handlers.AlertHandler{DB: app.DB, AllowPrivate: cfg.Alerts.AllowPrivateWebhooks}
+
+	e.POST("/event", h.Track)
+	e.POST("/event/batch", h.TrackBatch)
+	e.GET("/p.gif", h.Pixel)
+
+	// Health and monitoring
+	e.GET("/healthz", hh.Healthz)
+	e.GET("/readyz", hh.Readyz)
+	if cfg.Metrics.Enabled {
+		e.GET("/metrics", hh.Metrics, authMiddleware.RequireBearerToken(cfg.Metrics.Token))
+	}
+
+	// Auth routes
+	e.GET("/login", a.LoginPage)
+	e.POST("/login", a.Login)
+	e.GET("/login/2fa", a.TwoFactorPage)
+	e.POST("/login/2fa", a.TwoFactor)
+	e.GET("/login/oidc", a.OIDCLogin)
+	e.GET("/login/oidc/callback", a.OIDCCallback)
+	e.POST("/logout", a.Logout)
+	e.GET("/invite/:token", uh.InvitePage)
+	e.POST("/invite/:token", uh.AcceptInvite)
+
+	e.GET("/assets/js/t.js", h.TrackerScript)
+	e.StaticFS("/assets", echo.MustSubFS(&assets.Assets, "assets"))
+
+	// Protected routes
+	protected := e.Group("")
+	protected.Use(authMiddleware.RequireAuth(app.DB, proxyAuth))
+	protected.GET("/", h.Dashboard)
+	protected.GET("/dashboard", h.Dashboard)
+	protected.GET("/bots", h.BotReport)
+	protected.GET("/export", h.Export)
+
+	// Account security
+	protected.GET("/account", ah.Account)
+	protected.GET("/account/security", ah.Security)
+	protected.POST("/account/password", ah.ChangePassword)
+	protected.POST("/account/sessions/revoke-others", ah.RevokeOtherSessions)
+	protected.POST("/account/sessions/:id/revoke", ah.RevokeSession)
+	protected.POST("/account/2fa/setup", ah.SetupTwoFactor)
+	protected.POST("/account/2fa/confirm", ah.ConfirmTwoFactor)
+	protected.POST("/account/2fa/recovery-codes", ah.RegenerateRecoveryCodes)
+	protected.POST("/account/2fa/disable", ah.DisableTwoFactor)
+
+	// User management
+	admin := protected.Group("", authMiddleware.RequireRole(models.RoleAdmin))
+	admin.GET("/users", uh.List)
+	admin.POST("/users/invite", uh.Invite)
+	admin.POST("/users/:id/role", uh.SetRole)
+	admin.POST("/users/:id/disable", uh.Disable)
+	admin.POST("/users/:id/enable", uh.Enable)
+	admin.POST("/users/:id/delete", uh.Delete)
+	admin.POST("/users/:id/sites", uh.SetSites)
+	admin.POST("/users/:id/2fa/reset", uh.ResetTwoFactor)
+
+	// Scheduled email reports
+	admin.GET("/reports", rh.List)
+	admin.POST("/reports", rh.Add)
+	admin.POST("/reports/:id/test", rh.SendTest)
+	admin.POST("/reports/:id/delete", rh.Delete)
+	admin.GET("/alerts", alh.List)
+	admin.POST("/alerts", alh.Add)
+	admin.POST("/alerts/:id/test", alh.SendTest)
+	admin.POST("/alerts/:id/delete", alh.Delete)
+
+	// Static files
+	e.Static("/static", "static")
+
+	go services.StartCleanupRoutine(db, cfg.Retention)
+	go services.StartBotSweepRoutine(db, bots, cfg.Tracking.HeartbeatInterval)
+	go services.StartAlertRoutine(db, cfg.Alerts)
+	sinkCtx, stopSink := context.WithCancel(context.Background())
+	sinkDone := make(chan struct{})
+	if h.Sink != nil {
+		go func() {
+			h.Sink.Run(sinkCtx)
+			close(sinkDone)
+		}()
+	} else {
+		close(sinkDone)
+	}
+	if mail != nil {
+		go services.StartReportRoutine(db, mail, emails.RenderReport, cfg.Mail)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	started := make(chan error, 1)
+	go func() {
+		log.Printf("Server starting on port %s", cfg.Server.Port)
+		started <- e.Start(":" + cfg.Server.Port)
+	}()
+
+	select {
+	case err = <-started:
+	case <-ctx.Done():
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err = e.Shutdown(shutdownCtx)
+	}
+
+	// The sink only stops once requests are done, so the events they
+	// accepted are still queued for it to keep.
+	stopSink()
+	<-sinkDone
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
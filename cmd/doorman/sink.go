@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+const sinkUsage = `usage:
+  doorman sink list
+  doorman sink replay [--limit n]`
+
+func runSink(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(sinkUsage)
+	}
+
+	fs := flag.NewFlagSet("sink "+args[0], flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "replay at most this many batches (0 for all)")
+	positional, err := parseFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return errors.New(sinkUsage)
+	}
+
+	db, cfg, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	sink := services.NewEventSink(db, cfg.Sink)
+
+	switch args[0] {
+	case "list":
+		letters, err := sink.DeadLetters()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tURL\tEVENTS\tATTEMPTS\tCREATED\tERROR")
+		for _, l := range letters {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\n", l.ID, l.URL, l.Events, l.Attempts, l.CreatedAt.Format("2006-01-02 15:04"), l.Error)
+		}
+		return w.Flush()
+
+	case "replay":
+		if cfg.Sink.Secret == "" {
+			return errors.New("sink.secret (DOORMAN_SINK_SECRET) must be set to sign replayed batches")
+		}
+		delivered, failed, err := sink.Replay(context.Background(), *limit)
+		fmt.Printf("Replayed %d batches, %d failed again\n", delivered, failed)
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d batches are still undelivered, see doorman sink list", failed)
+		}
+
+	default:
+		return errors.New(sinkUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+const siteUsage = `usage:
+  doorman site add <domain> [--name name]
+  doorman site list`
+
+func runSite(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(siteUsage)
+	}
+
+	fs := flag.NewFlagSet("site "+args[0], flag.ContinueOnError)
+	name := fs.String("name", "", "display name (defaults to the domain)")
+	positional, err := parseFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	sites := services.NewSiteService(db)
+
+	switch args[0] {
+	case "add":
+		if len(positional) != 1 {
+			return errors.New(siteUsage)
+		}
+		site, err := sites.Add(*name, positional[0])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added site %s (id %d)\n", site.Domain, site.ID)
+
+	case "list":
+		list, err := sites.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDOMAIN\tNAME\tCREATED")
+		for _, s := range list {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.ID, s.Domain, s.Name, s.CreatedAt.Format("2006-01-02"))
+		}
+		return w.Flush()
+
+	default:
+		return errors.New(siteUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+const dateLayout = "2006-01-02"
+
+func runStats(configPath string, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	siteRef := fs.String("site", "", "site domain or id (default: all sites)")
+	from := fs.String("from", "", "first day, YYYY-MM-DD (default: 30 days ago)")
+	to := fs.String("to", "", "last day, YYYY-MM-DD (default: today)")
+	format := fs.String("format", "table", "output format: table or json")
+	limit := fs.Int("limit", 10, "rows per breakdown")
+	bots := fs.Bool("bots", false, "include traffic flagged as bots")
+	if _, err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	filter, err := parseRange(*from, *to)
+	if err != nil {
+		return err
+	}
+
+	if *bots {
+		filter.Bots = types.IncludeBots
+	}
+
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+
+	if *siteRef != "" {
+		site, err := services.NewSiteService(db).Find(*siteRef)
+		if err != nil {
+			return err
+		}
+		filter.SiteID = &site.ID
+	}
+
+	report, err := services.NewStatsService(db).Report(filter, *limit)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case "table":
+		return printReport(os.Stdout, report)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+}
+
+// parseRange turns inclusive YYYY-MM-DD bounds into a filter
+func parseRange(from, to string) (types.StatsFilter, error) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	filter := types.StatsFilter{
+		From: today.AddDate(0, 0, -30),
+		To:   today.AddDate(0, 0, 1),
+	}
+
+	if from != "" {
+		t, err := time.Parse(dateLayout, from)
+		if err != nil {
+			return filter, fmt.Errorf("invalid --from: %w", err)
+		}
+		filter.From = t
+	}
+	if to != "" {
+		t, err := time.Parse(dateLayout, to)
+		if err != nil {
+			return filter, fmt.Errorf("invalid --to: %w", err)
+		}
+		filter.To = t.AddDate(0, 0, 1)
+	}
+	if !filter.To.After(filter.From) {
+		return filter, fmt.Errorf("--to must not be before --from")
+	}
+
+	return filter, nil
+}
+
+func printReport(out io.Writer, r types.StatsReport) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Period\t%s to %s\n", r.From.Format(dateLayout), r.To.AddDate(0, 0, -1).Format(dateLayout))
+	fmt.Fprintf(w, "Page visits\t%d\n", r.Metrics.TotalPageVisits)
+	fmt.Fprintf(w, "Unique visitors\t%d\n", r.Metrics.UniqueVisitors)
+	fmt.Fprintf(w, "Avg dwell time\t%.0fs\n", r.Metrics.AvgDwellTime)
+	fmt.Fprintf(w, "Avg scroll depth\t%.0f%%\n", r.Metrics.AvgScrollDepth)
+	fmt.Fprintf(w, "Bot share\t%.1f%%\n", r.Metrics.BotPercentage)
+
+	fmt.Fprintln(w, "\nPAGE\tVISITS\tAVG TIME\tAVG SCROLL")
+	for _, p := range r.TopPages {
+		fmt.Fprintf(w, "%s\t%d\t%.0fs\t%.0f%%\n", p.URL, p.Visits, p.AvgDwellTime, p.AvgScroll)
+	}
+
+	fmt.Fprintln(w, "\nREFERRER\tVISITS")
+	for _, ref := range r.TopReferrers {
+		fmt.Fprintf(w, "%s\t%d\n", ref.Referrer, ref.Count)
+	}
+
+	fmt.Fprintln(w, "\nCOUNTRY\tVISITS")
+	for _, c := range r.TopCountries {
+		fmt.Fprintf(w, "%s\t%d\n", c.Country, c.Count)
+	}
+
+	fmt.Fprintln(w, "\nDATE\tPAGE VISITS\tUNIQUE USERS")
+	for _, d := range r.Daily {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", d.Date, d.PageVisits, d.UniqueUsers)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+const userUsage = `usage:
+  doorman user create <username> [--password pw] [--role owner|admin|viewer]
+  doorman user list
+  doorman user reset-password <username> [--password pw]
+  doorman user delete <username>
+  doorman user reset-2fa <username>
+
+Without --password the password is read from stdin.`
+
+func runUser(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	password := fs.String("password", "", "password (read from stdin if omitted)")
+	role := fs.String("role", models.RoleViewer, "role for create: owner, admin or viewer")
+	positional, err := parseFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+	users := services.NewUserService(db)
+
+	switch args[0] {
+	case "create":
+		if len(positional) != 1 {
+			return errors.New(userUsage)
+		}
+		pw, err := passwordOrPrompt(*password)
+		if err != nil {
+			return err
+		}
+		user, err := users.Create(positional[0], pw, *role)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created %s %s (id %d)\n", user.Role, user.Username, user.ID)
+
+	case "list":
+		list, err := users.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tUSERNAME\tROLE\tSTATUS\tCREATED")
+		for _, u := range list {
+			status := "active"
+			if u.InvitePending() {
+				status = "invited"
+			} else if u.Disabled {
+				status = "disabled"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", u.ID, u.Username, u.Role, status, u.CreatedAt.Format("2006-01-02"))
+		}
+		return w.Flush()
+
+	case "reset-password":
+		if len(positional) != 1 {
+			return errors.New(userUsage)
+		}
+		pw, err := passwordOrPrompt(*password)
+		if err != nil {
+			return err
+		}
+		if err := users.ResetPassword(positional[0], pw); err != nil {
+			return err
+		}
+		fmt.Printf("Password reset for %s\n", positional[0])
+
+	case "delete":
+		if len(positional) != 1 {
+			return errors.New(userUsage)
+		}
+		if err := users.Delete(positional[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted user %s\n", positional[0])
+
+	case "reset-2fa":
+		if len(positional) != 1 {
+			return errors.New(userUsage)
+		}
+		user, err := users.Find(positional[0])
+		if err != nil {
+			return err
+		}
+		if err := services.NewTwoFactorService(db).Disable(user.ID); err != nil {
+			return err
+		}
+		fmt.Printf("Two-factor authentication turned off for %s\n", user.Username)
+
+	default:
+		return errors.New(userUsage)
+	}
+
+	return nil
+}
+
+func passwordOrPrompt(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+	return readPassword("Password: ")
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+
+	database "github.com/webbesoft/doorman/internal/database"
+)
+
+func runVacuum(configPath string) error {
+	db, _, err := openDB(configPath)
+	if err != nil {
+		return err
+	}
+
+	if err := database.Vacuum(db); err != nil {
+		return err
+	}
+	fmt.Println("Database vacuumed")
+	return nil
+}
@@ -0,0 +1,540 @@
+// Package botdetect scores visits for how likely they are to be automated.
+//
+// Every rule that matches a visit adds its weight to the visit's score,
+// capped to 0-100, and a visit scoring above the threshold is a bot. The
+// built-in rules are:
+//
+//   - crawler: one rule per entry of crawler-user-agents.json, a
+//     hand-picked subset of github.com/monperrus/crawler-user-agents (MIT
+//     licensed, see crawler-user-agents.LICENSE). go generate replaces it
+//     with the full upstream list.
+//   - generic_bot: user agents that call themselves a bot, crawler,
+//     spider or scraper
+//   - empty_user_agent: requests without a user agent
+//   - datacenter_ip: addresses in datacenter-ranges.txt
+//   - no_active_time, instant_scroll, too_fast, no_scroll_long_dwell:
+//     page visits that don't behave like a person reading
+//   - rapid_pages, burst_cadence, uniform_timing, no_interaction,
+//     no_heartbeat: sessions that move through pages like a script
+//
+// Configuration can reweigh or turn off any of them and add rules of its
+// own.
+package botdetect
+
+//go:generate curl -fsSL -o crawler-user-agents.json https://raw.githubusercontent.com/monperrus/crawler-user-agents/master/crawler-user-agents.json
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+//go:embed crawler-user-agents.json
+var crawlerList []byte
+
+//go:embed datacenter-ranges.txt
+var datacenterList []byte
+
+// Rule kinds.
+const (
+	KindUserAgent = "user_agent"
+	KindIP        = "ip"
+	KindBehavior  = "behavior"
+	KindSession   = "session"
+	KindCustom    = "custom"
+)
+
+// Built-in rules. Crawler list entries are named CrawlerPrefix plus their
+// pattern, with commas escaped, and weighed together under RuleCrawler.
+const (
+	RuleCrawler           = "crawler"
+	RuleGenericBot        = "generic_bot"
+	RuleEmptyUserAgent    = "empty_user_agent"
+	RuleDatacenterIP      = "datacenter_ip"
+	RuleNoActiveTime      = "no_active_time"
+	RuleInstantScroll     = "instant_scroll"
+	RuleTooFast           = "too_fast"
+	RuleNoScrollLongDwell = "no_scroll_long_dwell"
+	RuleRapidPages        = "rapid_pages"
+	RuleBurstCadence      = "burst_cadence"
+	RuleUniformTiming     = "uniform_timing"
+	RuleNoInteraction     = "no_interaction"
+	RuleNoHeartbeat       = "no_heartbeat"
+
+	CrawlerPrefix = RuleCrawler + ":"
+)
+
+// DefaultWeights are the weights of the built-in rules.
+var DefaultWeights = map[string]int{
+	RuleCrawler:           100,
+	RuleGenericBot:        60,
+	RuleEmptyUserAgent:    100,
+	RuleDatacenterIP:      40,
+	RuleNoActiveTime:      30,
+	RuleInstantScroll:     20,
+	RuleTooFast:           25,
+	RuleNoScrollLongDwell: 15,
+	RuleRapidPages:        30,
+	RuleBurstCadence:      20,
+	RuleUniformTiming:     25,
+	RuleNoInteraction:     30,
+	RuleNoHeartbeat:       35,
+}
+
+// DefaultThreshold is the score above which Default flags a visit.
+const DefaultThreshold = 50
+
+// uaCacheSize bounds the number of user agents whose matches are cached.
+const uaCacheSize = 10000
+
+var genericBot = regexp.MustCompile(`(?i)(^|[^a-z])(bot|crawler|spider|scraper)([^a-z]|$)|[a-z](bot|crawler|spider)[/;)]`)
+
+// Signals is what is known about a visit.
+type Signals struct {
+	UserAgent string
+	IP        string
+	// IPRules names the rules that matched an earlier evaluation. When
+	// IP is unknown, as when rescoring later, the IP rules among them
+	// match again.
+	IPRules []string
+	// Page visit metrics; behavior rules only apply once DwellTime is set.
+	DwellTime   int
+	ActiveTime  int
+	ScrollDepth int
+	// Session covers the visitor's other recent page visits; session
+	// rules only apply when it is set.
+	Session *Session
+}
+
+// Session summarizes a visitor's recent page visits.
+type Session struct {
+	// Starts holds when each page visit began, oldest first.
+	Starts []time.Time
+	// Interacted is set once any page reported activity or scrolling.
+	Interacted bool
+	// HeartbeatMissed is set when pages were viewed but none of them
+	// reported back within the tracker's heartbeat interval.
+	HeartbeatMissed bool
+}
+
+// pagesPerMinute is the rate pages were opened at.
+func (s *Session) pagesPerMinute() float64 {
+	if len(s.Starts) < 2 {
+		return 0
+	}
+	span := s.Starts[len(s.Starts)-1].Sub(s.Starts[0])
+	return float64(len(s.Starts)-1) / max(span.Minutes(), 1.0/60)
+}
+
+// gaps returns the time between consecutive page visits.
+func (s *Session) gaps() []time.Duration {
+	if len(s.Starts) < 2 {
+		return nil
+	}
+	gaps := make([]time.Duration, len(s.Starts)-1)
+	for i := range gaps {
+		gaps[i] = s.Starts[i+1].Sub(s.Starts[i])
+	}
+	return gaps
+}
+
+// Rule is one detection rule. A rule matches when all of its conditions
+// do; a rule with an empty network list never matches.
+type Rule struct {
+	Name   string
+	Kind   string
+	Weight int
+
+	userAgent *regexp.Regexp
+	nets      []*net.IPNet
+	test      func(Signals) bool
+}
+
+// Result is the outcome of evaluating a visit.
+type Result struct {
+	// Score is the sum of the weights of Rules, capped to 0-100.
+	Score int
+	// Rules names the rules that matched, in evaluation order.
+	Rules []string
+	// Bot is set when Score is above the threshold.
+	Bot bool
+	// Kind is the kind of the heaviest rule that matched.
+	Kind string
+}
+
+// Engine evaluates visits against a set of rules. It is safe for
+// concurrent use.
+type Engine struct {
+	Threshold int
+
+	rules  []*Rule
+	byName map[string]*Rule
+
+	mu      sync.Mutex
+	uaCache map[string][]bool
+}
+
+// New builds an engine from the built-in rules and cfg. Visits scoring
+// above threshold are bots.
+func New(cfg config.BotConfig, threshold int) (*Engine, error) {
+	crawlers := crawlerList
+	if cfg.CrawlersFile != "" {
+		data, err := os.ReadFile(cfg.CrawlersFile)
+		if err != nil {
+			return nil, fmt.Errorf("bots.crawlers_file: %w", err)
+		}
+		crawlers = data
+	}
+	datacenters := datacenterList
+	if cfg.DatacenterRangesFile != "" {
+		data, err := os.ReadFile(cfg.DatacenterRangesFile)
+		if err != nil {
+			return nil, fmt.Errorf("bots.datacenter_ranges_file: %w", err)
+		}
+		datacenters = data
+	}
+
+	e := &Engine{Threshold: threshold, byName: map[string]*Rule{}, uaCache: map[string][]bool{}}
+	add := func(r *Rule) error {
+		if _, ok := e.byName[r.Name]; ok {
+			return fmt.Errorf("bot rule %q is defined twice", r.Name)
+		}
+		e.rules = append(e.rules, r)
+		e.byName[r.Name] = r
+		return nil
+	}
+
+	crawlerRules, err := parseCrawlers(crawlers)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range crawlerRules {
+		if err := add(r); err != nil {
+			return nil, err
+		}
+	}
+
+	nets, err := parseRanges(datacenters)
+	if err != nil {
+		return nil, fmt.Errorf("datacenter ranges: %w", err)
+	}
+	behavior := func(f func(Signals) bool) func(Signals) bool {
+		return func(s Signals) bool { return s.DwellTime > 0 && f(s) }
+	}
+	session := func(f func(*Session) bool) func(Signals) bool {
+		return func(s Signals) bool { return s.Session != nil && f(s.Session) }
+	}
+	builtin := []*Rule{
+		{Name: RuleGenericBot, Kind: KindUserAgent, userAgent: genericBot},
+		{Name: RuleEmptyUserAgent, Kind: KindUserAgent, test: func(s Signals) bool {
+			return strings.TrimSpace(s.UserAgent) == ""
+		}},
+		{Name: RuleDatacenterIP, Kind: KindIP, nets: nets},
+		{Name: RuleNoActiveTime, Kind: KindBehavior, test: behavior(func(s Signals) bool {
+			return s.ActiveTime == 0
+		})},
+		{Name: RuleInstantScroll, Kind: KindBehavior, test: behavior(func(s Signals) bool {
+			return s.ScrollDepth == 100 && s.ActiveTime < 2
+		})},
+		{Name: RuleTooFast, Kind: KindBehavior, test: behavior(func(s Signals) bool {
+			return s.ScrollDepth > 80 && s.DwellTime < 3
+		})},
+		{Name: RuleNoScrollLongDwell, Kind: KindBehavior, test: behavior(func(s Signals) bool {
+			return s.ScrollDepth == 0 && s.DwellTime > 10
+		})},
+		{Name: RuleRapidPages, Kind: KindSession, test: session(func(s *Session) bool {
+			return len(s.Starts) >= 5 && s.pagesPerMinute() > 20
+		})},
+		{Name: RuleBurstCadence, Kind: KindSession, test: session(func(s *Session) bool {
+			// three pages within a second
+			for i := 2; i < len(s.Starts); i++ {
+				if s.Starts[i].Sub(s.Starts[i-2]) < time.Second {
+					return true
+				}
+			}
+			return false
+		})},
+		{Name: RuleUniformTiming, Kind: KindSession, test: session(uniformTiming)},
+		{Name: RuleNoInteraction, Kind: KindSession, test: session(func(s *Session) bool {
+			return len(s.Starts) >= 3 && !s.Interacted
+		})},
+		{Name: RuleNoHeartbeat, Kind: KindSession, test: session(func(s *Session) bool {
+			return s.HeartbeatMissed
+		})},
+	}
+	for _, r := range builtin {
+		r.Weight = DefaultWeights[r.Name]
+		if err := add(r); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range cfg.Rules {
+		r := &Rule{Name: c.Name, Kind: KindCustom, Weight: c.Weight}
+		if c.UserAgent != "" {
+			if r.userAgent, err = regexp.Compile(c.UserAgent); err != nil {
+				return nil, fmt.Errorf("bot rule %q: %w", c.Name, err)
+			}
+		}
+		if len(c.IPs) > 0 {
+			if r.nets, err = config.ParseNets(c.IPs); err != nil {
+				return nil, fmt.Errorf("bot rule %q: %w", c.Name, err)
+			}
+		}
+		if err := add(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.reweigh(cfg.Weights); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+var (
+	defaultOnce   sync.Once
+	defaultEngine *Engine
+)
+
+// Default returns an engine with the built-in rules and DefaultThreshold.
+func Default() *Engine {
+	defaultOnce.Do(func() {
+		e, err := New(config.BotConfig{}, DefaultThreshold)
+		if err != nil {
+			panic("botdetect: built-in rules: " + err.Error())
+		}
+		defaultEngine = e
+	})
+	return defaultEngine
+}
+
+// reweigh applies configured weights, then drops rules weighing 0.
+// RuleCrawler sets every crawler rule not given a weight of its own.
+func (e *Engine) reweigh(weights map[string]int) error {
+	if w, ok := weights[RuleCrawler]; ok {
+		for _, r := range e.rules {
+			if _, own := weights[r.Name]; !own && strings.HasPrefix(r.Name, CrawlerPrefix) {
+				r.Weight = w
+			}
+		}
+	}
+	for name, w := range weights {
+		if name == RuleCrawler {
+			continue
+		}
+		r, ok := e.byName[name]
+		if !ok {
+			return fmt.Errorf("bots.weights: unknown rule %q", name)
+		}
+		r.Weight = w
+	}
+
+	kept := e.rules[:0]
+	for _, r := range e.rules {
+		if r.Weight == 0 {
+			delete(e.byName, r.Name)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	e.rules = kept
+	return nil
+}
+
+// Evaluate scores a visit.
+func (e *Engine) Evaluate(s Signals) Result {
+	uaHits := e.userAgentHits(s.UserAgent)
+	ip := net.ParseIP(s.IP)
+
+	var res Result
+	heaviest := 0
+	for i, r := range e.rules {
+		if r.userAgent != nil && !uaHits[i] {
+			continue
+		}
+		if r.nets != nil && !contains(r.nets, ip) && (ip != nil || !slices.Contains(s.IPRules, r.Name)) {
+			continue
+		}
+		if r.test != nil && !r.test(s) {
+			continue
+		}
+		res.Score += r.Weight
+		res.Rules = append(res.Rules, r.Name)
+		if r.Weight > heaviest {
+			heaviest, res.Kind = r.Weight, r.Kind
+		}
+	}
+
+	res.Score = min(max(res.Score, 0), 100)
+	res.Bot = res.Score > e.Threshold
+	return res
+}
+
+// userAgentHits reports, for each rule, whether its user agent pattern
+// matches ua. Matching every crawler pattern is the expensive part of
+// evaluating a visit, so results are cached per user agent.
+func (e *Engine) userAgentHits(ua string) []bool {
+	e.mu.Lock()
+	hits, ok := e.uaCache[ua]
+	e.mu.Unlock()
+	if ok {
+		return hits
+	}
+
+	hits = make([]bool, len(e.rules))
+	for i, r := range e.rules {
+		hits[i] = r.userAgent != nil && r.userAgent.MatchString(ua)
+	}
+
+	e.mu.Lock()
+	if len(e.uaCache) >= uaCacheSize {
+		e.uaCache = map[string][]bool{}
+	}
+	e.uaCache[ua] = hits
+	e.mu.Unlock()
+	return hits
+}
+
+// Rules returns the active rules sorted by name.
+func (e *Engine) Rules() []Rule {
+	rules := make([]Rule, len(e.rules))
+	for i, r := range e.rules {
+		rules[i] = *r
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// Rule looks up an active rule by name.
+func (e *Engine) Rule(name string) (Rule, bool) {
+	r, ok := e.byName[name]
+	if !ok {
+		return Rule{}, false
+	}
+	return *r, true
+}
+
+// uniformTiming reports sessions whose pages follow each other at the
+// same pace, within a tenth of a second or 5%, as scripts that sleep
+// between requests do.
+func uniformTiming(s *Session) bool {
+	gaps := s.gaps()
+	if len(gaps) < 4 {
+		return false
+	}
+	lo, hi := slices.Min(gaps), slices.Max(gaps)
+	var sum time.Duration
+	for _, g := range gaps {
+		sum += g
+	}
+	mean := sum / time.Duration(len(gaps))
+	return hi-lo <= max(100*time.Millisecond, mean/20)
+}
+
+// CrawlerName turns a crawler rule's name into something readable, the
+// literal text its pattern starts with, such as "Googlebot" for
+// "crawler:Googlebot\/". ok is false for other rules.
+func CrawlerName(rule string) (name string, ok bool) {
+	escaped, ok := strings.CutPrefix(rule, CrawlerPrefix)
+	if !ok {
+		return "", false
+	}
+	pattern := ruleUnescaper.Replace(escaped)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return pattern, true
+	}
+	prefix, _ := re.LiteralPrefix()
+	if prefix = strings.Trim(prefix, " /-_;("); prefix == "" {
+		return pattern, true
+	}
+	return prefix, true
+}
+
+// Rule names are stored comma-separated, so the commas some patterns have,
+// as in a{2,3}, are escaped in the rule's name, along with the escape.
+var (
+	ruleEscaper   = strings.NewReplacer("%", "%25", ",", "%2C")
+	ruleUnescaper = strings.NewReplacer("%25", "%", "%2C", ",")
+)
+
+// CrawlerRule returns the name of the rule for a crawler list pattern.
+func CrawlerRule(pattern string) string {
+	return CrawlerPrefix + ruleEscaper.Replace(pattern)
+}
+
+// parseCrawlers reads a crawler-user-agents.json list. Patterns Go's
+// regexp package can't compile are skipped.
+func parseCrawlers(data []byte) ([]*Rule, error) {
+	var entries []struct {
+		Pattern string `json:"pattern"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("crawler list: %w", err)
+	}
+
+	rules := make([]*Rule, 0, len(entries))
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if entry.Pattern == "" || seen[entry.Pattern] {
+			continue
+		}
+		seen[entry.Pattern] = true
+		re, err := regexp.Compile(entry.Pattern)
+		if err != nil {
+			log.Printf("Skipping crawler pattern %q: %v", entry.Pattern, err)
+			continue
+		}
+		rules = append(rules, &Rule{
+			Name:      CrawlerRule(entry.Pattern),
+			Kind:      KindUserAgent,
+			Weight:    DefaultWeights[RuleCrawler],
+			userAgent: re,
+		})
+	}
+	return rules, nil
+}
+
+// parseRanges reads one IP or CIDR per line; blank lines and lines
+// starting with # are ignored.
+func parseRanges(data []byte) ([]*net.IPNet, error) {
+	var entries []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return config.ParseNets(entries)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
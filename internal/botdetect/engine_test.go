@@ -0,0 +1,231 @@
+package botdetect
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+const (
+	chrome  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+	firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	safari  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"
+	cubot   = "Mozilla/5.0 (Linux; Android 9; CUBOT_X20 Build/PPR1.180610.011) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36"
+)
+
+func TestEvaluate(t *testing.T) {
+	e := Default()
+
+	tests := []struct {
+		name  string
+		s     Signals
+		rules []string
+		bot   bool
+	}{
+		{name: "browser", s: Signals{UserAgent: chrome, IP: "192.168.1.5"}},
+		{name: "phone named like a bot", s: Signals{UserAgent: cubot}},
+		{name: "uptime checker title", s: Signals{UserAgent: firefox + " check-monitor"}},
+		{
+			name:  "crawler",
+			s:     Signals{UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"},
+			rules: []string{CrawlerPrefix + `Googlebot\/`, RuleGenericBot},
+			bot:   true,
+		},
+		{name: "http library", s: Signals{UserAgent: "python-requests/2.31.0"}, rules: []string{CrawlerPrefix + "python-requests"}, bot: true},
+		{name: "self-declared bot", s: Signals{UserAgent: "AcmeBot/1.0"}, rules: []string{RuleGenericBot}, bot: true},
+		{name: "empty user agent", s: Signals{UserAgent: " "}, rules: []string{RuleEmptyUserAgent}, bot: true},
+		{name: "datacenter", s: Signals{UserAgent: chrome, IP: "159.89.10.20"}, rules: []string{RuleDatacenterIP}},
+		{
+			name:  "datacenter and idle",
+			s:     Signals{UserAgent: chrome, IP: "2a01:4f8::1", DwellTime: 30},
+			rules: []string{RuleDatacenterIP, RuleNoActiveTime, RuleNoScrollLongDwell},
+			bot:   true,
+		},
+		{name: "reader", s: Signals{UserAgent: safari, DwellTime: 60, ActiveTime: 40, ScrollDepth: 70}},
+		{
+			name:  "instant scroll",
+			s:     Signals{UserAgent: safari, DwellTime: 2, ActiveTime: 1, ScrollDepth: 100},
+			rules: []string{RuleInstantScroll, RuleTooFast},
+		},
+		{name: "behavior needs dwell time", s: Signals{UserAgent: safari, ScrollDepth: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := e.Evaluate(tt.s)
+			if !slices.Equal(res.Rules, tt.rules) {
+				t.Fatalf("expected rules %v, got %v", tt.rules, res.Rules)
+			}
+			if res.Bot != tt.bot {
+				t.Fatalf("expected bot=%v, got %+v", tt.bot, res)
+			}
+		})
+	}
+}
+
+func TestEvaluate_Score(t *testing.T) {
+	res := Default().Evaluate(Signals{UserAgent: "", IP: "159.89.10.20", DwellTime: 30})
+	if res.Score != 100 {
+		t.Fatalf("expected the score to be capped at 100, got %d", res.Score)
+	}
+	if res.Kind != KindUserAgent {
+		t.Fatalf("expected the heaviest rule's kind, got %q", res.Kind)
+	}
+}
+
+func TestEvaluate_Session(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	every := func(n int, gap time.Duration) []time.Time {
+		starts := make([]time.Time, n)
+		for i := range starts {
+			starts[i] = start.Add(time.Duration(i) * gap)
+		}
+		return starts
+	}
+
+	tests := []struct {
+		name    string
+		session Session
+		rules   []string
+	}{
+		{name: "reader", session: Session{Starts: []time.Time{start, start.Add(40 * time.Second), start.Add(3 * time.Minute)}, Interacted: true}},
+		{name: "script", session: Session{Starts: every(6, 2*time.Second), Interacted: true}, rules: []string{RuleRapidPages, RuleUniformTiming}},
+		{name: "burst", session: Session{Starts: every(3, 300*time.Millisecond), Interacted: true}, rules: []string{RuleBurstCadence}},
+		{name: "never interacted", session: Session{Starts: every(3, time.Minute)}, rules: []string{RuleNoInteraction}},
+		{
+			name:    "uneven but fast",
+			session: Session{Starts: []time.Time{start, start.Add(time.Second), start.Add(4 * time.Second), start.Add(5 * time.Second), start.Add(9 * time.Second)}, Interacted: true},
+			rules:   []string{RuleRapidPages},
+		},
+		{name: "no heartbeat", session: Session{Starts: every(1, 0), HeartbeatMissed: true}, rules: []string{RuleNoHeartbeat}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := Default().Evaluate(Signals{UserAgent: safari, Session: &tt.session})
+			if !slices.Equal(res.Rules, tt.rules) {
+				t.Fatalf("expected rules %v, got %v", tt.rules, res.Rules)
+			}
+		})
+	}
+}
+
+func TestEvaluate_IPRules(t *testing.T) {
+	res := Default().Evaluate(Signals{UserAgent: chrome, IPRules: []string{RuleDatacenterIP}})
+	if !slices.Equal(res.Rules, []string{RuleDatacenterIP}) {
+		t.Fatalf("expected the earlier IP match to carry over, got %v", res.Rules)
+	}
+	res = Default().Evaluate(Signals{UserAgent: chrome, IP: "192.168.1.5", IPRules: []string{RuleDatacenterIP}})
+	if len(res.Rules) != 0 {
+		t.Fatalf("expected a known IP to be evaluated afresh, got %v", res.Rules)
+	}
+}
+
+func TestCrawlerList(t *testing.T) {
+	var entries []struct {
+		Pattern   string   `json:"pattern"`
+		Instances []string `json:"instances"`
+	}
+	if err := json.Unmarshal(crawlerList, &entries); err != nil {
+		t.Fatalf("invalid crawler list: %v", err)
+	}
+
+	e := Default()
+	for _, entry := range entries {
+		for _, ua := range entry.Instances {
+			if !slices.Contains(e.Evaluate(Signals{UserAgent: ua}).Rules, CrawlerRule(entry.Pattern)) {
+				t.Errorf("%q doesn't match its own instance %q", entry.Pattern, ua)
+			}
+		}
+	}
+	for _, ua := range []string{chrome, firefox, safari, cubot} {
+		if res := e.Evaluate(Signals{UserAgent: ua}); len(res.Rules) > 0 {
+			t.Errorf("browser %q matched %v", ua, res.Rules)
+		}
+	}
+}
+
+func TestCrawlerName(t *testing.T) {
+	for rule, want := range map[string]string{
+		CrawlerPrefix + `Googlebot\/`:               "Googlebot",
+		CrawlerPrefix + "AdsBot-Google([^-]|$)":     "AdsBot-Google",
+		CrawlerPrefix + "[wW]get":                   "[wW]get",
+		CrawlerPrefix + "Screaming Frog SEO Spider": "Screaming Frog SEO Spider",
+		CrawlerRule("[sS]craper{1,2}"):              "[sS]craper{1,2}",
+	} {
+		if got, ok := CrawlerName(rule); !ok || got != want {
+			t.Errorf("CrawlerName(%q) = %q, want %q", rule, got, want)
+		}
+	}
+	if _, ok := CrawlerName(RuleGenericBot); ok {
+		t.Error("expected other rules not to be crawlers")
+	}
+}
+
+func TestNew_Config(t *testing.T) {
+	dir := t.TempDir()
+	crawlers := filepath.Join(dir, "crawlers.json")
+	if err := os.WriteFile(crawlers, []byte(`[{"pattern":"Acme"},{"pattern":"(?<=x)y"},{"pattern":"Fetch(er){1,2}"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ranges := filepath.Join(dir, "ranges.txt")
+	if err := os.WriteFile(ranges, []byte("# office\n203.0.113.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := New(config.BotConfig{
+		CrawlersFile:         crawlers,
+		DatacenterRangesFile: ranges,
+		Weights:              map[string]int{RuleCrawler: 70, RuleNoActiveTime: 0},
+		Rules: []config.BotRule{
+			{Name: "staff", IPs: []string{"198.51.100.0/24"}, Weight: -100},
+			{Name: "synthetic", UserAgent: "Synthetic", IPs: []string{"203.0.113.9"}, Weight: 80},
+		},
+	}, 60)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := e.Rule(CrawlerPrefix + "(?<=x)y"); ok {
+		t.Fatal("expected the pattern Go can't compile to be skipped")
+	}
+	if _, ok := e.Rule(RuleNoActiveTime); ok {
+		t.Fatal("expected a weight of 0 to turn the rule off")
+	}
+	if r, _ := e.Rule(CrawlerPrefix + "Acme"); r.Weight != 70 {
+		t.Fatalf("expected the crawler weight to apply, got %d", r.Weight)
+	}
+
+	if res := e.Evaluate(Signals{UserAgent: "Acme/1.0"}); !res.Bot || res.Score != 70 {
+		t.Fatalf("expected the replacement crawler list to be used, got %+v", res)
+	}
+	// Rule names are stored comma-separated, so a pattern's commas mustn't
+	// show in its name.
+	if res := e.Evaluate(Signals{UserAgent: "Fetcher/1.0"}); !slices.Equal(res.Rules, []string{CrawlerRule("Fetch(er){1,2}")}) ||
+		strings.Contains(res.Rules[0], ",") {
+		t.Fatalf("expected the crawler rule's name to be escaped, got %+v", res)
+	}
+	if res := e.Evaluate(Signals{UserAgent: "Googlebot/2.1", IP: "198.51.100.7"}); res.Bot || res.Score != 0 {
+		t.Fatalf("expected the negative weight to clear the score, got %+v", res)
+	}
+	if res := e.Evaluate(Signals{UserAgent: "Synthetic", IP: "203.0.113.8"}); strings.Contains(strings.Join(res.Rules, ","), "synthetic") {
+		t.Fatalf("expected a custom rule to need both its user agent and IP, got %+v", res)
+	}
+	res := e.Evaluate(Signals{UserAgent: "Synthetic", IP: "203.0.113.9"})
+	if !slices.Equal(res.Rules, []string{RuleDatacenterIP, "synthetic"}) || !res.Bot || res.Kind != KindCustom {
+		t.Fatalf("expected the custom and datacenter rules, got %+v", res)
+	}
+
+	if _, err := New(config.BotConfig{Weights: map[string]int{"nope": 5}}, 50); err == nil {
+		t.Fatal("expected an unknown weight to be refused")
+	}
+	if _, err := New(config.BotConfig{Rules: []config.BotRule{{Name: RuleGenericBot, UserAgent: "x", Weight: 1}}}, 50); err == nil {
+		t.Fatal("expected a custom rule shadowing a built-in one to be refused")
+	}
+}
@@ -0,0 +1,726 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective Doorman configuration. Values are resolved in
+// order: built-in defaults, the YAML config file, then environment
+// variables named by the `env` tag. Fields tagged `secret:"true"` are
+// redacted when printed.
+type Config struct {
+	Env       string          `yaml:"env" env:"APP_ENV"`
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	Session   SessionConfig   `yaml:"session"`
+	Admin     AdminConfig     `yaml:"admin"`
+	Login     LoginConfig     `yaml:"login"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	Proxy     ProxyConfig     `yaml:"proxy"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Retention RetentionConfig `yaml:"retention"`
+	Tracking  TrackingConfig  `yaml:"tracking"`
+	Ingest    IngestConfig    `yaml:"ingest"`
+	Bots      BotConfig       `yaml:"bots"`
+	Mail      MailConfig      `yaml:"mail"`
+	Alerts    AlertConfig     `yaml:"alerts"`
+	Sink      SinkConfig      `yaml:"sink"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port" env:"PORT"`
+}
+
+type DatabaseConfig struct {
+	Provider string `yaml:"provider" env:"DB_PROVIDER"`
+	// URL is a full DSN for postgres/mysql and takes precedence over the
+	// individual connection fields.
+	URL      string `yaml:"url" env:"DATABASE_URL" secret:"true"`
+	Host     string `yaml:"host" env:"DB_HOST"`
+	Port     string `yaml:"port" env:"DB_PORT"`
+	User     string `yaml:"user" env:"DB_USER"`
+	Password string `yaml:"password" env:"DB_PASSWORD" secret:"true"`
+	Name     string `yaml:"name" env:"DB_NAME"`
+	SSLMode  string `yaml:"sslmode" env:"DB_SSLMODE"`
+	// Path is the SQLite database file.
+	Path string `yaml:"path" env:"DB_PATH"`
+	// AutoMigrate applies pending schema migrations on startup.
+	AutoMigrate bool `yaml:"auto_migrate" env:"DB_AUTO_MIGRATE"`
+}
+
+// SessionConfig controls dashboard sessions, which are stored in the
+// database and referenced by a signed cookie.
+type SessionConfig struct {
+	Secret string `yaml:"secret" env:"DOORMAN_SESSION_SECRET" secret:"true"`
+	// IdleTimeout ends a session after this long without a request.
+	IdleTimeout time.Duration `yaml:"idle_timeout" env:"DOORMAN_SESSION_IDLE_TIMEOUT"`
+	// AbsoluteTimeout ends a session this long after login regardless of
+	// activity.
+	AbsoluteTimeout time.Duration `yaml:"absolute_timeout" env:"DOORMAN_SESSION_ABSOLUTE_TIMEOUT"`
+	// CookieSecure restricts the cookie to HTTPS. Disable it only for local
+	// development over plain HTTP.
+	CookieSecure bool `yaml:"cookie_secure" env:"DOORMAN_SESSION_COOKIE_SECURE"`
+	// CookieSameSite is lax, strict or none.
+	CookieSameSite string `yaml:"cookie_samesite" env:"DOORMAN_SESSION_COOKIE_SAMESITE"`
+}
+
+// SameSite returns CookieSameSite as an http.SameSite value.
+func (s SessionConfig) SameSite() http.SameSite {
+	switch s.CookieSameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteLaxMode
+	}
+}
+
+type AdminConfig struct {
+	Username string `yaml:"username" env:"ADMIN_USER"`
+	Password string `yaml:"password" env:"ADMIN_PASSWORD" secret:"true"`
+}
+
+// LoginConfig throttles password guessing. Failed attempts are counted per
+// username and per client IP over the last LockoutDuration.
+type LoginConfig struct {
+	// BackoffAfter failures are allowed before each further attempt must
+	// wait BackoffBase, doubling with every failure.
+	BackoffAfter int           `yaml:"backoff_after" env:"DOORMAN_LOGIN_BACKOFF_AFTER"`
+	BackoffBase  time.Duration `yaml:"backoff_base" env:"DOORMAN_LOGIN_BACKOFF_BASE"`
+	// LockoutAfter failures block logins for LockoutDuration.
+	LockoutAfter    int           `yaml:"lockout_after" env:"DOORMAN_LOGIN_LOCKOUT_AFTER"`
+	LockoutDuration time.Duration `yaml:"lockout_duration" env:"DOORMAN_LOGIN_LOCKOUT_DURATION"`
+}
+
+// OIDCConfig enables single sign-on through an OpenID Connect provider.
+// It's off unless Issuer is set.
+type OIDCConfig struct {
+	// Issuer is the provider URL; its discovery document is read from
+	// Issuer + "/.well-known/openid-configuration".
+	Issuer       string `yaml:"issuer" env:"DOORMAN_OIDC_ISSUER"`
+	ClientID     string `yaml:"client_id" env:"DOORMAN_OIDC_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"DOORMAN_OIDC_CLIENT_SECRET" secret:"true"`
+	// RedirectURL is Doorman's callback, ending in /login/oidc/callback.
+	RedirectURL string   `yaml:"redirect_url" env:"DOORMAN_OIDC_REDIRECT_URL"`
+	Scopes      []string `yaml:"scopes" env:"DOORMAN_OIDC_SCOPES"`
+	// ButtonLabel is shown on the login page.
+	ButtonLabel string `yaml:"button_label" env:"DOORMAN_OIDC_BUTTON_LABEL"`
+
+	// AllowedDomains admits users whose verified email is in one of these
+	// domains.
+	AllowedDomains []string `yaml:"allowed_domains" env:"DOORMAN_OIDC_ALLOWED_DOMAINS"`
+	// GroupsClaim names the ID token claim that lists the user's groups.
+	GroupsClaim string `yaml:"groups_claim" env:"DOORMAN_OIDC_GROUPS_CLAIM"`
+	// AllowedGroups admits members of any of these groups.
+	AllowedGroups []string `yaml:"allowed_groups" env:"DOORMAN_OIDC_ALLOWED_GROUPS"`
+
+	// OwnerGroups and AdminGroups grant those roles; everyone else gets
+	// DefaultRole. When either is set, roles are updated on every sign-in.
+	OwnerGroups []string `yaml:"owner_groups" env:"DOORMAN_OIDC_OWNER_GROUPS"`
+	AdminGroups []string `yaml:"admin_groups" env:"DOORMAN_OIDC_ADMIN_GROUPS"`
+	DefaultRole string   `yaml:"default_role" env:"DOORMAN_OIDC_DEFAULT_ROLE"`
+}
+
+// Enabled reports whether SSO is configured.
+func (o OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+func (o OIDCConfig) problems(session SessionConfig) []string {
+	if !o.Enabled() {
+		return nil
+	}
+
+	var problems []string
+	if o.ClientID == "" || o.RedirectURL == "" {
+		problems = append(problems, "oidc.client_id and oidc.redirect_url must be set when oidc.issuer is")
+	}
+	if len(o.AllowedDomains) == 0 && len(o.AllowedGroups) == 0 {
+		problems = append(problems, "oidc.allowed_domains or oidc.allowed_groups must be set, or anyone with an account at the provider could sign in")
+	}
+	if len(o.AllowedGroups)+len(o.OwnerGroups)+len(o.AdminGroups) > 0 && o.GroupsClaim == "" {
+		problems = append(problems, "oidc.groups_claim must be set to use groups")
+	}
+	switch o.DefaultRole {
+	case "owner", "admin", "viewer":
+	default:
+		problems = append(problems, fmt.Sprintf("oidc.default_role %q is not one of owner, admin, viewer", o.DefaultRole))
+	}
+	// The provider redirects back with a cross-site GET, which strict
+	// cookies aren't sent on.
+	if session.CookieSameSite == "strict" {
+		problems = append(problems, "oidc requires session.cookie_samesite lax or none")
+	}
+	return problems
+}
+
+// ProxyConfig describes the reverse proxies in front of Doorman.
+type ProxyConfig struct {
+	// Trusted lists the CIDRs or addresses of proxies whose headers are
+	// believed. Requests from anywhere else can't use them.
+	Trusted []string `yaml:"trusted" env:"DOORMAN_TRUSTED_PROXIES"`
+	// ClientIPHeader is where trusted proxies put the client address:
+	// X-Forwarded-For, X-Real-IP, CF-Connecting-IP or Forwarded (RFC 7239).
+	// Empty means clients connect directly and the peer address is used.
+	ClientIPHeader string `yaml:"client_ip_header" env:"DOORMAN_CLIENT_IP_HEADER"`
+
+	// AuthHeader turns on proxy authentication: a trusted proxy names the
+	// signed-in user in this header (e.g. X-Forwarded-User) and Doorman
+	// skips its own login. Users are created with AuthDefaultRole.
+	AuthHeader      string `yaml:"auth_header" env:"DOORMAN_PROXY_AUTH_HEADER"`
+	AuthDefaultRole string `yaml:"auth_default_role" env:"DOORMAN_PROXY_AUTH_DEFAULT_ROLE"`
+	// AuthLogoutURL is where Logout sends proxy-authenticated users, such
+	// as the proxy's own sign-out endpoint.
+	AuthLogoutURL string `yaml:"auth_logout_url" env:"DOORMAN_PROXY_AUTH_LOGOUT_URL"`
+}
+
+// TrustedNets parses Trusted. Bare addresses become single-host networks.
+func (p ProxyConfig) TrustedNets() ([]*net.IPNet, error) {
+	return ParseNets(p.Trusted)
+}
+
+// ParseNets parses IP addresses and CIDRs; a bare address becomes a
+// single-host network.
+func ParseNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p ProxyConfig) problems() []string {
+	var problems []string
+	if _, err := p.TrustedNets(); err != nil {
+		problems = append(problems, fmt.Sprintf("proxy.trusted (DOORMAN_TRUSTED_PROXIES): %v", err))
+	}
+	switch strings.ToLower(p.ClientIPHeader) {
+	case "":
+	case "x-forwarded-for", "x-real-ip", "cf-connecting-ip", "forwarded":
+		if len(p.Trusted) == 0 {
+			problems = append(problems, "proxy.trusted must be set when proxy.client_ip_header is, or the header is never believed")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("proxy.client_ip_header %q is not one of X-Forwarded-For, X-Real-IP, CF-Connecting-IP, Forwarded", p.ClientIPHeader))
+	}
+	if p.AuthHeader != "" {
+		if len(p.Trusted) == 0 {
+			problems = append(problems, "proxy.trusted must be set when proxy.auth_header is, or any client could pick its user")
+		}
+		switch p.AuthDefaultRole {
+		case "owner", "admin", "viewer":
+		default:
+			problems = append(problems, fmt.Sprintf("proxy.auth_default_role %q is not one of owner, admin, viewer", p.AuthDefaultRole))
+		}
+	}
+	return problems
+}
+
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled" env:"DOORMAN_METRICS_ENABLED"`
+	Token   string `yaml:"token" env:"DOORMAN_METRICS_TOKEN" secret:"true"`
+}
+
+type RetentionConfig struct {
+	Days            int           `yaml:"days" env:"DOORMAN_RETENTION_DAYS"`
+	CleanupInterval time.Duration `yaml:"cleanup_interval" env:"DOORMAN_CLEANUP_INTERVAL"`
+}
+
+type TrackingConfig struct {
+	// HeartbeatInterval is how often the tracker script reports while a
+	// page stays open.
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval" env:"DOORMAN_HEARTBEAT_INTERVAL"`
+	// BotScoreThreshold is the bot score above which a visit is flagged
+	// as a bot; see BotConfig.
+	BotScoreThreshold int `yaml:"bot_score_threshold" env:"DOORMAN_BOT_SCORE_THRESHOLD"`
+}
+
+// BotConfig tunes bot detection. Every rule that matches a visit adds its
+// weight to the visit's score, and visits scoring above
+// tracking.bot_score_threshold are flagged.
+type BotConfig struct {
+	// CrawlersFile replaces the built-in crawler list with a newer copy of
+	// crawler-user-agents.json (github.com/monperrus/crawler-user-agents).
+	CrawlersFile string `yaml:"crawlers_file" env:"DOORMAN_BOT_CRAWLERS_FILE"`
+	// DatacenterRangesFile replaces the built-in datacenter networks with
+	// a file of CIDRs, one per line.
+	DatacenterRangesFile string `yaml:"datacenter_ranges_file" env:"DOORMAN_BOT_DATACENTER_RANGES_FILE"`
+	// Weights overrides the weight of built-in rules by name; 0 turns a
+	// rule off. "crawler" applies to every crawler list entry.
+	Weights map[string]int `yaml:"weights"`
+	// Rules adds custom rules.
+	Rules []BotRule `yaml:"rules"`
+}
+
+// BotRule matches visits whose user agent matches the UserAgent regular
+// expression and whose IP is in one of IPs; either may be left out.
+// Negative weights mark traffic as human.
+type BotRule struct {
+	Name      string   `yaml:"name"`
+	UserAgent string   `yaml:"user_agent"`
+	IPs       []string `yaml:"ips"`
+	Weight    int      `yaml:"weight"`
+}
+
+func (b BotConfig) problems() []string {
+	var problems []string
+	seen := map[string]bool{}
+	for i, r := range b.Rules {
+		switch {
+		case r.Name == "":
+			problems = append(problems, fmt.Sprintf("bots.rules[%d] needs a name", i))
+		case strings.Contains(r.Name, ","):
+			problems = append(problems, fmt.Sprintf("bots.rules[%d].name must not contain a comma", i))
+		case seen[r.Name]:
+			problems = append(problems, fmt.Sprintf("bots.rules: %q is defined twice", r.Name))
+		}
+		seen[r.Name] = true
+		if r.UserAgent == "" && len(r.IPs) == 0 {
+			problems = append(problems, fmt.Sprintf("bots.rules[%d] needs user_agent or ips", i))
+		}
+		if _, err := regexp.Compile(r.UserAgent); err != nil {
+			problems = append(problems, fmt.Sprintf("bots.rules[%d].user_agent: %v", i, err))
+		}
+		if _, err := ParseNets(r.IPs); err != nil {
+			problems = append(problems, fmt.Sprintf("bots.rules[%d].ips: %v", i, err))
+		}
+		if r.Weight == 0 {
+			problems = append(problems, fmt.Sprintf("bots.rules[%d].weight must not be 0", i))
+		}
+	}
+	return problems
+}
+
+// IngestConfig bounds what /event accepts. A zero limit turns that limit
+// off.
+type IngestConfig struct {
+	MaxBodyBytes       int64 `yaml:"max_body_bytes" env:"DOORMAN_INGEST_MAX_BODY_BYTES"`
+	MaxURLLength       int   `yaml:"max_url_length" env:"DOORMAN_INGEST_MAX_URL_LENGTH"`
+	MaxReferrerLength  int   `yaml:"max_referrer_length" env:"DOORMAN_INGEST_MAX_REFERRER_LENGTH"`
+	MaxUserAgentLength int   `yaml:"max_user_agent_length" env:"DOORMAN_INGEST_MAX_USER_AGENT_LENGTH"`
+	// MaxBatchSize and MaxBatchBytes bound /event/batch requests; each
+	// event in a batch must also fit the limits above. Every event counts
+	// towards the rate limits, so MaxBatchSize can't exceed VisitorBurst.
+	MaxBatchSize  int   `yaml:"max_batch_size" env:"DOORMAN_INGEST_MAX_BATCH_SIZE"`
+	MaxBatchBytes int64 `yaml:"max_batch_bytes" env:"DOORMAN_INGEST_MAX_BATCH_BYTES"`
+	// VisitorRate is how many events per second one client IP may send
+	// on average, in bursts of up to VisitorBurst.
+	VisitorRate  float64 `yaml:"visitor_rate" env:"DOORMAN_INGEST_VISITOR_RATE"`
+	VisitorBurst int     `yaml:"visitor_burst" env:"DOORMAN_INGEST_VISITOR_BURST"`
+	// GlobalRate and GlobalBurst cap events from all clients together.
+	GlobalRate  float64 `yaml:"global_rate" env:"DOORMAN_INGEST_GLOBAL_RATE"`
+	GlobalBurst int     `yaml:"global_burst" env:"DOORMAN_INGEST_GLOBAL_BURST"`
+}
+
+func (i IngestConfig) problems() []string {
+	var problems []string
+	if i.MaxBodyBytes < 0 || i.MaxURLLength < 0 || i.MaxReferrerLength < 0 || i.MaxUserAgentLength < 0 ||
+		i.MaxBatchSize < 0 || i.MaxBatchBytes < 0 {
+		problems = append(problems, "ingest size limits must not be negative")
+	}
+	if i.VisitorRate < 0 || i.GlobalRate < 0 {
+		problems = append(problems, "ingest.visitor_rate and ingest.global_rate must not be negative")
+	}
+	if i.VisitorRate > 0 && i.VisitorBurst < 1 {
+		problems = append(problems, "ingest.visitor_burst must be at least 1 when ingest.visitor_rate is set")
+	}
+	if i.VisitorRate > 0 && (i.MaxBatchSize == 0 || i.MaxBatchSize > i.VisitorBurst) {
+		problems = append(problems, "ingest.max_batch_size must be set and no larger than ingest.visitor_burst, or full batches are always rate limited")
+	}
+	if i.GlobalRate > 0 && i.GlobalBurst < 1 {
+		problems = append(problems, "ingest.global_burst must be at least 1 when ingest.global_rate is set")
+	}
+	return problems
+}
+
+// MailConfig sets up the SMTP server that scheduled reports are sent
+// through. It's off unless Host is set.
+type MailConfig struct {
+	Host string `yaml:"host" env:"DOORMAN_SMTP_HOST"`
+	Port int    `yaml:"port" env:"DOORMAN_SMTP_PORT"`
+	// TLS is starttls to upgrade a plain connection, tls to connect over
+	// TLS from the start (usually port 465) or none.
+	TLS      string `yaml:"tls" env:"DOORMAN_SMTP_TLS"`
+	Username string `yaml:"username" env:"DOORMAN_SMTP_USERNAME"`
+	Password string `yaml:"password" env:"DOORMAN_SMTP_PASSWORD" secret:"true"`
+	// From is the sender address, optionally with a name:
+	// "Doorman <doorman@example.com>".
+	From string `yaml:"from" env:"DOORMAN_SMTP_FROM"`
+	// BaseURL is where Doorman's dashboard is reached, for links in
+	// emails.
+	BaseURL string `yaml:"base_url" env:"DOORMAN_BASE_URL"`
+	// ReportInterval is how often due reports are looked for.
+	ReportInterval time.Duration `yaml:"report_interval" env:"DOORMAN_REPORT_INTERVAL"`
+}
+
+// Enabled reports whether an SMTP server is configured.
+func (m MailConfig) Enabled() bool {
+	return m.Host != ""
+}
+
+func (m MailConfig) problems() []string {
+	if !m.Enabled() {
+		return nil
+	}
+
+	var problems []string
+	if m.Port < 1 || m.Port > 65535 {
+		problems = append(problems, "mail.port must be between 1 and 65535")
+	}
+	switch m.TLS {
+	case "starttls", "tls", "none":
+	default:
+		problems = append(problems, fmt.Sprintf("mail.tls %q is not one of starttls, tls, none", m.TLS))
+	}
+	if m.From == "" {
+		problems = append(problems, "mail.from must be set when mail.host is")
+	} else if _, err := mail.ParseAddress(m.From); err != nil {
+		problems = append(problems, fmt.Sprintf("mail.from: %v", err))
+	}
+	if m.Password != "" && m.Username == "" {
+		problems = append(problems, "mail.username must be set when mail.password is")
+	}
+	if m.BaseURL != "" {
+		if u, err := url.Parse(m.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("mail.base_url %q is not an http(s) URL", m.BaseURL))
+		}
+	}
+	if m.ReportInterval < time.Minute {
+		problems = append(problems, "mail.report_interval must be at least 1m")
+	}
+	return problems
+}
+
+// AlertConfig controls how alert rules, which are managed in the
+// dashboard, are evaluated.
+type AlertConfig struct {
+	// Interval is how often every rule is checked.
+	Interval time.Duration `yaml:"interval" env:"DOORMAN_ALERT_INTERVAL"`
+	// AllowPrivateWebhooks lets webhooks reach loopback, link-local and
+	// private addresses, such as a chat server on the same network.
+	AllowPrivateWebhooks bool `yaml:"allow_private_webhooks" env:"DOORMAN_ALERT_ALLOW_PRIVATE_WEBHOOKS"`
+}
+
+// SinkConfig forwards every accepted tracking event to HTTP endpoints in
+// batches. It's off unless URLs are set.
+type SinkConfig struct {
+	URLs []string `yaml:"urls" env:"DOORMAN_SINK_URLS"`
+	// Secret signs every request, like the secrets of alert webhooks.
+	Secret string `yaml:"secret" env:"DOORMAN_SINK_SECRET" secret:"true"`
+	// A batch is sent once it holds BatchSize events, and whatever has
+	// queued up every FlushInterval.
+	BatchSize     int           `yaml:"batch_size" env:"DOORMAN_SINK_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"DOORMAN_SINK_FLUSH_INTERVAL"`
+	// A batch is tried up to MaxAttempts times, waiting RetryBackoff,
+	// doubled each time, in between, before it's kept as a dead letter.
+	MaxAttempts  int           `yaml:"max_attempts" env:"DOORMAN_SINK_MAX_ATTEMPTS"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"DOORMAN_SINK_RETRY_BACKOFF"`
+	// QueueSize bounds the events waiting to be sent. Events that don't
+	// fit are dropped.
+	QueueSize int `yaml:"queue_size" env:"DOORMAN_SINK_QUEUE_SIZE"`
+}
+
+// Enabled reports whether any endpoint is configured.
+func (s SinkConfig) Enabled() bool {
+	return len(s.URLs) > 0
+}
+
+func (s SinkConfig) problems() []string {
+	if !s.Enabled() {
+		return nil
+	}
+
+	var problems []string
+	for _, raw := range s.URLs {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("sink.urls: %q is not an http(s) URL", raw))
+		}
+	}
+	if s.Secret == "" {
+		problems = append(problems, "sink.secret (DOORMAN_SINK_SECRET) must be set when sink.urls is")
+	}
+	if s.BatchSize < 1 {
+		problems = append(problems, "sink.batch_size must be at least 1")
+	}
+	if s.QueueSize < s.BatchSize {
+		problems = append(problems, "sink.queue_size must not be smaller than sink.batch_size")
+	}
+	if s.FlushInterval < 100*time.Millisecond {
+		problems = append(problems, "sink.flush_interval must be at least 100ms")
+	}
+	if s.MaxAttempts < 1 {
+		problems = append(problems, "sink.max_attempts must be at least 1")
+	}
+	if s.RetryBackoff <= 0 {
+		problems = append(problems, "sink.retry_backoff must be positive")
+	}
+	return problems
+}
+
+// Default returns the built-in configuration.
+func Default() *Config {
+	return &Config{
+		Env: "production",
+		Server: ServerConfig{
+			Port: "8080",
+		},
+		Database: DatabaseConfig{
+			Provider:    "sqlite",
+			Path:        "analytics.db",
+			SSLMode:     "disable",
+			AutoMigrate: true,
+		},
+		Session: SessionConfig{
+			IdleTimeout:     12 * time.Hour,
+			AbsoluteTimeout: 7 * 24 * time.Hour,
+			CookieSecure:    true,
+			CookieSameSite:  "lax",
+		},
+		Admin: AdminConfig{
+			Username: "admin",
+		},
+		Login: LoginConfig{
+			BackoffAfter:    3,
+			BackoffBase:     2 * time.Second,
+			LockoutAfter:    10,
+			LockoutDuration: 15 * time.Minute,
+		},
+		OIDC: OIDCConfig{
+			Scopes:      []string{"openid", "profile", "email"},
+			ButtonLabel: "Sign in with SSO",
+			GroupsClaim: "groups",
+			DefaultRole: "viewer",
+		},
+		Proxy: ProxyConfig{
+			AuthDefaultRole: "viewer",
+		},
+		Retention: RetentionConfig{
+			Days:            90,
+			CleanupInterval: 24 * time.Hour,
+		},
+		Tracking: TrackingConfig{
+			HeartbeatInterval: 30 * time.Second,
+			BotScoreThreshold: 50,
+		},
+		Ingest: IngestConfig{
+			MaxBodyBytes:       8 << 10,
+			MaxURLLength:       2048,
+			MaxReferrerLength:  2048,
+			MaxUserAgentLength: 512,
+			MaxBatchSize:       20,
+			MaxBatchBytes:      64 << 10,
+			VisitorRate:        1,
+			VisitorBurst:       20,
+			GlobalRate:         200,
+			GlobalBurst:        1000,
+		},
+		Mail: MailConfig{
+			Port:           587,
+			TLS:            "starttls",
+			ReportInterval: 15 * time.Minute,
+		},
+		Alerts: AlertConfig{
+			Interval: 5 * time.Minute,
+		},
+		Sink: SinkConfig{
+			BatchSize:     100,
+			FlushInterval: 5 * time.Second,
+			MaxAttempts:   5,
+			RetryBackoff:  time.Second,
+			QueueSize:     10000,
+		},
+	}
+}
+
+// Load resolves the configuration and validates it.
+func Load(path string) (*Config, error) {
+	cfg, err := Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Resolve builds the configuration from defaults, the optional YAML file at
+// path and the environment without validating it.
+func Resolve(path string) (*Config, error) {
+	if os.Getenv("APP_ENV") == "local" {
+		if err := godotenv.Load(); err != nil {
+			log.Println("Warning: .env not loaded:", err)
+		}
+	}
+
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file: %w", err)
+		}
+
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(cfg, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the configuration for values Doorman can't start with.
+func (c *Config) Validate() error {
+	var problems []string
+
+	if c.Session.Secret == "" {
+		problems = append(problems, "session.secret (DOORMAN_SESSION_SECRET) must be set")
+	}
+
+	if c.Session.IdleTimeout < time.Minute {
+		problems = append(problems, "session.idle_timeout must be at least 1m")
+	}
+	if c.Session.AbsoluteTimeout < c.Session.IdleTimeout {
+		problems = append(problems, "session.absolute_timeout must not be shorter than session.idle_timeout")
+	}
+	switch c.Session.CookieSameSite {
+	case "lax", "strict":
+	case "none":
+		if !c.Session.CookieSecure {
+			problems = append(problems, "session.cookie_samesite none requires session.cookie_secure")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("session.cookie_samesite %q is not one of lax, strict, none", c.Session.CookieSameSite))
+	}
+
+	problems = append(problems, c.Database.problems()...)
+
+	if c.Server.Port == "" {
+		problems = append(problems, "server.port (PORT) must be set")
+	}
+
+	if c.Login.BackoffAfter < 1 {
+		problems = append(problems, "login.backoff_after must be at least 1")
+	}
+	if c.Login.LockoutAfter <= c.Login.BackoffAfter {
+		problems = append(problems, "login.lockout_after must be greater than login.backoff_after")
+	}
+	if c.Login.BackoffBase <= 0 || c.Login.LockoutDuration <= 0 {
+		problems = append(problems, "login.backoff_base and login.lockout_duration must be positive")
+	}
+
+	problems = append(problems, c.OIDC.problems(c.Session)...)
+	problems = append(problems, c.Proxy.problems()...)
+
+	if c.Retention.Days < 1 {
+		problems = append(problems, "retention.days must be at least 1")
+	}
+	if c.Retention.CleanupInterval < time.Minute {
+		problems = append(problems, "retention.cleanup_interval must be at least 1m")
+	}
+
+	if c.Tracking.HeartbeatInterval < time.Second {
+		problems = append(problems, "tracking.heartbeat_interval must be at least 1s")
+	}
+	if c.Tracking.BotScoreThreshold < 0 || c.Tracking.BotScoreThreshold > 100 {
+		problems = append(problems, "tracking.bot_score_threshold must be between 0 and 100")
+	}
+	problems = append(problems, c.Ingest.problems()...)
+	problems = append(problems, c.Bots.problems()...)
+	problems = append(problems, c.Mail.problems()...)
+	if c.Alerts.Interval < time.Minute {
+		problems = append(problems, "alerts.interval must be at least 1m")
+	}
+	problems = append(problems, c.Sink.problems()...)
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// ValidateDatabase checks only the database settings, for commands that
+// don't start the server.
+func (c *Config) ValidateDatabase() error {
+	if problems := c.Database.problems(); len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (d DatabaseConfig) problems() []string {
+	switch d.Provider {
+	case "sqlite":
+		if d.Path == "" {
+			return []string{"database.path (DB_PATH) must be set for sqlite"}
+		}
+	case "postgres", "pg", "mysql":
+		if d.URL == "" && (d.Host == "" || d.Name == "") {
+			return []string{fmt.Sprintf("database.url (DATABASE_URL) or database.host and database.name must be set for %s", d.Provider)}
+		}
+	default:
+		return []string{fmt.Sprintf("database.provider (DB_PROVIDER) %q is not one of sqlite, postgres, mysql", d.Provider)}
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with secrets masked.
+func (c *Config) Redacted() *Config {
+	out := *c
+	redact(&out)
+	return &out
+}
+
+// YAML renders the configuration as a YAML document.
+func (c *Config) YAML() ([]byte, error) {
+	return yaml.Marshal(c)
+}
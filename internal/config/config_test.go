@@ -0,0 +1,183 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve_FileAndEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doorman.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  port: "9090"
+session:
+  secret: from-file
+retention:
+  days: 30
+  cleanup_interval: 6h
+`), 0o600)
+	assert.NoError(t, err)
+
+	t.Setenv("DOORMAN_SESSION_SECRET", "from-env")
+	t.Setenv("DOORMAN_METRICS_ENABLED", "true")
+
+	cfg, err := Resolve(path)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "9090", cfg.Server.Port)
+	assert.Equal(t, "from-env", cfg.Session.Secret, "env should override the file")
+	assert.Equal(t, 30, cfg.Retention.Days)
+	assert.Equal(t, 6*time.Hour, cfg.Retention.CleanupInterval)
+	assert.True(t, cfg.Metrics.Enabled)
+	assert.Equal(t, 50, cfg.Tracking.BotScoreThreshold, "unset values keep their defaults")
+}
+
+func TestResolve_UnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "doorman.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("retension:\n  days: 5\n"), 0o600))
+
+	_, err := Resolve(path)
+	assert.Error(t, err)
+}
+
+func TestResolve_InvalidEnv(t *testing.T) {
+	t.Setenv("DOORMAN_RETENTION_DAYS", "ninety")
+
+	_, err := Resolve("")
+	assert.ErrorContains(t, err, "DOORMAN_RETENTION_DAYS")
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Database.Provider = "oracle"
+
+	err := cfg.Validate()
+
+	var verr *ValidationError
+	assert.True(t, errors.As(err, &verr))
+	assert.Len(t, verr.Problems, 2)
+	assert.True(t, strings.Contains(err.Error(), "DOORMAN_SESSION_SECRET"))
+
+	cfg = Default()
+	cfg.Session.Secret = "secret"
+	assert.NoError(t, cfg.Validate())
+
+	// SSO without a restriction on who may sign in is refused.
+	cfg.OIDC.Issuer = "https://accounts.example.com"
+	cfg.OIDC.ClientID = "doorman"
+	cfg.OIDC.RedirectURL = "https://doorman.example.com/login/oidc/callback"
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, "oidc.allowed_domains")
+
+	cfg.OIDC.AllowedDomains = []string{"example.com"}
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Ingest.VisitorBurst = cfg.Ingest.MaxBatchSize - 1
+	assert.ErrorContains(t, cfg.Validate(), "ingest.max_batch_size", "a full batch must fit the burst")
+	cfg.Ingest.VisitorBurst = 0
+	assert.ErrorContains(t, cfg.Validate(), "ingest.visitor_burst")
+	cfg.Ingest.VisitorRate = 0
+	assert.NoError(t, cfg.Validate(), "a zero rate turns the limit off")
+
+	cfg.Bots.Rules = []BotRule{{Name: "office", IPs: []string{"203.0.113.0/24"}, Weight: -100}}
+	assert.NoError(t, cfg.Validate())
+	cfg.Bots.Rules = append(cfg.Bots.Rules, BotRule{Name: "office", UserAgent: "(", Weight: 0})
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, `"office" is defined twice`)
+	assert.ErrorContains(t, err, "bots.rules[1].user_agent")
+	assert.ErrorContains(t, err, "bots.rules[1].weight")
+	cfg.Bots.Rules = []BotRule{{Name: "office,vpn", IPs: []string{"203.0.113.0/24"}, Weight: -100}}
+	assert.ErrorContains(t, cfg.Validate(), "bots.rules[0].name")
+}
+
+func TestProxyConfig(t *testing.T) {
+	cfg := Default()
+	cfg.Session.Secret = "secret"
+	cfg.Proxy.AuthHeader = "X-Forwarded-User"
+	assert.ErrorContains(t, cfg.Validate(), "proxy.trusted must be set")
+
+	cfg.Proxy.Trusted = []string{"10.0.0.0/8", "192.168.1.10", "::1", "bogus"}
+	assert.ErrorContains(t, cfg.Validate(), `"bogus"`)
+
+	cfg.Proxy.Trusted = cfg.Proxy.Trusted[:3]
+	assert.NoError(t, cfg.Validate())
+
+	nets, err := cfg.Proxy.TrustedNets()
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.1.10/32", nets[1].String())
+	assert.Equal(t, "::1/128", nets[2].String())
+
+	cfg.Proxy.ClientIPHeader = "X-Client-IP"
+	assert.ErrorContains(t, cfg.Validate(), "proxy.client_ip_header")
+
+	cfg.Proxy.ClientIPHeader = "x-forwarded-for"
+	assert.NoError(t, cfg.Validate())
+
+	cfg.Proxy.AuthHeader = ""
+	cfg.Proxy.Trusted = nil
+	assert.ErrorContains(t, cfg.Validate(), "proxy.trusted must be set when proxy.client_ip_header is")
+}
+
+func TestMailConfig(t *testing.T) {
+	cfg := Default()
+	cfg.Session.Secret = "secret"
+	cfg.Mail.Port = 0
+	assert.NoError(t, cfg.Validate(), "mail settings are ignored without a host")
+
+	cfg.Mail.Host = "smtp.example.com"
+	cfg.Mail.TLS = "ssl"
+	err := cfg.Validate()
+	assert.ErrorContains(t, err, "mail.port")
+	assert.ErrorContains(t, err, `mail.tls "ssl"`)
+	assert.ErrorContains(t, err, "mail.from must be set")
+
+	cfg.Mail.Port = 465
+	cfg.Mail.TLS = "tls"
+	cfg.Mail.From = "Doorman <doorman@example.com>"
+	cfg.Mail.BaseURL = "doorman.example.com"
+	assert.ErrorContains(t, cfg.Validate(), "mail.base_url")
+
+	cfg.Mail.BaseURL = "https://doorman.example.com"
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestSinkConfig(t *testing.T) {
+	t.Setenv("DOORMAN_SESSION_SECRET", "secret")
+	t.Setenv("DOORMAN_SINK_BATCH_SIZE", "0")
+	cfg, err := Resolve("")
+	assert.NoError(t, err)
+	assert.NoError(t, cfg.Validate(), "sink settings are ignored without URLs")
+
+	t.Setenv("DOORMAN_SINK_URLS", "https://warehouse.example.com/in, ftp://example.com")
+	cfg, err = Resolve("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://warehouse.example.com/in", "ftp://example.com"}, cfg.Sink.URLs)
+	err = cfg.Validate()
+	assert.ErrorContains(t, err, `sink.urls: "ftp://example.com"`)
+	assert.ErrorContains(t, err, "sink.secret")
+	assert.ErrorContains(t, err, "sink.batch_size")
+
+	cfg.Sink.URLs = cfg.Sink.URLs[:1]
+	cfg.Sink.Secret = "sink-secret"
+	cfg.Sink.BatchSize = 100
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := Default()
+	cfg.Session.Secret = "super-secret"
+	cfg.Database.Password = "hunter2"
+
+	out, err := cfg.Redacted().YAML()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "super-secret")
+	assert.NotContains(t, string(out), "hunter2")
+	assert.Contains(t, string(out), "[redacted]")
+	assert.Equal(t, "super-secret", cfg.Session.Secret, "original config must be untouched")
+}
@@ -1,49 +1,103 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
+	"strings"
 	"time"
 
-	"github.com/joho/godotenv"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/metrics"
 	"github.com/webbesoft/doorman/internal/models"
 )
 
-func InitDB() (*gorm.DB, error) {
-	provider := os.Getenv("DB_PROVIDER")
+// InitDB connects and brings the schema up to date. It refuses to run
+// against a schema migrated by a newer release.
+func InitDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	db, err := Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := PendingMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if pending > 0 {
+		if !cfg.AutoMigrate {
+			return nil, fmt.Errorf("%d pending migrations; run `doorman migrate up`", pending)
+		}
+		if _, err := MigrateUp(db); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
 
-	db, err := connectByProvider(provider)
+// Open connects without touching the schema.
+func Open(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	db, err := connectByProvider(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.AutoMigrate(&models.Analytics{}, &models.PageVisit{}, &models.User{}); err != nil {
+	if err := db.Use(metrics.GormPlugin{}); err != nil {
 		return nil, err
 	}
 
 	return db, nil
 }
 
-func EnsureDefaultAdmin(db *gorm.DB) error {
-	if os.Getenv("APP_ENV") == "local" {
-		if err := godotenv.Load(); err != nil {
-			log.Println("Warning: .env not loaded:", err)
-		}
+// CheckReady verifies the database answers and the schema is in place.
+func CheckReady(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database unreachable: %w", err)
+	}
+
+	pending, err := PendingMigrations(db.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("schema not migrated: %d pending migrations", pending)
+	}
+
+	return nil
+}
+
+func EnsureDefaultAdmin(db *gorm.DB, cfg config.AdminConfig) error {
+	if cfg.Username == "" {
+		return nil
 	}
 
 	var user models.User
-	if err := db.Where("username = ?", "admin").First(&user).Error; err == gorm.ErrRecordNotFound {
+	if err := db.Where("username = ?", cfg.Username).First(&user).Error; err == gorm.ErrRecordNotFound {
+		if cfg.Password == "" {
+			return fmt.Errorf("admin.password (ADMIN_PASSWORD) must be set to create the default admin %q", cfg.Username)
+		}
+
 		log.Println("Creating default admin; password from ADMIN_PASSWORD env var")
-		hashedPassword, _ := models.HashPassword(os.Getenv("ADMIN_PASSWORD"))
+		hashedPassword, err := models.HashPassword(cfg.Password)
+		if err != nil {
+			return err
+		}
 		defaultUser := models.User{
-			Username: os.Getenv("ADMIN_USER"),
+			Username: cfg.Username,
 			Password: hashedPassword,
+			Role:     models.RoleOwner,
 		}
 		return db.Create(&defaultUser).Error
 	}
@@ -51,24 +105,15 @@ func EnsureDefaultAdmin(db *gorm.DB) error {
 	return nil
 }
 
-func connectByProvider(provider string) (*gorm.DB, error) {
-	switch provider {
+func connectByProvider(cfg config.DatabaseConfig) (*gorm.DB, error) {
+	switch cfg.Provider {
 	case "postgres", "pg":
 		// Prefer full DATABASE_URL
-		dsn := os.Getenv("DATABASE_URL")
+		dsn := cfg.URL
 		if dsn == "" {
-			host := os.Getenv("DB_HOST")
-			port := os.Getenv("DB_PORT")
-			user := os.Getenv("DB_USER")
-			password := os.Getenv("DB_PASSWORD")
-			dbname := os.Getenv("DB_NAME")
-			sslmode := os.Getenv("DB_SSLMODE")
-			if sslmode == "" {
-				sslmode = "disable"
-			}
 			dsn = fmt.Sprintf(
 				"host=%s user=%s password=%s dbname=%s port=%s sslmode=%s TimeZone=UTC",
-				host, user, password, dbname, port, sslmode,
+				cfg.Host, cfg.User, cfg.Password, cfg.Name, cfg.Port, cfg.SSLMode,
 			)
 		}
 		db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
@@ -77,47 +122,69 @@ func connectByProvider(provider string) (*gorm.DB, error) {
 
 	case "mysql":
 		// Prefer full DATABASE_URL if provided
-		dsn := os.Getenv("DATABASE_URL")
+		dsn := cfg.URL
 		if dsn == "" {
-			host := os.Getenv("DB_HOST")
-			port := os.Getenv("DB_PORT")
+			port := cfg.Port
 			if port == "" {
 				port = "3306"
 			}
-			user := os.Getenv("DB_USER")
-			password := os.Getenv("DB_PASSWORD")
-			dbname := os.Getenv("DB_NAME")
 			dsn = fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-				user, password, host, port, dbname)
+				cfg.User, cfg.Password, cfg.Host, port, cfg.Name)
 		}
 		db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
 
 		return db, err
 
 	default:
-		// Default to SQLite. DB_PATH env can override the file path.
-		path := os.Getenv("DB_PATH")
-		if path == "" {
-			path = "analytics.db"
-		}
-		if provider != "" {
-			log.Printf("DB_PROVIDER=%s not recognized, defaulting to sqlite", provider)
-		}
-		db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+		db, err := gorm.Open(sqlite.Open(sqliteDSN(cfg.Path)), &gorm.Config{})
 
 		return db, err
 	}
 }
 
+// sqliteDSN turns on foreign keys for every connection to path. SQLite
+// leaves them off by default, which would ignore ON DELETE CASCADE.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_foreign_keys=1"
+}
+
 // remove page views older than retention period
-func CleanupOldData(db *gorm.DB, retentionDays int) error {
+func CleanupOldData(db *gorm.DB, retentionDays int) (int64, error) {
 	cutoff := time.Now().AddDate(0, 0, -retentionDays)
 
 	result := db.Where("created_at < ?", cutoff).Delete(&models.Analytics{})
 	if result.Error != nil {
-		return result.Error
+		return 0, result.Error
 	}
 
 	log.Printf("Cleaned up %d old page views (older than %d days)", result.RowsAffected, retentionDays)
-	return nil
+	return result.RowsAffected, nil
+}
+
+// CountOldData reports how many page views CleanupOldData would remove
+func CountOldData(db *gorm.DB, retentionDays int) (int64, error) {
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+
+	var count int64
+	err := db.Model(&models.Analytics{}).Where("created_at < ?", cutoff).Count(&count).Error
+	return count, err
+}
+
+// Vacuum reclaims space and refreshes planner statistics
+func Vacuum(db *gorm.DB) error {
+	switch Dialect(db) {
+	case "postgres":
+		return db.Exec("VACUUM ANALYZE").Error
+	case "mysql":
+		return db.Exec("OPTIMIZE TABLE analytics, page_visits").Error
+	default:
+		if err := db.Exec("VACUUM").Error; err != nil {
+			return err
+		}
+		return db.Exec("ANALYZE").Error
+	}
 }
@@ -0,0 +1,291 @@
+package database
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// ErrSchemaTooNew is returned when the database has migrations applied that
+// this build doesn't know about, i.e. it was migrated by a newer release.
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of doorman")
+
+// Migration is one versioned schema change, loaded from
+// migrations/<dialect>/<version>_<name>.{up,down}.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus reports whether a migration has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+type schemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var schemaMigrationsDDL = map[string]string{
+	"sqlite":   "CREATE TABLE IF NOT EXISTS schema_migrations (version integer PRIMARY KEY, name text NOT NULL, applied_at datetime NOT NULL)",
+	"postgres": "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name text NOT NULL, applied_at timestamptz NOT NULL)",
+	"mysql":    "CREATE TABLE IF NOT EXISTS schema_migrations (version bigint PRIMARY KEY, name varchar(255) NOT NULL, applied_at datetime(3) NOT NULL)",
+}
+
+// Migrations returns the embedded migrations for the given dialect in
+// version order.
+func Migrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for dialect %q", dialect)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			continue
+		}
+
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		prefix, label, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: expected <version>_<name>", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version: %w", name, err)
+		}
+
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %04d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// Dialect returns the migration dialect for a connection.
+func Dialect(db *gorm.DB) string {
+	return db.Dialector.Name()
+}
+
+// MigrateUp applies every pending migration and returns the ones applied.
+func MigrateUp(db *gorm.DB) ([]Migration, error) {
+	migrations, applied, err := loadState(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := execScript(tx, m.Up); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// MigrateDown rolls back the most recent steps migrations.
+func MigrateDown(db *gorm.DB, steps int) ([]Migration, error) {
+	migrations, applied, err := loadState(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == "" {
+			return done, fmt.Errorf("migration %04d_%s can't be rolled back: no down script", m.Version, m.Name)
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := execScript(tx, m.Down); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("rollback %04d_%s: %w", m.Version, m.Name, err)
+		}
+
+		log.Printf("Rolled back migration %04d_%s", m.Version, m.Name)
+		done = append(done, m)
+	}
+
+	return done, nil
+}
+
+// MigrationStatuses lists every known migration and when it was applied.
+func MigrationStatuses(db *gorm.DB) ([]MigrationStatus, error) {
+	migrations, applied, err := readState(db)
+	if err != nil && !errors.Is(err, ErrSchemaTooNew) {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if row, ok := applied[m.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, err
+}
+
+// PendingMigrations returns how many migrations have not been applied yet.
+// It only reads, so readiness probes can call it on read-only replicas.
+func PendingMigrations(db *gorm.DB) (int, error) {
+	migrations, applied, err := readState(db)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// loadState is readState for migrating, creating schema_migrations first
+// if needed.
+func loadState(db *gorm.DB) ([]Migration, map[int]schemaMigration, error) {
+	if err := db.Exec(schemaMigrationsDDL[Dialect(db)]).Error; err != nil {
+		return nil, nil, fmt.Errorf("create schema_migrations: %w", err)
+	}
+	return readState(db)
+}
+
+// readState returns the known migrations and the applied ones keyed by
+// version; without schema_migrations none are applied. It fails with
+// ErrSchemaTooNew if an applied version is unknown to this build.
+func readState(db *gorm.DB) ([]Migration, map[int]schemaMigration, error) {
+	migrations, err := Migrations(Dialect(db))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []schemaMigration
+	if db.Migrator().HasTable(&schemaMigration{}) {
+		if err := db.Order("version").Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+
+	applied := make(map[int]schemaMigration, len(rows))
+	for _, row := range rows {
+		if !known[row.Version] {
+			return migrations, applied, fmt.Errorf("%w: found migration %d", ErrSchemaTooNew, row.Version)
+		}
+		applied[row.Version] = row
+	}
+
+	return migrations, applied, nil
+}
+
+// execScript runs each statement of a migration script. Statements are
+// separated by a semicolon at the end of a line.
+func execScript(tx *gorm.DB, script string) error {
+	var stmt strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+
+		stmt.WriteString(line)
+		stmt.WriteString("\n")
+
+		if strings.HasSuffix(trimmed, ";") {
+			if err := tx.Exec(stmt.String()).Error; err != nil {
+				return err
+			}
+			stmt.Reset()
+		}
+	}
+
+	if strings.TrimSpace(stmt.String()) != "" {
+		return tx.Exec(stmt.String()).Error
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+// every model backed by a migrated table
+var migratedModels = []interface{}{
+	&models.Analytics{},
+	&models.PageVisit{},
+	&models.User{},
+	&models.Site{},
+	&models.APIKey{},
+	&models.SiteGrant{},
+	&models.RecoveryCode{},
+	&models.AuthEvent{},
+	&models.Session{},
+	&models.CustomEvent{},
+	&models.BotRuleHit{},
+	&models.BotScore{},
+	&models.ImportedStat{},
+	&models.ReportSchedule{},
+	&models.AlertRule{},
+	&models.AlertEvent{},
+	&models.SinkDeadLetter{},
+}
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	assert.NoError(t, err)
+	return db
+}
+
+func TestMigrateUp_MatchesModels(t *testing.T) {
+	db := openTestDB(t)
+
+	applied, err := MigrateUp(db)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, applied)
+
+	migrator := db.Migrator()
+	for _, model := range migratedModels {
+		s, err := schema.Parse(model, &sync.Map{}, db.NamingStrategy)
+		assert.NoError(t, err)
+
+		assert.True(t, migrator.HasTable(model), "missing table %s", s.Table)
+		for _, field := range s.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			assert.True(t, migrator.HasColumn(model, field.DBName), "missing column %s.%s", s.Table, field.DBName)
+		}
+	}
+
+	pending, err := PendingMigrations(db)
+	assert.NoError(t, err)
+	assert.Zero(t, pending)
+
+	// running again is a no-op
+	applied, err = MigrateUp(db)
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestPendingMigrations_ReadOnly(t *testing.T) {
+	db := openTestDB(t)
+
+	migrations, err := Migrations("sqlite")
+	assert.NoError(t, err)
+	pending, err := PendingMigrations(db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(migrations), pending)
+	assert.Error(t, CheckReady(context.Background(), db))
+	assert.False(t, db.Migrator().HasTable(&schemaMigration{}), "readiness checks don't create tables")
+}
+
+func TestMigrateDown(t *testing.T) {
+	db := openTestDB(t)
+
+	applied, err := MigrateUp(db)
+	assert.NoError(t, err)
+
+	rolledBack, err := MigrateDown(db, len(applied))
+	assert.NoError(t, err)
+	assert.Len(t, rolledBack, len(applied))
+
+	for _, model := range migratedModels {
+		assert.False(t, db.Migrator().HasTable(model))
+	}
+
+	pending, err := PendingMigrations(db)
+	assert.NoError(t, err)
+	assert.Equal(t, len(applied), pending)
+}
+
+func TestMigrateUp_AdoptsAutoMigratedSchema(t *testing.T) {
+	db := openTestDB(t)
+	// schema as created by GORM AutoMigrate before versioned migrations
+	for _, stmt := range []string{
+		"CREATE TABLE `analytics` (`id` integer PRIMARY KEY AUTOINCREMENT,`url` text NOT NULL,`referrer` text,`user_agent` text,`ip_hash` text,`country` text,`is_bot` numeric DEFAULT false,`bot_score` integer,`bot_reason` text,`created_at` datetime,`updated_at` datetime)",
+		"CREATE INDEX `idx_analytics_url` ON `analytics`(`url`)",
+		"CREATE TABLE `page_visits` (`id` integer PRIMARY KEY AUTOINCREMENT,`analytics_id` integer,`url` text,`ip_hash` text,`dwell_time` integer,`active_time` integer,`scroll_depth` integer,`created_at` datetime,`updated_at` datetime,CONSTRAINT `fk_analytics_page_visits` FOREIGN KEY (`analytics_id`) REFERENCES `analytics`(`id`))",
+		"CREATE TABLE `users` (`id` integer PRIMARY KEY AUTOINCREMENT,`username` text NOT NULL,`password` text NOT NULL,`created_at` datetime,CONSTRAINT `uni_users_username` UNIQUE (`username`))",
+		"INSERT INTO `users` (`username`, `password`) VALUES ('admin', 'x')",
+	} {
+		assert.NoError(t, db.Exec(stmt).Error)
+	}
+
+	_, err := MigrateUp(db)
+	assert.NoError(t, err)
+
+	var count int64
+	db.Model(&models.User{}).Count(&count)
+	assert.Equal(t, int64(1), count, "existing data must survive")
+}
+
+func TestMigrations_SchemaTooNew(t *testing.T) {
+	db := openTestDB(t)
+
+	_, err := MigrateUp(db)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Create(&schemaMigration{Version: 99999, Name: "future", AppliedAt: time.Now()}).Error)
+
+	_, err = PendingMigrations(db)
+	assert.True(t, errors.Is(err, ErrSchemaTooNew))
+
+	_, err = MigrateUp(db)
+	assert.True(t, errors.Is(err, ErrSchemaTooNew))
+}
+
+func TestMigrations_DialectsInSync(t *testing.T) {
+	sqliteMigrations, err := Migrations("sqlite")
+	assert.NoError(t, err)
+
+	for _, dialect := range []string{"postgres", "mysql"} {
+		migrations, err := Migrations(dialect)
+		assert.NoError(t, err)
+		assert.Len(t, migrations, len(sqliteMigrations), dialect)
+
+		for i, m := range migrations {
+			assert.Equal(t, sqliteMigrations[i].Version, m.Version, dialect)
+			assert.Equal(t, sqliteMigrations[i].Name, m.Name, dialect)
+			assert.NotEmpty(t, m.Down, "%s %04d has no down script", dialect, m.Version)
+		}
+	}
+}
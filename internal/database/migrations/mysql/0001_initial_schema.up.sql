@@ -0,0 +1,42 @@
+-- MySQL can't index unbounded text columns, so URLs use prefix indexes.
+CREATE TABLE IF NOT EXISTS analytics (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    url text NOT NULL,
+    referrer text,
+    user_agent text,
+    ip_hash varchar(64),
+    country varchar(191),
+    is_bot boolean DEFAULT false,
+    bot_score bigint,
+    bot_reason text,
+    created_at datetime(3),
+    updated_at datetime(3),
+    INDEX idx_analytics_is_bot (is_bot),
+    INDEX idx_analytics_country (country),
+    INDEX idx_analytics_ip_hash (ip_hash),
+    INDEX idx_analytics_url (url(255))
+);
+
+CREATE TABLE IF NOT EXISTS page_visits (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    analytics_id bigint unsigned,
+    url text,
+    ip_hash varchar(64),
+    dwell_time bigint,
+    active_time bigint,
+    scroll_depth bigint,
+    created_at datetime(3),
+    updated_at datetime(3),
+    INDEX idx_page_visits_ip_hash (ip_hash),
+    INDEX idx_page_visits_url (url(255)),
+    INDEX idx_page_visits_analytics_id (analytics_id),
+    CONSTRAINT fk_analytics_page_visits FOREIGN KEY (analytics_id) REFERENCES analytics (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    username varchar(191) NOT NULL,
+    password text NOT NULL,
+    created_at datetime(3),
+    CONSTRAINT uni_users_username UNIQUE (username)
+);
@@ -0,0 +1,6 @@
+ALTER TABLE page_visits DROP INDEX idx_page_visits_site_id, DROP COLUMN site_id;
+
+ALTER TABLE analytics DROP INDEX idx_analytics_site_id, DROP COLUMN site_id;
+
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS sites;
@@ -0,0 +1,25 @@
+CREATE TABLE sites (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    name varchar(255) NOT NULL,
+    domain varchar(191) NOT NULL,
+    created_at datetime(3),
+    CONSTRAINT uni_sites_domain UNIQUE (domain)
+);
+
+CREATE TABLE api_keys (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    name varchar(255) NOT NULL,
+    prefix varchar(32) NOT NULL,
+    key_hash varchar(64) NOT NULL,
+    site_id bigint unsigned,
+    created_at datetime(3),
+    last_used_at datetime(3),
+    revoked_at datetime(3),
+    INDEX idx_api_keys_prefix (prefix),
+    CONSTRAINT uni_api_keys_key_hash UNIQUE (key_hash),
+    CONSTRAINT fk_api_keys_site FOREIGN KEY (site_id) REFERENCES sites (id) ON DELETE CASCADE
+);
+
+ALTER TABLE analytics ADD COLUMN site_id bigint unsigned, ADD INDEX idx_analytics_site_id (site_id);
+
+ALTER TABLE page_visits ADD COLUMN site_id bigint unsigned, ADD INDEX idx_page_visits_site_id (site_id);
@@ -0,0 +1,8 @@
+DROP TABLE IF EXISTS site_grants;
+
+ALTER TABLE users
+    DROP INDEX idx_users_invite_token_hash,
+    DROP COLUMN invite_expires_at,
+    DROP COLUMN invite_token_hash,
+    DROP COLUMN disabled,
+    DROP COLUMN role;
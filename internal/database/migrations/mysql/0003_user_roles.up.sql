@@ -0,0 +1,19 @@
+ALTER TABLE users
+    ADD COLUMN role varchar(16) NOT NULL DEFAULT 'viewer',
+    ADD COLUMN disabled boolean NOT NULL DEFAULT false,
+    ADD COLUMN invite_token_hash varchar(64),
+    ADD COLUMN invite_expires_at datetime(3),
+    ADD UNIQUE INDEX idx_users_invite_token_hash (invite_token_hash);
+
+-- users created before roles existed keep full access
+UPDATE users SET role = 'owner';
+
+CREATE TABLE site_grants (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    site_id bigint unsigned NOT NULL,
+    created_at datetime(3),
+    UNIQUE INDEX idx_site_grants_user_site (user_id, site_id),
+    CONSTRAINT fk_users_site_grants FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_site_grants_site FOREIGN KEY (site_id) REFERENCES sites (id) ON DELETE CASCADE
+);
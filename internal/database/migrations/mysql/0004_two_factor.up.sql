@@ -0,0 +1,14 @@
+ALTER TABLE users
+    ADD COLUMN totp_secret varchar(64),
+    ADD COLUMN totp_enabled_at datetime(3),
+    ADD COLUMN totp_last_step bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE recovery_codes (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    code_hash varchar(64) NOT NULL,
+    used_at datetime(3),
+    created_at datetime(3),
+    INDEX idx_recovery_codes_user_id (user_id),
+    CONSTRAINT fk_users_recovery_codes FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,16 @@
+CREATE TABLE auth_events (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned,
+    username varchar(191),
+    type varchar(32) NOT NULL,
+    reason varchar(191),
+    ip_hash varchar(64),
+    user_agent text,
+    session_id varchar(64),
+    created_at datetime(3),
+    INDEX idx_auth_events_user_id (user_id),
+    INDEX idx_auth_events_username (username),
+    INDEX idx_auth_events_ip_hash (ip_hash),
+    INDEX idx_auth_events_session_id (session_id),
+    INDEX idx_auth_events_created_at (created_at)
+);
@@ -0,0 +1,15 @@
+CREATE TABLE sessions (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    token_hash varchar(64) NOT NULL,
+    user_id bigint unsigned,
+    data text,
+    ip_hash varchar(64),
+    user_agent text,
+    created_at datetime(3),
+    last_seen_at datetime(3),
+    expires_at datetime(3),
+    UNIQUE INDEX idx_sessions_token_hash (token_hash),
+    INDEX idx_sessions_user_id (user_id),
+    INDEX idx_sessions_expires_at (expires_at),
+    CONSTRAINT fk_sessions_user FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+CREATE TABLE custom_events (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    site_id bigint unsigned,
+    url text,
+    ip_hash varchar(64),
+    name varchar(64) NOT NULL,
+    props text,
+    created_at datetime(3),
+    INDEX idx_custom_events_site_id (site_id),
+    INDEX idx_custom_events_ip_hash (ip_hash),
+    INDEX idx_custom_events_name (name),
+    INDEX idx_custom_events_created_at (created_at)
+);
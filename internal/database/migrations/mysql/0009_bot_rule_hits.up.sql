@@ -0,0 +1,11 @@
+CREATE TABLE bot_rule_hits (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    analytics_id bigint unsigned NOT NULL,
+    site_id bigint unsigned,
+    rule varchar(191) NOT NULL,
+    created_at datetime(3),
+    UNIQUE INDEX idx_bot_rule_hits_analytics_rule (analytics_id, rule),
+    INDEX idx_bot_rule_hits_site_id (site_id),
+    INDEX idx_bot_rule_hits_rule (rule),
+    INDEX idx_bot_rule_hits_created_at (created_at)
+);
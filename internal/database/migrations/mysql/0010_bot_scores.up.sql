@@ -0,0 +1,12 @@
+CREATE TABLE bot_scores (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    analytics_id bigint unsigned NOT NULL,
+    site_id bigint unsigned,
+    score bigint,
+    is_bot boolean,
+    rules text,
+    created_at datetime(3),
+    INDEX idx_bot_scores_analytics_id (analytics_id),
+    INDEX idx_bot_scores_site_id (site_id),
+    INDEX idx_bot_scores_created_at (created_at)
+);
@@ -0,0 +1 @@
+ALTER TABLE analytics DROP COLUMN source;
@@ -0,0 +1 @@
+ALTER TABLE analytics ADD COLUMN source varchar(16) NOT NULL DEFAULT 'script';
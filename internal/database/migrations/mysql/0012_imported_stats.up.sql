@@ -0,0 +1,13 @@
+CREATE TABLE imported_stats (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    site_id bigint unsigned NOT NULL,
+    source varchar(16) NOT NULL,
+    date datetime(3) NOT NULL,
+    kind varchar(16) NOT NULL,
+    value varchar(191) NOT NULL,
+    visitors bigint,
+    pageviews bigint,
+    created_at datetime(3),
+    UNIQUE INDEX idx_imported_stats_key (site_id, source, date, kind, value),
+    INDEX idx_imported_stats_date (date)
+);
@@ -0,0 +1,12 @@
+CREATE TABLE report_schedules (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    site_id bigint unsigned NOT NULL,
+    email varchar(191) NOT NULL,
+    frequency varchar(16) NOT NULL,
+    next_run_at datetime(3) NOT NULL,
+    last_sent_at datetime(3),
+    last_error text,
+    created_at datetime(3),
+    UNIQUE INDEX idx_report_schedules_site_email (site_id, email),
+    INDEX idx_report_schedules_next_run_at (next_run_at)
+);
@@ -0,0 +1,28 @@
+CREATE TABLE alert_rules (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    name varchar(255) NOT NULL,
+    site_id bigint unsigned,
+    kind varchar(16) NOT NULL,
+    threshold double,
+    window_duration bigint NOT NULL,
+    event_name varchar(255),
+    webhook_url text NOT NULL,
+    format varchar(16) NOT NULL,
+    secret varchar(255) NOT NULL,
+    firing boolean,
+    checked_at datetime(3),
+    created_at datetime(3),
+    INDEX idx_alert_rules_site_id (site_id)
+);
+
+CREATE TABLE alert_events (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    rule_id bigint unsigned NOT NULL,
+    state varchar(16) NOT NULL,
+    value double,
+    message text,
+    error text,
+    created_at datetime(3),
+    INDEX idx_alert_events_rule_id (rule_id),
+    INDEX idx_alert_events_created_at (created_at)
+);
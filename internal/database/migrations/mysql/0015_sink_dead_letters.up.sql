@@ -0,0 +1,11 @@
+CREATE TABLE sink_dead_letters (
+    id bigint unsigned AUTO_INCREMENT PRIMARY KEY,
+    url text NOT NULL,
+    payload longtext NOT NULL,
+    events bigint,
+    attempts bigint,
+    error text,
+    created_at datetime(3),
+    updated_at datetime(3),
+    INDEX idx_sink_dead_letters_created_at (created_at)
+);
@@ -0,0 +1,43 @@
+-- Matches the schema previously created by GORM AutoMigrate so existing
+-- databases are adopted without changes.
+CREATE TABLE IF NOT EXISTS analytics (
+    id bigserial PRIMARY KEY,
+    url text NOT NULL,
+    referrer text,
+    user_agent text,
+    ip_hash text,
+    country text,
+    is_bot boolean DEFAULT false,
+    bot_score bigint,
+    bot_reason text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_analytics_is_bot ON analytics (is_bot);
+CREATE INDEX IF NOT EXISTS idx_analytics_country ON analytics (country);
+CREATE INDEX IF NOT EXISTS idx_analytics_ip_hash ON analytics (ip_hash);
+CREATE INDEX IF NOT EXISTS idx_analytics_url ON analytics (url);
+
+CREATE TABLE IF NOT EXISTS page_visits (
+    id bigserial PRIMARY KEY,
+    analytics_id bigint,
+    url text,
+    ip_hash text,
+    dwell_time bigint,
+    active_time bigint,
+    scroll_depth bigint,
+    created_at timestamptz,
+    updated_at timestamptz,
+    CONSTRAINT fk_analytics_page_visits FOREIGN KEY (analytics_id) REFERENCES analytics (id) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_page_visits_ip_hash ON page_visits (ip_hash);
+CREATE INDEX IF NOT EXISTS idx_page_visits_url ON page_visits (url);
+CREATE INDEX IF NOT EXISTS idx_page_visits_analytics_id ON page_visits (analytics_id);
+
+CREATE TABLE IF NOT EXISTS users (
+    id bigserial PRIMARY KEY,
+    username text NOT NULL,
+    password text NOT NULL,
+    created_at timestamptz,
+    CONSTRAINT uni_users_username UNIQUE (username)
+);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS idx_page_visits_site_id;
+ALTER TABLE page_visits DROP COLUMN site_id;
+
+DROP INDEX IF EXISTS idx_analytics_site_id;
+ALTER TABLE analytics DROP COLUMN site_id;
+
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS sites;
@@ -0,0 +1,27 @@
+CREATE TABLE sites (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    domain text NOT NULL,
+    created_at timestamptz,
+    CONSTRAINT uni_sites_domain UNIQUE (domain)
+);
+
+CREATE TABLE api_keys (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    prefix text NOT NULL,
+    key_hash text NOT NULL,
+    site_id bigint,
+    created_at timestamptz,
+    last_used_at timestamptz,
+    revoked_at timestamptz,
+    CONSTRAINT uni_api_keys_key_hash UNIQUE (key_hash),
+    CONSTRAINT fk_api_keys_site FOREIGN KEY (site_id) REFERENCES sites (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_api_keys_prefix ON api_keys (prefix);
+
+ALTER TABLE analytics ADD COLUMN site_id bigint;
+CREATE INDEX idx_analytics_site_id ON analytics (site_id);
+
+ALTER TABLE page_visits ADD COLUMN site_id bigint;
+CREATE INDEX idx_page_visits_site_id ON page_visits (site_id);
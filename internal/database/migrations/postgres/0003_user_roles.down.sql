@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS site_grants;
+
+DROP INDEX IF EXISTS idx_users_invite_token_hash;
+ALTER TABLE users DROP COLUMN invite_expires_at;
+ALTER TABLE users DROP COLUMN invite_token_hash;
+ALTER TABLE users DROP COLUMN disabled;
+ALTER TABLE users DROP COLUMN role;
@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN role text NOT NULL DEFAULT 'viewer';
+ALTER TABLE users ADD COLUMN disabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN invite_token_hash text;
+ALTER TABLE users ADD COLUMN invite_expires_at timestamptz;
+CREATE UNIQUE INDEX idx_users_invite_token_hash ON users (invite_token_hash);
+
+-- users created before roles existed keep full access
+UPDATE users SET role = 'owner';
+
+CREATE TABLE site_grants (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    site_id bigint NOT NULL,
+    created_at timestamptz,
+    CONSTRAINT fk_users_site_grants FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    CONSTRAINT fk_site_grants_site FOREIGN KEY (site_id) REFERENCES sites (id) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX idx_site_grants_user_site ON site_grants (user_id, site_id);
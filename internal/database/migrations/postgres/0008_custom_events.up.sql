@@ -0,0 +1,13 @@
+CREATE TABLE custom_events (
+    id bigserial PRIMARY KEY,
+    site_id bigint,
+    url text,
+    ip_hash text,
+    name text NOT NULL,
+    props text,
+    created_at timestamptz
+);
+CREATE INDEX idx_custom_events_site_id ON custom_events (site_id);
+CREATE INDEX idx_custom_events_ip_hash ON custom_events (ip_hash);
+CREATE INDEX idx_custom_events_name ON custom_events (name);
+CREATE INDEX idx_custom_events_created_at ON custom_events (created_at);
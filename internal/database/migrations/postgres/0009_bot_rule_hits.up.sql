@@ -0,0 +1,11 @@
+CREATE TABLE bot_rule_hits (
+    id bigserial PRIMARY KEY,
+    analytics_id bigint NOT NULL,
+    site_id bigint,
+    rule text NOT NULL,
+    created_at timestamptz
+);
+CREATE UNIQUE INDEX idx_bot_rule_hits_analytics_rule ON bot_rule_hits (analytics_id, rule);
+CREATE INDEX idx_bot_rule_hits_site_id ON bot_rule_hits (site_id);
+CREATE INDEX idx_bot_rule_hits_rule ON bot_rule_hits (rule);
+CREATE INDEX idx_bot_rule_hits_created_at ON bot_rule_hits (created_at);
@@ -0,0 +1,12 @@
+CREATE TABLE bot_scores (
+    id bigserial PRIMARY KEY,
+    analytics_id bigint NOT NULL,
+    site_id bigint,
+    score bigint,
+    is_bot boolean,
+    rules text,
+    created_at timestamptz
+);
+CREATE INDEX idx_bot_scores_analytics_id ON bot_scores (analytics_id);
+CREATE INDEX idx_bot_scores_site_id ON bot_scores (site_id);
+CREATE INDEX idx_bot_scores_created_at ON bot_scores (created_at);
@@ -0,0 +1 @@
+ALTER TABLE analytics ADD COLUMN source text NOT NULL DEFAULT 'script';
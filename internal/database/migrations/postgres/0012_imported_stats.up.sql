@@ -0,0 +1,13 @@
+CREATE TABLE imported_stats (
+    id bigserial PRIMARY KEY,
+    site_id bigint NOT NULL,
+    source text NOT NULL,
+    date timestamptz NOT NULL,
+    kind text NOT NULL,
+    value text NOT NULL,
+    visitors bigint,
+    pageviews bigint,
+    created_at timestamptz
+);
+CREATE UNIQUE INDEX idx_imported_stats_key ON imported_stats (site_id, source, date, kind, value);
+CREATE INDEX idx_imported_stats_date ON imported_stats (date);
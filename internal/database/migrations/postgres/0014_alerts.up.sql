@@ -0,0 +1,28 @@
+CREATE TABLE alert_rules (
+    id bigserial PRIMARY KEY,
+    name text NOT NULL,
+    site_id bigint,
+    kind text NOT NULL,
+    threshold double precision,
+    window_duration bigint NOT NULL,
+    event_name text,
+    webhook_url text NOT NULL,
+    format text NOT NULL,
+    secret text NOT NULL,
+    firing boolean,
+    checked_at timestamptz,
+    created_at timestamptz
+);
+CREATE INDEX idx_alert_rules_site_id ON alert_rules (site_id);
+
+CREATE TABLE alert_events (
+    id bigserial PRIMARY KEY,
+    rule_id bigint NOT NULL,
+    state text NOT NULL,
+    value double precision,
+    message text,
+    error text,
+    created_at timestamptz
+);
+CREATE INDEX idx_alert_events_rule_id ON alert_events (rule_id);
+CREATE INDEX idx_alert_events_created_at ON alert_events (created_at);
@@ -0,0 +1,11 @@
+CREATE TABLE sink_dead_letters (
+    id bigserial PRIMARY KEY,
+    url text NOT NULL,
+    payload text NOT NULL,
+    events bigint,
+    attempts bigint,
+    error text,
+    created_at timestamptz,
+    updated_at timestamptz
+);
+CREATE INDEX idx_sink_dead_letters_created_at ON sink_dead_letters (created_at);
@@ -0,0 +1 @@
+ALTER TABLE report_schedules DROP COLUMN retry_at;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `page_visits`;
+DROP TABLE IF EXISTS `analytics`;
+DROP TABLE IF EXISTS `users`;
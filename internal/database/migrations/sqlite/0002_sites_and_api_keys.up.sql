@@ -0,0 +1,27 @@
+CREATE TABLE `sites` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `name` text NOT NULL,
+    `domain` text NOT NULL,
+    `created_at` datetime,
+    CONSTRAINT `uni_sites_domain` UNIQUE (`domain`)
+);
+
+CREATE TABLE `api_keys` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `name` text NOT NULL,
+    `prefix` text NOT NULL,
+    `key_hash` text NOT NULL,
+    `site_id` integer,
+    `created_at` datetime,
+    `last_used_at` datetime,
+    `revoked_at` datetime,
+    CONSTRAINT `uni_api_keys_key_hash` UNIQUE (`key_hash`),
+    CONSTRAINT `fk_api_keys_site` FOREIGN KEY (`site_id`) REFERENCES `sites`(`id`) ON DELETE CASCADE
+);
+CREATE INDEX `idx_api_keys_prefix` ON `api_keys`(`prefix`);
+
+ALTER TABLE `analytics` ADD COLUMN `site_id` integer;
+CREATE INDEX `idx_analytics_site_id` ON `analytics`(`site_id`);
+
+ALTER TABLE `page_visits` ADD COLUMN `site_id` integer;
+CREATE INDEX `idx_page_visits_site_id` ON `page_visits`(`site_id`);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS `recovery_codes`;
+
+ALTER TABLE `users` DROP COLUMN `totp_last_step`;
+ALTER TABLE `users` DROP COLUMN `totp_enabled_at`;
+ALTER TABLE `users` DROP COLUMN `totp_secret`;
@@ -0,0 +1,16 @@
+CREATE TABLE `auth_events` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `user_id` integer,
+    `username` text,
+    `type` text NOT NULL,
+    `reason` text,
+    `ip_hash` text,
+    `user_agent` text,
+    `session_id` text,
+    `created_at` datetime
+);
+CREATE INDEX `idx_auth_events_user_id` ON `auth_events`(`user_id`);
+CREATE INDEX `idx_auth_events_username` ON `auth_events`(`username`);
+CREATE INDEX `idx_auth_events_ip_hash` ON `auth_events`(`ip_hash`);
+CREATE INDEX `idx_auth_events_session_id` ON `auth_events`(`session_id`);
+CREATE INDEX `idx_auth_events_created_at` ON `auth_events`(`created_at`);
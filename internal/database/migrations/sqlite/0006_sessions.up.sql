@@ -0,0 +1,15 @@
+CREATE TABLE `sessions` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `token_hash` text NOT NULL,
+    `user_id` integer,
+    `data` text,
+    `ip_hash` text,
+    `user_agent` text,
+    `created_at` datetime,
+    `last_seen_at` datetime,
+    `expires_at` datetime,
+    CONSTRAINT `fk_sessions_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`) ON DELETE CASCADE
+);
+CREATE UNIQUE INDEX `idx_sessions_token_hash` ON `sessions`(`token_hash`);
+CREATE INDEX `idx_sessions_user_id` ON `sessions`(`user_id`);
+CREATE INDEX `idx_sessions_expires_at` ON `sessions`(`expires_at`);
@@ -0,0 +1,2 @@
+ALTER TABLE `users` ADD COLUMN `oidc_subject` text;
+CREATE UNIQUE INDEX `idx_users_oidc_subject` ON `users`(`oidc_subject`);
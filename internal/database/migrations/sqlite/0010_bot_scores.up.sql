@@ -0,0 +1,12 @@
+CREATE TABLE `bot_scores` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `analytics_id` integer NOT NULL,
+    `site_id` integer,
+    `score` integer,
+    `is_bot` numeric,
+    `rules` text,
+    `created_at` datetime
+);
+CREATE INDEX `idx_bot_scores_analytics_id` ON `bot_scores`(`analytics_id`);
+CREATE INDEX `idx_bot_scores_site_id` ON `bot_scores`(`site_id`);
+CREATE INDEX `idx_bot_scores_created_at` ON `bot_scores`(`created_at`);
@@ -0,0 +1,13 @@
+CREATE TABLE `imported_stats` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `site_id` integer NOT NULL,
+    `source` text NOT NULL,
+    `date` datetime NOT NULL,
+    `kind` text NOT NULL,
+    `value` text NOT NULL,
+    `visitors` integer,
+    `pageviews` integer,
+    `created_at` datetime
+);
+CREATE UNIQUE INDEX `idx_imported_stats_key` ON `imported_stats`(`site_id`, `source`, `date`, `kind`, `value`);
+CREATE INDEX `idx_imported_stats_date` ON `imported_stats`(`date`);
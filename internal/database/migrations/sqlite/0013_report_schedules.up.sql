@@ -0,0 +1,12 @@
+CREATE TABLE `report_schedules` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `site_id` integer NOT NULL,
+    `email` text NOT NULL,
+    `frequency` text NOT NULL,
+    `next_run_at` datetime NOT NULL,
+    `last_sent_at` datetime,
+    `last_error` text,
+    `created_at` datetime
+);
+CREATE UNIQUE INDEX `idx_report_schedules_site_email` ON `report_schedules`(`site_id`, `email`);
+CREATE INDEX `idx_report_schedules_next_run_at` ON `report_schedules`(`next_run_at`);
@@ -0,0 +1,28 @@
+CREATE TABLE `alert_rules` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `name` text NOT NULL,
+    `site_id` integer,
+    `kind` text NOT NULL,
+    `threshold` real,
+    `window_duration` integer NOT NULL,
+    `event_name` text,
+    `webhook_url` text NOT NULL,
+    `format` text NOT NULL,
+    `secret` text NOT NULL,
+    `firing` numeric,
+    `checked_at` datetime,
+    `created_at` datetime
+);
+CREATE INDEX `idx_alert_rules_site_id` ON `alert_rules`(`site_id`);
+
+CREATE TABLE `alert_events` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `rule_id` integer NOT NULL,
+    `state` text NOT NULL,
+    `value` real,
+    `message` text,
+    `error` text,
+    `created_at` datetime
+);
+CREATE INDEX `idx_alert_events_rule_id` ON `alert_events`(`rule_id`);
+CREATE INDEX `idx_alert_events_created_at` ON `alert_events`(`created_at`);
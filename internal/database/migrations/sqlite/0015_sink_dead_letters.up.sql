@@ -0,0 +1,11 @@
+CREATE TABLE `sink_dead_letters` (
+    `id` integer PRIMARY KEY AUTOINCREMENT,
+    `url` text NOT NULL,
+    `payload` text NOT NULL,
+    `events` integer,
+    `attempts` integer,
+    `error` text,
+    `created_at` datetime,
+    `updated_at` datetime
+);
+CREATE INDEX `idx_sink_dead_letters_created_at` ON `sink_dead_letters`(`created_at`);
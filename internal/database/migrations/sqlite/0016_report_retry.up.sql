@@ -0,0 +1 @@
+ALTER TABLE `report_schedules` ADD COLUMN `retry_at` datetime;
@@ -0,0 +1,107 @@
+// Package export writes rows of analytics data as CSV, NDJSON or Parquet,
+// one row at a time, so exports of any size can be streamed.
+package export
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// Formats data can be exported in.
+const (
+	CSV     = "csv"
+	NDJSON  = "ndjson"
+	Parquet = "parquet"
+)
+
+// Formats lists every format.
+var Formats = []string{CSV, NDJSON, Parquet}
+
+// Kind is the type of a column's values.
+type Kind int
+
+const (
+	String Kind = iota
+	Int
+	Float
+	Bool
+	Time
+)
+
+// Column describes one column of an export. Nullable columns may hold
+// nil.
+type Column struct {
+	Name     string
+	Kind     Kind
+	Nullable bool
+}
+
+// Writer writes rows whose values match its columns: string, int64,
+// float64, bool or time.Time, or nil in nullable columns. Close must be
+// called to complete the output.
+type Writer interface {
+	Write(row []any) error
+	Close() error
+}
+
+// ValidFormat reports whether format is one of Formats.
+func ValidFormat(format string) bool {
+	return slices.Contains(Formats, format)
+}
+
+// ContentType is the media type of a format.
+func ContentType(format string) string {
+	switch format {
+	case CSV:
+		return "text/csv; charset=utf-8"
+	case NDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/vnd.apache.parquet"
+	}
+}
+
+// NewWriter starts writing rows with columns to w in format.
+func NewWriter(w io.Writer, format string, columns []Column) (Writer, error) {
+	switch format {
+	case CSV:
+		return newCSVWriter(w, columns)
+	case NDJSON:
+		return &ndjsonWriter{w: w, columns: columns}, nil
+	case Parquet:
+		return newParquetWriter(w, columns)
+	default:
+		return nil, fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+// check makes sure a row matches the columns, so every format rejects
+// the same mistakes.
+func check(columns []Column, row []any) error {
+	if len(row) != len(columns) {
+		return fmt.Errorf("row has %d values for %d columns", len(row), len(columns))
+	}
+	for i, c := range columns {
+		var ok bool
+		switch row[i].(type) {
+		case nil:
+			ok = c.Nullable
+		case string:
+			ok = c.Kind == String
+		case int64:
+			ok = c.Kind == Int
+		case float64:
+			ok = c.Kind == Float
+		case bool:
+			ok = c.Kind == Bool
+		case time.Time:
+			ok = c.Kind == Time
+		}
+		if !ok {
+			return fmt.Errorf("column %s can't hold %T", c.Name, row[i])
+		}
+	}
+	return nil
+}
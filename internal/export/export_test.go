@@ -0,0 +1,171 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testColumns = []Column{
+	{Name: "time", Kind: Time},
+	{Name: "url", Kind: String},
+	{Name: "visits", Kind: Int},
+	{Name: "share", Kind: Float},
+	{Name: "is_bot", Kind: Bool},
+	{Name: "site", Kind: String, Nullable: true},
+}
+
+var testRows = [][]any{
+	{time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC), "https://example.com/", int64(12), 0.5, false, "example.com"},
+	{time.Date(2024, 1, 5, 11, 0, 0, 0, time.UTC), `https://example.com/?q="a,b"`, int64(3), 0.25, true, nil},
+}
+
+func writeRows(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, format, testColumns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range testRows {
+		if err := w.Write(row); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSV(t *testing.T) {
+	want := "time,url,visits,share,is_bot,site\n" +
+		"2024-01-05T10:00:00Z,https://example.com/,12,0.5,false,example.com\n" +
+		"2024-01-05T11:00:00Z,\"https://example.com/?q=\"\"a,b\"\"\",3,0.25,true,\n"
+	if got := string(writeRows(t, CSV)); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	want := `{"time":"2024-01-05T10:00:00Z","url":"https://example.com/","visits":12,"share":0.5,"is_bot":false,"site":"example.com"}` + "\n" +
+		`{"time":"2024-01-05T11:00:00Z","url":"https://example.com/?q=\"a,b\"","visits":3,"share":0.25,"is_bot":true,"site":null}` + "\n"
+	if got := string(writeRows(t, NDJSON)); got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestWriter_RejectsMismatchedRows(t *testing.T) {
+	for _, format := range Formats {
+		w, err := NewWriter(&bytes.Buffer{}, format, testColumns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write([]any{"not a time", "", int64(0), 0.0, false, nil}); err == nil {
+			t.Fatalf("%s: expected a string in a time column to be refused", format)
+		}
+		if err := w.Write(testRows[0][:3]); err == nil {
+			t.Fatalf("%s: expected a short row to be refused", format)
+		}
+	}
+}
+
+func TestParquet(t *testing.T) {
+	data := writeRows(t, Parquet)
+	if !bytes.HasPrefix(data, parquetMagic) || !bytes.HasSuffix(data, parquetMagic) {
+		t.Fatal("expected the file to start and end with PAR1")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	footer := data[len(data)-8-size : len(data)-8]
+
+	meta := (&thriftReader{b: footer}).readStruct()
+	if rows := meta[3].(int64); rows != int64(len(testRows)) {
+		t.Fatalf("expected %d rows, got %d", len(testRows), rows)
+	}
+	schema := meta[2].([]any)
+	var names []string
+	for _, el := range schema[1:] {
+		names = append(names, string(el.(map[int16]any)[4].([]byte)))
+	}
+	if got := strings.Join(names, ","); got != "time,url,visits,share,is_bot,site" {
+		t.Fatalf("unexpected schema %s", got)
+	}
+	if site := schema[6].(map[int16]any); site[3].(int64) != parquetOptional {
+		t.Fatalf("expected site to be optional, got %v", site)
+	}
+
+	groups := meta[4].([]any)
+	chunks := groups[0].(map[int16]any)[1].([]any)
+	if len(groups) != 1 || len(chunks) != len(testColumns) {
+		t.Fatalf("expected one row group of %d columns, got %v", len(testColumns), groups)
+	}
+	for _, chunk := range chunks {
+		column := chunk.(map[int16]any)[3].(map[int16]any)
+		offset := column[9].(int64)
+		header := (&thriftReader{b: data[offset:]}).readStruct()
+		if header[1].(int64) != parquetDataPage || header[5].(map[int16]any)[1].(int64) != int64(len(testRows)) {
+			t.Fatalf("unexpected page header %v", header)
+		}
+	}
+}
+
+// thriftReader decodes just enough of Thrift's compact protocol to check
+// the metadata the writer produces.
+type thriftReader struct {
+	b []byte
+	p int
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.p:])
+	r.p += n
+	return v
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		v := r.uvarint()
+		return int64(v>>1) ^ -int64(v&1)
+	case thriftBinary:
+		n := int(r.uvarint())
+		r.p += n
+		return r.b[r.p-n : r.p]
+	case thriftList:
+		header := r.b[r.p]
+		r.p++
+		n := int(header >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.readStruct()
+	}
+	panic("unexpected thrift type")
+}
+
+func (r *thriftReader) readStruct() map[int16]any {
+	fields := make(map[int16]any)
+	var id int16
+	for {
+		header := r.b[r.p]
+		r.p++
+		if header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			v := r.uvarint()
+			id = int16(v>>1) ^ -int16(v&1)
+		}
+		fields[id] = r.value(header & 0x0f)
+	}
+}
@@ -0,0 +1,368 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// rowGroupRows is how many rows are held in memory before they're written
+// out as a row group.
+const rowGroupRows = 8192
+
+var parquetMagic = []byte("PAR1")
+
+// Parquet physical types, converted types and other enums of the format
+// that the writer uses.
+const (
+	parquetBoolean   = 0
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetGzip = 2
+
+	parquetDataPage = 0
+)
+
+// columnChunk is what the footer records about a column of a row group.
+type columnChunk struct {
+	offset       int64
+	values       int64
+	uncompressed int64
+	compressed   int64
+}
+
+type rowGroup struct {
+	rows    int64
+	size    int64
+	columns []columnChunk
+}
+
+// parquetWriter writes a Parquet file with a row group for every
+// rowGroupRows rows. Each column chunk is a single gzipped data page of
+// plainly encoded values.
+type parquetWriter struct {
+	w       io.Writer
+	offset  int64
+	columns []Column
+	rows    [][]any
+	groups  []rowGroup
+	total   int64
+}
+
+func newParquetWriter(w io.Writer, columns []Column) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w, columns: columns}
+	return pw, pw.write(parquetMagic)
+}
+
+func (pw *parquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+func (pw *parquetWriter) Write(row []any) error {
+	if err := check(pw.columns, row); err != nil {
+		return err
+	}
+	pw.rows = append(pw.rows, append([]any(nil), row...))
+	if len(pw.rows) < rowGroupRows {
+		return nil
+	}
+	return pw.flush()
+}
+
+// flush writes the buffered rows as a row group.
+func (pw *parquetWriter) flush() error {
+	if len(pw.rows) == 0 {
+		return nil
+	}
+
+	group := rowGroup{rows: int64(len(pw.rows))}
+	for i, c := range pw.columns {
+		body := encodeColumn(c, pw.rows, i)
+
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(body); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		var header thriftWriter
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(body)))
+		header.i32(3, int32(compressed.Len()))
+		header.beginStruct(5)
+		header.i32(1, int32(len(pw.rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.stop()
+
+		chunk := columnChunk{
+			offset:       pw.offset,
+			values:       int64(len(pw.rows)),
+			uncompressed: int64(header.buf.Len() + len(body)),
+			compressed:   int64(header.buf.Len() + compressed.Len()),
+		}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(compressed.Bytes()); err != nil {
+			return err
+		}
+		group.columns = append(group.columns, chunk)
+		group.size += chunk.uncompressed
+	}
+
+	pw.groups = append(pw.groups, group)
+	pw.total += group.rows
+	pw.rows = pw.rows[:0]
+	return nil
+}
+
+// Close writes the remaining rows and the footer describing the file.
+func (pw *parquetWriter) Close() error {
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.beginList(2, thriftStruct, len(pw.columns)+1)
+	meta.beginElement()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, c := range pw.columns {
+		meta.beginElement()
+		meta.i32(1, physicalType(c.Kind))
+		if c.Nullable {
+			meta.i32(3, parquetOptional)
+		} else {
+			meta.i32(3, parquetRequired)
+		}
+		meta.binary(4, c.Name)
+		switch c.Kind {
+		case String:
+			meta.i32(6, parquetUTF8)
+		case Time:
+			meta.i32(6, parquetTimestampMillis)
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, pw.total)
+	meta.beginList(4, thriftStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		meta.beginElement()
+		meta.beginList(1, thriftStruct, len(g.columns))
+		for i, chunk := range g.columns {
+			meta.beginElement()
+			meta.i64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.i32(1, physicalType(pw.columns[i].Kind))
+			meta.beginList(2, thriftI32, 2)
+			meta.listI32(parquetPlain)
+			meta.listI32(parquetRLE)
+			meta.beginList(3, thriftBinary, 1)
+			meta.listBinary(pw.columns[i].Name)
+			meta.i32(4, parquetGzip)
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.uncompressed)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.i64(2, g.size)
+		meta.i64(3, g.rows)
+		meta.endStruct()
+	}
+	meta.binary(6, "doorman")
+	meta.stop()
+
+	if err := pw.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := pw.write(binary.LittleEndian.AppendUint32(nil, uint32(meta.buf.Len()))); err != nil {
+		return err
+	}
+	return pw.write(parquetMagic)
+}
+
+func physicalType(k Kind) int32 {
+	switch k {
+	case Int, Time:
+		return parquetInt64
+	case Float:
+		return parquetDouble
+	case Bool:
+		return parquetBoolean
+	default:
+		return parquetByteArray
+	}
+}
+
+// encodeColumn encodes column i of rows as the body of a data page: the
+// definition levels of a nullable column, then the values that aren't
+// null.
+func encodeColumn(c Column, rows [][]any, i int) []byte {
+	var body []byte
+	if c.Nullable {
+		levels := encodeLevels(rows, i)
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(levels)))
+		body = append(body, levels...)
+	}
+
+	var bits byte
+	var nbits int
+	for _, row := range rows {
+		switch v := row[i].(type) {
+		case string:
+			body = binary.LittleEndian.AppendUint32(body, uint32(len(v)))
+			body = append(body, v...)
+		case int64:
+			body = binary.LittleEndian.AppendUint64(body, uint64(v))
+		case time.Time:
+			body = binary.LittleEndian.AppendUint64(body, uint64(v.UnixMilli()))
+		case float64:
+			body = binary.LittleEndian.AppendUint64(body, math.Float64bits(v))
+		case bool:
+			if v {
+				bits |= 1 << nbits
+			}
+			if nbits++; nbits == 8 {
+				body = append(body, bits)
+				bits, nbits = 0, 0
+			}
+		}
+	}
+	if nbits > 0 {
+		body = append(body, bits)
+	}
+	return body
+}
+
+// encodeLevels encodes whether each value of column i is set as runs of
+// the RLE/bit-packing hybrid encoding, with a bit width of one.
+func encodeLevels(rows [][]any, i int) []byte {
+	var out []byte
+	for start := 0; start < len(rows); {
+		set := rows[start][i] != nil
+		end := start + 1
+		for end < len(rows) && (rows[end][i] != nil) == set {
+			end++
+		}
+		out = binary.AppendUvarint(out, uint64(end-start)<<1)
+		if set {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		start = end
+	}
+	return out
+}
+
+// Types of Thrift's compact protocol.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the structs of Parquet's metadata with Thrift's
+// compact protocol. Fields must be written in increasing order of id.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+	id   int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.id; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	t.id = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64((v<<1)^(v>>63))))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.listBinary(s)
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElement()
+}
+
+// beginElement starts a struct inside a list.
+func (t *thriftWriter) beginElement() {
+	t.last = append(t.last, t.id)
+	t.id = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.id = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+func (t *thriftWriter) beginList(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | elem)
+		return
+	}
+	t.buf.WriteByte(0xf0 | elem)
+	t.buf.Write(binary.AppendUvarint(nil, uint64(n)))
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) listBinary(s string) {
+	t.buf.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.buf.WriteString(s)
+}
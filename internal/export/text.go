@@ -0,0 +1,92 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+type csvWriter struct {
+	w       *csv.Writer
+	columns []Column
+	record  []string
+}
+
+func newCSVWriter(w io.Writer, columns []Column) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+	for i, c := range columns {
+		cw.record[i] = c.Name
+	}
+	return cw, cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Write(row []any) error {
+	if err := check(cw.columns, row); err != nil {
+		return err
+	}
+	for i, v := range row {
+		switch v := v.(type) {
+		case nil:
+			cw.record[i] = ""
+		case string:
+			cw.record[i] = v
+		case int64:
+			cw.record[i] = strconv.FormatInt(v, 10)
+		case float64:
+			cw.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			cw.record[i] = strconv.FormatBool(v)
+		case time.Time:
+			cw.record[i] = v.UTC().Format(time.RFC3339)
+		}
+	}
+	return cw.w.Write(cw.record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// ndjsonWriter writes each row as a JSON object on its own line, with
+// keys in column order.
+type ndjsonWriter struct {
+	w       io.Writer
+	columns []Column
+	buf     []byte
+}
+
+func (nw *ndjsonWriter) Write(row []any) error {
+	if err := check(nw.columns, row); err != nil {
+		return err
+	}
+	buf := append(nw.buf[:0], '{')
+	for i, v := range row {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		name, err := json.Marshal(nw.columns[i].Name)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, name...), ':')
+		if t, ok := v.(time.Time); ok {
+			v = t.UTC().Format(time.RFC3339)
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, value...)
+	}
+	buf = append(buf, '}', '\n')
+	nw.buf = buf
+	_, err := nw.w.Write(buf)
+	return err
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/types"
+	"github.com/webbesoft/doorman/templates/pages"
+)
+
+// AccountHandler serves the signed-in user's own security settings
+type AccountHandler struct {
+	DB *gorm.DB
+}
+
+// Account renders the account page
+func (a *AccountHandler) Account(c echo.Context) error {
+	return a.render(c, nil, nil, c.QueryParam("error"), c.QueryParam("msg"))
+}
+
+func (a *AccountHandler) render(c echo.Context, setup *types.TwoFactorSetup, recoveryCodes []string, errMsg, msg string) error {
+	user := middleware.CurrentUser(c)
+
+	var remaining int64
+	if user.TwoFactorEnabled() {
+		var err error
+		remaining, err = services.NewTwoFactorService(a.DB).RemainingRecoveryCodes(user)
+		if err != nil {
+			return err
+		}
+	}
+
+	return render(c, pages.AccountPage(user, setup, recoveryCodes, remaining, errMsg, msg))
+}
+
+// Security renders the user's sessions and recent login activity
+func (a *AccountHandler) Security(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+
+	recent, err := services.NewAuthEventService(a.DB).Recent(user.ID, 50)
+	if err != nil {
+		return err
+	}
+	active, err := services.NewSessionService(a.DB).ListForUser(user.ID)
+	if err != nil {
+		return err
+	}
+
+	return render(c, pages.SecurityPage(user, recent, active, currentSessionID(c), c.QueryParam("error"), c.QueryParam("msg")))
+}
+
+// RevokeSession signs one of the user's other sessions out
+func (a *AccountHandler) RevokeSession(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	if uint(id) == currentSessionID(c) {
+		return redirectWithError(c, "/account/security", errors.New("use Logout to end this session"))
+	}
+
+	if err := services.NewSessionService(a.DB).Revoke(middleware.CurrentUser(c).ID, uint(id)); err != nil {
+		return redirectWithError(c, "/account/security", err)
+	}
+
+	return c.Redirect(http.StatusFound, "/account/security?msg="+url.QueryEscape("Session signed out."))
+}
+
+// RevokeOtherSessions signs the user out everywhere else
+func (a *AccountHandler) RevokeOtherSessions(c echo.Context) error {
+	n, err := services.NewSessionService(a.DB).RevokeAll(middleware.CurrentUser(c).ID, currentSessionID(c))
+	if err != nil {
+		return redirectWithError(c, "/account/security", err)
+	}
+
+	msg := fmt.Sprintf("Signed out of %d other sessions.", n)
+	return c.Redirect(http.StatusFound, "/account/security?msg="+url.QueryEscape(msg))
+}
+
+// ChangePassword updates the password and signs out other sessions
+func (a *AccountHandler) ChangePassword(c echo.Context) error {
+	password := c.FormValue("password")
+	if password != c.FormValue("password_confirm") {
+		return redirectWithError(c, "/account/security", errors.New("passwords don't match"))
+	}
+
+	err := services.NewUserService(a.DB).ChangePassword(
+		middleware.CurrentUser(c),
+		c.FormValue("current_password"),
+		password,
+		currentSessionID(c),
+	)
+	if err != nil {
+		return redirectWithError(c, "/account/security", err)
+	}
+
+	return c.Redirect(http.StatusFound, "/account/security?msg="+url.QueryEscape("Password changed. Other sessions were signed out."))
+}
+
+func currentSessionID(c echo.Context) uint {
+	sess, _ := session.Get("session", c)
+	id, _ := strconv.ParseUint(sess.ID, 10, 64)
+	return uint(id)
+}
+
+// SetupTwoFactor starts enrollment and shows the QR code
+func (a *AccountHandler) SetupTwoFactor(c echo.Context) error {
+	key, err := services.NewTwoFactorService(a.DB).Enroll(middleware.CurrentUser(c))
+	if err != nil {
+		return redirectWithError(c, "/account", err)
+	}
+
+	return a.renderSetup(c, key, "")
+}
+
+// ConfirmTwoFactor enables 2FA and shows the recovery codes once
+func (a *AccountHandler) ConfirmTwoFactor(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+	twoFactor := services.NewTwoFactorService(a.DB)
+
+	codes, err := twoFactor.Confirm(user, c.FormValue("code"))
+	if errors.Is(err, services.ErrInvalidCode) {
+		key, keyErr := twoFactor.PendingKey(user)
+		if keyErr != nil {
+			return redirectWithError(c, "/account", keyErr)
+		}
+		return a.renderSetup(c, key, err.Error())
+	}
+	if err != nil {
+		return redirectWithError(c, "/account", err)
+	}
+
+	return a.render(c, nil, codes, "", "Two-factor authentication is on. Save these recovery codes somewhere safe; they won't be shown again.")
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes after checking a code
+func (a *AccountHandler) RegenerateRecoveryCodes(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+	twoFactor := services.NewTwoFactorService(a.DB)
+
+	if err := twoFactor.Verify(user, c.FormValue("code")); err != nil {
+		return redirectWithError(c, "/account", err)
+	}
+
+	codes, err := twoFactor.RegenerateRecoveryCodes(user)
+	if err != nil {
+		return redirectWithError(c, "/account", err)
+	}
+
+	return a.render(c, nil, codes, "", "New recovery codes generated. The old ones no longer work.")
+}
+
+// DisableTwoFactor turns 2FA off after checking a code
+func (a *AccountHandler) DisableTwoFactor(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+	twoFactor := services.NewTwoFactorService(a.DB)
+
+	if err := twoFactor.Verify(user, c.FormValue("code")); err != nil {
+		return redirectWithError(c, "/account", err)
+	}
+	if err := twoFactor.Disable(user.ID); err != nil {
+		return redirectWithError(c, "/account", err)
+	}
+
+	return c.Redirect(http.StatusFound, "/account?msg="+url.QueryEscape("Two-factor authentication is off."))
+}
+
+func (a *AccountHandler) renderSetup(c echo.Context, key *otp.Key, errMsg string) error {
+	svg, err := services.QRCodeSVG(key.URL())
+	if err != nil {
+		return err
+	}
+
+	setup := &types.TwoFactorSetup{QRCode: svg, Secret: key.Secret()}
+	return a.render(c, setup, nil, errMsg, "")
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/templates/pages"
+)
+
+// alertHistoryLimit is how many past alerts the page shows
+const alertHistoryLimit = 50
+
+// AlertHandler manages traffic alert rules.
+type AlertHandler struct {
+	DB *gorm.DB
+	// AllowPrivate lets webhooks reach loopback, link-local and private
+	// addresses.
+	AllowPrivate bool
+}
+
+func (a *AlertHandler) service() *services.AlertService {
+	return services.NewAlertService(a.DB, a.AllowPrivate)
+}
+
+// List renders the alert rules and recent alerts
+func (a *AlertHandler) List(c echo.Context) error {
+	alerts := a.service()
+	rules, err := alerts.List()
+	if err != nil {
+		return err
+	}
+	history, err := alerts.History(alertHistoryLimit)
+	if err != nil {
+		return err
+	}
+	sites, err := services.NewSiteService(a.DB).List()
+	if err != nil {
+		return err
+	}
+
+	return render(c, pages.AlertsPage(
+		middleware.CurrentUser(c),
+		rules,
+		history,
+		sites,
+		c.QueryParam("error"),
+		c.QueryParam("msg"),
+	))
+}
+
+// Add creates an alert rule from the form
+func (a *AlertHandler) Add(c echo.Context) error {
+	rule := models.AlertRule{
+		Name:       strings.TrimSpace(c.FormValue("name")),
+		Kind:       c.FormValue("kind"),
+		EventName:  strings.TrimSpace(c.FormValue("event")),
+		WebhookURL: strings.TrimSpace(c.FormValue("webhook_url")),
+		Format:     c.FormValue("format"),
+	}
+	if site := c.FormValue("site"); site != "" {
+		id, err := strconv.ParseUint(site, 10, 64)
+		if err != nil {
+			return redirectWithError(c, "/alerts", services.ErrSiteNotFound)
+		}
+		siteID := uint(id)
+		rule.SiteID = &siteID
+	}
+	if v := c.FormValue("threshold"); v != "" {
+		threshold, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return redirectWithError(c, "/alerts", errors.New("the threshold must be a number"))
+		}
+		rule.Threshold = threshold
+	}
+	window, err := time.ParseDuration(c.FormValue("window"))
+	if err != nil {
+		return redirectWithError(c, "/alerts", errors.New("the window must be a duration such as 30m or 6h"))
+	}
+	rule.Window = window
+
+	if err := a.service().Add(&rule); err != nil {
+		return redirectWithError(c, "/alerts", err)
+	}
+	return c.Redirect(http.StatusFound, "/alerts?msg="+url.QueryEscape("Alert "+rule.Name+" added."))
+}
+
+// Delete removes a rule and its history
+func (a *AlertHandler) Delete(c echo.Context) error {
+	return a.manage(c, "Alert deleted", func(alerts *services.AlertService, id uint) error {
+		return alerts.Delete(id)
+	})
+}
+
+// SendTest posts a test alert to a rule's webhook
+func (a *AlertHandler) SendTest(c echo.Context) error {
+	return a.manage(c, "Test alert sent", func(alerts *services.AlertService, id uint) error {
+		return alerts.SendTest(c.Request().Context(), id)
+	})
+}
+
+func (a *AlertHandler) manage(c echo.Context, success string, action func(*services.AlertService, uint) error) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if err := action(a.service(), uint(id)); err != nil {
+		return redirectWithError(c, "/alerts", err)
+	}
+
+	return c.Redirect(http.StatusFound, "/alerts?msg="+url.QueryEscape(success))
+}
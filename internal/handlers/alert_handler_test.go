@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/webhook"
+)
+
+func TestAlertHandler(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	var events []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events = append(events, r.Header.Get(webhook.EventHeader))
+	}))
+	defer receiver.Close()
+	ah := &AlertHandler{DB: h.DB, AllowPrivate: true}
+
+	e := echo.New()
+	g := e.Group("", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("user", &models.User{ID: 1, Role: models.RoleAdmin})
+			return next(c)
+		}
+	})
+	g.GET("/alerts", ah.List)
+	g.POST("/alerts", ah.Add)
+	g.POST("/alerts/:id/test", ah.SendTest)
+	g.POST("/alerts/:id/delete", ah.Delete)
+	post := func(path string, form url.Values) string {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%s: expected a redirect, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get("Location")
+	}
+
+	form := url.Values{"name": {"Bots"}, "kind": {"bot_share"}, "threshold": {"40"}, "window": {"soon"}, "webhook_url": {receiver.URL}, "format": {"slack"}}
+	if loc := post("/alerts", form); !strings.Contains(loc, "error=") {
+		t.Fatalf("expected a bad window to be refused, got %q", loc)
+	}
+	form.Set("window", "2h")
+	if loc := post("/alerts", form); !strings.Contains(loc, "msg=") {
+		t.Fatalf("expected the alert to be added, got %q", loc)
+	}
+
+	var rule models.AlertRule
+	if err := h.DB.Where("name = ?", "Bots").First(&rule).Error; err != nil {
+		t.Fatalf("expected the rule to be stored: %v", err)
+	}
+	if rule.SiteID != nil || rule.Threshold != 40 || rule.Window.Hours() != 2 || rule.Secret == "" {
+		t.Fatalf("unexpected rule %+v", rule)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/alerts", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the page to render, got %d", rec.Code)
+	}
+
+	if loc := post(fmt.Sprintf("/alerts/%d/test", rule.ID), nil); !strings.Contains(loc, "msg=Test+alert+sent") {
+		t.Fatalf("expected the test alert to be sent, got %q", loc)
+	}
+	if len(events) != 1 || events[0] != "alert.test" {
+		t.Fatalf("expected one test alert, got %v", events)
+	}
+
+	post(fmt.Sprintf("/alerts/%d/delete", rule.ID), nil)
+	var count int64
+	h.DB.Model(&models.AlertRule{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected the rule to be deleted, %d left", count)
+	}
+	h.DB.Model(&models.AlertEvent{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected the history to be deleted, %d left", count)
+	}
+}
@@ -1,23 +1,53 @@
 package handlers
 
 import (
-	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
 	"gorm.io/gorm"
 
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/middleware"
 	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/sessionstore"
 	"github.com/webbesoft/doorman/templates/pages"
 )
 
+// twoFactorLoginWindow is how long the second login step stays open after
+// the password check.
+const twoFactorLoginWindow = 5 * time.Minute
+
+// oidcLoginWindow is how long a user has to finish signing in at the SSO
+// provider.
+const oidcLoginWindow = 10 * time.Minute
+
 type AuthHandler struct {
 	DB *gorm.DB
+	// Limits throttles repeated failed logins.
+	Limits config.LoginConfig
+	// OIDC enables single sign-on; nil when it isn't configured.
+	OIDC *services.OIDCService
+	// Proxy signs users in from an authenticating proxy's header; nil
+	// when it isn't configured.
+	Proxy *middleware.ProxyAuth
 }
 
 // LoginPage renders the login page
 func (a *AuthHandler) LoginPage(c echo.Context) error {
+	// The proxy has already signed the user in.
+	if a.Proxy.Username(c.Request()) != "" {
+		return c.Redirect(http.StatusFound, "/dashboard")
+	}
+
 	errParam := c.QueryParam("error")
 	var errMsg string
 	switch errParam {
@@ -27,6 +57,14 @@ func (a *AuthHandler) LoginPage(c echo.Context) error {
 		errMsg = "Please provide username and password."
 	case "expired":
 		errMsg = "Your session has expired. Please sign in again."
+	case "disabled":
+		errMsg = "This account has been disabled."
+	case "sso":
+		errMsg = "Single sign-on failed. Please try again."
+	case "sso_denied":
+		errMsg = services.ErrSSODenied.Error() + "."
+	case "sso_taken":
+		errMsg = "A local account already uses that username. Ask an admin to link it."
 	default:
 		// If an explicit message is provided via ?msg=... prefer that
 		if m := c.QueryParam("msg"); m != "" {
@@ -34,7 +72,12 @@ func (a *AuthHandler) LoginPage(c echo.Context) error {
 		}
 	}
 
-	return pages.LoginPage(errMsg).Render(context.Background(), c.Response().Writer)
+	var ssoLabel string
+	if a.OIDC != nil {
+		ssoLabel = a.OIDC.Config.ButtonLabel
+	}
+
+	return render(c, pages.LoginPage(errMsg, ssoLabel))
 }
 
 // Login handles user authentication
@@ -46,26 +89,273 @@ func (a *AuthHandler) Login(c echo.Context) error {
 		return c.Redirect(http.StatusFound, "/login?error=missing")
 	}
 
+	defer a.lockLogin(c, username)()
+	if blocked, err := a.throttled(c, username); blocked || err != nil {
+		return err
+	}
+
 	var user models.User
 	if err := a.DB.Where("username = ?", username).First(&user).Error; err != nil {
+		a.record(c, models.AuthLoginFailure, username, nil, "unknown_user")
 		return c.Redirect(http.StatusFound, "/login?error=invalid")
 	}
 
-	if !models.CheckPasswordHash(password, user.Password) {
+	if user.InvitePending() || !models.CheckPasswordHash(password, user.Password) {
+		a.record(c, models.AuthLoginFailure, username, &user.ID, "bad_password")
 		return c.Redirect(http.StatusFound, "/login?error=invalid")
 	}
 
+	if user.Disabled {
+		a.record(c, models.AuthLoginFailure, username, &user.ID, "disabled")
+		return c.Redirect(http.StatusFound, "/login?error=disabled")
+	}
+
+	if user.TwoFactorEnabled() {
+		return a.askSecondFactor(c, &user)
+	}
+
+	return a.startSession(c, &user)
+}
+
+// OIDCLogin sends the browser to the SSO provider
+func (a *AuthHandler) OIDCLogin(c echo.Context) error {
+	if a.OIDC == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	state, err := newOIDCValue()
+	if err != nil {
+		return err
+	}
+	nonce, err := newOIDCValue()
+	if err != nil {
+		return err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := a.OIDC.AuthCodeURL(c.Request().Context(), state, nonce, verifier)
+	if err != nil {
+		c.Logger().Errorf("SSO login failed: %v", err)
+		return c.Redirect(http.StatusFound, "/login?error=sso")
+	}
+
+	sess, _ := session.Get("session", c)
+	sess.Values["oidc_state"] = state
+	sess.Values["oidc_nonce"] = nonce
+	sess.Values["oidc_verifier"] = verifier
+	sess.Values["oidc_since"] = time.Now().Unix()
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback completes an SSO sign-in, creating the user on first visit
+func (a *AuthHandler) OIDCCallback(c echo.Context) error {
+	if a.OIDC == nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	sess, _ := session.Get("session", c)
+	state, _ := sess.Values["oidc_state"].(string)
+	nonce, _ := sess.Values["oidc_nonce"].(string)
+	verifier, _ := sess.Values["oidc_verifier"].(string)
+	since, _ := sess.Values["oidc_since"].(int64)
+	// The state is single-use, whatever the outcome.
+	for _, key := range []string{"oidc_state", "oidc_nonce", "oidc_verifier", "oidc_since"} {
+		delete(sess.Values, key)
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+
+	if state == "" || c.QueryParam("state") != state || time.Since(time.Unix(since, 0)) > oidcLoginWindow {
+		return c.Redirect(http.StatusFound, "/login?error=expired")
+	}
+	if e := c.QueryParam("error"); e != "" {
+		c.Logger().Warnf("SSO provider returned %s: %s", e, c.QueryParam("error_description"))
+		return c.Redirect(http.StatusFound, "/login?error=sso")
+	}
+
+	identity, err := a.OIDC.Exchange(c.Request().Context(), c.QueryParam("code"), nonce, verifier)
+	if err != nil {
+		c.Logger().Errorf("SSO callback failed: %v", err)
+		return c.Redirect(http.StatusFound, "/login?error=sso")
+	}
+
+	role, err := a.OIDC.Role(identity)
+	if err != nil {
+		a.record(c, models.AuthLoginFailure, identity.Username(), nil, "sso_denied")
+		return c.Redirect(http.StatusFound, "/login?error=sso_denied")
+	}
+
+	user, err := services.NewUserService(a.DB).ProvisionOIDC(identity, role, a.OIDC.SyncsRoles())
+	if errors.Is(err, services.ErrUsernameTaken) {
+		a.record(c, models.AuthLoginFailure, identity.Username(), nil, "sso_taken")
+		return c.Redirect(http.StatusFound, "/login?error=sso_taken")
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.Disabled {
+		a.record(c, models.AuthLoginFailure, user.Username, &user.ID, "disabled")
+		return c.Redirect(http.StatusFound, "/login?error=disabled")
+	}
+
+	// A local account linked to the identity keeps its own second factor,
+	// whatever the provider asked for.
+	if user.TwoFactorEnabled() {
+		return a.askSecondFactor(c, user)
+	}
+	return a.startSession(c, user)
+}
+
+func newOIDCValue() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// askSecondFactor sends a user who passed the first login step on to the
+// TOTP step. The session only remembers who they are; user_id isn't set
+// until the code is verified.
+func (a *AuthHandler) askSecondFactor(c echo.Context, user *models.User) error {
 	sess, _ := session.Get("session", c)
+	sess.Values["pending_user_id"] = user.ID
+	sess.Values["pending_since"] = time.Now().Unix()
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/login/2fa")
+}
+
+// startSession signs the user in with a fresh session and records the login
+func (a *AuthHandler) startSession(c echo.Context, user *models.User) error {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "pending_user_id")
+	delete(sess.Values, "pending_since")
 	sess.Values["user_id"] = user.ID
-	sess.Save(c.Request(), c.Response())
+	if err := sessionstore.Renew(c.Request(), c.Response(), sess); err != nil {
+		return err
+	}
 
+	a.recordSession(c, models.AuthLoginSuccess, user.Username, &user.ID, sess.ID)
 	return c.Redirect(http.StatusFound, "/dashboard")
 }
 
+// lockLogin holds off other attempts for username and from this client
+// until the returned func is called, so the throttle sees this attempt's
+// outcome before checking the next.
+func (a *AuthHandler) lockLogin(c echo.Context, username string) (unlock func()) {
+	return services.NewLoginThrottle(a.DB, a.Limits).Lock(username, models.HashIP(c.RealIP()))
+}
+
+// throttled redirects back to the login page if there have been too many
+// recent failures for this username or client
+func (a *AuthHandler) throttled(c echo.Context, username string) (bool, error) {
+	wait, err := services.NewLoginThrottle(a.DB, a.Limits).RetryAfter(username, models.HashIP(c.RealIP()))
+	if err != nil {
+		c.Logger().Errorf("Failed to check login throttle: %v", err)
+		return false, nil
+	}
+	if wait <= 0 {
+		return false, nil
+	}
+
+	a.record(c, models.AuthLoginThrottled, username, nil, "")
+	msg := fmt.Sprintf("Too many failed sign-in attempts. Try again in %s.", wait.Round(time.Second))
+	return true, c.Redirect(http.StatusFound, "/login?msg="+url.QueryEscape(msg))
+}
+
+func (a *AuthHandler) record(c echo.Context, eventType, username string, userID *uint, reason string) {
+	a.recordEvent(c, &models.AuthEvent{Type: eventType, Username: username, UserID: userID, Reason: reason})
+}
+
+func (a *AuthHandler) recordSession(c echo.Context, eventType, username string, userID *uint, sid string) {
+	a.recordEvent(c, &models.AuthEvent{Type: eventType, Username: username, UserID: userID, SessionID: sid})
+}
+
+func (a *AuthHandler) recordEvent(c echo.Context, event *models.AuthEvent) {
+	event.IPHash = models.HashIP(c.RealIP())
+	event.UserAgent = c.Request().UserAgent()
+	if err := services.NewAuthEventService(a.DB).Record(event); err != nil {
+		c.Logger().Errorf("Failed to record auth event: %v", err)
+	}
+}
+
+// TwoFactorPage renders the second login step
+func (a *AuthHandler) TwoFactorPage(c echo.Context) error {
+	if _, ok := pendingUserID(c); !ok {
+		return c.Redirect(http.StatusFound, "/login?error=expired")
+	}
+
+	var errMsg string
+	if c.QueryParam("error") == "invalid" {
+		errMsg = "Invalid authentication code."
+	}
+
+	return render(c, pages.TwoFactorLoginPage(errMsg))
+}
+
+// TwoFactor verifies the TOTP or recovery code and completes the login
+func (a *AuthHandler) TwoFactor(c echo.Context) error {
+	userID, ok := pendingUserID(c)
+	if !ok {
+		return c.Redirect(http.StatusFound, "/login?error=expired")
+	}
+
+	var user models.User
+	if err := a.DB.First(&user, userID).Error; err != nil || user.Disabled {
+		return c.Redirect(http.StatusFound, "/login?error=expired")
+	}
+
+	defer a.lockLogin(c, user.Username)()
+	if blocked, err := a.throttled(c, user.Username); blocked || err != nil {
+		return err
+	}
+
+	if err := services.NewTwoFactorService(a.DB).Verify(&user, c.FormValue("code")); err != nil {
+		a.record(c, models.AuthLoginFailure, user.Username, &user.ID, "bad_code")
+		return c.Redirect(http.StatusFound, "/login/2fa?error=invalid")
+	}
+
+	return a.startSession(c, &user)
+}
+
+// pendingUserID returns the user waiting on the second login step, if they
+// passed the password check recently enough.
+func pendingUserID(c echo.Context) (uint, bool) {
+	sess, _ := session.Get("session", c)
+	userID, ok := sess.Values["pending_user_id"].(uint)
+	if !ok {
+		return 0, false
+	}
+	since, _ := sess.Values["pending_since"].(int64)
+	if time.Since(time.Unix(since, 0)) > twoFactorLoginWindow {
+		return 0, false
+	}
+	return userID, true
+}
+
 // Logout handles user logout
 func (a *AuthHandler) Logout(c echo.Context) error {
 	sess, _ := session.Get("session", c)
-	sess.Values = make(map[interface{}]interface{})
+	if userID, ok := sess.Values["user_id"].(uint); ok {
+		var user models.User
+		if err := a.DB.First(&user, userID).Error; err == nil {
+			a.recordSession(c, models.AuthLogout, user.Username, &user.ID, sess.ID)
+		}
+	}
+
+	sess.Options.MaxAge = -1
 	sess.Save(c.Request(), c.Response())
+
+	if a.Proxy.Username(c.Request()) != "" && a.Proxy.LogoutURL != "" {
+		return c.Redirect(http.StatusFound, a.Proxy.LogoutURL)
+	}
 	return c.Redirect(http.StatusFound, "/login")
 }
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	database "github.com/webbesoft/doorman/internal/database"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/oidctest"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/sessionstore"
+)
+
+// browser keeps cookies between requests to an echo server.
+type browser struct {
+	e       *echo.Echo
+	cookies map[string]*http.Cookie
+}
+
+func (b *browser) get(target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, c := range b.cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	b.e.ServeHTTP(rec, req)
+	for _, c := range rec.Result().Cookies() {
+		b.cookies[c.Name] = c
+	}
+	return rec
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	if _, err := database.MigrateUp(db); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+
+	idp := oidctest.NewServer(t, "doorman")
+	cfg := config.Default()
+	cfg.Session.Secret = "test-secret"
+	cfg.OIDC.Issuer = idp.URL
+	cfg.OIDC.ClientID = "doorman"
+	cfg.OIDC.RedirectURL = "http://doorman.test/login/oidc/callback"
+	cfg.OIDC.AllowedDomains = []string{"example.com"}
+
+	a := &AuthHandler{DB: db, Limits: cfg.Login, OIDC: services.NewOIDCService(cfg.OIDC)}
+	e := echo.New()
+	e.Use(session.Middleware(sessionstore.New(db, cfg.Session)))
+	e.GET("/login/oidc", a.OIDCLogin)
+	e.GET("/login/oidc/callback", a.OIDCCallback)
+
+	signIn := func(b *browser) (*httptest.ResponseRecorder, string) {
+		t.Helper()
+		rec := b.get("/login/oidc")
+		if rec.Code != http.StatusFound {
+			t.Fatalf("expected redirect to provider, got %d", rec.Code)
+		}
+		callback, err := idp.Authorize(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("authorize failed: %v", err)
+		}
+		return b.get(callback.RequestURI()), callback.RequestURI()
+	}
+
+	idp.SetClaims(map[string]interface{}{"sub": "sub-1", "email": "alice@example.com", "email_verified": true})
+	b := &browser{e: e, cookies: map[string]*http.Cookie{}}
+	rec, callback := signIn(b)
+	if loc := rec.Header().Get("Location"); loc != "/dashboard" {
+		t.Fatalf("expected sign-in to reach the dashboard, got %d %q", rec.Code, loc)
+	}
+
+	var user models.User
+	if err := db.Where("oidc_subject = ?", "sub-1").First(&user).Error; err != nil {
+		t.Fatalf("expected user to be provisioned: %v", err)
+	}
+	if user.Username != "alice@example.com" || user.Role != models.RoleViewer {
+		t.Fatalf("unexpected user %q with role %q", user.Username, user.Role)
+	}
+	var sessions int64
+	db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	if sessions != 1 {
+		t.Fatalf("expected one session, got %d", sessions)
+	}
+
+	// The state is single-use.
+	if loc := b.get(callback).Header().Get("Location"); loc != "/login?error=expired" {
+		t.Fatalf("expected replayed callback to be rejected, got %q", loc)
+	}
+
+	// A local account with 2FA that SSO links to still needs its code.
+	enabled := time.Now()
+	if err := db.Create(&models.User{Username: "bob@example.com", Password: "x", Role: models.RoleOwner, TOTPEnabledAt: &enabled}).Error; err != nil {
+		t.Fatal(err)
+	}
+	idp.SetClaims(map[string]interface{}{"sub": "sub-3", "email": "bob@example.com", "email_verified": true})
+	rec, _ = signIn(&browser{e: e, cookies: map[string]*http.Cookie{}})
+	if loc := rec.Header().Get("Location"); loc != "/login/2fa" {
+		t.Fatalf("expected the linked account to be asked for its code, got %q", loc)
+	}
+	var bob models.User
+	if err := db.Where("username = ?", "bob@example.com").First(&bob).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.Model(&models.Session{}).Where("user_id = ?", bob.ID).Count(&sessions)
+	if sessions != 0 {
+		t.Fatalf("expected no session before the second factor, got %d", sessions)
+	}
+
+	// Users outside the allowed domains aren't created.
+	idp.SetClaims(map[string]interface{}{"sub": "sub-2", "email": "eve@elsewhere.org", "email_verified": true})
+	rec, _ = signIn(&browser{e: e, cookies: map[string]*http.Cookie{}})
+	if loc := rec.Header().Get("Location"); loc != "/login?error=sso_denied" {
+		t.Fatalf("expected denial, got %q", loc)
+	}
+	var count int64
+	db.Model(&models.User{}).Where("oidc_subject = ?", "sub-2").Count(&count)
+	if count != 0 {
+		t.Fatal("denied user was provisioned")
+	}
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/types"
+	"github.com/webbesoft/doorman/templates/pages"
+)
+
+// BotReport shows the traffic flagged as bots: which crawlers came, the
+// pages they hit and why visits were flagged, along with every detection
+// rule and how many visits it matched. Crawler list entries only show up
+// among the rules once they have matched.
+func (h *Handler) BotReport(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+	sites, selected, filter, err := siteFilter(c, h.DB, user)
+	if err != nil {
+		return err
+	}
+	filter.Bots = types.OnlyBots
+
+	bots := h.Bots
+	if bots == nil {
+		bots = botdetect.Default()
+	}
+	stats := services.NewStatsService(h.DB)
+
+	metrics, err := stats.Overview(filter)
+	if err != nil {
+		c.Logger().Errorf("Failed to load bot metrics: %v", err)
+	}
+
+	topPages, err := stats.TopPages(filter, 10)
+	if err != nil {
+		c.Logger().Errorf("Failed to load bot pages: %v", err)
+	}
+
+	reasons, err := stats.BotReasons(filter, 10)
+	if err != nil {
+		c.Logger().Errorf("Failed to load bot reasons: %v", err)
+	}
+
+	hits, err := stats.BotRuleHits(filter)
+	if err != nil {
+		c.Logger().Errorf("Failed to load bot rule hits: %v", err)
+	}
+
+	var crawlers []types.CrawlerStats
+	seen := make(map[string]bool, len(hits))
+	for i := range hits {
+		seen[hits[i].Rule] = true
+		if rule, ok := bots.Rule(hits[i].Rule); ok {
+			hits[i].Kind = rule.Kind
+			hits[i].Weight = rule.Weight
+		}
+		if name, ok := botdetect.CrawlerName(hits[i].Rule); ok {
+			crawlers = append(crawlers, types.CrawlerStats{Name: name, Visits: hits[i].Hits})
+		}
+	}
+	for _, rule := range bots.Rules() {
+		if seen[rule.Name] || strings.HasPrefix(rule.Name, botdetect.CrawlerPrefix) {
+			continue
+		}
+		hits = append(hits, types.BotRuleStats{Rule: rule.Name, Kind: rule.Kind, Weight: rule.Weight})
+	}
+
+	return render(c, pages.BotsPage(user, sites, selected, bots.Threshold, metrics, crawlers, topPages, reasons, hits))
+}
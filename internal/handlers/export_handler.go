@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/export"
+	"github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+// Export streams a dataset as a download, for the site picked like on
+// the dashboard and the days from and to, both included and optional.
+// visitors=salted adds visitor IDs salted for this download only.
+func (h *Handler) Export(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+	_, _, filter, err := siteFilter(c, h.DB, user)
+	if err != nil {
+		return err
+	}
+	if c.QueryParam("bots") == "1" {
+		filter.Bots = types.IncludeBots
+	}
+
+	dataset := c.QueryParam("dataset")
+	if !services.ValidDataset(dataset) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown dataset")
+	}
+	format := c.QueryParam("format")
+	if format == "" {
+		format = export.CSV
+	}
+	if !export.ValidFormat(format) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unknown format")
+	}
+	if err := dateRange(c, &filter); err != nil {
+		return err
+	}
+
+	exports := services.NewExportService(h.DB)
+	switch c.QueryParam("visitors") {
+	case "", "omit":
+	case "salted":
+		exports.VisitorSalt = make([]byte, 32)
+		if _, err := rand.Read(exports.VisitorSalt); err != nil {
+			return err
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "visitors must be omit or salted")
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, export.ContentType(format))
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="doorman-%s.%s"`, dataset, format))
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusOK)
+
+	// Once streaming has started the status can't change, so a failure
+	// leaves the download cut short.
+	if err := exports.Export(res, format, dataset, filter); err != nil {
+		c.Logger().Errorf("Export of %s failed: %v", dataset, err)
+	}
+	return nil
+}
+
+// dateRange narrows filter to the from and to query parameters, days
+// given as YYYY-MM-DD.
+func dateRange(c echo.Context, filter *types.StatsFilter) error {
+	if from := c.QueryParam("from"); from != "" {
+		t, err := time.Parse(time.DateOnly, from)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid from date")
+		}
+		filter.From = t
+	}
+	if to := c.QueryParam("to"); to != "" {
+		t, err := time.Parse(time.DateOnly, to)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid to date")
+		}
+		filter.To = t.AddDate(0, 0, 1)
+	}
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.To.After(filter.From) {
+		return echo.NewHTTPError(http.StatusBadRequest, "The range ends before it starts")
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+func TestExport(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	site, err := services.NewSiteService(h.DB).Add("Export", "export.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, url := range []string{"https://export.example.com/", "https://export.example.com/", "https://export.example.com/docs"} {
+		a := models.Analytics{SiteID: &site.ID, URL: url, IPHash: "visitor", CreatedAt: at}
+		if err := h.DB.Create(&a).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := h.DB.Create(&models.PageVisit{AnalyticsID: a.ID, SiteID: &site.ID, URL: url, IPHash: "visitor", CreatedAt: at}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	owner := &models.User{ID: 1, Role: models.RoleOwner}
+	e := echo.New()
+	e.GET("/export", h.Export, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("X-Test-Viewer") != "" {
+				c.Set("user", &models.User{ID: 2, Role: models.RoleViewer})
+			} else {
+				c.Set("user", owner)
+			}
+			return next(c)
+		}
+	})
+	get := func(query string, viewer bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/export?"+query, nil)
+		if viewer {
+			req.Header.Set("X-Test-Viewer", "1")
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	siteParam := fmt.Sprintf("site=%d", site.ID)
+	rec := get("dataset=pages&format=ndjson&from=2024-05-01&to=2024-05-01&"+siteParam, false)
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "application/x-ndjson" {
+		t.Fatalf("expected NDJSON, got %d %q: %s", rec.Code, rec.Header().Get(echo.HeaderContentType), rec.Body.String())
+	}
+	if got := rec.Header().Get(echo.HeaderContentDisposition); got != `attachment; filename="doorman-pages.ndjson"` {
+		t.Fatalf("unexpected Content-Disposition %q", got)
+	}
+	want := `{"url":"https://export.example.com/","visits":2,"avg_dwell_time":0,"avg_scroll_depth":0}` + "\n" +
+		`{"url":"https://export.example.com/docs","visits":1,"avg_dwell_time":0,"avg_scroll_depth":0}` + "\n"
+	if rec.Body.String() != want {
+		t.Fatalf("unexpected export\n%s", rec.Body.String())
+	}
+
+	rec = get("dataset=pageviews&from=2024-05-02&"+siteParam, false)
+	if lines := strings.Count(rec.Body.String(), "\n"); rec.Code != http.StatusOK || lines != 1 {
+		t.Fatalf("expected only the CSV header after the range, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, query := range []string{"dataset=visitors", "dataset=pages&format=xml", "dataset=pages&from=May", "dataset=pages&visitors=raw"} {
+		if rec := get(query+"&"+siteParam, false); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", query, rec.Code)
+		}
+	}
+	if rec := get("dataset=pages&"+siteParam, true); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected viewers without a grant to be refused, got %d", rec.Code)
+	}
+}
@@ -1,342 +1,481 @@
 package handlers
 
 import (
-	"context"
-	"crypto/sha256"
-	"encoding/json"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/a-h/templ"
 	"github.com/labstack/echo/v4"
 	"gorm.io/gorm"
 
+	assets "github.com/webbesoft/doorman"
+	"github.com/webbesoft/doorman/client"
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/ingest"
+	"github.com/webbesoft/doorman/internal/metrics"
+	"github.com/webbesoft/doorman/internal/middleware"
 	"github.com/webbesoft/doorman/internal/models"
 	"github.com/webbesoft/doorman/internal/services"
 	"github.com/webbesoft/doorman/internal/types"
+	"github.com/webbesoft/doorman/templates/components"
 	"github.com/webbesoft/doorman/templates/pages"
 )
 
 type Handler struct {
 	DB *gorm.DB
+	// Bots scores visits; nil uses the built-in rules.
+	Bots *botdetect.Engine
+	// HeartbeatInterval is injected into the tracker script.
+	HeartbeatInterval time.Duration
+	// Ingest bounds the size of tracking events and Limiter their rate;
+	// the zero values accept anything.
+	Ingest  config.IngestConfig
+	Limiter *services.IngestLimiter
+	// Sink forwards accepted events; nil when no endpoint is configured.
+	Sink *services.EventSink
 }
 
-var botPatterns = []string{
-	"bot", "crawler", "spider", "scraper", "scraping",
-	"googlebot", "bingbot", "ahrefsbot", "semrushbot",
-	"gptbot", "claude-web", "chatgpt-user", "anthropic-ai",
-	"pingdom", "uptime", "monitor", "check",
-	"facebookexternalhit", "twitterbot", "linkedinbot",
-	"slackbot", "discordbot", "telegrambot",
-	"python-requests", "go-http-client", "curl", "wget",
+// eventError is the body of a refused tracking event. Fields lists every
+// field that failed validation.
+type eventError struct {
+	Error  string              `json:"error"`
+	Fields []ingest.FieldError `json:"fields,omitempty"`
 }
 
-type TrackRequest struct {
-	URL         string `json:"url"`
-	Referrer    string `json:"referrer"`
-	DwellTime   int    `json:"dwellTime"`
-	ActiveTime  int    `json:"activeTime"`
-	ScrollDepth int    `json:"scrollDepth"`
-	Final       bool   `json:"final"`
+// rejection is a refused event: the status to answer with, the reason it
+// is counted under and the error to report.
+type rejection struct {
+	status int
+	reason string
+	body   eventError
+}
+
+func reject(status int, reason, msg string, fields ...ingest.FieldError) *rejection {
+	return &rejection{status: status, reason: reason, body: eventError{Error: msg, Fields: fields}}
+}
+
+// batchResult reports what happened to one event of a batch.
+type batchResult struct {
+	Status string `json:"status"`
+	*eventError
 }
 
 // Track handles incoming analytics data
 func (h *Handler) Track(c echo.Context) error {
-	var req TrackRequest
+	v, rej := h.sender(c, models.SourceScript)
+	if rej != nil {
+		return h.refuse(c, rej)
+	}
 
-	body, err := io.ReadAll(c.Request().Body)
-	if err != nil {
-		c.Logger().Errorf("Failed to read body: %v", err)
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request body"})
+	if ok, reason := h.Limiter.Allow(v.IPHash); !ok {
+		return h.refuse(c, reject(http.StatusTooManyRequests, reason, "Too many events"))
 	}
 
-	if len(body) == 0 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empty request body"})
+	body, rej := h.readEvents(c, h.Ingest.MaxBodyBytes)
+	if rej != nil {
+		return h.refuse(c, rej)
+	}
+	ev, rej := h.checkEvent(c, body, v.UserAgent)
+	if rej != nil {
+		return h.refuse(c, rej)
 	}
 
-	if err := json.Unmarshal(body, &req); err != nil {
-		var inner string
-		if err2 := json.Unmarshal(body, &inner); err2 == nil {
-			if err3 := json.Unmarshal([]byte(inner), &req); err3 != nil {
-				c.Logger().Errorf("Failed to parse inner JSON: %v", err3)
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
-			}
-		} else {
-			trimmed := strings.TrimSpace(string(body))
-			if strings.HasPrefix(trimmed, "{") {
-				if err4 := json.Unmarshal([]byte(trimmed), &req); err4 != nil {
-					c.Logger().Errorf("Failed to unmarshal trimmed JSON: %v", err4)
-					return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
-				}
-			} else {
-				c.Logger().Errorf("Failed to parse JSON: %v", err)
-				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid JSON"})
-			}
-		}
+	if rej := h.record(c, v, ev); rej != nil {
+		return h.refuse(c, rej)
 	}
 
-	// Hash IP for GDPR compliance (no personal data stored)
-	ip := c.RealIP()
-	hasher := sha256.New()
-	hasher.Write([]byte(ip))
-	ipHash := fmt.Sprintf("%x", hasher.Sum(nil))
+	metrics.EventsIngested.Inc()
 
-	c.Logger().Debugf("Processing request from IP hash: %s", ipHash[:8]+"...")
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
 
-	userAgent := c.Request().UserAgent()
-	isBotUA := isBot(userAgent)
+// Pixel records a page view from the /p.gif tracking pixel, for readers
+// without JavaScript. The u parameter is the page, falling back to the
+// Referer header, and r the page's referrer. The GIF is served either
+// way, so a refused view never shows as a broken image.
+func (h *Handler) Pixel(c echo.Context) error {
+	if rej := h.pixelView(c); rej != nil {
+		metrics.RejectEvent(rej.reason)
+	} else {
+		metrics.EventsIngested.Inc()
+	}
 
-	geoService := services.NewGeoService(h.DB)
-	geo := geoService.GetGeoDataCached(ip, ipHash)
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-store")
+	return c.Blob(http.StatusOK, "image/gif", transparentGIF)
+}
 
-	var existingAnalytic models.Analytics
-	err = h.DB.
-		Where("ip_hash = ? AND url = ?", ipHash, req.URL).
-		First(&existingAnalytic).Error
+func (h *Handler) pixelView(c echo.Context) *rejection {
+	v, rej := h.sender(c, models.SourcePixel)
+	if rej != nil {
+		return rej
+	}
+	if ok, reason := h.Limiter.Allow(v.IPHash); !ok {
+		return reject(http.StatusTooManyRequests, reason, "Too many events")
+	}
 
-	var analytic models.Analytics
+	url := c.QueryParam("u")
+	if url == "" {
+		url = c.Request().Referer()
+	}
+	ev, err := ingest.Pageview(url, c.QueryParam("r"))
+	var invalid *ingest.ValidationError
+	if errors.As(err, &invalid) {
+		return reject(http.StatusBadRequest, "invalid_field", "Invalid event", invalid.Fields...)
+	}
+	if err != nil {
+		return reject(http.StatusBadRequest, "invalid_field", "Invalid event")
+	}
+	if field := h.oversizedField(ev, v.UserAgent); field != "" {
+		return reject(http.StatusBadRequest, "field_too_long", "Invalid event", ingest.FieldError{Field: field, Message: "is too long"})
+	}
 
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		analytic = models.Analytics{
-			IPHash:    ipHash,
-			URL:       req.URL,
-			Country:   geo.Country,
-			UserAgent: userAgent,
-			Referrer:  req.Referrer,
-			IsBot:     isBotUA,
-			CreatedAt: time.Now(),
-		}
+	return h.record(c, v, ev)
+}
 
-		if err := h.DB.Create(&analytic).Error; err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save analytics"})
-		}
-	} else if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	} else {
-		analytic = existingAnalytic
-	}
-
-	// Create page visit record
-	fmt.Printf("Analytic ID: %d, URL: %s, IPHash: %s\n", analytic.ID, req.URL, ipHash)
-	var pv models.PageVisit
-	pvErr := h.DB.
-		Where("ip_hash = ? AND url = ? AND analytics_id = ?", ipHash, req.URL, analytic.ID).
-		Order("created_at DESC").
-		First(&pv).Error
-
-	if errors.Is(pvErr, gorm.ErrRecordNotFound) {
-		// Create new page visit for first heartbeat
-		pv = models.PageVisit{
-			IPHash:      ipHash,
-			URL:         req.URL,
-			AnalyticsID: analytic.ID,
-			DwellTime:   req.DwellTime,
-			ActiveTime:  req.ActiveTime,
-			ScrollDepth: req.ScrollDepth,
-			CreatedAt:   time.Now(),
-		}
+// transparentGIF is a 1x1 transparent GIF.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
 
-		if err := h.DB.Create(&pv).Error; err != nil {
-			c.Logger().Errorf("Failed to create page visit: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to save page visit"})
-		}
-	} else if pvErr != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Database error"})
-	} else {
-		pv.DwellTime = req.DwellTime
-		pv.ActiveTime = req.ActiveTime
-		pv.ScrollDepth = req.ScrollDepth
-		pv.UpdatedAt = time.Now()
-
-		if err := h.DB.Save(&pv).Error; err != nil {
-			c.Logger().Errorf("Failed to update page visit: %v", err)
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update page visit"})
-		}
+// record stores a single event in its own transaction.
+func (h *Handler) record(c echo.Context, v services.Visitor, ev *ingest.Event) *rejection {
+	v = h.locate(v)
+	var accepted []types.SinkEvent
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		return h.events(tx, &accepted).Record(v, ev)
+	})
+	if rej := siteRejection(err); rej != nil {
+		return rej
 	}
+	if err != nil {
+		c.Logger().Errorf("Failed to record event: %v", err)
+		return reject(http.StatusInternalServerError, "db_error", "Failed to save analytics")
+	}
+	h.forward(accepted)
+	return nil
+}
 
-	// Calculate bot score if not a bot UA and has dwell time
-	if !isBotUA && req.DwellTime > 0 {
-		score, reason := calculateBotiness(&pv)
-		analytic.BotScore = score
-		analytic.BotReason = reason
-
-		// Update analytic if high bot score
-		if score > 50 {
-			analytic.IsBot = true
-			analytic.BotScore = score
-			analytic.BotReason = reason
-			if err := h.DB.Save(&analytic).Error; err != nil {
-				c.Logger().Warnf("Failed to update analytics bot score: %v", err)
-			}
+// events records in tx, collecting the events for the sink in accepted
+// when there is one.
+func (h *Handler) events(tx *gorm.DB, accepted *[]types.SinkEvent) *services.EventService {
+	events := services.NewEventService(tx, h.Bots, h.HeartbeatInterval)
+	if h.Sink != nil {
+		events.Accepted = func(ev types.SinkEvent) {
+			*accepted = append(*accepted, ev)
 		}
 	}
+	return events
+}
 
-	return c.NoContent(http.StatusNoContent)
+// forward hands events to the sink once their transaction is committed,
+// so nothing rolled back is sent.
+func (h *Handler) forward(accepted []types.SinkEvent) {
+	if h.Sink != nil && len(accepted) > 0 {
+		h.Sink.Enqueue(accepted...)
+	}
 }
 
-// Dashboard renders the analytics dashboard
-func (h *Handler) Dashboard(c echo.Context) error {
-	metrics := h.getOverallMetrics()
+// siteRejection turns the errors for events outside the allowed sites
+// into rejections, and returns nil for any other error.
+func siteRejection(err error) *rejection {
+	switch {
+	case errors.Is(err, services.ErrUnknownSite):
+		return reject(http.StatusForbidden, "unknown_site", "Unknown site")
+	case errors.Is(err, services.ErrSiteNotAllowed):
+		return reject(http.StatusForbidden, "site_not_allowed", "Site not allowed for this API key")
+	}
+	return nil
+}
 
-	topPages := h.getTopPages()
+// TrackBatch handles a JSON array of events from one visitor. They are
+// stored in a single transaction; the response lists a result for each
+// event in order, so one bad event doesn't cost the others.
+func (h *Handler) TrackBatch(c echo.Context) error {
+	v, rej := h.sender(c, models.SourceScript)
+	if rej != nil {
+		return h.refuse(c, rej)
+	}
 
-	topReferrers := h.getTopReferrers()
+	body, rej := h.readEvents(c, h.Ingest.MaxBatchBytes)
+	if rej != nil {
+		return h.refuse(c, rej)
+	}
+	items, err := ingest.DecodeBatch(body, h.Ingest.MaxBatchSize)
+	if errors.Is(err, ingest.ErrBatchTooLarge) {
+		return h.refuse(c, reject(http.StatusRequestEntityTooLarge, "batch_too_large", "Too many events in batch"))
+	}
+	if err != nil {
+		return h.refuse(c, reject(http.StatusBadRequest, "invalid_json", "Invalid JSON"))
+	}
 
-	dailyStats := h.getDailyStats()
+	v = h.locate(v)
+	results := make([]batchResult, len(items))
+	accepted := 0
+	var forwarded []types.SinkEvent
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		events := h.events(tx, &forwarded)
+		for i, item := range items {
+			var ev *ingest.Event
+			var rej *rejection
+			if ok, reason := h.Limiter.Allow(v.IPHash); !ok {
+				rej = reject(http.StatusTooManyRequests, reason, "Too many events")
+			} else {
+				ev, rej = h.checkEvent(c, item, v.UserAgent)
+			}
 
-	topCountries := h.getTopCountries()
+			if rej == nil {
+				err := events.Record(v, ev)
+				if rej = siteRejection(err); rej == nil && err != nil {
+					accepted++ // lost with the ones before it
+					return err
+				}
+			}
 
-	return pages.DashboardPage(
-		topReferrers,
-		topPages,
-		dailyStats,
-		topCountries,
-		metrics,
-	).Render(context.Background(), c.Response().Writer)
-}
+			if rej != nil {
+				metrics.RejectEvent(rej.reason)
+				results[i] = batchResult{Status: "rejected", eventError: &rej.body}
+				continue
+			}
+			results[i] = batchResult{Status: "ok"}
+			accepted++
+		}
+		return nil
+	})
+	if err != nil {
+		c.Logger().Errorf("Failed to record batch: %v", err)
+		// Events rejected for another reason were counted already.
+		metrics.EventsRejected.WithLabelValues("db_error").Add(float64(accepted))
+		return c.JSON(http.StatusInternalServerError, eventError{Error: "Failed to save analytics"})
+	}
 
-func (h *Handler) getOverallMetrics() types.DashboardMetrics {
-	var metrics types.DashboardMetrics
+	metrics.EventsIngested.Add(float64(accepted))
+	h.forward(forwarded)
 
-	h.DB.Model(&models.PageVisit{}).Count(&metrics.TotalPageVisits)
+	return c.JSON(http.StatusOK, map[string][]batchResult{"results": results})
+}
 
-	h.DB.Model(&models.Analytics{}).Count(&metrics.TotalAnalytics)
+// readEvents reads a request body of at most limit bytes.
+func (h *Handler) readEvents(c echo.Context, limit int64) ([]byte, *rejection) {
+	if limit > 0 {
+		c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, limit)
+	}
+	body, err := io.ReadAll(c.Request().Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, reject(http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+	}
+	if err != nil {
+		c.Logger().Errorf("Failed to read body: %v", err)
+		return nil, reject(http.StatusBadRequest, "read_error", "Invalid request body")
+	}
+	if len(body) == 0 {
+		return nil, reject(http.StatusBadRequest, "empty_body", "Empty request body")
+	}
+	return body, nil
+}
 
-	h.DB.Model(&models.Analytics{}).
-		Distinct("ip_hash").
-		Count(&metrics.UniqueVisitors)
+// checkEvent decodes one event and applies the length limits.
+func (h *Handler) checkEvent(c echo.Context, raw []byte, userAgent string) (*ingest.Event, *rejection) {
+	ev, err := ingest.Decode(raw)
+	var invalid *ingest.ValidationError
+	if errors.As(err, &invalid) {
+		return nil, reject(http.StatusBadRequest, "invalid_field", "Invalid event", invalid.Fields...)
+	}
+	if err != nil {
+		c.Logger().Debugf("Failed to decode event: %v", err)
+		return nil, reject(http.StatusBadRequest, "invalid_json", "Invalid JSON")
+	}
 
-	var avgMetrics struct {
-		AvgDwellTime   float64
-		AvgScrollDepth float64
+	if field := h.oversizedField(ev, userAgent); field != "" {
+		return nil, reject(http.StatusBadRequest, "field_too_long", "Invalid event", ingest.FieldError{Field: field, Message: "is too long"})
 	}
-	h.DB.Model(&models.PageVisit{}).
-		Select("AVG(dwell_time) as avg_dwell_time, AVG(scroll_depth) as avg_scroll_depth").
-		Where("dwell_time > 0").
-		Scan(&avgMetrics)
+	return ev, nil
+}
 
-	metrics.AvgDwellTime = avgMetrics.AvgDwellTime
-	metrics.AvgScrollDepth = avgMetrics.AvgScrollDepth
+// sender identifies the visitor events are about. Browsers report for
+// themselves. A site's server reporting with an API key in the
+// Authorization header names the visitor in the X-Doorman-Visitor-IP and
+// X-Doorman-Visitor-User-Agent headers instead, and is held to the key's
+// site.
+func (h *Handler) sender(c echo.Context, source string) (services.Visitor, *rejection) {
+	req := c.Request()
+	key, ok := strings.CutPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok {
+		ip := c.RealIP()
+		return services.Visitor{IP: ip, IPHash: models.HashIP(ip), UserAgent: req.UserAgent(), Source: source}, nil
+	}
 
-	// Bot percentage
-	var botCount int64
-	h.DB.Model(&models.Analytics{}).
-		Where("is_bot = ?", true).
-		Count(&botCount)
+	apiKey, err := services.NewAPIKeyService(h.DB).Authenticate(key)
+	if errors.Is(err, services.ErrAPIKeyNotFound) {
+		return services.Visitor{}, reject(http.StatusUnauthorized, "invalid_api_key", "Invalid API key")
+	}
+	if err != nil {
+		c.Logger().Errorf("Failed to check API key: %v", err)
+		return services.Visitor{}, reject(http.StatusInternalServerError, "db_error", "Failed to check API key")
+	}
 
-	if metrics.TotalAnalytics > 0 {
-		metrics.BotPercentage = float64(botCount) / float64(metrics.TotalAnalytics) * 100
+	ip := req.Header.Get(client.HeaderVisitorIP)
+	if net.ParseIP(ip) == nil {
+		return services.Visitor{}, reject(http.StatusBadRequest, "invalid_field", "Invalid event",
+			ingest.FieldError{Field: client.HeaderVisitorIP, Message: "must be the visitor's IP address"})
 	}
+	return services.Visitor{
+		IP:        ip,
+		IPHash:    models.HashIP(ip),
+		UserAgent: req.Header.Get(client.HeaderVisitorUserAgent),
+		Source:    models.SourceServer,
+		SiteID:    apiKey.SiteID,
+	}, nil
+}
 
-	return metrics
+// locate adds the visitor's country. The lookup happens here, outside any
+// transaction.
+func (h *Handler) locate(v services.Visitor) services.Visitor {
+	if geo := services.NewGeoService(h.DB).GetGeoDataCached(v.IP, v.IPHash); geo != nil {
+		v.Country = geo.Country
+	}
+	return v
 }
 
-func (h *Handler) getTopPages() []types.TopPage {
-	var topPages []types.TopPage
-
-	h.DB.Model(&models.PageVisit{}).
-		Select(`
-			url,
-			COUNT(*) as visits,
-			AVG(dwell_time) as avg_dwell_time,
-			AVG(scroll_depth) as avg_scroll
-		`).
-		Where("url != ''").
-		Group("url").
-		Order("visits DESC").
-		Limit(10).
-		Scan(&topPages)
-
-	return topPages
+func (h *Handler) refuse(c echo.Context, r *rejection) error {
+	metrics.RejectEvent(r.reason)
+	return c.JSON(r.status, r.body)
 }
 
-func (h *Handler) getTopReferrers() []types.TopReferrer {
-	var topReferrers []types.TopReferrer
+// oversizedField names the first event field over its configured length
+// limit, or returns "".
+func (h *Handler) oversizedField(req *ingest.Event, userAgent string) string {
+	switch {
+	case h.Ingest.MaxURLLength > 0 && len(req.URL) > h.Ingest.MaxURLLength:
+		return "url"
+	case h.Ingest.MaxReferrerLength > 0 && len(req.Referrer) > h.Ingest.MaxReferrerLength:
+		return "referrer"
+	case h.Ingest.MaxUserAgentLength > 0 && len(userAgent) > h.Ingest.MaxUserAgentLength:
+		return "User-Agent"
+	}
+	return ""
+}
 
-	h.DB.Model(&models.Analytics{}).
-		Select("COALESCE(NULLIF(referrer, ''), 'Direct') as referrer, COUNT(*) as count").
-		Group("referrer").
-		Order("count DESC").
-		Limit(10).
-		Scan(&topReferrers)
+// TrackerScript serves t.js with the configured heartbeat interval
+func (h *Handler) TrackerScript(c echo.Context) error {
+	script, err := fs.ReadFile(assets.Assets, "assets/js/t.js")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
 
-	return topReferrers
-}
+	if h.HeartbeatInterval > 0 {
+		script = bytes.Replace(script,
+			[]byte("var HEARTBEAT_INTERVAL = 30000;"),
+			[]byte(fmt.Sprintf("var HEARTBEAT_INTERVAL = %d;", h.HeartbeatInterval.Milliseconds())),
+			1,
+		)
+	}
 
-func (h *Handler) getDailyStats() []types.DailyStats {
-	var dailyStats []types.DailyStats
-
-	h.DB.Raw(`
-		SELECT 
-			DATE(pv.created_at) as date,
-			COUNT(DISTINCT pv.id) as page_visits,
-			COUNT(DISTINCT a.ip_hash) as unique_users,
-			AVG(pv.dwell_time) as avg_dwell_time
-		FROM page_visits pv
-		JOIN analytics a ON pv.analytics_id = a.id
-		WHERE pv.created_at >= ?
-		GROUP BY DATE(pv.created_at)
-		ORDER BY date ASC
-	`, time.Now().AddDate(0, 0, -7)).Scan(&dailyStats)
-
-	return dailyStats
+	return c.Blob(http.StatusOK, "application/javascript; charset=utf-8", script)
 }
 
-func (h *Handler) getTopCountries() []types.CountryStats {
-	var topCountries []types.CountryStats
+// Dashboard renders the analytics dashboard
+func (h *Handler) Dashboard(c echo.Context) error {
+	user := middleware.CurrentUser(c)
+	sites, selected, filter, err := siteFilter(c, h.DB, user)
+	if err != nil {
+		return err
+	}
+	showBots := c.QueryParam("bots") == "1"
+	if showBots {
+		filter.Bots = types.IncludeBots
+	}
 
-	h.DB.Model(&models.Analytics{}).
-		Select("COALESCE(NULLIF(country, ''), 'Unknown') as country, COUNT(*) as count").
-		Group("country").
-		Order("count DESC").
-		Limit(10).
-		Scan(&topCountries)
+	stats := services.NewStatsService(h.DB)
 
-	return topCountries
-}
+	metrics, err := stats.Overview(filter)
+	if err != nil {
+		c.Logger().Errorf("Failed to load metrics: %v", err)
+	}
 
-func isBot(userAgent string) bool {
-	ua := strings.ToLower(userAgent)
-	for _, pattern := range botPatterns {
-		if strings.Contains(ua, strings.ToLower(pattern)) {
-			return true
-		}
+	topPages, err := stats.TopPages(filter, 10)
+	if err != nil {
+		c.Logger().Errorf("Failed to load top pages: %v", err)
 	}
 
-	// empty ua likely bot
-	return ua == ""
-}
+	topReferrers, err := stats.TopReferrers(filter, 10)
+	if err != nil {
+		c.Logger().Errorf("Failed to load top referrers: %v", err)
+	}
 
-func calculateBotiness(pv *models.PageVisit) (int, string) {
-	score := 0
-	reasons := []string{}
+	daily := filter
+	daily.From = time.Now().AddDate(0, 0, -7)
+	dailyStats, err := stats.DailyStats(daily)
+	if err != nil {
+		c.Logger().Errorf("Failed to load daily stats: %v", err)
+	}
 
-	if pv.DwellTime > 0 && pv.ActiveTime == 0 {
-		score += 30
-		reasons = append(reasons, "no_active_time")
+	topCountries, err := stats.TopCountries(filter, 10)
+	if err != nil {
+		c.Logger().Errorf("Failed to load top countries: %v", err)
 	}
 
-	// instant scroll to bottom
-	if pv.ScrollDepth == 100 && pv.ActiveTime < 2 {
-		score += 20
-		reasons = append(reasons, "instant_scroll")
+	return render(c, pages.DashboardPage(
+		user,
+		sites,
+		selected,
+		showBots,
+		topReferrers,
+		topPages,
+		dailyStats,
+		topCountries,
+		metrics,
+	))
+}
+
+// siteFilter reads the site a stats page is for from the site query
+// parameter. Users limited to some sites default to their first one.
+// It returns the sites user may pick from along with the selection.
+func siteFilter(c echo.Context, db *gorm.DB, user *models.User) ([]models.Site, string, types.StatsFilter, error) {
+	users := services.NewUserService(db)
+
+	sites, err := users.AllowedSites(user)
+	if err != nil {
+		c.Logger().Errorf("Failed to load sites: %v", err)
 	}
 
-	// speed reader
-	if pv.ScrollDepth > 80 && pv.DwellTime < 3 {
-		score += 25
-		reasons = append(reasons, "too_fast")
+	selected := c.QueryParam("site")
+	if selected == "" && !user.SeesAllSites() {
+		if len(sites) == 0 {
+			return nil, "", types.StatsFilter{}, echo.NewHTTPError(http.StatusForbidden, "You haven't been given access to any sites yet")
+		}
+		selected = strconv.FormatUint(uint64(sites[0].ID), 10)
 	}
 
-	// no scroll
-	if pv.ScrollDepth == 0 && pv.DwellTime > 10 {
-		score += 15
-		reasons = append(reasons, "no_scroll_long_dwell")
+	filter := types.StatsFilter{}
+	if selected != "" {
+		id, err := strconv.ParseUint(selected, 10, 64)
+		if err != nil {
+			return nil, "", filter, echo.NewHTTPError(http.StatusBadRequest, "Invalid site")
+		}
+		siteID := uint(id)
+		filter.SiteID = &siteID
+	}
+	if !users.CanViewSite(user, filter.SiteID) {
+		return nil, "", filter, echo.NewHTTPError(http.StatusForbidden, "You don't have access to this site")
 	}
+	return sites, selected, filter, nil
+}
 
-	reasonStr := strings.Join(reasons, ",")
-	return score, reasonStr
+// render writes a page with the request's CSRF token available to its forms.
+func render(c echo.Context, page templ.Component) error {
+	ctx := components.WithCSRFToken(c.Request().Context(), middleware.CSRFToken(c))
+	return page.Render(ctx, c.Response().Writer)
 }
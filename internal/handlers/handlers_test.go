@@ -2,18 +2,28 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 
+	"github.com/webbesoft/doorman/client"
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/metrics"
+	"github.com/webbesoft/doorman/internal/middleware"
 	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/internal/types"
 )
 
 func newTestHandler(t *testing.T) (*Handler, func()) {
@@ -24,7 +34,7 @@ func newTestHandler(t *testing.T) (*Handler, func()) {
 		t.Fatalf("failed to open test db: %v", err)
 	}
 
-	if err := db.AutoMigrate(&models.Analytics{}, &models.PageVisit{}); err != nil {
+	if err := db.AutoMigrate(&models.Analytics{}, &models.PageVisit{}, &models.Site{}, &models.BotRuleHit{}, &models.BotScore{}, &models.APIKey{}, &models.ImportedStat{}, &models.SiteGrant{}, &models.ReportSchedule{}, &models.AlertRule{}, &models.AlertEvent{}, &models.SinkDeadLetter{}); err != nil {
 		t.Fatalf("auto migrate failed: %v", err)
 	}
 
@@ -122,3 +132,430 @@ func TestTrack_BadRequest(t *testing.T) {
 		t.Fatalf("expected error message in response, got: %v", resp)
 	}
 }
+
+func TestTrack_SpoofedClientIP(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	tests := []struct {
+		name    string
+		header  string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"direct client sends XFF", "", "192.168.1.20:5678", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "192.168.1.20"},
+		{"direct client sends X-Real-IP", "", "192.168.1.21:5678", map[string]string{"X-Real-IP": "192.0.2.1"}, "192.168.1.21"},
+		{"untrusted peer sends XFF", "X-Forwarded-For", "172.20.0.5:5678", map[string]string{"X-Forwarded-For": "192.0.2.1"}, "172.20.0.5"},
+		{"client prefixes XFF through proxy", "X-Forwarded-For", "10.0.0.2:5678", map[string]string{"X-Forwarded-For": "192.0.2.1, 192.168.1.22"}, "192.168.1.22"},
+		{"untrusted peer sends Forwarded", "Forwarded", "172.20.0.6:5678", map[string]string{"Forwarded": "for=192.0.2.1"}, "172.20.0.6"},
+		{"client sends CF header past proxy", "CF-Connecting-IP", "172.20.0.7:5678", map[string]string{"CF-Connecting-IP": "192.0.2.1"}, "172.20.0.7"},
+		{"trusted proxy", "X-Real-IP", "10.0.0.2:5678", map[string]string{"X-Real-IP": "192.168.1.23"}, "192.168.1.23"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extract, err := middleware.NewIPExtractor(config.ProxyConfig{
+				Trusted:        []string{"10.0.0.0/8"},
+				ClientIPHeader: tt.header,
+			})
+			if err != nil {
+				t.Fatalf("NewIPExtractor: %v", err)
+			}
+			e := echo.New()
+			e.IPExtractor = extract
+			e.POST("/event", h.Track)
+
+			url := fmt.Sprintf("/spoof-%d", i)
+			body, _ := json.Marshal(map[string]string{"url": url})
+			req := httptest.NewRequest(http.MethodPost, "/event", bytes.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.RemoteAddr = tt.peer
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected status 200 got %d body=%s", rec.Code, rec.Body.String())
+			}
+
+			var pv models.Analytics
+			if err := h.DB.Where("url = ?", url).First(&pv).Error; err != nil {
+				t.Fatalf("expected a page view in db: %v", err)
+			}
+			if pv.IPHash != models.HashIP(tt.want) {
+				t.Errorf("expected the visit to be attributed to %s", tt.want)
+			}
+		})
+	}
+}
+
+func TestTrack_Limits(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	h.Ingest = config.IngestConfig{MaxBodyBytes: 256, MaxURLLength: 64, MaxReferrerLength: 64, MaxUserAgentLength: 32}
+	h.Limiter = services.NewIngestLimiter(config.IngestConfig{VisitorRate: 0.001, VisitorBurst: 2})
+	if err := h.DB.Create(&models.Site{Name: "Example", Domain: "example.com"}).Error; err != nil {
+		t.Fatalf("failed to create site: %v", err)
+	}
+
+	e := echo.New()
+	e.POST("/event", h.Track)
+	send := func(peer, body, userAgent string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = peer
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name      string
+		peer      string
+		body      string
+		userAgent string
+		status    int
+		reason    string
+	}{
+		{"accepted", "192.168.2.1:1000", `{"url":"https://www.example.com/"}`, "Mozilla/5.0", http.StatusOK, ""},
+		{"body too large", "192.168.2.2:1000", `{"url":"https://example.com/","referrer":"` + strings.Repeat("a", 300) + `"}`, "Mozilla/5.0", http.StatusRequestEntityTooLarge, "body_too_large"},
+		{"url too long", "192.168.2.3:1000", `{"url":"https://example.com/` + strings.Repeat("a", 64) + `"}`, "Mozilla/5.0", http.StatusBadRequest, "field_too_long"},
+		{"user agent too long", "192.168.2.4:1000", `{"url":"https://example.com/"}`, strings.Repeat("M", 33), http.StatusBadRequest, "field_too_long"},
+		{"unknown host", "192.168.2.5:1000", `{"url":"https://elsewhere.org/"}`, "Mozilla/5.0", http.StatusForbidden, "unknown_site"},
+		{"relative url", "192.168.2.6:1000", `{"url":"/about"}`, "Mozilla/5.0", http.StatusForbidden, "unknown_site"},
+		{"second event", "192.168.2.1:1000", `{"url":"https://example.com/about"}`, "Mozilla/5.0", http.StatusOK, ""},
+		{"rate limited", "192.168.2.1:1000", `{"url":"https://example.com/contact"}`, "Mozilla/5.0", http.StatusTooManyRequests, services.RejectVisitorRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before float64
+			if tt.reason != "" {
+				before = testutil.ToFloat64(metrics.EventsRejected.WithLabelValues(tt.reason))
+			}
+
+			rec := send(tt.peer, tt.body, tt.userAgent)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d got %d body=%s", tt.status, rec.Code, rec.Body.String())
+			}
+			if tt.reason != "" {
+				if got := testutil.ToFloat64(metrics.EventsRejected.WithLabelValues(tt.reason)) - before; got != 1 {
+					t.Fatalf("expected one %s rejection to be counted, got %v", tt.reason, got)
+				}
+			}
+		})
+	}
+
+	var count int64
+	h.DB.Model(&models.Analytics{}).Where("url LIKE ?", "https://%").Count(&count)
+	if count != 2 {
+		t.Fatalf("expected only the accepted events to be stored, got %d", count)
+	}
+}
+
+func TestTrack_InvalidFields(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	e := echo.New()
+	e.POST("/event", h.Track)
+
+	req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(`{"v":1,"url":"/invalid","dwellTime":-5,"scrollDepth":-1}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Error  string `json:"error"`
+		Fields []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	if len(resp.Fields) != 2 || resp.Fields[0].Field != "dwellTime" || resp.Fields[1].Field != "scrollDepth" {
+		t.Fatalf("expected errors for dwellTime and scrollDepth, got %+v", resp.Fields)
+	}
+
+	var count int64
+	h.DB.Model(&models.Analytics{}).Where("url = ?", "/invalid").Count(&count)
+	if count != 0 {
+		t.Fatal("invalid event was stored")
+	}
+}
+
+func TestTrackBatch(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if err := h.DB.AutoMigrate(&models.CustomEvent{}); err != nil {
+		t.Fatalf("auto migrate failed: %v", err)
+	}
+	h.Ingest = config.IngestConfig{MaxBatchSize: 5, MaxURLLength: 64}
+
+	e := echo.New()
+	e.POST("/event/batch", h.TrackBatch)
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/event/batch", strings.NewReader(body))
+		req.RemoteAddr = "192.168.3.1:1000"
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(`[
+		{"v":2,"type":"pageview","url":"/batch"},
+		{"v":2,"type":"heartbeat","url":"/batch","dwellTime":-3},
+		{"v":2,"type":"event","url":"/batch","name":"signup","props":{"plan":"pro"}},
+		{"v":2,"type":"heartbeat","url":"/batch","dwellTime":35,"activeTime":20,"scrollDepth":50},
+		{"v":2,"url":"/` + strings.Repeat("x", 64) + `"}
+	]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var resp struct {
+		Results []struct {
+			Status string `json:"status"`
+			Error  string `json:"error"`
+			Fields []struct {
+				Field string `json:"field"`
+			} `json:"fields"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid json response: %v", err)
+	}
+	var statuses []string
+	for _, r := range resp.Results {
+		statuses = append(statuses, r.Status)
+	}
+	if got := strings.Join(statuses, ","); got != "ok,rejected,ok,ok,rejected" {
+		t.Fatalf("unexpected results %s: %s", got, rec.Body.String())
+	}
+	if f := resp.Results[1].Fields; len(f) != 1 || f[0].Field != "dwellTime" {
+		t.Fatalf("expected the rejected heartbeat to name dwellTime, got %+v", resp.Results[1])
+	}
+
+	var pv models.PageVisit
+	if err := h.DB.Where("url = ?", "/batch").First(&pv).Error; err != nil {
+		t.Fatalf("expected a page visit: %v", err)
+	}
+	if pv.DwellTime != 35 || pv.ScrollDepth != 50 {
+		t.Fatalf("expected the last heartbeat to win, got dwell %d scroll %d", pv.DwellTime, pv.ScrollDepth)
+	}
+	var custom models.CustomEvent
+	if err := h.DB.Where("name = ?", "signup").First(&custom).Error; err != nil {
+		t.Fatalf("expected the custom event to be stored: %v", err)
+	}
+
+	if rec := post(`[{},{},{},{},{},{}]`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected oversized batch to be refused, got %d", rec.Code)
+	}
+	if rec := post(`{"url":"/batch"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a lone event to be refused, got %d", rec.Code)
+	}
+
+	// A failed transaction counts the events it rolls back as database
+	// errors, but not those rejected for another reason.
+	if err := h.DB.Migrator().DropTable(&models.CustomEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.DB.AutoMigrate(&models.CustomEvent{})
+	before := testutil.ToFloat64(metrics.EventsRejected.WithLabelValues("db_error"))
+	rec = post(`[
+		{"v":2,"type":"pageview","url":"/rollback"},
+		{"v":2,"type":"heartbeat","url":"/rollback","dwellTime":-3},
+		{"v":2,"type":"event","url":"/rollback","name":"signup"}
+	]`)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the batch to fail, got %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(metrics.EventsRejected.WithLabelValues("db_error")) - before; got != 2 {
+		t.Fatalf("expected the page view and the failed event to count as database errors, got %v", got)
+	}
+}
+
+func TestTrack_Sink(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+	if err := h.DB.AutoMigrate(&models.CustomEvent{}); err != nil {
+		t.Fatalf("auto migrate failed: %v", err)
+	}
+
+	batches := make(chan []types.SinkEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Events []types.SinkEvent `json:"events"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		batches <- payload.Events
+	}))
+	defer receiver.Close()
+
+	cfg := config.Default().Sink
+	cfg.URLs = []string{receiver.URL}
+	cfg.Secret = "sink-secret"
+	cfg.BatchSize = 3
+	cfg.FlushInterval = time.Hour
+	h.Sink = services.NewEventSink(h.DB, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Sink.Run(ctx)
+
+	e := echo.New()
+	e.POST("/event", h.Track)
+	e.POST("/event/batch", h.TrackBatch)
+	post := func(path, userAgent, body string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.RemoteAddr = "192.168.4.1:1000"
+		req.Header.Set("User-Agent", userAgent)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200 got %d body=%s", path, rec.Code, rec.Body.String())
+		}
+	}
+
+	post("/event/batch", "Mozilla/5.0", `[
+		{"v":2,"type":"pageview","url":"/sink"},
+		{"v":2,"type":"event","url":"/sink","name":"signup"},
+		{"v":2,"type":"heartbeat","url":"/sink","dwellTime":-3}
+	]`)
+	post("/event", "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)", `{"url":"/crawled"}`)
+	post("/event", "Mozilla/5.0", `{"url":"/sink/next"}`)
+
+	select {
+	case events := <-batches:
+		var got []string
+		for _, ev := range events {
+			got = append(got, ev.Type+" "+ev.URL)
+			if ev.Visitor != models.HashIP("192.168.4.1") {
+				t.Fatalf("expected the hashed IP as visitor, got %q", ev.Visitor)
+			}
+		}
+		if strings.Join(got, ",") != "pageview /sink,event /sink,pageview /sink/next" {
+			t.Fatalf("unexpected events forwarded: %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the accepted events to be forwarded")
+	}
+}
+
+func TestPixel(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	e := echo.New()
+	e.GET("/p.gif", h.Pixel)
+	get := func(target, referer string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = "192.168.4.1:1000"
+		req.Header.Set("User-Agent", "Lynx/2.9.0")
+		req.Header.Set("Referer", referer)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/p.gif?u=https%3A%2F%2Fexample.com%2Fpost&r=https%3A%2F%2Fnews.example.org%2F", "")
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "image/gif" {
+		t.Fatalf("expected a GIF, got %d %q", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	if !bytes.HasPrefix(rec.Body.Bytes(), []byte("GIF89a")) {
+		t.Fatalf("expected GIF data, got %q", rec.Body.String())
+	}
+
+	var a models.Analytics
+	if err := h.DB.Where("url = ?", "https://example.com/post").First(&a).Error; err != nil {
+		t.Fatalf("expected the page view to be stored: %v", err)
+	}
+	if a.Source != models.SourcePixel || a.Referrer != "https://news.example.org/" || a.UserAgent != "Lynx/2.9.0" {
+		t.Fatalf("unexpected page view %+v", a)
+	}
+
+	get("/p.gif", "https://example.com/from-referer")
+	var fallback models.Analytics
+	if err := h.DB.Where("url = ?", "https://example.com/from-referer").First(&fallback).Error; err != nil {
+		t.Fatalf("expected the Referer header to stand in for u: %v", err)
+	}
+
+	before := testutil.ToFloat64(metrics.EventsRejected.WithLabelValues("invalid_field"))
+	if rec := get("/p.gif", ""); rec.Code != http.StatusOK {
+		t.Fatalf("expected the GIF even for a refused view, got %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(metrics.EventsRejected.WithLabelValues("invalid_field")) - before; got != 1 {
+		t.Fatalf("expected the refusal to be counted, got %v", got)
+	}
+}
+
+func TestTrack_APIKey(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	blog := models.Site{Name: "Blog", Domain: "blog.example.com"}
+	shop := models.Site{Name: "Shop", Domain: "shop.example.com"}
+	for _, site := range []*models.Site{&blog, &shop} {
+		if err := h.DB.Create(site).Error; err != nil {
+			t.Fatalf("failed to create site: %v", err)
+		}
+	}
+	_, key, err := services.NewAPIKeyService(h.DB).Create("web", &blog.ID)
+	if err != nil {
+		t.Fatalf("failed to create api key: %v", err)
+	}
+
+	e := echo.New()
+	e.POST("/event", h.Track)
+	send := func(auth, visitorIP, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/event", strings.NewReader(`{"url":"`+url+`"}`))
+		req.RemoteAddr = "192.168.5.1:1000"
+		req.Header.Set("User-Agent", "Go-http-client/1.1")
+		req.Header.Set(echo.HeaderAuthorization, auth)
+		req.Header.Set(client.HeaderVisitorIP, visitorIP)
+		req.Header.Set(client.HeaderVisitorUserAgent, "Mozilla/5.0")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := send("Bearer "+key, "192.168.5.77", "https://blog.example.com/"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 got %d body=%s", rec.Code, rec.Body.String())
+	}
+	var a models.Analytics
+	if err := h.DB.Where("url = ?", "https://blog.example.com/").First(&a).Error; err != nil {
+		t.Fatalf("expected the page view to be stored: %v", err)
+	}
+	if a.IPHash != models.HashIP("192.168.5.77") || a.UserAgent != "Mozilla/5.0" || a.Source != models.SourceServer {
+		t.Fatalf("expected the page view to be the named visitor's, got %+v", a)
+	}
+
+	tests := []struct {
+		name      string
+		auth      string
+		visitorIP string
+		url       string
+		status    int
+	}{
+		{"wrong key", "Bearer dm_nope", "192.168.5.77", "https://blog.example.com/", http.StatusUnauthorized},
+		{"missing visitor", "Bearer " + key, "", "https://blog.example.com/", http.StatusBadRequest},
+		{"other site", "Bearer " + key, "192.168.5.77", "https://shop.example.com/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := send(tt.auth, tt.visitorIP, tt.url); rec.Code != tt.status {
+				t.Fatalf("expected status %d got %d body=%s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	database "github.com/webbesoft/doorman/internal/database"
+	"github.com/webbesoft/doorman/internal/metrics"
+)
+
+type HealthHandler struct {
+	DB *gorm.DB
+}
+
+// Healthz reports that the process is up and serving requests
+func (h *HealthHandler) Healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readyz reports whether the database is reachable and migrated
+func (h *HealthHandler) Readyz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), 2*time.Second)
+	defer cancel()
+
+	if err := database.CheckReady(ctx, h.DB); err != nil {
+		c.Logger().Warnf("Readiness check failed: %v", err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"status": "unavailable",
+			"error":  err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Metrics exposes Prometheus metrics in text format
+func (h *HealthHandler) Metrics(c echo.Context) error {
+	metrics.Handler().ServeHTTP(c.Response(), c.Request())
+	return nil
+}
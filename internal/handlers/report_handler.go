@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/mailer"
+	"github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/templates/emails"
+	"github.com/webbesoft/doorman/templates/pages"
+)
+
+// ReportHandler manages scheduled email reports.
+type ReportHandler struct {
+	DB *gorm.DB
+	// Mailer is nil when email isn't set up.
+	Mailer  mailer.Mailer
+	BaseURL string
+}
+
+func (r *ReportHandler) service() *services.ReportService {
+	return services.NewReportService(r.DB, r.Mailer, emails.RenderReport, r.BaseURL)
+}
+
+// List renders the report schedules page
+func (r *ReportHandler) List(c echo.Context) error {
+	schedules, err := r.service().List()
+	if err != nil {
+		return err
+	}
+	sites, err := services.NewSiteService(r.DB).List()
+	if err != nil {
+		return err
+	}
+
+	return render(c, pages.ReportsPage(
+		middleware.CurrentUser(c),
+		schedules,
+		sites,
+		r.Mailer != nil,
+		c.QueryParam("error"),
+		c.QueryParam("msg"),
+	))
+}
+
+// Add schedules a report for a recipient
+func (r *ReportHandler) Add(c echo.Context) error {
+	siteID, err := strconv.ParseUint(c.FormValue("site"), 10, 64)
+	if err != nil {
+		return redirectWithError(c, "/reports", services.ErrSiteNotFound)
+	}
+
+	schedule, err := r.service().Add(uint(siteID), c.FormValue("email"), c.FormValue("frequency"))
+	if err != nil {
+		return redirectWithError(c, "/reports", err)
+	}
+	return c.Redirect(http.StatusFound, "/reports?msg="+url.QueryEscape("Reports will be sent to "+schedule.Email+"."))
+}
+
+// Delete stops a schedule
+func (r *ReportHandler) Delete(c echo.Context) error {
+	return r.manage(c, "Report deleted", func(reports *services.ReportService, id uint) error {
+		return reports.Delete(id)
+	})
+}
+
+// SendTest sends a schedule's report right away
+func (r *ReportHandler) SendTest(c echo.Context) error {
+	return r.manage(c, "Test report sent", func(reports *services.ReportService, id uint) error {
+		return reports.SendTest(c.Request().Context(), id)
+	})
+}
+
+func (r *ReportHandler) manage(c echo.Context, success string, action func(*services.ReportService, uint) error) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if err := action(r.service(), uint(id)); err != nil {
+		return redirectWithError(c, "/reports", err)
+	}
+
+	return c.Redirect(http.StatusFound, "/reports?msg="+url.QueryEscape(success))
+}
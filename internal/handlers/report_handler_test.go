@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/mailer"
+	"github.com/webbesoft/doorman/internal/mailtest"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+func TestReportHandler(t *testing.T) {
+	h, cleanup := newTestHandler(t)
+	defer cleanup()
+
+	site, err := services.NewSiteService(h.DB).Add("Reports", "reports.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mailtest.NewServer(t)
+	m, err := mailer.NewSMTP(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh := &ReportHandler{DB: h.DB, Mailer: m, BaseURL: "https://doorman.example.com"}
+
+	e := echo.New()
+	g := e.Group("", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("user", &models.User{ID: 1, Role: models.RoleAdmin})
+			return next(c)
+		}
+	})
+	g.GET("/reports", rh.List)
+	g.POST("/reports", rh.Add)
+	g.POST("/reports/:id/test", rh.SendTest)
+	g.POST("/reports/:id/delete", rh.Delete)
+	post := func(path string, form url.Values) string {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("%s: expected a redirect, got %d: %s", path, rec.Code, rec.Body.String())
+		}
+		return rec.Header().Get("Location")
+	}
+
+	siteParam := fmt.Sprintf("%d", site.ID)
+	if loc := post("/reports", url.Values{"site": {siteParam}, "email": {"ada@example.org"}, "frequency": {"daily"}}); !strings.Contains(loc, "error=") {
+		t.Fatalf("expected an unknown frequency to be refused, got %q", loc)
+	}
+	if loc := post("/reports", url.Values{"site": {siteParam}, "email": {"ada@example.org"}, "frequency": {"weekly"}}); !strings.Contains(loc, "msg=") {
+		t.Fatalf("expected the schedule to be added, got %q", loc)
+	}
+
+	var schedule models.ReportSchedule
+	if err := h.DB.Where("email = ?", "ada@example.org").First(&schedule).Error; err != nil {
+		t.Fatalf("expected the schedule to be stored: %v", err)
+	}
+	defer h.DB.Where("1 = 1").Delete(&models.ReportSchedule{})
+
+	// Plain text is left unescaped.
+	from, _ := services.ReportPeriod(models.ReportWeekly, time.Now())
+	visit := models.Analytics{SiteID: &site.ID, URL: "https://reports.example.com/pricing?plan=pro&period=year", Referrer: "https://news.example.org/?a=1&b=2", IPHash: "reader", CreatedAt: from.Add(time.Hour)}
+	if err := h.DB.Create(&visit).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DB.Create(&models.PageVisit{AnalyticsID: visit.ID, SiteID: &site.ID, URL: visit.URL, IPHash: visit.IPHash, CreatedAt: visit.CreatedAt}).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer h.DB.Where("site_id = ?", site.ID).Delete(&models.PageVisit{})
+	defer h.DB.Where("site_id = ?", site.ID).Delete(&models.Analytics{})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the page to render, got %d", rec.Code)
+	}
+
+	if loc := post(fmt.Sprintf("/reports/%d/test", schedule.ID), nil); !strings.Contains(loc, "msg=Test+report+sent") {
+		t.Fatalf("expected the test report to be sent, got %q", loc)
+	}
+	msgs := server.Messages()
+	if len(msgs) != 1 || !strings.HasPrefix(msgs[0].Header("Subject"), "[Test] Weekly report for Reports") {
+		t.Fatalf("expected a test report, got %d messages", len(msgs))
+	}
+	text := msgs[0].Part("text/plain")
+	for _, want := range []string{
+		"This is a test report.\n",
+		"Visitors            1  new\n",
+		"Pageviews           1  new\n",
+		"         1  /pricing?plan=pro&period=year\n",
+		"         1  https://news.example.org/?a=1&b=2\n",
+		"Open the dashboard: https://doorman.example.com/dashboard?site=" + siteParam + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("expected the text version to contain %q, got:\n%s", want, text)
+		}
+	}
+	if html := msgs[0].Part("text/html"); !strings.Contains(html, "/pricing?plan=pro&amp;period=year") {
+		t.Fatalf("expected the HTML version to list the page, got:\n%s", html)
+	}
+
+	rh.Mailer = nil
+	if loc := post(fmt.Sprintf("/reports/%d/test", schedule.ID), nil); !strings.Contains(loc, "error=") {
+		t.Fatalf("expected sending without email set up to fail, got %q", loc)
+	}
+
+	post(fmt.Sprintf("/reports/%d/delete", schedule.ID), nil)
+	var count int64
+	h.DB.Model(&models.ReportSchedule{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected the schedule to be deleted, %d left", count)
+	}
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/middleware"
+	"github.com/webbesoft/doorman/internal/services"
+	"github.com/webbesoft/doorman/templates/pages"
+)
+
+type UserHandler struct {
+	DB *gorm.DB
+}
+
+// List renders the user management page
+func (u *UserHandler) List(c echo.Context) error {
+	return u.render(c, "", c.QueryParam("error"), c.QueryParam("msg"))
+}
+
+func (u *UserHandler) render(c echo.Context, inviteLink, errMsg, msg string) error {
+	users, err := services.NewUserService(u.DB).List()
+	if err != nil {
+		return err
+	}
+	sites, err := services.NewSiteService(u.DB).List()
+	if err != nil {
+		return err
+	}
+
+	return render(c, pages.UsersPage(
+		middleware.CurrentUser(c),
+		users,
+		sites,
+		inviteLink,
+		errMsg,
+		msg,
+	))
+}
+
+// Invite creates a pending user and shows the invite link once
+func (u *UserHandler) Invite(c echo.Context) error {
+	siteIDs, err := formSiteIDs(c)
+	if err != nil {
+		return redirectWithError(c, "/users", err)
+	}
+
+	invited, token, err := services.NewUserService(u.DB).Invite(
+		middleware.CurrentUser(c),
+		c.FormValue("username"),
+		c.FormValue("role"),
+		siteIDs,
+	)
+	if err != nil {
+		return redirectWithError(c, "/users", err)
+	}
+
+	link := c.Scheme() + "://" + c.Request().Host + "/invite/" + token
+	return u.render(c, link, "", "Invited "+invited.Username+". Send them this link; it won't be shown again.")
+}
+
+// SetRole changes a user's role
+func (u *UserHandler) SetRole(c echo.Context) error {
+	return u.manage(c, "Role updated", func(users *services.UserService, id uint) error {
+		return users.SetRole(middleware.CurrentUser(c), id, c.FormValue("role"))
+	})
+}
+
+// Disable blocks a user from signing in
+func (u *UserHandler) Disable(c echo.Context) error {
+	return u.manage(c, "User disabled", func(users *services.UserService, id uint) error {
+		return users.SetDisabled(middleware.CurrentUser(c), id, true)
+	})
+}
+
+// Enable lets a disabled user sign in again
+func (u *UserHandler) Enable(c echo.Context) error {
+	return u.manage(c, "User enabled", func(users *services.UserService, id uint) error {
+		return users.SetDisabled(middleware.CurrentUser(c), id, false)
+	})
+}
+
+// Delete removes a user
+func (u *UserHandler) Delete(c echo.Context) error {
+	return u.manage(c, "User deleted", func(users *services.UserService, id uint) error {
+		return users.DeleteAs(middleware.CurrentUser(c), id)
+	})
+}
+
+// SetSites replaces the sites a user may view
+func (u *UserHandler) SetSites(c echo.Context) error {
+	return u.manage(c, "Site access updated", func(users *services.UserService, id uint) error {
+		siteIDs, err := formSiteIDs(c)
+		if err != nil {
+			return err
+		}
+		return users.SetGrants(middleware.CurrentUser(c), id, siteIDs)
+	})
+}
+
+// ResetTwoFactor lets an admin turn off 2FA for a locked-out user
+func (u *UserHandler) ResetTwoFactor(c echo.Context) error {
+	return u.manage(c, "Two-factor authentication reset", func(users *services.UserService, id uint) error {
+		return services.NewTwoFactorService(users.DB).Reset(middleware.CurrentUser(c), id)
+	})
+}
+
+func (u *UserHandler) manage(c echo.Context, success string, action func(*services.UserService, uint) error) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	if err := action(services.NewUserService(u.DB), uint(id)); err != nil {
+		return redirectWithError(c, "/users", err)
+	}
+
+	return c.Redirect(http.StatusFound, "/users?msg="+url.QueryEscape(success))
+}
+
+// InvitePage renders the form where an invited user sets their password
+func (u *UserHandler) InvitePage(c echo.Context) error {
+	user, err := services.NewUserService(u.DB).FindInvite(c.Param("token"))
+	if err != nil {
+		return render(c, pages.InvitePage("", "", err.Error()))
+	}
+
+	return render(c, pages.InvitePage(user.Username, c.Param("token"), c.QueryParam("error")))
+}
+
+// AcceptInvite sets the invited user's password
+func (u *UserHandler) AcceptInvite(c echo.Context) error {
+	token := c.Param("token")
+	password := c.FormValue("password")
+
+	if password != c.FormValue("password_confirm") {
+		return c.Redirect(http.StatusFound, "/invite/"+token+"?error="+url.QueryEscape("Passwords don't match."))
+	}
+
+	if _, err := services.NewUserService(u.DB).AcceptInvite(token, password); err != nil {
+		return redirectWithError(c, "/invite/"+token, err)
+	}
+
+	return c.Redirect(http.StatusFound, "/login?msg="+url.QueryEscape("Your account is ready. Please sign in."))
+}
+
+func formSiteIDs(c echo.Context) ([]uint, error) {
+	form, err := c.FormParams()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint
+	for _, v := range form["sites"] {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid site")
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, nil
+}
+
+func redirectWithError(c echo.Context, path string, err error) error {
+	return c.Redirect(http.StatusFound, path+"?error="+url.QueryEscape(err.Error()))
+}
@@ -0,0 +1,142 @@
+package importer
+
+import (
+	"bufio"
+	_ "embed"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+// Sources of aggregate imports, as stored in ImportedStat.Source.
+const (
+	SourcePlausible = "plausible"
+	SourceGA        = "ga"
+)
+
+type aggregateKey struct {
+	date  time.Time
+	kind  string
+	value string
+}
+
+type figures struct {
+	visitors  int64
+	pageviews int64
+}
+
+// Aggregates adds up the daily figures of one site's export before they
+// are stored as ImportedStats.
+type Aggregates struct {
+	Source string
+	SiteID uint
+	// Until skips days from then on, which Doorman tracked itself.
+	Until time.Time
+	// Summary counts the rows read: Imported those kept, Overlapping
+	// those from Until on, Invalid those that couldn't be read.
+	Summary Summary
+
+	figures map[aggregateKey]*figures
+}
+
+func NewAggregates(source string, siteID uint, until time.Time) *Aggregates {
+	return &Aggregates{Source: source, SiteID: siteID, Until: until, figures: make(map[aggregateKey]*figures)}
+}
+
+// Add counts figures of kind for a day. Figures for the same day, kind
+// and value add up.
+func (a *Aggregates) Add(day time.Time, kind, value string, visitors, pageviews int64) {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	if !a.Until.IsZero() && !day.Before(a.Until) {
+		a.Summary.Overlapping++
+		return
+	}
+	if r := []rune(value); len(r) > models.MaxImportedValue {
+		value = string(r[:models.MaxImportedValue])
+	}
+
+	key := aggregateKey{date: day, kind: kind, value: value}
+	f, ok := a.figures[key]
+	if !ok {
+		f = &figures{}
+		a.figures[key] = f
+	}
+	f.visitors += visitors
+	f.pageviews += pageviews
+	a.Summary.Imported++
+}
+
+// Len is the number of ImportedStats Save would store.
+func (a *Aggregates) Len() int {
+	return len(a.figures)
+}
+
+// Save stores the figures, replacing any imported before for the same
+// days.
+func (a *Aggregates) Save(db *gorm.DB) error {
+	stats := make([]models.ImportedStat, 0, len(a.figures))
+	now := time.Now()
+	for key, f := range a.figures {
+		stats = append(stats, models.ImportedStat{
+			SiteID:    a.SiteID,
+			Source:    a.Source,
+			Date:      key.date,
+			Kind:      key.kind,
+			Value:     key.value,
+			Visitors:  f.visitors,
+			Pageviews: f.pageviews,
+			CreatedAt: now,
+		})
+	}
+	if len(stats) == 0 {
+		return nil
+	}
+
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "site_id"}, {Name: "source"}, {Name: "date"}, {Name: "kind"}, {Name: "value"}},
+		DoUpdates: clause.AssignmentColumns([]string{"visitors", "pageviews"}),
+	}).CreateInBatches(stats, batchSize).Error
+}
+
+// parseCount reads a count as exported, allowing thousands separators.
+// Empty cells count as zero.
+func parseCount(s string) (int64, bool) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	if s == "" {
+		return 0, true
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return int64(f), err == nil
+}
+
+//go:embed countries.txt
+var countryList string
+
+var countries = func() map[string]string {
+	names := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(countryList))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if code, name, ok := strings.Cut(line, " "); ok && !strings.HasPrefix(line, "#") {
+			names[code] = name
+		}
+	}
+	return names
+}()
+
+// countryName turns an ISO 3166 country code into the name geolocation
+// stores; anything else is returned as it is.
+func countryName(code string) string {
+	if name, ok := countries[strings.ToUpper(code)]; ok {
+		return name
+	}
+	return code
+}
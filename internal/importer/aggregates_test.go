@@ -0,0 +1,152 @@
+package importer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func importedStats(t *testing.T, agg *Aggregates) map[string]models.ImportedStat {
+	t.Helper()
+	db := newTestDB(t)
+	if err := agg.Save(db); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	var stats []models.ImportedStat
+	if err := db.Find(&stats).Error; err != nil {
+		t.Fatal(err)
+	}
+	byKey := make(map[string]models.ImportedStat, len(stats))
+	for _, s := range stats {
+		byKey[s.Date.UTC().Format(time.DateOnly)+" "+s.Kind+" "+s.Value] = s
+	}
+	return byKey
+}
+
+func TestReadPlausible(t *testing.T) {
+	until := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	agg := NewAggregates(SourcePlausible, 1, until)
+	files := map[string]string{
+		"imported_visitors_20240101_20240302.csv": "date,visitors,pageviews,bounces,visits,visit_duration\n" +
+			"2024-03-01,10,25,3,12,600\n2024-03-02,4,9,1,5,100\n",
+		"imported_pages_20240101_20240302.csv": "date,hostname,page,visits,visitors,pageviews,exits,time_on_page\n" +
+			"2024-03-01,blog.example.com,/post,8,6,12,4,300\n2024-03-01,,/about,2,2,3,2,20\n",
+		"imported_sources_20240101_20240302.csv": "date,source,referrer,utm_source,visitors,visits,bounces,visit_duration,pageviews\n" +
+			"2024-03-01,Direct / None,,,5,6,1,100,10\n2024-03-01,Hacker News,news.ycombinator.com/item,,3,3,0,50,7\n",
+		"imported_locations_20240101_20240302.csv": "date,country,region,city,visitors,visits,bounces,visit_duration,pageviews\n" +
+			"2024-03-01,NL,NL-NH,2759794,4,4,0,10,10\n2024-03-01,NL,NL-UT,2745912,2,2,0,10,5\nnot a date,NL,,,1,1,0,0,1\n",
+	}
+	for name, data := range files {
+		if err := ReadPlausible(name, strings.NewReader(data), agg, "blog.example.com", ""); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	err := ReadPlausible("imported_browsers_20240101_20240302.csv", strings.NewReader("date,browser\n"), agg, "blog.example.com", "")
+	if !errors.Is(err, ErrUnknownExport) {
+		t.Fatalf("expected browsers to be skipped, got %v", err)
+	}
+
+	if agg.Summary.Imported != 7 || agg.Summary.Overlapping != 1 || agg.Summary.Invalid != 1 {
+		t.Fatalf("unexpected summary %+v", agg.Summary)
+	}
+
+	stats := importedStats(t, agg)
+	want := map[string][2]int64{
+		"2024-03-01 total ":                              {10, 25},
+		"2024-03-01 page https://blog.example.com/post":  {6, 12},
+		"2024-03-01 page https://blog.example.com/about": {2, 3},
+		"2024-03-01 referrer ":                           {5, 10},
+		"2024-03-01 referrer news.ycombinator.com/item":  {3, 7},
+		"2024-03-01 country Netherlands":                 {6, 15},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("expected %d figures, got %v", len(want), stats)
+	}
+	for key, figures := range want {
+		s, ok := stats[key]
+		if !ok || s.Visitors != figures[0] || s.Pageviews != figures[1] || s.Source != SourcePlausible {
+			t.Fatalf("%s: expected %v, got %+v", key, figures, s)
+		}
+	}
+
+	// Pages of a site served over plain HTTP match the URLs it tracked.
+	agg = NewAggregates(SourcePlausible, 1, until)
+	pages := "imported_pages_20240101_20240302.csv"
+	if err := ReadPlausible(pages, strings.NewReader(files[pages]), agg, "blog.example.com", "http"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := importedStats(t, agg)["2024-03-01 page http://blog.example.com/about"]; !ok {
+		t.Fatalf("expected the scheme to be used, got %v", importedStats(t, agg))
+	}
+}
+
+func TestReadGA(t *testing.T) {
+	report := strings.Join([]string{
+		"# ----------------------------------------",
+		"# Pages and screens: Page path and screen class",
+		"# 20240101-20240131",
+		"# ----------------------------------------",
+		"",
+		"Page path and screen class,Date,Views,Users",
+		"/,20240105,\"1,204\",310",
+		"/pricing,20240105,40,22",
+		"/,2024-01-06,100,50",
+		"/,(other),1,1",
+		"",
+		"Day Index,Views",
+		"1/5/24,1244",
+	}, "\n")
+
+	agg := NewAggregates(SourceGA, 1, time.Time{})
+	if err := ReadGA(strings.NewReader(report), agg, "example.com", "https"); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if agg.Summary.Imported != 3 || agg.Summary.Invalid != 1 {
+		t.Fatalf("unexpected summary %+v", agg.Summary)
+	}
+
+	stats := importedStats(t, agg)
+	if s := stats["2024-01-05 page https://example.com/"]; s.Pageviews != 1204 || s.Visitors != 310 {
+		t.Fatalf("unexpected figures %+v", s)
+	}
+	if s := stats["2024-01-06 page https://example.com/"]; s.Pageviews != 100 {
+		t.Fatalf("unexpected figures %+v", s)
+	}
+
+	countries := "Date,Country,Sessions,Views\n20240105,Germany,3,7\n20240105,(not set),1,2\n"
+	agg = NewAggregates(SourceGA, 1, time.Time{})
+	if err := ReadGA(strings.NewReader(countries), agg, "example.com", "https"); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	stats = importedStats(t, agg)
+	if stats["2024-01-05 country Germany"].Pageviews != 7 || stats["2024-01-05 country "].Pageviews != 2 {
+		t.Fatalf("unexpected figures %v", stats)
+	}
+
+	if err := ReadGA(strings.NewReader("Country,Views\nGermany,7\n"), agg, "example.com", "https"); err == nil {
+		t.Fatal("expected reports without dates to be refused")
+	}
+}
+
+func TestAggregates_SaveReplaces(t *testing.T) {
+	db := newTestDB(t)
+	day := time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)
+	for _, pageviews := range []int64{10, 12} {
+		agg := NewAggregates(SourceGA, 1, time.Time{})
+		agg.Add(day, models.ImportedTotal, "", 5, pageviews)
+		if err := agg.Save(db); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+	}
+
+	var stats []models.ImportedStat
+	if err := db.Find(&stats).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Pageviews != 12 {
+		t.Fatalf("expected importing again to replace the figures, got %+v", stats)
+	}
+}
@@ -0,0 +1,144 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+// Column names Google Analytics uses for the same thing, in GA4 and
+// Universal Analytics exports.
+var (
+	gaDate      = []string{"date", "day"}
+	gaPage      = []string{"page path and screen class", "page path + query string", "page path", "page", "landing page", "landing page + query string"}
+	gaHost      = []string{"hostname", "host name"}
+	gaReferrer  = []string{"full referrer", "session source", "first user source", "source", "session source / medium", "source / medium"}
+	gaCountry   = []string{"country"}
+	gaPageviews = []string{"views", "screen page views", "pageviews", "page views"}
+	gaVisitors  = []string{"total users", "users", "active users", "unique pageviews"}
+)
+
+// ReadGA adds the figures of a report exported from Google Analytics as
+// CSV to agg. The report needs the Date dimension and a views or users
+// metric; a page, source or country dimension makes it a report of that
+// kind, and without one it holds the site's totals. Pages are taken to
+// be on host unless the report has a hostname dimension.
+//
+// Only the first table of an export is read; Universal Analytics appends
+// more, such as a Day Index, after a blank line.
+func ReadGA(r io.Reader, agg *Aggregates, host, scheme string) error {
+	rows := csv.NewReader(r)
+	rows.Comment = '#'
+	rows.FieldsPerRecord = -1
+
+	header, err := rows.Read()
+	if err != nil {
+		return err
+	}
+	col := columns(header)
+	find := func(names []string) int {
+		for _, name := range names {
+			if i, ok := col[name]; ok {
+				return i
+			}
+		}
+		return -1
+	}
+
+	date := find(gaDate)
+	if date < 0 {
+		return errors.New("the report needs the Date dimension")
+	}
+	pageviews, visitors := find(gaPageviews), find(gaVisitors)
+	if pageviews < 0 && visitors < 0 {
+		return errors.New("the report needs a views or users metric")
+	}
+	kind, dimension := models.ImportedTotal, -1
+	for _, d := range []struct {
+		kind  string
+		names []string
+	}{
+		{models.ImportedPage, gaPage},
+		{models.ImportedReferrer, gaReferrer},
+		{models.ImportedCountry, gaCountry},
+	} {
+		if i := find(d.names); i >= 0 {
+			kind, dimension = d.kind, i
+			break
+		}
+	}
+	hostname := find(gaHost)
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	for {
+		row, err := rows.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(row) != len(header) {
+			return nil
+		}
+
+		day, ok := parseGADate(row[date])
+		if !ok {
+			agg.Summary.Invalid++
+			continue
+		}
+		var views, users int64
+		okViews, okUsers := true, true
+		if pageviews >= 0 {
+			views, okViews = parseCount(row[pageviews])
+		}
+		if visitors >= 0 {
+			users, okUsers = parseCount(row[visitors])
+		}
+		if !okViews || !okUsers {
+			agg.Summary.Invalid++
+			continue
+		}
+
+		var value string
+		if dimension >= 0 {
+			value = strings.TrimSpace(row[dimension])
+		}
+		switch kind {
+		case models.ImportedPage:
+			h := host
+			if hostname >= 0 && row[hostname] != "" {
+				h = row[hostname]
+			}
+			value = fmt.Sprintf("%s://%s%s", scheme, h, value)
+		case models.ImportedReferrer:
+			// Visits without a referrer show up as the direct source.
+			if value == "(direct)" || strings.HasPrefix(value, "(direct) /") || value == "(not set)" {
+				value = ""
+			}
+		case models.ImportedCountry:
+			if value == "(not set)" {
+				value = ""
+			}
+		}
+		agg.Add(day, kind, value, users, views)
+	}
+}
+
+// parseGADate reads the dates of GA exports, 20240131 or 2024-01-31.
+func parseGADate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"20060102", time.DateOnly} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
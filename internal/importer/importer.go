@@ -0,0 +1,172 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/ingest"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+// batchSize is how many page views are stored per transaction.
+const batchSize = 500
+
+// ErrNoHost is returned for logs that don't record the host of requests
+// when LogImporter.Host isn't set.
+var ErrNoHost = errors.New("the log doesn't record hosts, so one must be given")
+
+// Summary counts what happened to the records of an import.
+type Summary struct {
+	Lines        int
+	Imported     int
+	Duplicates   int
+	NotPageviews int
+	Invalid      int
+	TooOld       int
+	Overlapping  int
+	UnknownSite  int
+}
+
+// view is a page view to store.
+type view struct {
+	visitor  services.Visitor
+	url      string
+	referrer string
+	at       time.Time
+}
+
+// viewWriter stores page views through services.EventService.Import, in
+// batches of one transaction each.
+type viewWriter struct {
+	db                *gorm.DB
+	bots              *botdetect.Engine
+	heartbeatInterval time.Duration
+	geo               *services.GeoService
+	sum               *Summary
+	batch             []view
+}
+
+func (w *viewWriter) add(v view) error {
+	w.batch = append(w.batch, v)
+	if len(w.batch) < batchSize {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *viewWriter) flush() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+
+	// Country lookups happen outside the transaction.
+	if w.geo != nil {
+		for i := range w.batch {
+			v := &w.batch[i].visitor
+			if geo := w.geo.GetGeoDataCached(v.IP, v.IPHash); geo != nil {
+				v.Country = geo.Country
+			}
+		}
+	}
+
+	counted := *w.sum
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		events := services.NewEventService(tx, w.bots, w.heartbeatInterval)
+		for _, v := range w.batch {
+			ev, err := ingest.Pageview(v.url, v.referrer)
+			if err != nil {
+				counted.Invalid++
+				continue
+			}
+
+			added, err := events.Import(v.visitor, ev, v.at)
+			switch {
+			case errors.Is(err, services.ErrUnknownSite):
+				counted.UnknownSite++
+			case err != nil:
+				return err
+			case added:
+				counted.Imported++
+			default:
+				counted.Duplicates++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*w.sum = counted
+	w.batch = w.batch[:0]
+	return nil
+}
+
+// LogImporter stores the page views found in access logs as if the
+// tracker had reported them when they happened: the same visitor hashing,
+// site matching and bot scoring, with the original timestamps.
+type LogImporter struct {
+	DB *gorm.DB
+	// Bots scores visits; nil uses the built-in rules.
+	Bots              *botdetect.Engine
+	HeartbeatInterval time.Duration
+	// Host and Scheme complete the URLs of logs that don't record them.
+	Host   string
+	Scheme string
+	// Since skips older hits, which cleanup would delete anyway.
+	Since time.Time
+	// Geo looks up visitors' countries; nil leaves them unknown.
+	Geo *services.GeoService
+}
+
+// Import reads r to the end and stores its page views, returning what it
+// did. Lines that can't be parsed are counted and skipped.
+func (im *LogImporter) Import(r *Reader) (Summary, error) {
+	var sum Summary
+	w := &viewWriter{db: im.DB, bots: im.Bots, heartbeatInterval: im.HeartbeatInterval, geo: im.Geo, sum: &sum}
+
+	for {
+		hit, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var lineErr *LineError
+		if errors.As(err, &lineErr) {
+			sum.Invalid++
+			continue
+		}
+		if err != nil {
+			return sum, err
+		}
+
+		switch {
+		case hit.Host == "" && im.Host == "":
+			return sum, fmt.Errorf("line %d: %w", r.Line(), ErrNoHost)
+		case !hit.IsPageview():
+			sum.NotPageviews++
+		case hit.Time.Before(im.Since):
+			sum.TooOld++
+		default:
+			err = w.add(view{
+				visitor:  services.Visitor{IP: hit.IP, IPHash: models.HashIP(hit.IP), UserAgent: hit.UserAgent, Source: models.SourceLog},
+				url:      hit.URL(im.Host, im.Scheme),
+				referrer: hit.Referrer,
+				at:       hit.Time,
+			})
+			if err != nil {
+				return sum, err
+			}
+		}
+	}
+
+	if err := w.flush(); err != nil {
+		return sum, err
+	}
+	sum.Lines = r.Line()
+	return sum, nil
+}
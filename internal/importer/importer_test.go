@@ -0,0 +1,98 @@
+package importer
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	if err := db.AutoMigrate(&models.Analytics{}, &models.PageVisit{}, &models.Site{}, &models.BotRuleHit{}, &models.BotScore{}, &models.ImportedStat{}); err != nil {
+		t.Fatalf("auto migrate failed: %v", err)
+	}
+	return db
+}
+
+func TestLogImporter(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := services.NewSiteService(db).Add("Blog", "blog.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Now().UTC().AddDate(0, 0, -3).Format("02/Jan/2006")
+	log := strings.Join([]string{
+		`192.168.1.9 - - [` + day + `:10:00:00 +0000] "GET /post HTTP/1.1" 200 512 "https://news.example.org/" "Mozilla/5.0"`,
+		`192.168.1.9 - - [` + day + `:10:00:01 +0000] "GET /style.css HTTP/1.1" 200 80 "https://blog.example.com/post" "Mozilla/5.0"`,
+		`192.168.1.9 - - [` + day + `:10:05:00 +0000] "GET /post HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+		`192.168.1.7 - - [` + day + `:11:00:00 +0000] "GET /about HTTP/1.1" 200 512 "-" "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"`,
+		`192.168.1.8 - - [01/Jan/2001:00:00:00 +0000] "GET /old HTTP/1.1" 200 512 "-" "Mozilla/5.0"`,
+		`half a line`,
+	}, "\n")
+
+	im := &LogImporter{DB: db, Host: "blog.example.com", Scheme: "https", Since: time.Now().AddDate(0, 0, -90)}
+	run := func() Summary {
+		t.Helper()
+		r, err := NewReader(strings.NewReader(log), FormatCombined)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err := im.Import(r)
+		if err != nil {
+			t.Fatalf("import failed: %v", err)
+		}
+		return sum
+	}
+
+	sum := run()
+	want := Summary{Lines: 6, Imported: 2, Duplicates: 1, NotPageviews: 1, Invalid: 1, TooOld: 1}
+	if sum != want {
+		t.Fatalf("expected %+v, got %+v", want, sum)
+	}
+
+	var post models.Analytics
+	if err := db.Where("url = ?", "https://blog.example.com/post").First(&post).Error; err != nil {
+		t.Fatalf("expected the page view to be stored: %v", err)
+	}
+	if post.IPHash != models.HashIP("192.168.1.9") || post.Source != models.SourceLog || post.SiteID == nil {
+		t.Fatalf("unexpected page view %+v", post)
+	}
+	if post.CreatedAt.UTC().Hour() != 10 || post.CreatedAt.UTC().Minute() != 0 {
+		t.Fatalf("expected the original time, got %v", post.CreatedAt)
+	}
+	var crawler models.Analytics
+	if err := db.Where("url = ?", "https://blog.example.com/about").First(&crawler).Error; err != nil {
+		t.Fatalf("expected the crawler's page view to be stored: %v", err)
+	}
+	if !crawler.IsBot {
+		t.Fatalf("expected the crawler to be flagged, got %+v", crawler)
+	}
+
+	again := run()
+	if again.Imported != 0 || again.Duplicates != 3 {
+		t.Fatalf("expected a re-import to add nothing, got %+v", again)
+	}
+	var count int64
+	db.Model(&models.PageVisit{}).Count(&count)
+	if count != 2 {
+		t.Fatalf("expected 2 page visits, got %d", count)
+	}
+
+	im.Host = ""
+	r, _ := NewReader(strings.NewReader(log), FormatCombined)
+	if _, err := im.Import(r); !errors.Is(err, ErrNoHost) {
+		t.Fatalf("expected logs without hosts to need one, got %v", err)
+	}
+}
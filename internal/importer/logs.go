@@ -0,0 +1,303 @@
+// Package importer reads page views recorded outside the tracker, such as
+// web server access logs, and stores them like tracked ones.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Access log formats.
+const (
+	// FormatAuto tells Caddy's JSON lines from Combined Log Format ones.
+	FormatAuto = "auto"
+	// FormatCombined is the Combined Log Format of nginx and Apache.
+	FormatCombined = "combined"
+	// FormatCaddy is Caddy's JSON access log.
+	FormatCaddy = "caddy"
+)
+
+// maxLineLength bounds a single log line.
+const maxLineLength = 1 << 20
+
+// Hit is one request found in an access log.
+type Hit struct {
+	Time   time.Time
+	IP     string
+	Method string
+	// Host is empty for Combined Log Format, which doesn't record it.
+	Host string
+	URI  string
+	// TLS is only known for Caddy logs.
+	TLS       bool
+	Status    int
+	Referrer  string
+	UserAgent string
+	// ContentType is the response's, when the log records it.
+	ContentType string
+}
+
+// pageExtensions are the file extensions of pages; paths without an
+// extension are pages too.
+var pageExtensions = map[string]bool{
+	".html": true, ".htm": true, ".shtml": true, ".xhtml": true,
+	".php": true, ".asp": true, ".aspx": true, ".jsp": true, ".cgi": true,
+}
+
+// IsPageview reports whether the hit is someone viewing a page, rather
+// than an asset, a form post or an error.
+func (h Hit) IsPageview() bool {
+	if h.Method != http.MethodGet {
+		return false
+	}
+	if (h.Status < 200 || h.Status > 299) && h.Status != http.StatusNotModified {
+		return false
+	}
+	if h.ContentType != "" {
+		return strings.HasPrefix(h.ContentType, "text/html")
+	}
+
+	p, _, _ := strings.Cut(h.URI, "?")
+	ext := strings.ToLower(path.Ext(p))
+	return ext == "" || pageExtensions[ext]
+}
+
+// URL is the page the hit was for, as the tracker would report it. host
+// and scheme fill in what the log doesn't record.
+func (h Hit) URL(host, scheme string) string {
+	if h.Host != "" {
+		host = h.Host
+		if h.TLS {
+			scheme = "https"
+		}
+	}
+	return scheme + "://" + host + h.URI
+}
+
+// LineError is a line that couldn't be parsed.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads hits from an access log a line at a time.
+type Reader struct {
+	format  string
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewReader(r io.Reader, format string) (*Reader, error) {
+	switch format {
+	case "", FormatAuto:
+		format = FormatAuto
+	case FormatCombined, FormatCaddy:
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected auto, combined or caddy", format)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineLength)
+	return &Reader{format: format, scanner: scanner}, nil
+}
+
+// Next returns the next hit, io.EOF at the end of the log, or a
+// *LineError for a line that isn't a request, after which reading can go
+// on.
+func (r *Reader) Next() (Hit, error) {
+	for r.scanner.Scan() {
+		r.line++
+		line := bytes.TrimSpace(r.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var hit Hit
+		var err error
+		switch {
+		case r.format == FormatCaddy, r.format == FormatAuto && line[0] == '{':
+			hit, err = ParseCaddy(line)
+		default:
+			hit, err = ParseCombined(string(line))
+		}
+		if err != nil {
+			return Hit{}, &LineError{Line: r.line, Err: err}
+		}
+		return hit, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return Hit{}, err
+	}
+	return Hit{}, io.EOF
+}
+
+// Line is the number of the last line read.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+const quoted = `"((?:[^"\\]|\\.)*)"`
+
+// combinedLine matches Combined Log Format; the referrer and user agent
+// are optional, so Common Log Format lines match too.
+var combinedLine = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] ` + quoted + ` (\d{3}) \S+(?: ` + quoted + ` ` + quoted + `)?`)
+
+const combinedTime = "02/Jan/2006:15:04:05 -0700"
+
+var errNotRequest = errors.New("not a request line")
+
+// ParseCombined parses a line of Combined Log Format:
+//
+//	203.0.113.9 - - [10/Oct/2024:13:55:36 +0000] "GET /post HTTP/1.1" 200 2326 "https://example.org/" "Mozilla/5.0 ..."
+func ParseCombined(line string) (Hit, error) {
+	m := combinedLine.FindStringSubmatch(line)
+	if m == nil {
+		return Hit{}, fmt.Errorf("not in Combined Log Format")
+	}
+
+	t, err := time.Parse(combinedTime, m[2])
+	if err != nil {
+		return Hit{}, fmt.Errorf("invalid time: %w", err)
+	}
+	method, uri, ok := parseRequest(unescape(m[3]))
+	if !ok {
+		return Hit{}, errNotRequest
+	}
+	status, _ := strconv.Atoi(m[4])
+
+	return Hit{
+		Time:      t,
+		IP:        m[1],
+		Method:    method,
+		URI:       uri,
+		Status:    status,
+		Referrer:  dash(unescape(m[5])),
+		UserAgent: dash(unescape(m[6])),
+	}, nil
+}
+
+// parseRequest splits a request line such as "GET /post HTTP/1.1".
+func parseRequest(request string) (method, uri string, ok bool) {
+	fields := strings.Fields(request)
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "/") {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
+// unescape undoes the escaping nginx and Apache apply to quoted fields.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == 'x' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
+
+// dash turns the "-" logged for a missing value into "".
+func dash(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+type caddyEntry struct {
+	TS      json.RawMessage `json:"ts"`
+	Request *struct {
+		RemoteIP string          `json:"remote_ip"`
+		ClientIP string          `json:"client_ip"`
+		Method   string          `json:"method"`
+		Host     string          `json:"host"`
+		URI      string          `json:"uri"`
+		Headers  http.Header     `json:"headers"`
+		TLS      json.RawMessage `json:"tls"`
+	} `json:"request"`
+	Status      int         `json:"status"`
+	RespHeaders http.Header `json:"resp_headers"`
+}
+
+// ParseCaddy parses a line of Caddy's JSON access log. Timestamps may be
+// Unix seconds, Caddy's default, or RFC 3339 strings.
+func ParseCaddy(line []byte) (Hit, error) {
+	var entry caddyEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return Hit{}, fmt.Errorf("invalid JSON: %w", err)
+	}
+	req := entry.Request
+	if req == nil || req.Method == "" || !strings.HasPrefix(req.URI, "/") {
+		return Hit{}, errNotRequest
+	}
+
+	t, err := caddyTime(entry.TS)
+	if err != nil {
+		return Hit{}, err
+	}
+
+	ip := req.ClientIP
+	if ip == "" {
+		ip = req.RemoteIP
+	}
+	return Hit{
+		Time:        t,
+		IP:          ip,
+		Method:      req.Method,
+		Host:        req.Host,
+		URI:         req.URI,
+		TLS:         len(req.TLS) > 0 && string(req.TLS) != "null",
+		Status:      entry.Status,
+		Referrer:    req.Headers.Get("Referer"),
+		UserAgent:   req.Headers.Get("User-Agent"),
+		ContentType: entry.RespHeaders.Get("Content-Type"),
+	}, nil
+}
+
+func caddyTime(raw json.RawMessage) (time.Time, error) {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err == nil {
+		whole, frac := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(frac*1e9)).UTC(), nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid ts %s", raw)
+}
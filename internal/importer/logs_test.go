@@ -0,0 +1,127 @@
+package importer
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCombined(t *testing.T) {
+	hit, err := ParseCombined(`192.168.1.9 - frank [10/Oct/2024:13:55:36 -0700] "GET /post?id=1 HTTP/1.1" 200 2326 "https://news.example.org/" "Mozilla/5.0 \"quoted\" \x41"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := Hit{
+		Time:      time.Date(2024, 10, 10, 20, 55, 36, 0, time.UTC),
+		IP:        "192.168.1.9",
+		Method:    "GET",
+		URI:       "/post?id=1",
+		Status:    200,
+		Referrer:  "https://news.example.org/",
+		UserAgent: `Mozilla/5.0 "quoted" A`,
+	}
+	if !hit.Time.Equal(want.Time) {
+		t.Fatalf("expected time %v, got %v", want.Time, hit.Time)
+	}
+	hit.Time = want.Time
+	if hit != want {
+		t.Fatalf("expected %+v, got %+v", want, hit)
+	}
+
+	common, err := ParseCombined(`192.168.1.9 - - [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.0" 304 -`)
+	if err != nil || common.Referrer != "" || common.UserAgent != "" || common.Status != 304 {
+		t.Fatalf("expected Common Log Format to parse, got %+v, %v", common, err)
+	}
+
+	for _, line := range []string{
+		`not a log line`,
+		`192.168.1.9 - - [10/Oct/2024:13:55:36 +0000] "\x16\x03\x01" 400 150 "-" "-"`,
+		`192.168.1.9 - - [yesterday] "GET / HTTP/1.1" 200 1 "-" "-"`,
+	} {
+		if _, err := ParseCombined(line); err == nil {
+			t.Errorf("expected %q to be refused", line)
+		}
+	}
+}
+
+func TestParseCaddy(t *testing.T) {
+	hit, err := ParseCaddy([]byte(`{"level":"info","ts":1728568536.5,"logger":"http.log.access","msg":"handled request","request":{"remote_ip":"10.0.0.2","client_ip":"192.168.1.9","proto":"HTTP/2.0","method":"GET","host":"blog.example.com","uri":"/post","headers":{"User-Agent":["Mozilla/5.0"],"Referer":["https://news.example.org/"]},"tls":{"resumed":false,"proto":"h2"}},"status":200,"resp_headers":{"Content-Type":["text/html; charset=utf-8"]}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hit.IP != "192.168.1.9" || hit.Host != "blog.example.com" || !hit.TLS || hit.UserAgent != "Mozilla/5.0" || hit.Referrer != "https://news.example.org/" {
+		t.Fatalf("unexpected hit %+v", hit)
+	}
+	if want := time.Unix(1728568536, 5e8); !hit.Time.Equal(want) {
+		t.Fatalf("expected time %v, got %v", want, hit.Time)
+	}
+	if got := hit.URL("", "http"); got != "https://blog.example.com/post" {
+		t.Fatalf("unexpected url %q", got)
+	}
+
+	iso, err := ParseCaddy([]byte(`{"ts":"2024-10-10T13:55:36Z","request":{"remote_ip":"192.168.1.9","method":"GET","host":"blog.example.com","uri":"/"},"status":200}`))
+	if err != nil || iso.IP != "192.168.1.9" || iso.TLS || iso.Time.Year() != 2024 {
+		t.Fatalf("expected ISO timestamps and remote_ip to be used, got %+v, %v", iso, err)
+	}
+
+	if _, err := ParseCaddy([]byte(`{"level":"info","ts":1728568536.5,"msg":"server running"}`)); err == nil {
+		t.Fatal("expected a non-access log entry to be refused")
+	}
+}
+
+func TestHit_IsPageview(t *testing.T) {
+	tests := []struct {
+		hit  Hit
+		want bool
+	}{
+		{Hit{Method: "GET", URI: "/", Status: 200}, true},
+		{Hit{Method: "GET", URI: "/blog/post/", Status: 200}, true},
+		{Hit{Method: "GET", URI: "/index.php?p=1", Status: 200}, true},
+		{Hit{Method: "GET", URI: "/about", Status: 304}, true},
+		{Hit{Method: "GET", URI: "/style.css", Status: 200}, false},
+		{Hit{Method: "GET", URI: "/logo.PNG", Status: 200}, false},
+		{Hit{Method: "GET", URI: "/missing", Status: 404}, false},
+		{Hit{Method: "POST", URI: "/contact", Status: 200}, false},
+		{Hit{Method: "GET", URI: "/api/items", Status: 200, ContentType: "application/json"}, false},
+		{Hit{Method: "GET", URI: "/feed.html", Status: 200, ContentType: "text/html"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.hit.IsPageview(); got != tt.want {
+			t.Errorf("%s %s %d: expected %v", tt.hit.Method, tt.hit.URI, tt.hit.Status, tt.want)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	log := strings.Join([]string{
+		`192.168.1.9 - - [10/Oct/2024:13:55:36 +0000] "GET / HTTP/1.1" 200 1 "-" "Mozilla/5.0"`,
+		``,
+		`garbage`,
+		`{"ts":1728568536,"request":{"remote_ip":"192.168.1.9","method":"GET","host":"example.com","uri":"/"},"status":200}`,
+	}, "\n")
+
+	r, err := NewReader(strings.NewReader(log), FormatAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hit, err := r.Next(); err != nil || hit.Host != "" {
+		t.Fatalf("expected a Combined Log Format hit, got %+v, %v", hit, err)
+	}
+	var lineErr *LineError
+	if _, err := r.Next(); !errors.As(err, &lineErr) || lineErr.Line != 3 {
+		t.Fatalf("expected an error for line 3, got %v", err)
+	}
+	if hit, err := r.Next(); err != nil || hit.Host != "example.com" {
+		t.Fatalf("expected a Caddy hit, got %+v, %v", hit, err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+
+	if _, err := NewReader(strings.NewReader(""), "w3c"); err == nil {
+		t.Fatal("expected an unknown format to be refused")
+	}
+}
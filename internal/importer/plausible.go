@@ -0,0 +1,120 @@
+package importer
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+// ErrUnknownExport is returned for files that aren't part of an export
+// the importer understands.
+var ErrUnknownExport = errors.New("not a file this importer reads")
+
+// plausibleKinds maps the names Plausible gives the CSV files of a site
+// export to the kind of figures they hold. Files for other dimensions,
+// such as browsers, have no place in Doorman's stats.
+var plausibleKinds = map[string]string{
+	"imported_visitors":  models.ImportedTotal,
+	"imported_pages":     models.ImportedPage,
+	"imported_sources":   models.ImportedReferrer,
+	"imported_locations": models.ImportedCountry,
+}
+
+// ReadPlausible adds the figures of one CSV file from a Plausible export
+// to agg. The file's name says what it holds; files for dimensions
+// Doorman doesn't have return ErrUnknownExport. Pages without a hostname
+// column are taken to be on host, and page URLs get scheme, https if
+// empty.
+func ReadPlausible(name string, r io.Reader, agg *Aggregates, host, scheme string) error {
+	base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+	var kind string
+	for prefix, k := range plausibleKinds {
+		if strings.HasPrefix(base, prefix) && strings.HasSuffix(base, ".csv") {
+			kind = k
+		}
+	}
+	if kind == "" {
+		return fmt.Errorf("%s: %w", name, ErrUnknownExport)
+	}
+
+	rows := csv.NewReader(r)
+	rows.FieldsPerRecord = -1
+	header, err := rows.Read()
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	col := columns(header)
+	if _, ok := col["date"]; !ok {
+		return fmt.Errorf("%s: no date column", name)
+	}
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	for {
+		row, err := rows.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		get := func(c string) string {
+			if i, ok := col[c]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+
+		day, err := time.Parse(time.DateOnly, get("date"))
+		visitors, okVisitors := parseCount(get("visitors"))
+		pageviews, okPageviews := parseCount(get("pageviews"))
+		if _, ok := col["pageviews"]; !ok {
+			// Older exports count visits rather than pageviews.
+			pageviews, okPageviews = parseCount(get("visits"))
+		}
+		if err != nil || !okVisitors || !okPageviews {
+			agg.Summary.Invalid++
+			continue
+		}
+
+		var value string
+		switch kind {
+		case models.ImportedPage:
+			h := get("hostname")
+			if h == "" {
+				h = host
+			}
+			value = scheme + "://" + h + get("page")
+		case models.ImportedReferrer:
+			value = get("referrer")
+			if value == "" {
+				value = get("source")
+			}
+			if value == "Direct / None" {
+				value = ""
+			}
+		case models.ImportedCountry:
+			value = countryName(get("country"))
+		}
+		agg.Add(day, kind, value, visitors, pageviews)
+	}
+}
+
+// columns indexes a CSV header by lower-cased column name.
+func columns(header []string) map[string]int {
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := col[name]; !ok {
+			col[name] = i
+		}
+	}
+	return col
+}
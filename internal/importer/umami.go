@@ -0,0 +1,308 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+// Tables of an Umami (v2) database the importer reads.
+const (
+	UmamiSessions = "session"
+	UmamiWebsites = "website"
+	UmamiEvents   = "website_event"
+)
+
+// umamiPageview is the event_type of page views; other events are custom.
+const umamiPageview = "1"
+
+var copyHeader = regexp.MustCompile(`^COPY (?:"?\w+"?\.)?"?(\w+)"? \(([^)]*)\) FROM stdin;$`)
+
+type umamiSession struct {
+	hostname string
+	country  string
+}
+
+// UmamiImporter stores the page views of an Umami database, which keeps
+// every event, like the tracker would have reported them. Visitors are
+// told apart by Umami's session IDs, as it doesn't keep IP addresses, so
+// their visits aren't bot scored.
+//
+// Sessions must be read before the events that refer to them.
+type UmamiImporter struct {
+	DB                *gorm.DB
+	Bots              *botdetect.Engine
+	HeartbeatInterval time.Duration
+	// Host completes the URLs of events whose website is unknown.
+	Host   string
+	Scheme string
+	// Since skips older events, which cleanup would delete anyway.
+	Since time.Time
+	// Until skips events from then on, which Doorman tracked itself.
+	Until time.Time
+
+	sessions map[string]umamiSession
+	websites map[string]string
+	writer   *viewWriter
+	sum      Summary
+}
+
+// ReadDump reads the tables the importer needs from a plain-format
+// pg_dump of an Umami database. It can be called again with more dumps
+// before Finish.
+func (u *UmamiImporter) ReadDump(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var table string
+	var cols []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if table == "" {
+			if m := copyHeader.FindStringSubmatch(line); m != nil {
+				table = m[1]
+				cols = strings.Split(m[2], ", ")
+				for i, c := range cols {
+					cols[i] = strings.Trim(c, `"`)
+				}
+			}
+			continue
+		}
+		if line == `\.` {
+			table = ""
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(cols) {
+			u.sum.Lines++
+			u.sum.Invalid++
+			continue
+		}
+		row := make(map[string]string, len(cols))
+		for i, c := range cols {
+			row[c] = unescapeCopy(fields[i])
+		}
+		if err := u.row(table, row); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadCSV reads one table of an Umami database exported as CSV with a
+// header, as MySQL users or pgAdmin would.
+func (u *UmamiImporter) ReadCSV(table string, r io.Reader) error {
+	switch table {
+	case UmamiSessions, UmamiWebsites, UmamiEvents:
+	default:
+		return fmt.Errorf("%s: %w", table, ErrUnknownExport)
+	}
+
+	rows := csv.NewReader(r)
+	rows.FieldsPerRecord = -1
+	header, err := rows.Read()
+	if err != nil {
+		return err
+	}
+	col := columns(header)
+	for {
+		fields, err := rows.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := make(map[string]string, len(col))
+		for name, i := range col {
+			if i < len(fields) && fields[i] != `\N` && fields[i] != "NULL" {
+				row[name] = fields[i]
+			}
+		}
+		if err := u.row(table, row); err != nil {
+			return err
+		}
+	}
+}
+
+func (u *UmamiImporter) row(table string, row map[string]string) error {
+	if u.writer == nil {
+		u.sessions = make(map[string]umamiSession)
+		u.websites = make(map[string]string)
+		u.writer = &viewWriter{db: u.DB, bots: u.Bots, heartbeatInterval: u.HeartbeatInterval, sum: &u.sum}
+	}
+
+	switch table {
+	case UmamiSessions:
+		u.sessions[row["session_id"]] = umamiSession{hostname: row["hostname"], country: row["country"]}
+	case UmamiWebsites:
+		u.websites[row["website_id"]] = row["domain"]
+	case UmamiEvents:
+		u.sum.Lines++
+		return u.event(row)
+	}
+	return nil
+}
+
+func (u *UmamiImporter) event(row map[string]string) error {
+	if row["event_type"] != umamiPageview {
+		u.sum.NotPageviews++
+		return nil
+	}
+	at, ok := parseUmamiTime(row["created_at"])
+	if !ok || row["session_id"] == "" {
+		u.sum.Invalid++
+		return nil
+	}
+	switch {
+	case at.Before(u.Since):
+		u.sum.TooOld++
+		return nil
+	case !u.Until.IsZero() && !at.Before(u.Until):
+		u.sum.Overlapping++
+		return nil
+	}
+
+	session := u.sessions[row["session_id"]]
+	host := firstOf(row["hostname"], session.hostname, u.websites[row["website_id"]], u.Host)
+	if host == "" {
+		return fmt.Errorf("event %s: %w", row["event_id"], ErrNoHost)
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	url := scheme + "://" + host + row["url_path"]
+	if q := row["url_query"]; q != "" {
+		url += "?" + strings.TrimPrefix(q, "?")
+	}
+	var referrer string
+	if d := row["referrer_domain"]; d != "" {
+		referrer = "https://" + d + row["referrer_path"]
+		if q := row["referrer_query"]; q != "" {
+			referrer += "?" + strings.TrimPrefix(q, "?")
+		}
+	}
+
+	return u.writer.add(view{
+		visitor: services.Visitor{
+			IPHash:  models.HashIP("umami:" + row["session_id"]),
+			Country: countryName(session.country),
+			Source:  models.SourceImport,
+		},
+		url:      url,
+		referrer: referrer,
+		at:       at,
+	})
+}
+
+// Finish stores the page views still waiting and returns what the import
+// did.
+func (u *UmamiImporter) Finish() (Summary, error) {
+	if u.writer != nil {
+		if err := u.writer.flush(); err != nil {
+			return u.sum, err
+		}
+	}
+	return u.sum, nil
+}
+
+// parseUmamiTime reads created_at as PostgreSQL and MySQL print it.
+// Times without a zone are UTC, which Umami stores.
+func parseUmamiTime(s string) (time.Time, bool) {
+	for _, layout := range []string{
+		"2006-01-02 15:04:05.999999999-07",
+		"2006-01-02 15:04:05.999999999-07:00",
+		"2006-01-02 15:04:05.999999999",
+		time.RFC3339Nano,
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// unescapeCopy decodes a field of PostgreSQL's COPY text format.
+func unescapeCopy(s string) string {
+	if s == `\N` {
+		return ""
+	}
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(s) && j < i+3 && isHex(s[j]) {
+				j++
+			}
+			if n, err := strconv.ParseUint(s[i+1:j], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i = j - 1
+			} else {
+				b.WriteByte(c)
+			}
+		default:
+			if c >= '0' && c <= '7' {
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				n, _ := strconv.ParseUint(s[i:j], 8, 16)
+				b.WriteByte(byte(n))
+				i = j - 1
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package importer
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
+)
+
+func TestUmamiImporter_ReadDump(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := services.NewSiteService(db).Add("Blog", "blog.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	day := time.Now().UTC().AddDate(0, 0, -3).Format(time.DateOnly)
+	dump := strings.Join([]string{
+		"--",
+		"-- PostgreSQL database dump",
+		"--",
+		"COPY public.session (session_id, website_id, hostname, browser, os, device, screen, language, country, subdivision1, subdivision2, city, created_at) FROM stdin;",
+		"s1\tw1\t\\N\tfirefox\tLinux\tdesktop\t1920x1080\ten-US\tNL\t\\N\t\\N\tAmsterdam\t" + day + " 09:59:00+00",
+		"\\.",
+		"",
+		"COPY public.website (website_id, name, domain, share_id, created_at) FROM stdin;",
+		"w1\tBlog\tblog.example.com\t\\N\t2023-01-01 00:00:00+00",
+		"\\.",
+		"",
+		"COPY public.website_event (event_id, website_id, session_id, created_at, url_path, url_query, referrer_path, referrer_query, referrer_domain, page_title, event_type, event_name) FROM stdin;",
+		"e1\tw1\ts1\t" + day + " 10:00:00.123+00\t/post\tref=rss\t/item\t\\N\tnews.example.org\tA post\\twith a tab\t1\t\\N",
+		"e2\tw1\ts1\t" + day + " 10:01:00+00\t/post\t\\N\t\\N\t\\N\t\\N\tA post\t2\tsignup",
+		"e3\tw1\ts1\t" + day + " 10:02:00+00\t/about\t\\N\t\\N\t\\N\t\\N\tAbout\t1\t\\N",
+		"e4\tw1\ts1\t2001-01-01 00:00:00+00\t/old\t\\N\t\\N\t\\N\t\\N\tOld\t1\t\\N",
+		"\\.",
+	}, "\n")
+
+	im := &UmamiImporter{DB: db, Since: time.Now().AddDate(0, 0, -90)}
+	if err := im.ReadDump(strings.NewReader(dump)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	sum, err := im.Finish()
+	if err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	want := Summary{Lines: 4, Imported: 2, NotPageviews: 1, TooOld: 1}
+	if sum != want {
+		t.Fatalf("expected %+v, got %+v", want, sum)
+	}
+
+	var post models.Analytics
+	if err := db.Where("url = ?", "https://blog.example.com/post?ref=rss").First(&post).Error; err != nil {
+		t.Fatalf("expected the page view to be stored: %v", err)
+	}
+	if post.IPHash != models.HashIP("umami:s1") || post.Source != models.SourceImport || post.SiteID == nil {
+		t.Fatalf("unexpected page view %+v", post)
+	}
+	if post.Country != "Netherlands" || post.Referrer != "https://news.example.org/item" {
+		t.Fatalf("unexpected page view %+v", post)
+	}
+	if post.CreatedAt.UTC().Hour() != 10 || post.BotScore != 0 {
+		t.Fatalf("unexpected page view %+v", post)
+	}
+}
+
+func TestUmamiImporter_ReadCSV(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+	until := now.Add(-time.Hour)
+	im := &UmamiImporter{DB: db, Host: "example.com", Until: until}
+
+	if err := im.ReadCSV(UmamiSessions, strings.NewReader("session_id,website_id,country\ns1,w1,DE\n")); err != nil {
+		t.Fatal(err)
+	}
+	events := "event_id,website_id,session_id,created_at,url_path,url_query,referrer_domain,event_type\n" +
+		"e1,w1,s1," + now.Add(-2*time.Hour).Format("2006-01-02 15:04:05") + ",/,NULL,NULL,1\n" +
+		"e2,w1,s1," + now.Format("2006-01-02 15:04:05") + ",/later,NULL,NULL,1\n"
+	if err := im.ReadCSV(UmamiEvents, strings.NewReader(events)); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := im.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.Imported != 1 || sum.Overlapping != 1 {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+
+	var a models.Analytics
+	if err := db.First(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.URL != "https://example.com/" || a.Country != "Germany" {
+		t.Fatalf("unexpected page view %+v", a)
+	}
+}
+
+func TestUnescapeCopy(t *testing.T) {
+	for in, want := range map[string]string{
+		`plain`:     "plain",
+		`\N`:        "",
+		`a\tb\\c`:   "a\tb\\c",
+		`\101\x42`:  "AB",
+		`trailing\`: `trailing\`,
+	} {
+		if got := unescapeCopy(in); got != want {
+			t.Fatalf("unescapeCopy(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package ingest defines the tracking event accepted by /event and
+// decodes it strictly.
+//
+// An event is a JSON object:
+//
+//	{
+//	  "v": 2,                 // schema version; may be omitted for 1
+//	  "type": "pageview",     // pageview, heartbeat or event (v2)
+//	  "url": "https://...",   // required, the page being viewed
+//	  "referrer": "https://...",
+//	  "dwellTime": 42,        // seconds on the page, >= 0
+//	  "activeTime": 30,       // seconds of activity, >= 0
+//	  "scrollDepth": 80,      // percent, 0-100
+//	  "final": false,         // true when the page is being left
+//	  "name": "signup",       // custom events only (v2)
+//	  "props": {"plan": "pro"}
+//	}
+//
+// Version 1 has no type, name or props; every v1 event is a page view.
+// Unknown fields are rejected, so typos surface instead of being dropped.
+// Batches are JSON arrays of events.
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// SchemaVersion is the newest event version this build understands.
+const SchemaVersion = 2
+
+// Event types.
+const (
+	TypePageview  = "pageview"
+	TypeHeartbeat = "heartbeat"
+	TypeCustom    = "event"
+)
+
+// Limits on custom events.
+const (
+	MaxNameLength = 64
+	MaxProps      = 20
+	MaxPropKey    = 64
+	MaxPropValue  = 256
+)
+
+// MaxDwellTime caps dwell and active time, in seconds. Longer values come
+// from tabs left open for days and would skew averages.
+const MaxDwellTime = 24 * 60 * 60
+
+// Event is one report from the tracker.
+type Event struct {
+	V           int               `json:"v"`
+	Type        string            `json:"type"`
+	URL         string            `json:"url"`
+	Referrer    string            `json:"referrer"`
+	DwellTime   int               `json:"dwellTime"`
+	ActiveTime  int               `json:"activeTime"`
+	ScrollDepth int               `json:"scrollDepth"`
+	Final       bool              `json:"final"`
+	Name        string            `json:"name"`
+	Props       map[string]string `json:"props"`
+}
+
+var (
+	// ErrMalformed is returned for bodies that aren't a single JSON
+	// object, or for batches, a JSON array.
+	ErrMalformed = errors.New("malformed event")
+	// ErrBatchTooLarge is returned for batches with too many events.
+	ErrBatchTooLarge = errors.New("too many events in batch")
+)
+
+// FieldError describes why one field was refused.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field that failed.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "invalid event: " + strings.Join(msgs, "; ")
+}
+
+// Decode parses and validates an event. Malformed JSON wraps ErrMalformed;
+// well-formed events with bad fields return a *ValidationError. Values
+// that are merely out of range, like a scroll depth of 120, are clamped.
+func Decode(body []byte) (*Event, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+
+	var ev Event
+	if err := dec.Decode(&ev); err != nil {
+		return nil, decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: unexpected data after the event", ErrMalformed)
+	}
+
+	if err := ev.validate(); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// Pageview returns a validated page view of url, for reports that don't
+// arrive as JSON, such as the tracking pixel.
+func Pageview(url, referrer string) (*Event, error) {
+	ev := &Event{V: SchemaVersion, Type: TypePageview, URL: url, Referrer: referrer}
+	if err := ev.validate(); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// DecodeBatch splits a batch, a JSON array of events, into its items
+// without decoding them, so each one can be accepted or refused on its
+// own. Batches over max items return ErrBatchTooLarge.
+func DecodeBatch(body []byte, max int) ([]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+
+	var items []json.RawMessage
+	if err := dec.Decode(&items); err != nil {
+		return nil, fmt.Errorf("%w: expected a JSON array of events", ErrMalformed)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: unexpected data after the batch", ErrMalformed)
+	}
+	if max > 0 && len(items) > max {
+		return nil, fmt.Errorf("%w: %d events, at most %d allowed", ErrBatchTooLarge, len(items), max)
+	}
+	return items, nil
+}
+
+// decodeError turns encoding/json errors that concern a single field into
+// a ValidationError.
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "" {
+			return fmt.Errorf("%w: expected a JSON object", ErrMalformed)
+		}
+		return &ValidationError{Fields: []FieldError{{
+			Field:   typeErr.Field,
+			Message: "must be a " + jsonType(typeErr.Type.Kind().String()),
+		}}}
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &ValidationError{Fields: []FieldError{{Field: strings.Trim(field, `"`), Message: "is not part of the schema"}}}
+	}
+	return fmt.Errorf("%w: %v", ErrMalformed, err)
+}
+
+func jsonType(kind string) string {
+	switch kind {
+	case "int", "int64":
+		return "whole number"
+	case "bool":
+		return "boolean"
+	default:
+		return kind
+	}
+}
+
+func (ev *Event) validate() error {
+	var fields []FieldError
+	fail := func(field, msg string) {
+		fields = append(fields, FieldError{Field: field, Message: msg})
+	}
+
+	switch {
+	case ev.V == 0:
+		ev.V = 1
+	case ev.V < 0 || ev.V > SchemaVersion:
+		fail("v", fmt.Sprintf("unsupported version, expected 1 to %d", SchemaVersion))
+	}
+
+	if ev.V == 1 && (ev.Type != "" || ev.Name != "" || ev.Props != nil) {
+		fail("v", "type, name and props require version 2")
+	}
+	if ev.Type == "" {
+		ev.Type = TypePageview
+	}
+
+	switch ev.Type {
+	case TypePageview, TypeHeartbeat:
+		if ev.Name != "" {
+			fail("name", "is only allowed for custom events")
+		}
+		if ev.Props != nil {
+			fail("props", "are only allowed for custom events")
+		}
+	case TypeCustom:
+		if ev.Name == "" {
+			fail("name", "is required for custom events")
+		} else if len(ev.Name) > MaxNameLength {
+			fail("name", fmt.Sprintf("must be at most %d bytes", MaxNameLength))
+		}
+		if len(ev.Props) > MaxProps {
+			fail("props", fmt.Sprintf("must have at most %d entries", MaxProps))
+		}
+		for k, v := range ev.Props {
+			if k == "" || len(k) > MaxPropKey || len(v) > MaxPropValue {
+				fail("props", fmt.Sprintf("keys must be 1 to %d bytes and values at most %d", MaxPropKey, MaxPropValue))
+				break
+			}
+		}
+	default:
+		fail("type", "must be pageview, heartbeat or event")
+	}
+
+	if strings.TrimSpace(ev.URL) == "" {
+		fail("url", "is required")
+	}
+	if ev.DwellTime < 0 {
+		fail("dwellTime", "must not be negative")
+	}
+	if ev.ActiveTime < 0 {
+		fail("activeTime", "must not be negative")
+	}
+	if ev.ScrollDepth < 0 {
+		fail("scrollDepth", "must not be negative")
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+
+	ev.DwellTime = min(ev.DwellTime, MaxDwellTime)
+	ev.ActiveTime = min(ev.ActiveTime, ev.DwellTime)
+	ev.ScrollDepth = min(ev.ScrollDepth, 100)
+	return nil
+}
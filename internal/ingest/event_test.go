@@ -0,0 +1,186 @@
+package ingest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		want   Event
+		fields []string
+		err    error
+	}{
+		{
+			name: "version 1",
+			body: `{"v":1,"url":"https://example.com/","referrer":"https://ref.example/","dwellTime":40,"activeTime":25,"scrollDepth":70,"final":true}`,
+			want: Event{V: 1, Type: TypePageview, URL: "https://example.com/", Referrer: "https://ref.example/", DwellTime: 40, ActiveTime: 25, ScrollDepth: 70, Final: true},
+		},
+		{
+			name: "version defaults to 1",
+			body: `{"url":"https://example.com/"}`,
+			want: Event{V: 1, Type: TypePageview, URL: "https://example.com/"},
+		},
+		{
+			name: "out of range values are clamped",
+			body: `{"url":"/a","dwellTime":999999,"activeTime":999999,"scrollDepth":180}`,
+			want: Event{V: 1, Type: TypePageview, URL: "/a", DwellTime: MaxDwellTime, ActiveTime: MaxDwellTime, ScrollDepth: 100},
+		},
+		{
+			name: "active time never exceeds dwell time",
+			body: `{"url":"/a","dwellTime":5,"activeTime":9}`,
+			want: Event{V: 1, Type: TypePageview, URL: "/a", DwellTime: 5, ActiveTime: 5},
+		},
+		{
+			name: "custom event",
+			body: `{"v":2,"type":"event","url":"/pricing","name":"signup","props":{"plan":"pro"}}`,
+			want: Event{V: 2, Type: TypeCustom, URL: "/pricing", Name: "signup", Props: map[string]string{"plan": "pro"}},
+		},
+		{
+			name: "heartbeat",
+			body: `{"v":2,"type":"heartbeat","url":"/a","dwellTime":30}`,
+			want: Event{V: 2, Type: TypeHeartbeat, URL: "/a", DwellTime: 30},
+		},
+		{name: "type needs version 2", body: `{"v":1,"type":"event","url":"/a","name":"x"}`, fields: []string{"v"}},
+		{name: "unknown type", body: `{"v":2,"type":"click","url":"/a"}`, fields: []string{"type"}},
+		{name: "custom event without name", body: `{"v":2,"type":"event","url":"/a"}`, fields: []string{"name"}},
+		{name: "props on a page view", body: `{"v":2,"url":"/a","props":{"a":"b"}}`, fields: []string{"props"}},
+		{name: "non-string prop", body: `{"v":2,"type":"event","url":"/a","name":"x","props":{"n":1}}`, fields: []string{"props.n"}},
+		{
+			name:   "negative values",
+			body:   `{"url":"/a","dwellTime":-1,"activeTime":-2,"scrollDepth":-3}`,
+			fields: []string{"dwellTime", "activeTime", "scrollDepth"},
+		},
+		{name: "missing url", body: `{"dwellTime":3}`, fields: []string{"url"}},
+		{name: "future version", body: `{"v":3,"url":"/a"}`, fields: []string{"v"}},
+		{name: "unknown field", body: `{"url":"/a","scroll":50}`, fields: []string{"scroll"}},
+		{name: "wrong type", body: `{"url":"/a","dwellTime":"12"}`, fields: []string{"dwellTime"}},
+		{name: "fractional number", body: `{"url":"/a","scrollDepth":12.5}`, fields: []string{"scrollDepth"}},
+		{name: "not json", body: `not-json`, err: ErrMalformed},
+		{name: "json in a string", body: `"{\"url\":\"/a\"}"`, err: ErrMalformed},
+		{name: "array", body: `[{"url":"/a"}]`, err: ErrMalformed},
+		{name: "trailing data", body: `{"url":"/a"}{"url":"/b"}`, err: ErrMalformed},
+		{name: "truncated", body: `{"url":"/a"`, err: ErrMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := Decode([]byte(tt.body))
+
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("expected %v, got %v", tt.err, err)
+				}
+				return
+			}
+
+			if tt.fields != nil {
+				var verr *ValidationError
+				if !errors.As(err, &verr) {
+					t.Fatalf("expected a validation error, got %v", err)
+				}
+				var got []string
+				for _, f := range verr.Fields {
+					got = append(got, f.Field)
+				}
+				if strings.Join(got, ",") != strings.Join(tt.fields, ",") {
+					t.Fatalf("expected errors for %v, got %v", tt.fields, verr.Fields)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(*ev, tt.want) {
+				t.Fatalf("expected %+v, got %+v", tt.want, *ev)
+			}
+		})
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	items, err := DecodeBatch([]byte(` [{"url":"/a"}, "junk", {"url":"/b"}] `), 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 3 || string(items[1]) != `"junk"` {
+		t.Fatalf("expected the three raw items, got %q", items)
+	}
+
+	if _, err := DecodeBatch([]byte(`[{},{},{},{}]`), 3); !errors.Is(err, ErrBatchTooLarge) {
+		t.Fatalf("expected ErrBatchTooLarge, got %v", err)
+	}
+	for _, body := range []string{`{"url":"/a"}`, `[{"url":"/a"}`, `[] []`, ``} {
+		if _, err := DecodeBatch([]byte(body), 3); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("expected ErrMalformed for %q, got %v", body, err)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		`{"v":1,"url":"https://example.com/","referrer":"","dwellTime":40,"activeTime":25,"scrollDepth":70,"final":true}`,
+		`{"url":"/a","dwellTime":-1}`,
+		`{"url":"/a","scrollDepth":1e9}`,
+		`{"url":"/a","extra":{}}`,
+		`{"v":2,"type":"event","url":"/a","name":"signup","props":{"plan":"pro"}}`,
+		`{"v":1,"type":"heartbeat","url":"/a"}`,
+		`"{\"url\":\"/a\"}"`,
+		`{"url":"/a"} trailing`,
+		`null`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		ev, err := Decode(body)
+		if err != nil {
+			if ev != nil {
+				t.Fatal("an event was returned with an error")
+			}
+			var verr *ValidationError
+			if !errors.Is(err, ErrMalformed) && !(errors.As(err, &verr) && len(verr.Fields) > 0) {
+				t.Fatalf("unexpected error type %T: %v", err, err)
+			}
+			return
+		}
+
+		if ev.V < 1 || ev.V > SchemaVersion {
+			t.Fatalf("accepted version %d", ev.V)
+		}
+		if strings.TrimSpace(ev.URL) == "" {
+			t.Fatal("accepted an event without a url")
+		}
+		switch ev.Type {
+		case TypePageview, TypeHeartbeat:
+			if ev.Name != "" || ev.Props != nil {
+				t.Fatal("accepted a name or props outside a custom event")
+			}
+		case TypeCustom:
+			if ev.V < 2 || ev.Name == "" || len(ev.Name) > MaxNameLength || len(ev.Props) > MaxProps {
+				t.Fatalf("accepted an invalid custom event %+v", ev)
+			}
+		default:
+			t.Fatalf("accepted type %q", ev.Type)
+		}
+		if ev.DwellTime < 0 || ev.DwellTime > MaxDwellTime {
+			t.Fatalf("dwell time %d out of range", ev.DwellTime)
+		}
+		if ev.ActiveTime < 0 || ev.ActiveTime > ev.DwellTime {
+			t.Fatalf("active time %d out of range", ev.ActiveTime)
+		}
+		if ev.ScrollDepth < 0 || ev.ScrollDepth > 100 {
+			t.Fatalf("scroll depth %d out of range", ev.ScrollDepth)
+		}
+		if utf8.Valid(body) && !utf8.ValidString(ev.URL) {
+			t.Fatal("decoding produced invalid UTF-8")
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/webbesoft/doorman/internal/mailtest"
+)
+
+func TestSMTP_Send(t *testing.T) {
+	server := mailtest.NewServer(t)
+	server.RequireAuth("reports", "hunter2")
+
+	m, err := NewSMTP(server.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(context.Background(), Message{
+		To:      "Ada <ada@example.org>",
+		Subject: "Wöchentlicher Bericht",
+		Text:    "Visitors: 12\nA line long enough that quoted-printable has to wrap it somewhere past the seventy-sixth column.\n",
+		HTML:    "<p>Visitors: <b>12</b></p>",
+	})
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	msgs := server.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	msg := msgs[0]
+	if msg.From != "doorman@example.com" || len(msg.To) != 1 || msg.To[0] != "ada@example.org" {
+		t.Fatalf("unexpected envelope %q to %q", msg.From, msg.To)
+	}
+	if got := msg.Header("Subject"); got != "Wöchentlicher Bericht" {
+		t.Fatalf("unexpected subject %q", got)
+	}
+	if got := msg.Header("To"); got != `"Ada" <ada@example.org>` {
+		t.Fatalf("unexpected To header %q", got)
+	}
+	if got := msg.Part("text/plain"); !strings.Contains(got, "wrap it somewhere past the seventy-sixth column.\n") {
+		t.Fatalf("unexpected text part %q", got)
+	}
+	if got := msg.Part("text/html"); got != "<p>Visitors: <b>12</b></p>" {
+		t.Fatalf("unexpected html part %q", got)
+	}
+
+	if err := m.Send(context.Background(), Message{To: "ada@example.org", Subject: "Plain", Text: "Only text"}); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	if got := server.Messages()[1].Part("text/plain"); got != "Only text\n" {
+		t.Fatalf("unexpected body %q", got)
+	}
+}
+
+func TestSMTP_SendFailures(t *testing.T) {
+	server := mailtest.NewServer(t)
+	server.RequireAuth("reports", "hunter2")
+
+	cfg := server.Config()
+	cfg.Password = "wrong"
+	m, _ := NewSMTP(cfg)
+	if err := m.Send(context.Background(), Message{To: "ada@example.org", Text: "hi"}); err == nil {
+		t.Fatal("expected a wrong password to be refused")
+	}
+
+	m, _ = NewSMTP(server.Config())
+	server.Reject("no such user")
+	err := m.Send(context.Background(), Message{To: "ada@example.org", Text: "hi"})
+	if err == nil || !strings.Contains(err.Error(), "no such user") {
+		t.Fatalf("expected the recipient to be refused, got %v", err)
+	}
+	if err := m.Send(context.Background(), Message{To: "ada@example.org\r\nBcc: eve@example.org", Text: "hi"}); err == nil {
+		t.Fatal("expected a recipient with a line break to be refused")
+	}
+
+	cfg = server.Config()
+	cfg.TLS = "starttls"
+	m, _ = NewSMTP(cfg)
+	server.Reject("")
+	if err := m.Send(context.Background(), Message{To: "ada@example.org", Text: "hi"}); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected a server without STARTTLS to be refused, got %v", err)
+	}
+	if len(server.Messages()) != 0 {
+		t.Fatalf("expected nothing to be delivered, got %d messages", len(server.Messages()))
+	}
+}
@@ -0,0 +1,258 @@
+// Package mailtest runs a minimal SMTP server for tests. It accepts every
+// message, after AUTH PLAIN if asked to, and keeps it for the test to look
+// at.
+package mailtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+// Message is a message the server accepted.
+type Message struct {
+	From string
+	To   []string
+	Data []byte
+}
+
+// Header returns the decoded value of the message header name.
+func (m Message) Header(name string) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return ""
+	}
+	value, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get(name))
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// Part returns the decoded body of the part of type mediaType, such as
+// text/plain, or the whole body of a message that isn't multipart and has
+// that type.
+func (m Message) Part(mediaType string) string {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return ""
+	}
+	typ, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	if !strings.HasPrefix(typ, "multipart/") {
+		if typ != mediaType {
+			return ""
+		}
+		return decode(msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		// NextPart undoes quoted-printable encoding itself.
+		p, err := mr.NextPart()
+		if err != nil {
+			return ""
+		}
+		if typ, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type")); typ == mediaType {
+			return decode(p.Header.Get("Content-Transfer-Encoding"), p)
+		}
+	}
+}
+
+func decode(encoding string, r io.Reader) string {
+	if strings.EqualFold(encoding, "quoted-printable") {
+		r = quotedprintable.NewReader(r)
+	}
+	b, _ := io.ReadAll(r)
+	return strings.ReplaceAll(string(b), "\r\n", "\n")
+}
+
+// Server is an SMTP server on a local port.
+type Server struct {
+	Host string
+	Port int
+
+	mu       sync.Mutex
+	username string
+	password string
+	messages []Message
+	reject   string
+}
+
+// NewServer starts a server that is closed when the test ends.
+func NewServer(t *testing.T) *Server {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().(*net.TCPAddr)
+	s := &Server{Host: addr.IP.String(), Port: addr.Port}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// RequireAuth makes the server accept mail only after AUTH PLAIN with
+// username and password.
+func (s *Server) RequireAuth(username, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.username, s.password = username, password
+}
+
+// Config returns mail settings that send through the server.
+func (s *Server) Config() config.MailConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return config.MailConfig{
+		Host:     s.Host,
+		Port:     s.Port,
+		TLS:      "none",
+		Username: s.username,
+		Password: s.password,
+		From:     "Doorman <doorman@example.com>",
+	}
+}
+
+// Messages returns the messages accepted so far.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Reject makes the server refuse recipients with reason; an empty reason
+// accepts them again.
+func (s *Server) Reject(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reject = reason
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	s.mu.Lock()
+	username, password := s.username, s.password
+	s.mu.Unlock()
+
+	var msg Message
+	authed := username == ""
+	reply := func(code int, text string) bool {
+		return tp.PrintfLine("%d %s", code, text) == nil
+	}
+
+	reply(220, "mailtest ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			if username != "" {
+				tp.PrintfLine("250-mailtest")
+				reply(250, "AUTH PLAIN")
+			} else {
+				reply(250, "mailtest")
+			}
+		case "HELO", "NOOP":
+			reply(250, "OK")
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			if !strings.EqualFold(mech, "PLAIN") {
+				reply(504, "Unrecognized authentication type")
+				continue
+			}
+			if initial == "" {
+				reply(334, "")
+				if initial, err = tp.ReadLine(); err != nil {
+					return
+				}
+			}
+			creds, _ := base64.StdEncoding.DecodeString(initial)
+			if string(creds) != "\x00"+username+"\x00"+password {
+				reply(535, "Authentication credentials invalid")
+				continue
+			}
+			authed = true
+			reply(235, "Authentication successful")
+		case "MAIL":
+			if !authed {
+				reply(530, "Authentication required")
+				continue
+			}
+			msg = Message{From: address(arg)}
+			reply(250, "OK")
+		case "RCPT":
+			s.mu.Lock()
+			reason := s.reject
+			s.mu.Unlock()
+			if reason != "" {
+				reply(550, reason)
+				continue
+			}
+			msg.To = append(msg.To, address(arg))
+			reply(250, "OK")
+		case "DATA":
+			if len(msg.To) == 0 {
+				reply(503, "Need RCPT first")
+				continue
+			}
+			reply(354, "End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = data
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			msg = Message{}
+			reply(250, "OK: queued as "+strconv.Itoa(len(s.Messages())))
+		case "RSET":
+			msg = Message{}
+			reply(250, "OK")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			reply(502, "Command not implemented")
+		}
+	}
+}
+
+// address takes the address out of "FROM:<a@example.com>" or
+// "TO:<a@example.com>".
+func address(arg string) string {
+	_, addr, _ := strings.Cut(arg, ":")
+	addr, _, _ = strings.Cut(strings.TrimSpace(addr), " ")
+	return strings.Trim(addr, "<>")
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every Doorman collector. A dedicated registry keeps the
+// /metrics output limited to what we register here.
+var Registry = prometheus.NewRegistry()
+
+var (
+	EventsIngested = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "events_ingested_total",
+		Help:      "Tracking events accepted and persisted.",
+	})
+
+	EventsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "events_rejected_total",
+		Help:      "Tracking events rejected, by reason.",
+	}, []string{"reason"})
+
+	BotDetections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "bot_detections_total",
+		Help:      "Visits flagged as bots, by detection source.",
+	}, []string{"source"})
+
+	GeoLookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "doorman",
+		Name:      "geo_lookup_duration_seconds",
+		Help:      "Latency of upstream geolocation lookups.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2, 5},
+	})
+
+	GeoLookupErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "geo_lookup_errors_total",
+		Help:      "Failed upstream geolocation lookups.",
+	})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "doorman",
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of database operations, by operation type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	CleanupRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "cleanup_runs_total",
+		Help:      "Retention cleanup runs, by result.",
+	}, []string{"result"})
+
+	CleanupDeletedRows = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "cleanup_deleted_rows_total",
+		Help:      "Rows removed by retention cleanup.",
+	})
+
+	CleanupLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "doorman",
+		Name:      "cleanup_last_run_timestamp_seconds",
+		Help:      "Unix time of the last retention cleanup run.",
+	})
+
+	SinkEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "doorman",
+		Name:      "sink_events_total",
+		Help:      "Events handled by the event sink by result, counted per endpoint except when dropped.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		EventsIngested,
+		EventsRejected,
+		BotDetections,
+		GeoLookupDuration,
+		GeoLookupErrors,
+		DBQueryDuration,
+		CleanupRuns,
+		CleanupDeletedRows,
+		CleanupLastRun,
+		SinkEvents,
+	)
+}
+
+// Handler serves the registry in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// RejectEvent records a rejected tracking event.
+func RejectEvent(reason string) {
+	EventsRejected.WithLabelValues(reason).Inc()
+}
+
+// ObserveCleanup records the outcome of a retention cleanup run.
+func ObserveCleanup(deleted int64, err error) {
+	CleanupLastRun.Set(float64(time.Now().Unix()))
+	if err != nil {
+		CleanupRuns.WithLabelValues("failure").Inc()
+		return
+	}
+	CleanupRuns.WithLabelValues("success").Inc()
+	CleanupDeletedRows.Add(float64(deleted))
+}
@@ -5,14 +5,68 @@ import (
 
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/services"
 )
 
-func RequireAuth(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		sess, _ := session.Get("session", c)
-		if sess.Values["user_id"] == nil {
-			return c.Redirect(http.StatusFound, "/login")
+const userKey = "user"
+
+// RequireAuth loads the signed-in user from the session and stores it on
+// the context. Missing, disabled or not yet activated users are sent to
+// the login page. With proxy set, a user named by a trusted proxy is
+// signed in (and created if needed) without a session.
+func RequireAuth(db *gorm.DB, proxy *ProxyAuth) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if username := proxy.Username(c.Request()); username != "" {
+				user, err := services.NewUserService(db).ProvisionProxyUser(username, proxy.DefaultRole)
+				if err != nil {
+					return err
+				}
+				if user.Disabled {
+					return echo.NewHTTPError(http.StatusForbidden, "This account has been disabled")
+				}
+				c.Set(userKey, user)
+				return next(c)
+			}
+
+			sess, _ := session.Get("session", c)
+			userID, ok := sess.Values["user_id"].(uint)
+			if !ok {
+				return c.Redirect(http.StatusFound, "/login")
+			}
+
+			var user models.User
+			if err := db.First(&user, userID).Error; err != nil || user.Disabled || user.InvitePending() {
+				sess.Values = make(map[interface{}]interface{})
+				sess.Save(c.Request(), c.Response())
+				return c.Redirect(http.StatusFound, "/login?error=expired")
+			}
+
+			c.Set(userKey, &user)
+			return next(c)
 		}
-		return next(c)
 	}
 }
+
+// RequireRole rejects users whose role is below role. It must run after
+// RequireAuth.
+func RequireRole(role string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user := CurrentUser(c)
+			if user == nil || !user.HasRole(role) {
+				return echo.NewHTTPError(http.StatusForbidden, "You don't have access to this page")
+			}
+			return next(c)
+		}
+	}
+}
+
+// CurrentUser returns the user set by RequireAuth, or nil.
+func CurrentUser(c echo.Context) *models.User {
+	user, _ := c.Get(userKey).(*models.User)
+	return user
+}
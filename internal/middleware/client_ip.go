@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+// NewIPExtractor returns how c.RealIP finds the client address. Headers
+// are only read when the direct peer is a trusted proxy; otherwise, and in
+// the default direct mode, the peer address is the client.
+func NewIPExtractor(cfg config.ProxyConfig) (echo.IPExtractor, error) {
+	trusted, err := cfg.TrustedNets()
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.CanonicalHeaderKey(cfg.ClientIPHeader)
+	return func(r *http.Request) string {
+		peer := peerIP(r)
+		if header == "" || peer == nil || !contains(trusted, peer) {
+			return ipString(peer, r.RemoteAddr)
+		}
+
+		var client net.IP
+		switch header {
+		case "X-Forwarded-For":
+			client = lastUntrusted(splitList(r.Header.Values(header)), trusted, parseIP)
+		case "Forwarded":
+			client = lastUntrusted(splitList(r.Header.Values(header)), trusted, forwardedFor)
+		default:
+			client = parseIP(r.Header.Get(header))
+		}
+		if client == nil {
+			return peer.String()
+		}
+		return client.String()
+	}, nil
+}
+
+// lastUntrusted walks a proxy chain from the nearest hop back and returns
+// the first address that isn't a trusted proxy; earlier entries could
+// have been written by the client. An unparseable hop ends the walk.
+func lastUntrusted(hops []string, trusted []*net.IPNet, parse func(string) net.IP) net.IP {
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = parse(hops[i])
+		if ip == nil || !contains(trusted, ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// forwardedFor returns the for= address of one RFC 7239 Forwarded element,
+// e.g. `for=192.0.2.60;proto=https` or `for="[2001:db8::17]:4711"`.
+func forwardedFor(element string) net.IP {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "for") {
+			return parseIP(strings.Trim(value, `"`))
+		}
+	}
+	return nil
+}
+
+// parseIP accepts an address with or without a port or IPv6 brackets.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+func peerIP(r *http.Request) net.IP {
+	return parseIP(r.RemoteAddr)
+}
+
+func ipString(ip net.IP, fallback string) string {
+	if ip == nil {
+		return fallback
+	}
+	return ip.String()
+}
+
+func splitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+func TestNewIPExtractor(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "2001:db8:ffff::/48"}
+
+	tests := []struct {
+		name    string
+		header  string
+		peer    string
+		headers map[string]string
+		want    string
+	}{
+		{"direct ignores headers", "", "192.0.2.10:1234", map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"}, "192.0.2.10"},
+		{"xff from untrusted peer", "X-Forwarded-For", "192.0.2.10:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "192.0.2.10"},
+		{"xff from trusted proxy", "X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"}, "198.51.100.1"},
+		{"xff spoofed prefix", "X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "203.0.113.66, 198.51.100.1"}, "198.51.100.1"},
+		{"xff skips proxy chain", "X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.1, 10.0.0.9"}, "198.51.100.1"},
+		{"xff garbage", "X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "not-an-ip"}, "10.0.0.2"},
+		{"real ip", "X-Real-IP", "10.0.0.2:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "198.51.100.1"},
+		{"real ip from untrusted peer", "X-Real-IP", "192.0.2.10:1234", map[string]string{"X-Real-IP": "198.51.100.1"}, "192.0.2.10"},
+		{"cloudflare", "CF-Connecting-IP", "10.0.0.2:1234", map[string]string{"CF-Connecting-IP": "198.51.100.1", "X-Forwarded-For": "203.0.113.66"}, "198.51.100.1"},
+		{"forwarded", "Forwarded", "10.0.0.2:1234", map[string]string{"Forwarded": `for=203.0.113.66, for=198.51.100.1;proto=https;by=10.0.0.2`}, "198.51.100.1"},
+		{"forwarded ipv6", "Forwarded", "[2001:db8:ffff::1]:443", map[string]string{"Forwarded": `For="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded obfuscated", "Forwarded", "10.0.0.2:1234", map[string]string{"Forwarded": "for=_hidden"}, "10.0.0.2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extract, err := NewIPExtractor(config.ProxyConfig{Trusted: trusted, ClientIPHeader: tt.header})
+			if err != nil {
+				t.Fatalf("NewIPExtractor: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/event", nil)
+			req.RemoteAddr = tt.peer
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := extract(req); got != tt.want {
+				t.Fatalf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ingestPaths receive events from tracked sites, which are cross-origin.
+var ingestPaths = []string{"/event", "/event/batch", "/p.gif"}
+
+// IngestCORS allows any origin to use the ingestion endpoints. Every
+// other route gets no CORS headers, so browsers keep the dashboard
+// same-origin.
+func IngestCORS() echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		Skipper: func(c echo.Context) bool {
+			return !matchPath(c.Request().URL.Path, ingestPaths)
+		},
+		AllowOrigins: []string{"*"},
+		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodOptions},
+	})
+}
+
+// matchPath reports whether path is one of paths, treating entries that
+// end in a slash as prefixes.
+func matchPath(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
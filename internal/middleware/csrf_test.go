@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+func newTestServer() *echo.Echo {
+	e := echo.New()
+	e.Use(IngestCORS())
+	e.Use(CSRF(config.SessionConfig{CookieSameSite: "lax"}))
+
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, CSRFToken(c)) }
+	e.GET("/login", ok)
+	e.POST("/login", ok)
+	e.POST("/users/invite", ok)
+	e.POST("/event", ok)
+	return e
+}
+
+func serve(e *echo.Echo, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCSRF(t *testing.T) {
+	e := newTestServer()
+
+	page := serve(e, httptest.NewRequest(http.MethodGet, "/login", nil))
+	token := page.Body.String()
+	if token == "" {
+		t.Fatal("expected a token on GET")
+	}
+	cookies := page.Result().Cookies()
+
+	post := func(path, formToken, headerToken string) int {
+		form := url.Values{"username": {"admin"}}
+		if formToken != "" {
+			form.Set(CSRFField, formToken)
+		}
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		if headerToken != "" {
+			req.Header.Set(CSRFHeader, headerToken)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return serve(e, req).Code
+	}
+
+	if code := post("/users/invite", "", ""); code == http.StatusOK {
+		t.Fatal("expected a POST without a token to be rejected")
+	}
+	if code := post("/users/invite", "forged", ""); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong token, got %d", code)
+	}
+	if code := post("/users/invite", token, ""); code != http.StatusOK {
+		t.Fatalf("expected form token to be accepted, got %d", code)
+	}
+	if code := post("/login", "", token); code != http.StatusOK {
+		t.Fatalf("expected header token to be accepted, got %d", code)
+	}
+
+	// The ingestion endpoint is posted to from other origins without cookies.
+	cookies = nil
+	if code := post("/event", "", ""); code != http.StatusOK {
+		t.Fatalf("expected /event to be exempt, got %d", code)
+	}
+}
+
+func TestIngestCORS(t *testing.T) {
+	e := newTestServer()
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/event", nil)
+	preflight.Header.Set(echo.HeaderOrigin, "https://example.com")
+	preflight.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPost)
+	rec := serve(e, preflight)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 preflight, got %d", rec.Code)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "*" {
+		t.Fatalf("expected /event to allow any origin, got %q", got)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/login", nil)
+	req.Header.Set(echo.HeaderOrigin, "https://example.com")
+	rec = serve(e, req)
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "" {
+		t.Fatalf("expected no CORS headers on dashboard routes, got %q", got)
+	}
+}
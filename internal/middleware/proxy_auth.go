@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+// ProxyAuth reads the user an authenticating reverse proxy (oauth2-proxy,
+// Authelia, ...) signed in. The header is only believed when the request's
+// direct peer is a trusted proxy, never based on forwarded addresses.
+type ProxyAuth struct {
+	Header      string
+	Trusted     []*net.IPNet
+	DefaultRole string
+	LogoutURL   string
+}
+
+// NewProxyAuth returns nil when proxy authentication isn't configured.
+func NewProxyAuth(cfg config.ProxyConfig) (*ProxyAuth, error) {
+	if cfg.AuthHeader == "" {
+		return nil, nil
+	}
+	trusted, err := cfg.TrustedNets()
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyAuth{
+		Header:      cfg.AuthHeader,
+		Trusted:     trusted,
+		DefaultRole: cfg.AuthDefaultRole,
+		LogoutURL:   cfg.AuthLogoutURL,
+	}, nil
+}
+
+// Username returns the user named by a trusted proxy, or "".
+func (p *ProxyAuth) Username(r *http.Request) string {
+	if p == nil {
+		return ""
+	}
+	username := strings.TrimSpace(r.Header.Get(p.Header))
+	if username == "" || !p.fromTrustedProxy(r) {
+		return ""
+	}
+	return username
+}
+
+func (p *ProxyAuth) fromTrustedProxy(r *http.Request) bool {
+	ip := peerIP(r)
+	return ip != nil && contains(p.Trusted, ip)
+}
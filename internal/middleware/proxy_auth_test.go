@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func TestRequireAuth_Proxy(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("failed to open test db: %v", err)
+	}
+	if err := db.AutoMigrate(&models.User{}); err != nil {
+		t.Fatalf("auto migrate failed: %v", err)
+	}
+
+	proxy, err := NewProxyAuth(config.ProxyConfig{
+		Trusted:         []string{"10.0.0.0/8"},
+		AuthHeader:      "X-Forwarded-User",
+		AuthDefaultRole: models.RoleViewer,
+	})
+	if err != nil {
+		t.Fatalf("NewProxyAuth: %v", err)
+	}
+
+	e := echo.New()
+	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secret"))))
+	e.GET("/dashboard", func(c echo.Context) error {
+		return c.String(http.StatusOK, CurrentUser(c).Username)
+	}, RequireAuth(db, proxy))
+
+	request := func(peer, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/dashboard", nil)
+		req.RemoteAddr = peer
+		req.Header.Set("X-Forwarded-User", user)
+		// A client-supplied forwarding header must not make it trusted.
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request("10.1.2.3:4567", "alice")
+	if rec.Code != http.StatusOK || rec.Body.String() != "alice" {
+		t.Fatalf("expected trusted proxy to sign alice in, got %d %q", rec.Code, rec.Body.String())
+	}
+	var alice models.User
+	if err := db.Where("username = ?", "alice").First(&alice).Error; err != nil {
+		t.Fatalf("expected alice to be created: %v", err)
+	}
+	if alice.Role != models.RoleViewer {
+		t.Fatalf("expected default role, got %q", alice.Role)
+	}
+
+	if rec := request("203.0.113.9:4567", "alice"); rec.Code != http.StatusFound {
+		t.Fatalf("expected untrusted peer to be sent to login, got %d", rec.Code)
+	}
+	if rec := request("10.1.2.3:4567", ""); rec.Code != http.StatusFound {
+		t.Fatalf("expected missing header to fall back to the session, got %d", rec.Code)
+	}
+
+	db.Model(&alice).Update("disabled", true)
+	if rec := request("10.1.2.3:4567", "alice"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected disabled user to be refused, got %d", rec.Code)
+	}
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -8,6 +11,7 @@ import (
 
 type Analytics struct {
 	ID        uint   `gorm:"primaryKey" json:"id"`
+	SiteID    *uint  `gorm:"index" json:"site_id,omitempty"`
 	URL       string `gorm:"not null;index" json:"url"`
 	Referrer  string `json:"referrer"`
 	UserAgent string `json:"user_agent"`
@@ -19,15 +23,35 @@ type Analytics struct {
 	BotScore  int    `json:"bot_score"`
 	BotReason string `json:"bot_reason,omitempty"`
 
+	// Source is how the visit was reported, one of the Source constants.
+	Source string `gorm:"not null;default:script" json:"source"`
+
 	PageVisits []PageVisit `gorm:"foreignKey:AnalyticsID"`
 
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// Ways a visit can be reported.
+const (
+	// SourceScript visits come from the t.js tracker, which also reports
+	// dwell time, activity and scrolling.
+	SourceScript = "script"
+	// SourcePixel visits come from the /p.gif tracking pixel.
+	SourcePixel = "pixel"
+	// SourceServer visits are reported by the site's own server with an
+	// API key.
+	SourceServer = "server"
+	// SourceLog visits are imported from web server access logs.
+	SourceLog = "log"
+	// SourceImport visits are imported from another analytics tool.
+	SourceImport = "import"
+)
+
 type PageVisit struct {
 	ID          uint   `gorm:"primaryKey"`
 	AnalyticsID uint   `gorm:"index"`
+	SiteID      *uint  `gorm:"index" json:"site_id,omitempty"`
 	URL         string `gorm:"index"`
 
 	IPHash string `gorm:"index" json:"-"`
@@ -40,6 +64,73 @@ type PageVisit struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// CustomEvent is a named event sent by the site, such as a signup. Props
+// holds the event's properties as a JSON object of strings.
+type CustomEvent struct {
+	ID     uint   `gorm:"primaryKey" json:"id"`
+	SiteID *uint  `gorm:"index" json:"site_id,omitempty"`
+	URL    string `json:"url"`
+	IPHash string `gorm:"index" json:"-"`
+
+	Name  string `gorm:"not null;index" json:"name"`
+	Props string `json:"props,omitempty"`
+
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// BotRuleHit records that a bot detection rule matched a visit. Each rule
+// is recorded once per visit.
+type BotRuleHit struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	AnalyticsID uint   `gorm:"not null;uniqueIndex:idx_bot_rule_hits_analytics_rule" json:"analytics_id"`
+	SiteID      *uint  `gorm:"index" json:"site_id,omitempty"`
+	Rule        string `gorm:"not null;uniqueIndex:idx_bot_rule_hits_analytics_rule;index" json:"rule"`
+
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// BotScore is a visit's bot score after it changed, kept to tune rules
+// and the threshold against. Rules lists the rules that matched.
+type BotScore struct {
+	ID          uint   `gorm:"primaryKey" json:"id"`
+	AnalyticsID uint   `gorm:"not null;index" json:"analytics_id"`
+	SiteID      *uint  `gorm:"index" json:"site_id,omitempty"`
+	Score       int    `json:"score"`
+	IsBot       bool   `json:"is_bot"`
+	Rules       string `json:"rules,omitempty"`
+
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// ImportedStat is a day's figures imported from another analytics tool
+// that only exports aggregates. Kind says what Value is: nothing for the
+// day's totals, or the page URL, referrer or country the figures are for.
+// Importing the same day again replaces its figures.
+type ImportedStat struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	SiteID    uint      `gorm:"not null;uniqueIndex:idx_imported_stats_key" json:"site_id"`
+	Source    string    `gorm:"not null;uniqueIndex:idx_imported_stats_key" json:"source"`
+	Date      time.Time `gorm:"not null;uniqueIndex:idx_imported_stats_key;index" json:"date"`
+	Kind      string    `gorm:"not null;uniqueIndex:idx_imported_stats_key" json:"kind"`
+	Value     string    `gorm:"not null;uniqueIndex:idx_imported_stats_key" json:"value"`
+	Visitors  int64     `json:"visitors"`
+	Pageviews int64     `json:"pageviews"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Kinds of imported figures.
+const (
+	ImportedTotal    = "total"
+	ImportedPage     = "page"
+	ImportedReferrer = "referrer"
+	ImportedCountry  = "country"
+)
+
+// MaxImportedValue bounds ImportedStat.Value, which is part of a unique
+// index.
+const MaxImportedValue = 191
+
 type PageAnalytics struct {
 	URL            string  `json:"url"`
 	TotalViews     int64   `json:"total_views"`
@@ -51,13 +142,284 @@ type PageAnalytics struct {
 	EngagementRate float64 `json:"engagement_rate"`
 }
 
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+// Roles lists every role from most to least privileged.
+var Roles = []string{RoleOwner, RoleAdmin, RoleViewer}
+
+var roleRank = map[string]int{RoleOwner: 3, RoleAdmin: 2, RoleViewer: 1}
+
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
 type User struct {
+	ID       uint   `gorm:"primaryKey"`
+	Username string `gorm:"unique;not null"`
+	Password string `gorm:"not null"`
+	Role     string `gorm:"not null;default:viewer"`
+	Disabled bool   `gorm:"not null;default:false"`
+
+	// Invited users have no password until they accept the invite.
+	InviteTokenHash *string `gorm:"uniqueIndex"`
+	InviteExpiresAt *time.Time
+
+	// TOTPSecret is set when enrollment starts; two-factor login is only
+	// required once TOTPEnabledAt is set. TOTPLastStep is the last accepted
+	// time step, so a code can't be replayed.
+	TOTPSecret    *string    `gorm:"column:totp_secret" json:"-"`
+	TOTPEnabledAt *time.Time `gorm:"column:totp_enabled_at"`
+	TOTPLastStep  int64      `gorm:"column:totp_last_step;not null;default:0" json:"-"`
+
+	// OIDCSubject links the user to their identity at the SSO provider.
+	// SSO-only users have an empty password and can't sign in with one.
+	OIDCSubject *string `gorm:"column:oidc_subject;uniqueIndex" json:"-"`
+
+	SiteGrants    []SiteGrant
+	RecoveryCodes []RecoveryCode
+
+	CreatedAt time.Time
+}
+
+// HasRole reports whether the user's role is at least role.
+func (u *User) HasRole(role string) bool {
+	return roleRank[u.Role] >= roleRank[role]
+}
+
+// CanManageUsers reports whether the user may invite and manage others.
+func (u *User) CanManageUsers() bool {
+	return u.HasRole(RoleAdmin)
+}
+
+// SeesAllSites reports whether the user has access to every site without
+// explicit grants.
+func (u *User) SeesAllSites() bool {
+	return u.HasRole(RoleAdmin)
+}
+
+// InvitePending reports whether the user hasn't set a password yet.
+func (u *User) InvitePending() bool {
+	return u.InviteTokenHash != nil
+}
+
+// TwoFactorEnabled reports whether login requires a TOTP code.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// RecoveryCode is a single-use code that stands in for a TOTP code.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Session is a signed-in dashboard session. The cookie holds a random
+// token; only its hash is stored.
+type Session struct {
+	ID        uint   `gorm:"primaryKey"`
+	TokenHash string `gorm:"uniqueIndex;not null"`
+	UserID    *uint  `gorm:"index"`
+	// Data is the gob-encoded session values.
+	Data       string
+	IPHash     string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	// ExpiresAt is the earlier of the idle and absolute deadlines.
+	ExpiresAt time.Time `gorm:"index"`
+}
+
+const (
+	AuthLoginSuccess   = "login_success"
+	AuthLoginFailure   = "login_failure"
+	AuthLoginThrottled = "login_throttled"
+	AuthLogout         = "logout"
+)
+
+// AuthEvent is an entry in the login audit log. UserID is nil when the
+// username didn't match an account.
+type AuthEvent struct {
 	ID        uint   `gorm:"primaryKey"`
-	Username  string `gorm:"unique;not null"`
-	Password  string `gorm:"not null"`
+	UserID    *uint  `gorm:"index"`
+	Username  string `gorm:"index"`
+	Type      string `gorm:"not null"`
+	Reason    string
+	IPHash    string `gorm:"index"`
+	UserAgent string
+	// SessionID ties a login to its logout.
+	SessionID string    `gorm:"index"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// SiteGrant gives a viewer access to one site.
+type SiteGrant struct {
+	ID        uint `gorm:"primaryKey"`
+	UserID    uint `gorm:"not null;uniqueIndex:idx_site_grants_user_site"`
+	SiteID    uint `gorm:"not null;uniqueIndex:idx_site_grants_user_site"`
+	Site      *Site
 	CreatedAt time.Time
 }
 
+// Site is a tracked website, matched to events by the host of their URL.
+type Site struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"not null" json:"name"`
+	Domain    string    `gorm:"unique;not null" json:"domain"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReportSchedule emails a site's summary to one recipient every week or
+// month. NextRunAt is when the next report is due.
+type ReportSchedule struct {
+	ID         uint `gorm:"primaryKey"`
+	SiteID     uint `gorm:"not null;uniqueIndex:idx_report_schedules_site_email"`
+	Site       *Site
+	Email      string    `gorm:"not null;uniqueIndex:idx_report_schedules_site_email"`
+	Frequency  string    `gorm:"not null"`
+	NextRunAt  time.Time `gorm:"not null;index"`
+	LastSentAt *time.Time
+	// LastError is why the last attempt failed, empty once one succeeds.
+	LastError string
+	// RetryAt is when a report that failed is tried again. NextRunAt is
+	// left alone until it's sent, so the report covers the period that
+	// was due.
+	RetryAt   *time.Time
+	CreatedAt time.Time
+}
+
+// Report frequencies.
+const (
+	ReportWeekly  = "weekly"
+	ReportMonthly = "monthly"
+)
+
+// AlertRule watches the traffic of a site, or of all sites when SiteID is
+// nil, over the last Window and posts to a webhook when Kind's condition
+// is met and again once it clears.
+type AlertRule struct {
+	ID     uint   `gorm:"primaryKey"`
+	Name   string `gorm:"not null"`
+	SiteID *uint  `gorm:"index"`
+	Site   *Site
+	Kind   string `gorm:"not null"`
+	// Threshold is a percentage for spike, drop and bot share rules and
+	// an event count for goal rules. No-events rules don't use it.
+	Threshold float64
+	Window    time.Duration `gorm:"column:window_duration;not null"`
+	// EventName is the custom event a goal rule counts.
+	EventName string
+	// Format is the payload WebhookURL expects: generic, slack or
+	// discord. Requests are signed with Secret.
+	WebhookURL string `gorm:"not null"`
+	Format     string `gorm:"not null"`
+	Secret     string `gorm:"not null"`
+	// Firing is whether the last notification sent was that the
+	// condition is met.
+	Firing    bool
+	CheckedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Kinds of alert rules.
+const (
+	AlertSpike    = "spike"
+	AlertDrop     = "drop"
+	AlertNoEvents = "no_events"
+	AlertBotShare = "bot_share"
+	AlertGoal     = "goal"
+)
+
+// Webhook payload formats.
+const (
+	WebhookGeneric = "generic"
+	WebhookSlack   = "slack"
+	WebhookDiscord = "discord"
+)
+
+// AlertEvent is the history of an alert rule: each time it fired,
+// resolved or was tested, and whether the webhook took the notification.
+type AlertEvent struct {
+	ID      uint `gorm:"primaryKey"`
+	RuleID  uint `gorm:"not null;index"`
+	Rule    *AlertRule
+	State   string `gorm:"not null"`
+	Value   float64
+	Message string
+	// Error is why the webhook didn't take the notification, empty when
+	// it did.
+	Error     string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Alert states.
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+	AlertTest     = "test"
+)
+
+// SinkDeadLetter is a batch of events the event sink couldn't deliver to
+// one of its endpoints, kept until it's replayed.
+type SinkDeadLetter struct {
+	ID  uint   `gorm:"primaryKey"`
+	URL string `gorm:"not null"`
+	// Payload is the request body, sent again as is on replay.
+	Payload   string `gorm:"not null"`
+	Events    int
+	Attempts  int
+	Error     string
+	CreatedAt time.Time `gorm:"index"`
+	UpdatedAt time.Time
+}
+
+// APIKey grants programmatic access. Only a SHA-256 hash of the key is
+// stored; Prefix identifies it in listings.
+type APIKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	Name       string `gorm:"not null"`
+	Prefix     string `gorm:"not null;index"`
+	KeyHash    string `gorm:"unique;not null"`
+	SiteID     *uint
+	Site       *Site
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+const apiKeyPrefix = "dm_"
+
+// GenerateAPIKey returns a new random key and its stored hash.
+func GenerateAPIKey() (key, hash string, err error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + hex.EncodeToString(buf)
+	return key, HashToken(key), nil
+}
+
+// HashToken is how API keys and other random secrets, such as session,
+// invite and recovery tokens, are stored. They're long and random enough
+// that a fast hash will do.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// HashIP is the only form in which client IPs are stored.
+func HashIP(ip string) string {
+	sum := sha256.Sum256([]byte(ip))
+	return hex.EncodeToString(sum[:])
+}
+
 func HashPassword(password string) (string, error) {
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
 	return string(bytes), err
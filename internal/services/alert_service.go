@@ -0,0 +1,385 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+	"github.com/webbesoft/doorman/internal/webhook"
+)
+
+var ErrAlertRuleNotFound = errors.New("alert rule not found")
+
+const (
+	// alertBaselineDays is how far back spike and drop rules look to see
+	// what traffic is usual.
+	alertBaselineDays = 7
+	// alertMinTraffic is how many page views a spike needs in its window,
+	// and a drop in its baseline, so that a handful of visits to a quiet
+	// site don't raise alerts.
+	alertMinTraffic = 10
+
+	alertMinWindow = 5 * time.Minute
+	alertMaxWindow = alertBaselineDays * 24 * time.Hour
+
+	webhookTimeout = 10 * time.Second
+)
+
+// AlertService manages alert rules, checks them and notifies their
+// webhooks.
+type AlertService struct {
+	DB     *gorm.DB
+	Client *http.Client
+	// AllowPrivate lets webhooks reach loopback, link-local and private
+	// addresses.
+	AllowPrivate bool
+}
+
+func NewAlertService(db *gorm.DB, allowPrivate bool) *AlertService {
+	client := webhook.PublicClient(webhookTimeout)
+	if allowPrivate {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	return &AlertService{DB: db, Client: client, AllowPrivate: allowPrivate}
+}
+
+// AlertCheck is what checking a rule found. Baseline is the usual value
+// for spike and drop rules.
+type AlertCheck struct {
+	Value    float64
+	Baseline float64
+	Firing   bool
+	Message  string
+}
+
+// List returns every rule with its site.
+func (s *AlertService) List() ([]models.AlertRule, error) {
+	var rules []models.AlertRule
+	err := s.DB.Preload("Site").Order("id").Find(&rules).Error
+	return rules, err
+}
+
+// History returns the latest limit notifications with their rules.
+func (s *AlertService) History(limit int) ([]models.AlertEvent, error) {
+	var events []models.AlertEvent
+	err := s.DB.Preload("Rule").Preload("Rule.Site").Order("id DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// Add validates rule and stores it with a new signing secret.
+func (s *AlertService) Add(rule *models.AlertRule) error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	rule.EventName = strings.TrimSpace(rule.EventName)
+	if err := validateAlertRule(rule, s.AllowPrivate); err != nil {
+		return err
+	}
+	if rule.SiteID != nil {
+		if err := s.DB.First(&models.Site{}, *rule.SiteID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrSiteNotFound
+			}
+			return err
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	rule.Secret = hex.EncodeToString(secret)
+	rule.Firing = false
+	return s.DB.Create(rule).Error
+}
+
+func validateAlertRule(rule *models.AlertRule, allowPrivate bool) error {
+	if rule.Name == "" {
+		return errors.New("name is required")
+	}
+	if rule.Window < alertMinWindow || rule.Window > alertMaxWindow {
+		return fmt.Errorf("the window must be between %s and %s", formatWindow(alertMinWindow), formatWindow(alertMaxWindow))
+	}
+	switch rule.Kind {
+	case models.AlertSpike:
+		if rule.Threshold <= 0 {
+			return errors.New("a spike needs a threshold above 0%")
+		}
+	case models.AlertDrop, models.AlertBotShare:
+		if rule.Threshold <= 0 || rule.Threshold > 100 {
+			return errors.New("the threshold must be a percentage between 0 and 100")
+		}
+	case models.AlertGoal:
+		if rule.EventName == "" {
+			return errors.New("a goal rule needs the name of the event it counts")
+		}
+		if rule.Threshold < 1 {
+			return errors.New("a goal rule needs a minimum of at least 1")
+		}
+	case models.AlertNoEvents:
+	default:
+		return errors.New("kind must be spike, drop, no_events, bot_share or goal")
+	}
+	switch rule.Format {
+	case models.WebhookGeneric, models.WebhookSlack, models.WebhookDiscord:
+	default:
+		return errors.New("format must be generic, slack or discord")
+	}
+	u, err := url.Parse(rule.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("the webhook must be an http(s) URL")
+	}
+	if !allowPrivate && webhook.CheckHost(u.Hostname()) != nil {
+		return errors.New("the webhook can't be on a loopback, link-local or private address; set alerts.allow_private_webhooks to allow it")
+	}
+	return nil
+}
+
+// Delete removes a rule and its history.
+func (s *AlertService) Delete(id uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("rule_id = ?", id).Delete(&models.AlertEvent{}).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&models.AlertRule{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrAlertRuleNotFound
+		}
+		return nil
+	})
+}
+
+// Check measures rule over the window ending at now.
+func (s *AlertService) Check(rule models.AlertRule, now time.Time) (AlertCheck, error) {
+	var check AlertCheck
+	f := types.StatsFilter{SiteID: rule.SiteID, From: now.Add(-rule.Window), To: now}
+	where, window := siteLabel(rule), formatWindow(rule.Window)
+	var errs []error
+
+	switch rule.Kind {
+	case models.AlertSpike, models.AlertDrop:
+		var current, past int64
+		errs = append(errs, scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", f).Count(&current).Error)
+		base := f
+		base.From, base.To = f.From.AddDate(0, 0, -alertBaselineDays), f.From
+		errs = append(errs, scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", base).Count(&past).Error)
+
+		check.Value = float64(current)
+		check.Baseline = float64(past) * float64(rule.Window) / float64(base.To.Sub(base.From))
+		if check.Baseline == 0 {
+			check.Message = fmt.Sprintf("%d page views on %s in the last %s, with no earlier traffic to compare with", current, where, window)
+			break
+		}
+		change := (check.Value - check.Baseline) / check.Baseline * 100
+		direction := "up"
+		if change < 0 {
+			direction = "down"
+		}
+		check.Message = fmt.Sprintf("Page views on %s are %s %.0f%%: %d in the last %s against a usual %.0f",
+			where, direction, math.Abs(change), current, window, check.Baseline)
+		if rule.Kind == models.AlertSpike {
+			check.Firing = current >= alertMinTraffic && change >= rule.Threshold
+		} else {
+			check.Firing = check.Baseline >= alertMinTraffic && -change >= rule.Threshold
+		}
+
+	case models.AlertNoEvents:
+		var views, events int64
+		errs = append(errs, scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", f).Count(&views).Error)
+		errs = append(errs, scope(s.DB.Model(&models.CustomEvent{}), "custom_events", f).Count(&events).Error)
+		check.Value = float64(views + events)
+		check.Firing = views+events == 0
+		check.Message = fmt.Sprintf("%d events from %s in the last %s", views+events, where, window)
+		if check.Firing {
+			check.Message = fmt.Sprintf("No events from %s in the last %s", where, window)
+		}
+
+	case models.AlertBotShare:
+		var total, bots int64
+		errs = append(errs, scope(s.DB.Model(&models.Analytics{}), "analytics", f).Count(&total).Error)
+		errs = append(errs, scope(s.DB.Model(&models.Analytics{}), "analytics", f).Where("is_bot = ?", true).Count(&bots).Error)
+		if total > 0 {
+			check.Value = float64(bots) / float64(total) * 100
+		}
+		check.Firing = total > 0 && check.Value > rule.Threshold
+		check.Message = fmt.Sprintf("Bots made up %.0f%% of %d visits to %s in the last %s", check.Value, total, where, window)
+
+	case models.AlertGoal:
+		var count int64
+		errs = append(errs, scope(s.DB.Model(&models.CustomEvent{}), "custom_events", f).Where("name = ?", rule.EventName).Count(&count).Error)
+		check.Value = float64(count)
+		check.Firing = check.Value < rule.Threshold
+		check.Message = fmt.Sprintf("%d %q events on %s in the last %s, against a minimum of %.0f", count, rule.EventName, where, window, rule.Threshold)
+
+	default:
+		return check, fmt.Errorf("unknown alert kind %q", rule.Kind)
+	}
+	return check, errors.Join(errs...)
+}
+
+// Evaluate checks every rule at now and notifies the webhooks of rules
+// that started or stopped firing. A rule whose webhook fails is notified
+// again on the next evaluation.
+func (s *AlertService) Evaluate(ctx context.Context, now time.Time) (int, error) {
+	rules, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	notified := 0
+	var errs []error
+	for _, rule := range rules {
+		check, err := s.Check(rule, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("alert %q: %w", rule.Name, err))
+			continue
+		}
+		updates := map[string]interface{}{"checked_at": now}
+		if check.Firing != rule.Firing {
+			state := models.AlertResolved
+			if check.Firing {
+				state = models.AlertFiring
+			}
+			if err := s.notify(ctx, rule, state, check, now); err != nil {
+				errs = append(errs, fmt.Errorf("alert %q: %w", rule.Name, err))
+			} else {
+				updates["firing"] = check.Firing
+				notified++
+			}
+		}
+		if err := s.DB.Model(&rule).Updates(updates).Error; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return notified, errors.Join(errs...)
+}
+
+// SendTest notifies the webhook of rule id of what checking it finds now,
+// marked as a test.
+func (s *AlertService) SendTest(ctx context.Context, id uint) error {
+	var rule models.AlertRule
+	if err := s.DB.Preload("Site").First(&rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAlertRuleNotFound
+		}
+		return err
+	}
+	now := time.Now()
+	check, err := s.Check(rule, now)
+	if err != nil {
+		return err
+	}
+	return s.notify(ctx, rule, models.AlertTest, check, now)
+}
+
+// notify posts the notification and records it in the rule's history.
+func (s *AlertService) notify(ctx context.Context, rule models.AlertRule, state string, check AlertCheck, now time.Time) error {
+	body, err := alertPayload(rule, state, check, now)
+	if err != nil {
+		return err
+	}
+	sendErr := webhook.Post(ctx, s.Client, rule.WebhookURL, rule.Secret, "alert."+state, body)
+
+	event := models.AlertEvent{RuleID: rule.ID, State: state, Value: check.Value, Message: check.Message}
+	if sendErr != nil {
+		event.Error = sendErr.Error()
+	}
+	if err := s.DB.Create(&event).Error; err != nil {
+		return errors.Join(sendErr, err)
+	}
+	return sendErr
+}
+
+// alertPayload is the request body for rule's webhook format.
+func alertPayload(rule models.AlertRule, state string, check AlertCheck, now time.Time) ([]byte, error) {
+	text := fmt.Sprintf("[%s] %s: %s", state, rule.Name, check.Message)
+	switch rule.Format {
+	case models.WebhookSlack:
+		return json.Marshal(map[string]string{"text": text})
+	case models.WebhookDiscord:
+		return json.Marshal(map[string]string{"content": text})
+	}
+
+	type payloadRule struct {
+		ID        uint    `json:"id"`
+		Name      string  `json:"name"`
+		Kind      string  `json:"kind"`
+		Threshold float64 `json:"threshold"`
+		Window    int64   `json:"window_seconds"`
+		EventName string  `json:"event_name,omitempty"`
+	}
+	return json.Marshal(struct {
+		Type     string      `json:"type"`
+		Rule     payloadRule `json:"rule"`
+		Site     string      `json:"site"`
+		Value    float64     `json:"value"`
+		Baseline float64     `json:"baseline,omitempty"`
+		Message  string      `json:"message"`
+		At       time.Time   `json:"at"`
+	}{
+		Type: "alert." + state,
+		Rule: payloadRule{
+			ID:        rule.ID,
+			Name:      rule.Name,
+			Kind:      rule.Kind,
+			Threshold: rule.Threshold,
+			Window:    int64(rule.Window / time.Second),
+			EventName: rule.EventName,
+		},
+		Site:     siteLabel(rule),
+		Value:    check.Value,
+		Baseline: check.Baseline,
+		Message:  check.Message,
+		At:       now.UTC(),
+	})
+}
+
+func siteLabel(rule models.AlertRule) string {
+	if rule.Site != nil {
+		return rule.Site.Domain
+	}
+	return "all sites"
+}
+
+// formatWindow writes d in days, hours or minutes, whichever is whole.
+func formatWindow(d time.Duration) string {
+	unit, n := "minute", int64(d/time.Minute)
+	switch {
+	case d%(24*time.Hour) == 0:
+		unit, n = "day", int64(d/(24*time.Hour))
+	case d%time.Hour == 0:
+		unit, n = "hour", int64(d/time.Hour)
+	}
+	if n == 1 {
+		return unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// StartAlertRoutine checks every alert rule every cfg.Interval.
+func StartAlertRoutine(db *gorm.DB, cfg config.AlertConfig) {
+	alerts := NewAlertService(db, cfg.AllowPrivateWebhooks)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := alerts.Evaluate(context.Background(), time.Now()); err != nil {
+			log.Printf("Alert evaluation failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/webhook"
+)
+
+type webhookCall struct {
+	path      string
+	event     string
+	signature string
+	body      []byte
+}
+
+// newWebhookReceiver records the requests it gets. Requests to /fail are
+// refused.
+func newWebhookReceiver(t *testing.T) (*httptest.Server, func() []webhookCall) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []webhookCall
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		calls = append(calls, webhookCall{r.URL.Path, r.Header.Get(webhook.EventHeader), r.Header.Get(webhook.SignatureHeader), body})
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []webhookCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]webhookCall(nil), calls...)
+	}
+}
+
+func TestAlertService_Add(t *testing.T) {
+	db := newEventTestDB(t)
+	alerts := NewAlertService(db, false)
+
+	valid := models.AlertRule{Name: "Spike", Kind: models.AlertSpike, Threshold: 200, Window: time.Hour, WebhookURL: "https://hooks.example.com/x", Format: models.WebhookGeneric}
+	for name, change := range map[string]func(*models.AlertRule){
+		"no name":           func(r *models.AlertRule) { r.Name = " " },
+		"short window":      func(r *models.AlertRule) { r.Window = time.Minute },
+		"unknown kind":      func(r *models.AlertRule) { r.Kind = "weird" },
+		"drop over 100%":    func(r *models.AlertRule) { r.Kind, r.Threshold = models.AlertDrop, 150 },
+		"goal without name": func(r *models.AlertRule) { r.Kind = models.AlertGoal },
+		"unknown format":    func(r *models.AlertRule) { r.Format = "teams" },
+		"not a URL":         func(r *models.AlertRule) { r.WebhookURL = "hooks.example.com" },
+		"unknown site":      func(r *models.AlertRule) { id := uint(42); r.SiteID = &id },
+		"loopback":          func(r *models.AlertRule) { r.WebhookURL = "http://127.0.0.1:8080/hook" },
+		"localhost":         func(r *models.AlertRule) { r.WebhookURL = "http://localhost/hook" },
+		"metadata":          func(r *models.AlertRule) { r.WebhookURL = "http://169.254.169.254/latest" },
+		"private network":   func(r *models.AlertRule) { r.WebhookURL = "https://[fd00::1]/hook" },
+	} {
+		rule := valid
+		change(&rule)
+		assert.Error(t, alerts.Add(&rule), name)
+	}
+
+	rule := valid
+	require.NoError(t, alerts.Add(&rule))
+	assert.Len(t, rule.Secret, 64)
+
+	internal := valid
+	internal.WebhookURL = "http://10.0.0.5/hook"
+	assert.NoError(t, NewAlertService(db, true).Add(&internal), "private addresses can be allowed")
+	assert.Equal(t, "hour", formatWindow(time.Hour))
+	assert.Equal(t, "2 days", formatWindow(48*time.Hour))
+	assert.Equal(t, "90 minutes", formatWindow(90*time.Minute))
+}
+
+func TestAlertService_Evaluate(t *testing.T) {
+	db := newEventTestDB(t)
+	alerts := NewAlertService(db, true)
+	srv, calls := newWebhookReceiver(t)
+
+	sites := NewSiteService(db)
+	busy, err := sites.Add("Busy", "busy.example.com")
+	require.NoError(t, err)
+	quiet, err := sites.Add("Quiet", "quiet.example.com")
+	require.NoError(t, err)
+
+	now := time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC)
+	views := func(site *models.Site, at time.Time, n int, bot bool) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Create(&models.Analytics{SiteID: &site.ID, URL: "https://" + site.Domain + "/", IPHash: "v", IsBot: bot, CreatedAt: at}).Error)
+		}
+	}
+	// Ten page views a day the week before, then a burst of humans and
+	// bots on busy, a single view on quiet and a crawler on quiet that
+	// doesn't count as traffic.
+	for day := 1; day <= 7; day++ {
+		views(busy, now.Add(-time.Duration(day)*24*time.Hour), 10, false)
+		views(quiet, now.Add(-time.Duration(day)*24*time.Hour-2*time.Hour), 10, false)
+	}
+	views(busy, now.Add(-10*time.Minute), 12, false)
+	views(busy, now.Add(-10*time.Minute), 12, true)
+	views(quiet, now.Add(-5*time.Hour), 1, false)
+	views(quiet, now.Add(-10*time.Minute), 1, true)
+	require.NoError(t, db.Create(&models.CustomEvent{SiteID: &busy.ID, Name: "signup", CreatedAt: now.Add(-5 * time.Minute)}).Error)
+
+	rules := []models.AlertRule{
+		{Name: "HN", SiteID: &busy.ID, Kind: models.AlertSpike, Threshold: 200, Window: time.Hour, Format: models.WebhookGeneric},
+		{Name: "Broken", SiteID: &quiet.ID, Kind: models.AlertDrop, Threshold: 50, Window: 24 * time.Hour, Format: models.WebhookSlack},
+		{Name: "Silent", SiteID: &quiet.ID, Kind: models.AlertNoEvents, Window: time.Hour, Format: models.WebhookDiscord},
+		{Name: "Bots", SiteID: &busy.ID, Kind: models.AlertBotShare, Threshold: 30, Window: time.Hour, Format: models.WebhookGeneric},
+		{Name: "Signups", SiteID: &busy.ID, Kind: models.AlertGoal, EventName: "signup", Threshold: 2, Window: time.Hour, Format: models.WebhookGeneric},
+		{Name: "Calm", Kind: models.AlertBotShare, Threshold: 90, Window: time.Hour, Format: models.WebhookGeneric},
+	}
+	for i := range rules {
+		rules[i].WebhookURL = srv.URL + "/" + strings.ToLower(rules[i].Name)
+		require.NoError(t, alerts.Add(&rules[i]))
+	}
+
+	notified, err := alerts.Evaluate(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 5, notified, "every rule but Calm fires")
+
+	byPath := map[string]webhookCall{}
+	for _, c := range calls() {
+		byPath[c.path] = c
+	}
+	require.Len(t, byPath, 5)
+
+	var generic struct {
+		Type     string  `json:"type"`
+		Site     string  `json:"site"`
+		Value    float64 `json:"value"`
+		Baseline float64 `json:"baseline"`
+		Message  string  `json:"message"`
+		Rule     struct {
+			Name   string `json:"name"`
+			Window int64  `json:"window_seconds"`
+		} `json:"rule"`
+	}
+	hn := byPath["/hn"]
+	require.NoError(t, json.Unmarshal(hn.body, &generic))
+	assert.Equal(t, "alert.firing", hn.event)
+	assert.Equal(t, "alert.firing", generic.Type)
+	assert.Equal(t, "busy.example.com", generic.Site)
+	assert.Equal(t, float64(12), generic.Value)
+	assert.Equal(t, int64(3600), generic.Rule.Window)
+	assert.Contains(t, generic.Message, "Page views on busy.example.com are up")
+	assert.NoError(t, webhook.Verify(rules[0].Secret, hn.signature, hn.body, time.Now(), time.Minute))
+
+	var slack map[string]string
+	require.NoError(t, json.Unmarshal(byPath["/broken"].body, &slack))
+	assert.Equal(t, "[firing] Broken: Page views on quiet.example.com are down 90%: 1 in the last day against a usual 10", slack["text"])
+	var discord map[string]string
+	require.NoError(t, json.Unmarshal(byPath["/silent"].body, &discord))
+	assert.Equal(t, "[firing] Silent: No events from quiet.example.com in the last hour", discord["content"])
+	assert.Contains(t, string(byPath["/bots"].body), "Bots made up 50% of 24 visits")
+	assert.Contains(t, string(byPath["/signups"].body), `1 \"signup\" events on busy.example.com`)
+
+	notified, err = alerts.Evaluate(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, notified, "firing rules aren't notified again")
+
+	// Traffic coming back resolves the no-events rule.
+	views(quiet, now.Add(-time.Minute), 1, false)
+	notified, err = alerts.Evaluate(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, notified)
+	last := calls()[len(calls())-1]
+	assert.Equal(t, "/silent", last.path)
+	assert.Equal(t, "alert.resolved", last.event)
+
+	// A failing webhook is kept in the history and tried again.
+	failing := models.AlertRule{Name: "Down", SiteID: &quiet.ID, Kind: models.AlertNoEvents, Window: 5 * time.Minute, WebhookURL: srv.URL + "/fail", Format: models.WebhookGeneric}
+	require.NoError(t, alerts.Add(&failing))
+	_, err = alerts.Evaluate(context.Background(), now.Add(time.Hour))
+	assert.ErrorContains(t, err, "503")
+	var stored models.AlertRule
+	require.NoError(t, db.First(&stored, failing.ID).Error)
+	assert.False(t, stored.Firing)
+	assert.NotNil(t, stored.CheckedAt)
+
+	history, err := alerts.History(100)
+	require.NoError(t, err)
+	require.NotEmpty(t, history)
+	assert.Equal(t, "Down", history[0].Rule.Name)
+	assert.Equal(t, models.AlertFiring, history[0].State)
+	assert.Contains(t, history[0].Error, "try later")
+
+	require.NoError(t, alerts.SendTest(context.Background(), rules[5].ID))
+	last = calls()[len(calls())-1]
+	assert.Equal(t, "alert.test", last.event)
+
+	require.NoError(t, alerts.Delete(failing.ID))
+	assert.ErrorIs(t, alerts.Delete(failing.ID), ErrAlertRuleNotFound)
+	var left int64
+	db.Model(&models.AlertEvent{}).Where("rule_id = ?", failing.ID).Count(&left)
+	assert.Zero(t, left)
+}
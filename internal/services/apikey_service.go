@@ -0,0 +1,91 @@
+package services
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+type APIKeyService struct {
+	DB *gorm.DB
+}
+
+func NewAPIKeyService(db *gorm.DB) *APIKeyService {
+	return &APIKeyService{DB: db}
+}
+
+// Create stores a new key and returns it with the plaintext key, which is
+// not recoverable afterwards.
+func (s *APIKeyService) Create(name string, siteID *uint) (*models.APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("name is required")
+	}
+
+	key, hash, err := models.GenerateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	apiKey := &models.APIKey{
+		Name:    name,
+		Prefix:  key[:11],
+		KeyHash: hash,
+		SiteID:  siteID,
+	}
+	if err := s.DB.Create(apiKey).Error; err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
+func (s *APIKeyService) List() ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := s.DB.Preload("Site").Order("created_at").Find(&keys).Error
+	return keys, err
+}
+
+// Authenticate returns the unrevoked key matching the plaintext key and
+// notes when it was last used, to the minute.
+func (s *APIKeyService) Authenticate(key string) (*models.APIKey, error) {
+	var apiKey models.APIKey
+	err := s.DB.Where("key_hash = ? AND revoked_at IS NULL", models.HashToken(key)).First(&apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) >= time.Minute {
+		if err := s.DB.Model(&apiKey).Update("last_used_at", now).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &apiKey, nil
+}
+
+// Revoke disables a key by ID or prefix.
+func (s *APIKeyService) Revoke(ref string) error {
+	query := s.DB.Model(&models.APIKey{}).Where("revoked_at IS NULL")
+	if id, err := strconv.ParseUint(ref, 10, 64); err == nil {
+		query = query.Where("id = ?", id)
+	} else {
+		query = query.Where("prefix = ?", ref)
+	}
+
+	result := query.Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
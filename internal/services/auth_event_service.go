@@ -0,0 +1,172 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+type AuthEventService struct {
+	DB *gorm.DB
+}
+
+func NewAuthEventService(db *gorm.DB) *AuthEventService {
+	return &AuthEventService{DB: db}
+}
+
+func (s *AuthEventService) Record(event *models.AuthEvent) error {
+	return s.DB.Create(event).Error
+}
+
+// Recent returns the user's latest login, failure and logout events.
+func (s *AuthEventService) Recent(userID uint, limit int) ([]models.AuthEvent, error) {
+	var events []models.AuthEvent
+	err := s.DB.Where("user_id = ?", userID).Order("created_at DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// Prune deletes events older than cutoff.
+func (s *AuthEventService) Prune(cutoff time.Time) (int64, error) {
+	res := s.DB.Where("created_at < ?", cutoff).Delete(&models.AuthEvent{})
+	return res.RowsAffected, res.Error
+}
+
+// LoginThrottle slows down password guessing using the failures recorded
+// in auth_events, so limits hold across restarts and replicas.
+type LoginThrottle struct {
+	DB     *gorm.DB
+	Config config.LoginConfig
+	Now    func() time.Time
+}
+
+func NewLoginThrottle(db *gorm.DB, cfg config.LoginConfig) *LoginThrottle {
+	return &LoginThrottle{DB: db, Config: cfg, Now: time.Now}
+}
+
+// Lock holds off other attempts for username and from ipHash until the
+// returned func is called. Checking an attempt with RetryAfter and
+// recording how it went under the lock keeps concurrent guesses from all
+// passing the check before any of their failures is recorded. The lock is
+// per process, so each replica lets at most one attempt through at a time.
+func (t *LoginThrottle) Lock(username, ipHash string) (unlock func()) {
+	// Usernames are always locked first so two attempts can't deadlock.
+	byUser := loginLocks.lock("username", username)
+	byIP := loginLocks.lock("ip_hash", ipHash)
+	return func() {
+		byIP()
+		byUser()
+	}
+}
+
+// RetryAfter returns how long the client must wait before another attempt
+// for username from ipHash, or zero if it may try now.
+func (t *LoginThrottle) RetryAfter(username, ipHash string) (time.Duration, error) {
+	byUser, err := t.retryAfter("username", username, true)
+	if err != nil {
+		return 0, err
+	}
+	byIP, err := t.retryAfter("ip_hash", ipHash, false)
+	if err != nil {
+		return 0, err
+	}
+	return max(byUser, byIP), nil
+}
+
+// retryAfter applies the backoff to recent failures matching column. When
+// resetOnSuccess is set, a successful login clears earlier failures; it
+// isn't for IPs, so one valid account can't unlock guessing at others.
+func (t *LoginThrottle) retryAfter(column, value string, resetOnSuccess bool) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	now := t.Now()
+	since := now.Add(-t.Config.LockoutDuration)
+
+	if resetOnSuccess {
+		var last models.AuthEvent
+		err := t.DB.Select("created_at").
+			Where(column+" = ? AND type = ? AND created_at > ?", value, models.AuthLoginSuccess, since).
+			Order("created_at DESC").
+			Limit(1).
+			Find(&last).Error
+		if err != nil {
+			return 0, err
+		}
+		if last.CreatedAt.After(since) {
+			since = last.CreatedAt
+		}
+	}
+
+	var failures []models.AuthEvent
+	err := t.DB.Select("created_at").
+		Where(column+" = ? AND type = ? AND created_at > ?", value, models.AuthLoginFailure, since).
+		Order("created_at DESC").
+		Limit(t.Config.LockoutAfter).
+		Find(&failures).Error
+	if err != nil {
+		return 0, err
+	}
+
+	count := len(failures)
+	if count < t.Config.BackoffAfter {
+		return 0, nil
+	}
+
+	var until time.Time
+	if count >= t.Config.LockoutAfter {
+		until = failures[0].CreatedAt.Add(t.Config.LockoutDuration)
+	} else {
+		until = failures[0].CreatedAt.Add(t.Config.BackoffBase << (count - t.Config.BackoffAfter))
+	}
+
+	if wait := until.Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// loginLocks serializes login attempts by username and by client.
+var loginLocks = keyedMutex{locks: map[string]*keyedLock{}}
+
+// keyedMutex hands out a mutex per key, dropping it once nobody holds or
+// waits for it.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (k *keyedMutex) lock(kind, value string) (unlock func()) {
+	if value == "" {
+		return func() {}
+	}
+	key := kind + ":" + value
+
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
@@ -0,0 +1,128 @@
+package services
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	db := newUserTestDB(t)
+	require.NoError(t, db.AutoMigrate(&models.AuthEvent{}))
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	throttle := NewLoginThrottle(db, config.LoginConfig{
+		BackoffAfter:    3,
+		BackoffBase:     2 * time.Second,
+		LockoutAfter:    6,
+		LockoutDuration: 15 * time.Minute,
+	})
+	throttle.Now = func() time.Time { return now }
+
+	fail := func(username, ip string) {
+		require.NoError(t, db.Create(&models.AuthEvent{
+			Type: models.AuthLoginFailure, Username: username, IPHash: ip, CreatedAt: now,
+		}).Error)
+	}
+	retry := func(username, ip string) time.Duration {
+		wait, err := throttle.RetryAfter(username, ip)
+		require.NoError(t, err)
+		return wait
+	}
+
+	fail("alice", "ip1")
+	fail("alice", "ip1")
+	assert.Zero(t, retry("alice", "ip1"), "a couple of typos are free")
+
+	fail("alice", "ip1")
+	assert.Equal(t, 2*time.Second, retry("alice", "ip1"))
+	fail("alice", "ip1")
+	assert.Equal(t, 4*time.Second, retry("alice", "ip1"))
+
+	// The IP is throttled for other usernames too.
+	assert.Equal(t, 4*time.Second, retry("bob", "ip1"))
+	assert.Zero(t, retry("bob", "ip2"))
+
+	fail("alice", "ip2")
+	fail("alice", "ip3")
+	assert.Equal(t, 15*time.Minute, retry("alice", "ip4"), "locked out after too many failures")
+
+	now = now.Add(16 * time.Minute)
+	assert.Zero(t, retry("alice", "ip4"), "old failures expire")
+
+	// A successful login clears the username's failures but not the IP's.
+	for i := 0; i < 3; i++ {
+		fail("carol", "ip5")
+	}
+	require.NoError(t, db.Create(&models.AuthEvent{
+		Type: models.AuthLoginSuccess, Username: "carol", IPHash: "ip6", CreatedAt: now.Add(time.Second),
+	}).Error)
+	assert.Zero(t, retry("carol", "ip6"))
+	assert.Equal(t, 2*time.Second, retry("dave", "ip5"))
+}
+
+func TestLoginThrottle_Lock(t *testing.T) {
+	db := newUserTestDB(t)
+	require.NoError(t, db.AutoMigrate(&models.AuthEvent{}))
+	throttle := NewLoginThrottle(db, config.LoginConfig{
+		BackoffAfter:    1,
+		BackoffBase:     time.Hour,
+		LockoutAfter:    5,
+		LockoutDuration: time.Hour,
+	})
+
+	// Concurrent guesses at one username each check the throttle and record
+	// their failure under the lock, so only the first gets through.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := fmt.Sprintf("ip%d", i)
+			defer throttle.Lock("alice", ip)()
+			wait, err := throttle.RetryAfter("alice", ip)
+			assert.NoError(t, err)
+			if wait == 0 {
+				assert.NoError(t, db.Create(&models.AuthEvent{Type: models.AuthLoginFailure, Username: "alice", IPHash: ip}).Error)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failures int64
+	require.NoError(t, db.Model(&models.AuthEvent{}).Where("type = ?", models.AuthLoginFailure).Count(&failures).Error)
+	assert.Equal(t, int64(1), failures)
+	assert.Empty(t, loginLocks.locks, "locks are dropped once released")
+}
+
+func TestAuthEventService_Recent(t *testing.T) {
+	db := newUserTestDB(t)
+	require.NoError(t, db.AutoMigrate(&models.AuthEvent{}))
+	events := NewAuthEventService(db)
+
+	alice, bob := uint(1), uint(2)
+	for _, e := range []models.AuthEvent{
+		{UserID: &alice, Type: models.AuthLoginSuccess, CreatedAt: time.Now().Add(-time.Hour)},
+		{UserID: &alice, Type: models.AuthLogout, CreatedAt: time.Now()},
+		{UserID: &bob, Type: models.AuthLoginSuccess},
+		{UserID: &alice, Type: models.AuthLoginSuccess, CreatedAt: time.Now().AddDate(0, -4, 0)},
+	} {
+		require.NoError(t, events.Record(&e))
+	}
+
+	recent, err := events.Recent(alice, 2)
+	require.NoError(t, err)
+	require.Len(t, recent, 2)
+	assert.Equal(t, models.AuthLogout, recent[0].Type)
+
+	pruned, err := events.Prune(time.Now().AddDate(0, -3, 0))
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, pruned)
+}
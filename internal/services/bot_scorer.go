@@ -0,0 +1,262 @@
+package services
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/metrics"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+const (
+	// SessionWindow is how far back a visitor's page visits count towards
+	// their session.
+	SessionWindow = 30 * time.Minute
+	// missedHeartbeats is how many heartbeat intervals may pass without
+	// any heartbeat before a session is considered to have missed them.
+	missedHeartbeats = 3
+	// maxSessionVisits bounds the page visits loaded to score a session;
+	// the newest are kept.
+	maxSessionVisits = 500
+)
+
+// SessionKey identifies a visitor's session: their page visits on one
+// site from one address and browser. The address alone would merge
+// everyone behind the same NAT or mobile carrier into one session.
+type SessionKey struct {
+	IPHash    string
+	UserAgent string
+	SiteID    *uint
+}
+
+// BotScorer scores a visitor's page visits with everything known about
+// their session and keeps a history of score changes. Scores are
+// recomputed from scratch each time, so a visit can be cleared as well as
+// flagged when more data arrives.
+type BotScorer struct {
+	DB *gorm.DB
+	// Bots scores visits; nil uses the built-in rules.
+	Bots *botdetect.Engine
+	// HeartbeatInterval is how often the tracker reports.
+	HeartbeatInterval time.Duration
+	Now               func() time.Time
+}
+
+func NewBotScorer(db *gorm.DB, bots *botdetect.Engine, heartbeatInterval time.Duration) *BotScorer {
+	if bots == nil {
+		bots = botdetect.Default()
+	}
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = 30 * time.Second
+	}
+	return &BotScorer{DB: db, Bots: bots, HeartbeatInterval: heartbeatInterval, Now: time.Now}
+}
+
+// Rescore scores every page visit in the session as of Now. ip may be
+// empty when rescoring later; IP rules that matched before then keep
+// matching.
+func (b *BotScorer) Rescore(key SessionKey, ip string) error {
+	_, err := b.rescore(key, ip)
+	return err
+}
+
+// rescore is Rescore, returning the session's analytics rows as scored.
+func (b *BotScorer) rescore(key SessionKey, ip string) ([]models.Analytics, error) {
+	now := b.Now()
+
+	query := b.DB.Model(&models.PageVisit{}).
+		Joins("JOIN analytics ON analytics.id = page_visits.analytics_id").
+		Where("page_visits.ip_hash = ? AND analytics.user_agent = ?", key.IPHash, key.UserAgent).
+		Where("page_visits.updated_at >= ? AND page_visits.created_at <= ?", now.Add(-SessionWindow), now)
+	if key.SiteID != nil {
+		query = query.Where("page_visits.site_id = ?", *key.SiteID)
+	} else {
+		query = query.Where("page_visits.site_id IS NULL")
+	}
+	var visits []models.PageVisit
+	err := query.
+		Select("page_visits.*").
+		Order("page_visits.created_at DESC").
+		Limit(maxSessionVisits).
+		Find(&visits).Error
+	if err != nil || len(visits) == 0 {
+		return nil, err
+	}
+	slices.Reverse(visits)
+
+	ids := make([]uint, 0, len(visits))
+	for _, pv := range visits {
+		ids = append(ids, pv.AnalyticsID)
+	}
+	var analytics []models.Analytics
+	if err := b.DB.Where("id IN ?", ids).Find(&analytics).Error; err != nil {
+		return nil, err
+	}
+	scripted := make(map[uint]bool, len(analytics))
+	for _, a := range analytics {
+		scripted[a.ID] = a.Source == models.SourceScript
+	}
+
+	// Every page counts towards the pace of the session, but only pages
+	// with the tracker script can show interaction and heartbeats.
+	session := &botdetect.Session{}
+	latest := make(map[uint]models.PageVisit, len(visits))
+	var lastSeen time.Time
+	script, heartbeats := false, false
+	for _, pv := range visits {
+		session.Starts = append(session.Starts, pv.CreatedAt)
+		latest[pv.AnalyticsID] = pv
+		if !scripted[pv.AnalyticsID] {
+			continue
+		}
+		script = true
+		if pv.ActiveTime > 0 || pv.ScrollDepth > 0 {
+			session.Interacted = true
+		}
+		if pv.DwellTime > 0 {
+			heartbeats = true
+		}
+		lastSeen = maxTime(lastSeen, pv.UpdatedAt)
+	}
+	if !script {
+		session.Interacted = true
+	}
+	session.HeartbeatMissed = script && !heartbeats && now.Sub(lastSeen) > missedHeartbeats*b.HeartbeatInterval
+
+	for i := range analytics {
+		a := &analytics[i]
+		pv := latest[a.ID]
+		result := b.Bots.Evaluate(botdetect.Signals{
+			UserAgent:   a.UserAgent,
+			IP:          ip,
+			IPRules:     splitRules(a.BotReason),
+			DwellTime:   pv.DwellTime,
+			ActiveTime:  pv.ActiveTime,
+			ScrollDepth: pv.ScrollDepth,
+			Session:     session,
+		})
+		if err := b.apply(a, result, now); err != nil {
+			return nil, err
+		}
+	}
+	return analytics, nil
+}
+
+// apply stores a new result for a visit when it differs from the last.
+func (b *BotScorer) apply(a *models.Analytics, result botdetect.Result, now time.Time) error {
+	reason := strings.Join(result.Rules, ",")
+	if a.BotScore == result.Score && a.BotReason == reason && a.IsBot == result.Bot {
+		return nil
+	}
+
+	flagged := result.Bot && !a.IsBot
+	a.IsBot = result.Bot
+	a.BotScore = result.Score
+	a.BotReason = reason
+	err := b.DB.Model(a).Select("is_bot", "bot_score", "bot_reason").Updates(a).Error
+	if err != nil {
+		return err
+	}
+
+	err = b.DB.Create(&models.BotScore{
+		AnalyticsID: a.ID,
+		SiteID:      a.SiteID,
+		Score:       result.Score,
+		IsBot:       result.Bot,
+		Rules:       reason,
+		CreatedAt:   now,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if flagged {
+		metrics.BotDetections.WithLabelValues(result.Kind).Inc()
+	}
+	return b.recordRuleHits(a, result.Rules, now)
+}
+
+// recordRuleHits notes the bot rules that matched a visit, once per rule
+// and visit, for the bot rule report.
+func (b *BotScorer) recordRuleHits(a *models.Analytics, rules []string, now time.Time) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	hits := make([]models.BotRuleHit, len(rules))
+	for i, rule := range rules {
+		hits[i] = models.BotRuleHit{
+			AnalyticsID: a.ID,
+			SiteID:      a.SiteID,
+			Rule:        rule,
+			CreatedAt:   now,
+		}
+	}
+	return b.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&hits).Error
+}
+
+// Sweep rescores sessions with tracker heartbeats since the last sweep,
+// which ingest leaves to it, and sessions that went quiet without a single
+// heartbeat, which no new event would rescore. It returns how many it
+// looked at.
+func (b *BotScorer) Sweep() (int, error) {
+	now := b.Now()
+
+	var sessions []SessionKey
+	err := b.DB.Model(&models.PageVisit{}).
+		Select("page_visits.ip_hash, analytics.user_agent, page_visits.site_id").
+		Joins("JOIN analytics ON analytics.id = page_visits.analytics_id").
+		Where("page_visits.updated_at >= ? AND analytics.source = ?", now.Add(-SessionWindow), models.SourceScript).
+		Group("page_visits.ip_hash, analytics.user_agent, page_visits.site_id").
+		Having("MAX(page_visits.updated_at) >= ? OR (MAX(page_visits.dwell_time) = 0 AND MAX(page_visits.updated_at) < ?)",
+			now.Add(-b.HeartbeatInterval), now.Add(-missedHeartbeats*b.HeartbeatInterval)).
+		Scan(&sessions).Error
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range sessions {
+		err := b.DB.Transaction(func(tx *gorm.DB) error {
+			scorer := *b
+			scorer.DB = tx
+			return scorer.Rescore(key, "")
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(sessions), nil
+}
+
+// StartBotSweepRoutine runs Sweep every heartbeat interval, which bounds
+// how long a heartbeat waits to count towards its session's score.
+func StartBotSweepRoutine(db *gorm.DB, bots *botdetect.Engine, heartbeatInterval time.Duration) {
+	scorer := NewBotScorer(db, bots, heartbeatInterval)
+	ticker := time.NewTicker(scorer.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := scorer.Sweep(); err != nil {
+			log.Printf("Bot rescoring failed: %v", err)
+		}
+	}
+}
+
+func splitRules(reason string) []string {
+	if reason == "" {
+		return nil
+	}
+	return strings.Split(reason, ",")
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func addVisit(t *testing.T, db *gorm.DB, ipHash, url string, at time.Time, dwell, active, scroll int) models.Analytics {
+	t.Helper()
+	a := models.Analytics{IPHash: ipHash, URL: url, UserAgent: "Mozilla/5.0", CreatedAt: at}
+	require.NoError(t, db.Create(&a).Error)
+	pv := models.PageVisit{AnalyticsID: a.ID, IPHash: ipHash, URL: url, DwellTime: dwell, ActiveTime: active, ScrollDepth: scroll, CreatedAt: at, UpdatedAt: at}
+	require.NoError(t, db.Create(&pv).Error)
+	return a
+}
+
+func testSession(ipHash string) SessionKey {
+	return SessionKey{IPHash: ipHash, UserAgent: "Mozilla/5.0"}
+}
+
+func TestBotScorer_Rescore(t *testing.T) {
+	db := newEventTestDB(t)
+	now := time.Now()
+	scorer := NewBotScorer(db, nil, 30*time.Second)
+	scorer.Now = func() time.Time { return now }
+
+	// A script walking through pages every two seconds, reporting dwell
+	// time but never any activity
+	start := now.Add(-time.Minute)
+	for i, url := range []string{"/1", "/2", "/3", "/4", "/5", "/6"} {
+		addVisit(t, db, "script", url, start.Add(time.Duration(i)*2*time.Second), 2, 0, 0)
+	}
+	// and a person reading two pages.
+	addVisit(t, db, "reader", "/1", start, 40, 25, 80)
+	addVisit(t, db, "reader", "/2", start.Add(time.Minute), 20, 15, 60)
+
+	require.NoError(t, scorer.Rescore(testSession("script"), "192.168.1.20"))
+	require.NoError(t, scorer.Rescore(testSession("reader"), "192.168.1.21"))
+
+	var script []models.Analytics
+	require.NoError(t, db.Where("ip_hash = ?", "script").Find(&script).Error)
+	require.Len(t, script, 6)
+	for _, a := range script {
+		assert.True(t, a.IsBot, a.URL)
+		assert.Equal(t, "no_active_time,rapid_pages,uniform_timing,no_interaction", a.BotReason)
+	}
+
+	var reader []models.Analytics
+	require.NoError(t, db.Where("ip_hash = ?", "reader").Find(&reader).Error)
+	for _, a := range reader {
+		assert.False(t, a.IsBot, a.URL)
+		assert.Zero(t, a.BotScore)
+	}
+
+	var history int64
+	require.NoError(t, db.Model(&models.BotScore{}).Count(&history).Error)
+	assert.Equal(t, int64(6), history, "only changed scores are kept")
+
+	require.NoError(t, scorer.Rescore(testSession("script"), "192.168.1.20"))
+	require.NoError(t, db.Model(&models.BotScore{}).Count(&history).Error)
+	assert.Equal(t, int64(6), history, "rescoring without news changes nothing")
+}
+
+func TestBotScorer_Sweep(t *testing.T) {
+	db := newEventTestDB(t)
+	now := time.Now()
+	scorer := NewBotScorer(db, nil, 30*time.Second)
+	scorer.Now = func() time.Time { return now }
+
+	// A page view from a datacenter that never sent a heartbeat,
+	quiet := addVisit(t, db, "quiet", "/", now.Add(-5*time.Minute), 0, 0, 0)
+	require.NoError(t, db.Model(&quiet).Update("bot_reason", "datacenter_ip").Error)
+	// one that just had a heartbeat,
+	fresh := addVisit(t, db, "fresh", "/", now.Add(-time.Minute), 0, 0, 0)
+	require.NoError(t, db.Model(&models.PageVisit{}).Where("analytics_id = ?", fresh.ID).
+		Updates(map[string]any{"dwell_time": 1, "updated_at": now.Add(-10 * time.Second)}).Error)
+	// one that reported back a while ago,
+	addVisit(t, db, "reported", "/", now.Add(-5*time.Minute), 12, 8, 30)
+	// and one from a session long over.
+	addVisit(t, db, "old", "/", now.Add(-2*time.Hour), 0, 0, 0)
+
+	swept, err := scorer.Sweep()
+	require.NoError(t, err)
+	assert.Equal(t, 2, swept)
+
+	var a models.Analytics
+	require.NoError(t, db.Where("ip_hash = ?", "quiet").First(&a).Error)
+	assert.Equal(t, "datacenter_ip,no_heartbeat", a.BotReason, "IP rules carry over without the address")
+	assert.True(t, a.IsBot)
+	var reported models.Analytics
+	require.NoError(t, db.Where("ip_hash = ?", "fresh").First(&reported).Error)
+	assert.Equal(t, "no_active_time", reported.BotReason, "heartbeats are scored by the sweep")
+}
+
+func TestBotScorer_SessionKey(t *testing.T) {
+	db := newEventTestDB(t)
+	now := time.Now()
+	scorer := NewBotScorer(db, nil, 30*time.Second)
+	scorer.Now = func() time.Time { return now }
+
+	// People behind one NAT opening pages within the same second, one of
+	// them on two sites. As one session that would be a burst.
+	site := uint(1)
+	visit := func(url, userAgent string, siteID *uint, at time.Time) {
+		a := addVisit(t, db, "office", url, at, 40, 20, 60)
+		require.NoError(t, db.Model(&a).Update("user_agent", userAgent).Error)
+		require.NoError(t, db.Model(&models.PageVisit{}).Where("analytics_id = ?", a.ID).Update("site_id", siteID).Error)
+	}
+	start := now.Add(-10 * time.Minute)
+	for i, gap := range []time.Duration{0, 47 * time.Second, 133 * time.Second, 182 * time.Second} {
+		at := start.Add(gap)
+		visit(fmt.Sprintf("/a%d", i), "Mozilla/5.0", nil, at)
+		visit(fmt.Sprintf("/b%d", i), "Mozilla/5.0 (Macintosh)", nil, at.Add(200*time.Millisecond))
+		visit(fmt.Sprintf("/c%d", i), "Mozilla/5.0 (Android)", nil, at.Add(400*time.Millisecond))
+		visit(fmt.Sprintf("/d%d", i), "Mozilla/5.0 (Macintosh)", &site, at.Add(600*time.Millisecond))
+		visit(fmt.Sprintf("/e%d", i), "Mozilla/5.0 (Macintosh)", &site, at.Add(800*time.Millisecond))
+	}
+
+	for _, key := range []SessionKey{
+		testSession("office"),
+		{IPHash: "office", UserAgent: "Mozilla/5.0 (Macintosh)"},
+		{IPHash: "office", UserAgent: "Mozilla/5.0 (Android)"},
+		{IPHash: "office", UserAgent: "Mozilla/5.0 (Macintosh)", SiteID: &site},
+	} {
+		require.NoError(t, scorer.Rescore(key, ""))
+	}
+
+	var flagged int64
+	require.NoError(t, db.Model(&models.Analytics{}).Where("bot_score > 0").Count(&flagged).Error)
+	assert.Zero(t, flagged, "sessions aren't merged by address alone")
+}
+
+func TestBotScorer_NewestVisits(t *testing.T) {
+	db := newEventTestDB(t)
+	now := time.Now()
+	scorer := NewBotScorer(db, nil, 30*time.Second)
+	scorer.Now = func() time.Time { return now }
+
+	start := now.Add(-20 * time.Minute)
+	for i := 0; i < maxSessionVisits+1; i++ {
+		addVisit(t, db, "long", fmt.Sprintf("/%d", i), start.Add(time.Duration(i)*time.Second), 2, 0, 0)
+	}
+	require.NoError(t, scorer.Rescore(testSession("long"), ""))
+
+	var oldest, newest models.Analytics
+	require.NoError(t, db.Where("url = ?", "/0").First(&oldest).Error)
+	require.NoError(t, db.Where("url = ?", fmt.Sprintf("/%d", maxSessionVisits)).First(&newest).Error)
+	assert.Zero(t, oldest.BotScore, "the oldest visit is left out")
+	assert.True(t, newest.IsBot, "the newest visit is scored")
+}
+
+func TestBotScorer_NoScript(t *testing.T) {
+	db := newEventTestDB(t)
+	now := time.Now()
+	scorer := NewBotScorer(db, nil, 30*time.Second)
+	scorer.Now = func() time.Time { return now }
+
+	// Pixel views can't show interaction or heartbeats, so a reader
+	// without JavaScript isn't held to them.
+	for i, url := range []string{"/1", "/2", "/3"} {
+		a := addVisit(t, db, "lynx", url, now.Add(time.Duration(i-10)*time.Minute), 0, 0, 0)
+		require.NoError(t, db.Model(&a).Update("source", models.SourcePixel).Error)
+	}
+	require.NoError(t, scorer.Rescore(testSession("lynx"), "192.168.1.30"))
+
+	swept, err := scorer.Sweep()
+	require.NoError(t, err)
+	assert.Zero(t, swept)
+
+	var flagged int64
+	require.NoError(t, db.Model(&models.Analytics{}).Where("ip_hash = ? AND bot_score > 0", "lynx").Count(&flagged).Error)
+	assert.Zero(t, flagged)
+}
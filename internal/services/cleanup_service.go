@@ -4,30 +4,62 @@ import (
 	"log"
 	"time"
 
+	"github.com/webbesoft/doorman/internal/config"
 	database "github.com/webbesoft/doorman/internal/database"
+	"github.com/webbesoft/doorman/internal/metrics"
+	"github.com/webbesoft/doorman/internal/models"
 	"gorm.io/gorm"
 )
 
-func StartCleanupRoutine(db *gorm.DB) {
-	ticker := time.NewTicker(24 * time.Hour)
+func StartCleanupRoutine(db *gorm.DB, cfg config.RetentionConfig) {
+	ticker := time.NewTicker(cfg.CleanupInterval)
 	defer ticker.Stop()
 
 	// Run immediately on startup
-	runCleanup(db)
+	runCleanup(db, cfg.Days)
 
 	for range ticker.C {
-		runCleanup(db)
+		runCleanup(db, cfg.Days)
 	}
 }
 
-func runCleanup(db *gorm.DB) {
+func runCleanup(db *gorm.DB, retentionDays int) {
 	log.Println("Running scheduled cleanup...")
 
-	// Clean up data older than 90 days
-	if err := database.CleanupOldData(db, 90); err != nil {
+	// Clean up data older than the retention period
+	deleted, err := database.CleanupOldData(db, retentionDays)
+	metrics.ObserveCleanup(deleted, err)
+	if err != nil {
 		log.Printf("Cleanup failed: %v", err)
 	}
 
+	// Custom events, bot rule hits and scores, alert history, undelivered
+	// sink batches and the login audit log follow the same retention
+	// period
+	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.CustomEvent{}).Error; err != nil {
+		log.Printf("Custom event cleanup failed: %v", err)
+	}
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.BotRuleHit{}).Error; err != nil {
+		log.Printf("Bot rule hit cleanup failed: %v", err)
+	}
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.BotScore{}).Error; err != nil {
+		log.Printf("Bot score cleanup failed: %v", err)
+	}
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.AlertEvent{}).Error; err != nil {
+		log.Printf("Alert history cleanup failed: %v", err)
+	}
+	if err := db.Where("created_at < ?", cutoff).Delete(&models.SinkDeadLetter{}).Error; err != nil {
+		log.Printf("Sink dead letter cleanup failed: %v", err)
+	}
+	if _, err := NewAuthEventService(db).Prune(cutoff); err != nil {
+		log.Printf("Auth event cleanup failed: %v", err)
+	}
+
+	if _, err := NewSessionService(db).PruneExpired(); err != nil {
+		log.Printf("Session cleanup failed: %v", err)
+	}
+
 	// TODO: Clear in-memory caches older than 24 hours
 
 	log.Println("Cleanup completed")
@@ -0,0 +1,310 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/ingest"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+// ErrUnknownSite is returned for events whose URL host isn't a configured
+// site, once at least one site exists.
+var ErrUnknownSite = errors.New("unknown site")
+
+// ErrSiteNotAllowed is returned for events for a site other than the one
+// the visitor is restricted to.
+var ErrSiteNotAllowed = errors.New("site not allowed")
+
+// Visitor is who sent a tracking event.
+type Visitor struct {
+	IPHash    string
+	UserAgent string
+	Country   string
+	// IP is only used for bot detection and is never stored.
+	IP string
+	// Source is how the events are reported; empty means the tracker
+	// script.
+	Source string
+	// SiteID, when set, restricts the visitor to events for that site,
+	// as for API keys issued for one site.
+	SiteID *uint
+}
+
+// EventService stores tracking events. Give it a transaction to store
+// several events atomically.
+type EventService struct {
+	DB *gorm.DB
+	// Bots scores visits; nil uses the built-in rules.
+	Bots *botdetect.Engine
+	// HeartbeatInterval is how often the tracker reports, for session
+	// scoring.
+	HeartbeatInterval time.Duration
+	// Accepted, when set, is called with every event Record stores for
+	// a visitor who isn't flagged as a bot, for the event sink.
+	Accepted func(types.SinkEvent)
+}
+
+func NewEventService(db *gorm.DB, bots *botdetect.Engine, heartbeatInterval time.Duration) *EventService {
+	return &EventService{DB: db, Bots: bots, HeartbeatInterval: heartbeatInterval}
+}
+
+// Record stores ev for v. Page views and heartbeats create the visitor's
+// analytics row for the URL on first sight and keep its page visit up to
+// date; custom events are stored as they come.
+func (s *EventService) Record(v Visitor, ev *ingest.Event) error {
+	siteID, err := s.siteForVisitor(v, ev.URL)
+	if err != nil {
+		return err
+	}
+
+	var bot bool
+	if ev.Type == ingest.TypeCustom {
+		bot, err = s.recordCustom(v, ev, siteID)
+	} else {
+		bot, err = s.recordView(v, ev, siteID)
+	}
+	if err != nil || bot || s.Accepted == nil {
+		return err
+	}
+	return s.accept(v, ev, siteID)
+}
+
+// accept passes ev to Accepted.
+func (s *EventService) accept(v Visitor, ev *ingest.Event, siteID *uint) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	source := v.Source
+	if source == "" {
+		source = models.SourceScript
+	}
+	s.Accepted(types.SinkEvent{
+		ID:          hex.EncodeToString(id),
+		Type:        ev.Type,
+		At:          time.Now().UTC(),
+		SiteID:      siteID,
+		Source:      source,
+		Visitor:     v.IPHash,
+		Country:     v.Country,
+		UserAgent:   v.UserAgent,
+		URL:         ev.URL,
+		Referrer:    ev.Referrer,
+		Name:        ev.Name,
+		Props:       ev.Props,
+		DwellTime:   ev.DwellTime,
+		ActiveTime:  ev.ActiveTime,
+		ScrollDepth: ev.ScrollDepth,
+	})
+	return nil
+}
+
+// Import stores a page view that happened at a past time, as found in a
+// web server log or another analytics tool. A view already recorded for
+// the visitor and URL is left alone, so importing the same data twice adds
+// nothing; Import reports whether the view was new.
+func (s *EventService) Import(v Visitor, ev *ingest.Event, at time.Time) (bool, error) {
+	siteID, err := s.siteForVisitor(v, ev.URL)
+	if err != nil {
+		return false, err
+	}
+
+	var existing int64
+	err = s.DB.Model(&models.Analytics{}).
+		Where("ip_hash = ? AND url = ?", v.IPHash, ev.URL).
+		Count(&existing).Error
+	if err != nil || existing > 0 {
+		return false, err
+	}
+
+	if _, err := s.createView(v, ev, siteID, at); err != nil {
+		return false, err
+	}
+	// Other analytics tools filter bots themselves and don't keep the
+	// user agents and addresses the rules need.
+	if v.Source == models.SourceImport {
+		return true, nil
+	}
+	scorer := NewBotScorer(s.DB, s.Bots, s.HeartbeatInterval)
+	scorer.Now = func() time.Time { return at }
+	return true, scorer.Rescore(SessionKey{IPHash: v.IPHash, UserAgent: v.UserAgent, SiteID: siteID}, v.IP)
+}
+
+// siteForVisitor is siteFor, holding visitors restricted to one site to
+// it.
+func (s *EventService) siteForVisitor(v Visitor, rawURL string) (*uint, error) {
+	siteID, err := s.siteFor(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if v.SiteID != nil && (siteID == nil || *siteID != *v.SiteID) {
+		return nil, ErrSiteNotAllowed
+	}
+	return siteID, nil
+}
+
+// siteFor resolves the site an event URL belongs to. Without any sites
+// configured every URL is accepted, unattributed.
+func (s *EventService) siteFor(rawURL string) (*uint, error) {
+	sites := NewSiteService(s.DB)
+	site, err := sites.ForURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if site != nil {
+		return &site.ID, nil
+	}
+
+	configured, err := sites.Any()
+	if err != nil {
+		return nil, err
+	}
+	if configured {
+		return nil, ErrUnknownSite
+	}
+	return nil, nil
+}
+
+// recordCustom stores a custom event. With Accepted set, it reports
+// whether bot scoring flagged the visitor's latest page on the site.
+func (s *EventService) recordCustom(v Visitor, ev *ingest.Event, siteID *uint) (bool, error) {
+	custom := models.CustomEvent{
+		SiteID:    siteID,
+		URL:       ev.URL,
+		IPHash:    v.IPHash,
+		Name:      ev.Name,
+		CreatedAt: time.Now(),
+	}
+	if len(ev.Props) > 0 {
+		props, err := json.Marshal(ev.Props)
+		if err != nil {
+			return false, err
+		}
+		custom.Props = string(props)
+	}
+	if err := s.DB.Create(&custom).Error; err != nil || s.Accepted == nil {
+		return false, err
+	}
+
+	var latest models.Analytics
+	query := s.DB.Select("is_bot").Where("ip_hash = ? AND user_agent = ?", v.IPHash, v.UserAgent)
+	if siteID != nil {
+		query = query.Where("site_id = ?", *siteID)
+	} else {
+		query = query.Where("site_id IS NULL")
+	}
+	err := query.Order("id DESC").First(&latest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	return latest.IsBot, err
+}
+
+// recordView stores a page view or heartbeat and reports whether the page
+// is flagged as a bot. A new page view rescores the visitor's session
+// straight away; heartbeats are left to the bot sweep, so a busy tab
+// doesn't rescore every visit in its session each time it reports.
+func (s *EventService) recordView(v Visitor, ev *ingest.Event, siteID *uint) (bool, error) {
+	var analytic models.Analytics
+	err := s.DB.
+		Where("ip_hash = ? AND url = ?", v.IPHash, ev.URL).
+		First(&analytic).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if analytic, err = s.createView(v, ev, siteID, time.Now()); err != nil {
+			return false, err
+		}
+		return s.rescore(v, analytic)
+	} else if err != nil {
+		return false, err
+	}
+
+	var pv models.PageVisit
+	err = s.DB.
+		Where("ip_hash = ? AND url = ? AND analytics_id = ?", v.IPHash, ev.URL, analytic.ID).
+		Order("created_at DESC").
+		First(&pv).Error
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Create new page visit for first heartbeat
+		pv = newPageVisit(v, ev, siteID, analytic.ID, time.Now())
+		if err := s.DB.Create(&pv).Error; err != nil {
+			return false, err
+		}
+	} else if err != nil {
+		return false, err
+	} else {
+		pv.DwellTime = ev.DwellTime
+		pv.ActiveTime = ev.ActiveTime
+		pv.ScrollDepth = ev.ScrollDepth
+		pv.UpdatedAt = time.Now()
+		if err := s.DB.Save(&pv).Error; err != nil {
+			return false, err
+		}
+	}
+
+	return analytic.IsBot, nil
+}
+
+// rescore rescores the session analytic belongs to and reports whether
+// analytic is flagged as a bot now.
+func (s *EventService) rescore(v Visitor, analytic models.Analytics) (bool, error) {
+	key := SessionKey{IPHash: analytic.IPHash, UserAgent: analytic.UserAgent, SiteID: analytic.SiteID}
+	scored, err := NewBotScorer(s.DB, s.Bots, s.HeartbeatInterval).rescore(key, v.IP)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range scored {
+		if a.ID == analytic.ID {
+			return a.IsBot, nil
+		}
+	}
+	return analytic.IsBot, nil
+}
+
+// createView stores the visitor's first view of a URL, made at at.
+func (s *EventService) createView(v Visitor, ev *ingest.Event, siteID *uint, at time.Time) (models.Analytics, error) {
+	source := v.Source
+	if source == "" {
+		source = models.SourceScript
+	}
+	analytic := models.Analytics{
+		SiteID:    siteID,
+		Source:    source,
+		IPHash:    v.IPHash,
+		URL:       ev.URL,
+		Country:   v.Country,
+		UserAgent: v.UserAgent,
+		Referrer:  ev.Referrer,
+		CreatedAt: at,
+		UpdatedAt: at,
+	}
+	if err := s.DB.Create(&analytic).Error; err != nil {
+		return analytic, err
+	}
+
+	pv := newPageVisit(v, ev, siteID, analytic.ID, at)
+	return analytic, s.DB.Create(&pv).Error
+}
+
+func newPageVisit(v Visitor, ev *ingest.Event, siteID *uint, analyticsID uint, at time.Time) models.PageVisit {
+	return models.PageVisit{
+		SiteID:      siteID,
+		IPHash:      v.IPHash,
+		URL:         ev.URL,
+		AnalyticsID: analyticsID,
+		DwellTime:   ev.DwellTime,
+		ActiveTime:  ev.ActiveTime,
+		ScrollDepth: ev.ScrollDepth,
+		CreatedAt:   at,
+		UpdatedAt:   at,
+	}
+}
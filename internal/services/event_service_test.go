@@ -0,0 +1,132 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/botdetect"
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/ingest"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func newEventTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Analytics{}, &models.PageVisit{}, &models.Site{}, &models.CustomEvent{}, &models.BotRuleHit{}, &models.BotScore{}, &models.ImportedStat{}, &models.ReportSchedule{}, &models.AlertRule{}, &models.AlertEvent{}, &models.SinkDeadLetter{}))
+	return db
+}
+
+func TestEventService_Record(t *testing.T) {
+	db := newEventTestDB(t)
+	events := NewEventService(db, nil, 0)
+	v := Visitor{IPHash: "visitor", UserAgent: "Mozilla/5.0", Country: "NL"}
+
+	// Without sites every URL is accepted.
+	require.NoError(t, events.Record(v, &ingest.Event{Type: ingest.TypePageview, URL: "/a"}))
+
+	site, err := NewSiteService(db).Add("Example", "example.com")
+	require.NoError(t, err)
+
+	view := &ingest.Event{Type: ingest.TypePageview, URL: "https://example.com/", Referrer: "https://ref.example/"}
+	require.NoError(t, events.Record(v, view))
+	heartbeat := &ingest.Event{Type: ingest.TypeHeartbeat, URL: "https://example.com/", DwellTime: 40, ActiveTime: 30, ScrollDepth: 60}
+	require.NoError(t, events.Record(v, heartbeat))
+
+	var analytic models.Analytics
+	require.NoError(t, db.Where("url = ?", "https://example.com/").First(&analytic).Error)
+	assert.Equal(t, site.ID, *analytic.SiteID)
+	assert.Equal(t, "NL", analytic.Country)
+	assert.Equal(t, "https://ref.example/", analytic.Referrer)
+
+	var visits []models.PageVisit
+	require.NoError(t, db.Where("analytics_id = ?", analytic.ID).Find(&visits).Error)
+	require.Len(t, visits, 1, "heartbeats update the page visit")
+	assert.Equal(t, 40, visits[0].DwellTime)
+	assert.Equal(t, 60, visits[0].ScrollDepth)
+
+	custom := &ingest.Event{Type: ingest.TypeCustom, URL: "https://example.com/pricing", Name: "signup", Props: map[string]string{"plan": "pro"}}
+	require.NoError(t, events.Record(v, custom))
+	var stored models.CustomEvent
+	require.NoError(t, db.First(&stored).Error)
+	assert.Equal(t, "signup", stored.Name)
+	assert.JSONEq(t, `{"plan":"pro"}`, stored.Props)
+	assert.Equal(t, site.ID, *stored.SiteID)
+
+	err = events.Record(v, &ingest.Event{Type: ingest.TypePageview, URL: "https://elsewhere.org/"})
+	assert.ErrorIs(t, err, ErrUnknownSite)
+
+	// A long visit without any activity scores 45.
+	idler := Visitor{IPHash: "idler", UserAgent: "Mozilla/5.0"}
+	idle := &ingest.Event{Type: ingest.TypeHeartbeat, URL: "https://example.com/idle", DwellTime: 60, ScrollDepth: 0}
+	require.NoError(t, events.Record(idler, idle))
+	var human models.Analytics
+	require.NoError(t, db.Where("url = ?", "https://example.com/idle").First(&human).Error)
+	assert.False(t, human.IsBot, "score 45 stays under the threshold")
+	assert.Equal(t, 45, human.BotScore)
+
+	strict, err := botdetect.New(config.BotConfig{}, 40)
+	require.NoError(t, err)
+	events.Bots = strict
+	require.NoError(t, events.Record(idler, idle))
+	sweep := func() {
+		t.Helper()
+		_, err := NewBotScorer(db, events.Bots, 0).Sweep()
+		require.NoError(t, err)
+	}
+	sweep()
+	var bot models.Analytics
+	require.NoError(t, db.Where("url = ?", "https://example.com/idle").First(&bot).Error)
+	assert.True(t, bot.IsBot)
+	assert.Equal(t, "no_active_time,no_scroll_long_dwell", bot.BotReason)
+
+	// The sweep rescores the visit after every heartbeat, so activity
+	// clears it again.
+	active := &ingest.Event{Type: ingest.TypeHeartbeat, URL: "https://example.com/idle", DwellTime: 90, ActiveTime: 50, ScrollDepth: 40}
+	require.NoError(t, events.Record(idler, active))
+	sweep()
+	var cleared models.Analytics
+	require.NoError(t, db.Where("url = ?", "https://example.com/idle").First(&cleared).Error)
+	assert.False(t, cleared.IsBot)
+	assert.Equal(t, 0, cleared.BotScore)
+	assert.Empty(t, cleared.BotReason)
+
+	var history []models.BotScore
+	require.NoError(t, db.Where("analytics_id = ?", bot.ID).Order("id").Find(&history).Error)
+	require.Len(t, history, 3, "each change is kept")
+	assert.Equal(t, []bool{false, true, false}, []bool{history[0].IsBot, history[1].IsBot, history[2].IsBot})
+	assert.Equal(t, 45, history[1].Score)
+
+	var hits []models.BotRuleHit
+	require.NoError(t, db.Where("analytics_id = ?", bot.ID).Order("rule").Find(&hits).Error)
+	require.Len(t, hits, 2, "each rule is recorded once per visit")
+	assert.Equal(t, "no_active_time", hits[0].Rule)
+	assert.Equal(t, site.ID, *hits[0].SiteID)
+}
+
+func TestEventService_RecordCrawler(t *testing.T) {
+	db := newEventTestDB(t)
+	events := NewEventService(db, nil, 0)
+	v := Visitor{IPHash: "crawler", UserAgent: "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"}
+
+	require.NoError(t, events.Record(v, &ingest.Event{Type: ingest.TypePageview, URL: "/a"}))
+
+	var analytic models.Analytics
+	require.NoError(t, db.First(&analytic).Error)
+	assert.True(t, analytic.IsBot)
+	assert.Equal(t, 100, analytic.BotScore)
+	assert.Equal(t, "crawler:bingbot,generic_bot", analytic.BotReason)
+
+	// A browser checking in now and then isn't a bot.
+	checker := Visitor{IPHash: "checker", UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0 (link check)"}
+	require.NoError(t, events.Record(checker, &ingest.Event{Type: ingest.TypePageview, URL: "/a"}))
+	var human models.Analytics
+	require.NoError(t, db.Where("ip_hash = ?", "checker").First(&human).Error)
+	assert.False(t, human.IsBot)
+}
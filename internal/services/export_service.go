@@ -0,0 +1,371 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/export"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+// Datasets that can be exported: raw page views, sessions and custom
+// events, and the breakdowns shown on the dashboard.
+const (
+	ExportPageviews  = "pageviews"
+	ExportSessions   = "sessions"
+	ExportEvents     = "events"
+	ExportPages      = "pages"
+	ExportReferrers  = "referrers"
+	ExportCountries  = "countries"
+	ExportDaily      = "daily"
+	ExportBotReasons = "bot-reasons"
+	ExportBotRules   = "bot-rules"
+)
+
+// ExportDatasets lists every dataset.
+var ExportDatasets = []string{
+	ExportPageviews, ExportSessions, ExportEvents,
+	ExportPages, ExportReferrers, ExportCountries, ExportDaily, ExportBotReasons, ExportBotRules,
+}
+
+var ErrUnknownDataset = errors.New("unknown export dataset")
+
+// ExportService writes datasets out for use elsewhere. Raw rows are read
+// from a cursor as they're written, so exports don't have to fit in
+// memory.
+type ExportService struct {
+	DB *gorm.DB
+	// VisitorSalt adds a visitor column of hashes salted again, so rows
+	// of the same visitor can be matched within exports sharing the salt
+	// but not with the hashes stored here. Without it visitors are left
+	// out.
+	VisitorSalt []byte
+}
+
+func NewExportService(db *gorm.DB) *ExportService {
+	return &ExportService{DB: db}
+}
+
+// ValidDataset reports whether name is one of ExportDatasets.
+func ValidDataset(name string) bool {
+	return slices.Contains(ExportDatasets, name)
+}
+
+// Columns lists the columns of a dataset.
+func (s *ExportService) Columns(dataset string) ([]export.Column, error) {
+	visitor := []export.Column{}
+	if s.VisitorSalt != nil {
+		visitor = append(visitor, export.Column{Name: "visitor", Kind: export.String})
+	}
+	site := export.Column{Name: "site", Kind: export.String, Nullable: true}
+
+	switch dataset {
+	case ExportPageviews:
+		return slices.Concat([]export.Column{{Name: "time", Kind: export.Time}}, visitor, []export.Column{
+			site,
+			{Name: "url", Kind: export.String},
+			{Name: "referrer", Kind: export.String},
+			{Name: "country", Kind: export.String},
+			{Name: "user_agent", Kind: export.String},
+			{Name: "source", Kind: export.String},
+			{Name: "is_bot", Kind: export.Bool},
+			{Name: "bot_score", Kind: export.Int},
+			{Name: "dwell_time", Kind: export.Int},
+			{Name: "active_time", Kind: export.Int},
+			{Name: "scroll_depth", Kind: export.Int},
+		}), nil
+	case ExportSessions:
+		return slices.Concat([]export.Column{{Name: "session", Kind: export.String}}, visitor, []export.Column{
+			site,
+			{Name: "started_at", Kind: export.Time},
+			{Name: "ended_at", Kind: export.Time},
+			{Name: "duration", Kind: export.Int},
+			{Name: "pageviews", Kind: export.Int},
+			{Name: "entry_page", Kind: export.String},
+			{Name: "exit_page", Kind: export.String},
+			{Name: "referrer", Kind: export.String},
+			{Name: "country", Kind: export.String},
+			{Name: "source", Kind: export.String},
+			{Name: "is_bot", Kind: export.Bool},
+		}), nil
+	case ExportEvents:
+		return slices.Concat([]export.Column{{Name: "time", Kind: export.Time}}, visitor, []export.Column{
+			site,
+			{Name: "url", Kind: export.String},
+			{Name: "name", Kind: export.String},
+			{Name: "props", Kind: export.String, Nullable: true},
+		}), nil
+	case ExportPages:
+		return []export.Column{
+			{Name: "url", Kind: export.String},
+			{Name: "visits", Kind: export.Int},
+			{Name: "avg_dwell_time", Kind: export.Float},
+			{Name: "avg_scroll_depth", Kind: export.Float},
+		}, nil
+	case ExportReferrers:
+		return []export.Column{{Name: "referrer", Kind: export.String}, {Name: "visits", Kind: export.Int}}, nil
+	case ExportCountries:
+		return []export.Column{{Name: "country", Kind: export.String}, {Name: "visits", Kind: export.Int}}, nil
+	case ExportDaily:
+		return []export.Column{
+			{Name: "date", Kind: export.String},
+			{Name: "page_visits", Kind: export.Int},
+			{Name: "unique_visitors", Kind: export.Int},
+			{Name: "avg_dwell_time", Kind: export.Float},
+		}, nil
+	case ExportBotReasons:
+		return []export.Column{{Name: "reason", Kind: export.String}, {Name: "visits", Kind: export.Int}}, nil
+	case ExportBotRules:
+		return []export.Column{{Name: "rule", Kind: export.String}, {Name: "hits", Kind: export.Int}}, nil
+	default:
+		return nil, ErrUnknownDataset
+	}
+}
+
+// Export writes the rows of dataset that match f to w in format.
+// Breakdowns of bot traffic ignore f.Bots.
+func (s *ExportService) Export(w io.Writer, format, dataset string, f types.StatsFilter) error {
+	columns, err := s.Columns(dataset)
+	if err != nil {
+		return err
+	}
+	out, err := export.NewWriter(w, format, columns)
+	if err != nil {
+		return err
+	}
+
+	stats := NewStatsService(s.DB)
+	switch dataset {
+	case ExportPageviews:
+		err = s.pageviews(out, f)
+	case ExportSessions:
+		err = s.sessions(out, f)
+	case ExportEvents:
+		err = s.events(out, f)
+	case ExportPages:
+		err = writeAll(out, stats.TopPages, f, func(p types.TopPage) []any {
+			return []any{p.URL, p.Visits, p.AvgDwellTime, p.AvgScroll}
+		})
+	case ExportReferrers:
+		err = writeAll(out, stats.TopReferrers, f, func(r types.TopReferrer) []any {
+			return []any{r.Referrer, r.Count}
+		})
+	case ExportCountries:
+		err = writeAll(out, stats.TopCountries, f, func(c types.CountryStats) []any {
+			return []any{c.Country, c.Count}
+		})
+	case ExportDaily:
+		daily := func(f types.StatsFilter, _ int) ([]types.DailyStats, error) { return stats.DailyStats(f) }
+		err = writeAll(out, daily, f, func(d types.DailyStats) []any {
+			return []any{d.Date, d.PageVisits, d.UniqueUsers, d.AvgDwellTime}
+		})
+	case ExportBotReasons:
+		err = writeAll(out, stats.BotReasons, f, func(r types.BotReasonStats) []any {
+			return []any{r.Reason, r.Count}
+		})
+	case ExportBotRules:
+		rules := func(f types.StatsFilter, _ int) ([]types.BotRuleStats, error) { return stats.BotRuleHits(f) }
+		err = writeAll(out, rules, f, func(r types.BotRuleStats) []any {
+			return []any{r.Rule, r.Hits}
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// writeAll writes a whole breakdown, which has a row per distinct value
+// and so is loaded at once.
+func writeAll[T any](out export.Writer, load func(types.StatsFilter, int) ([]T, error), f types.StatsFilter, row func(T) []any) error {
+	rows, err := load(f, -1)
+	if err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := out.Write(row(r)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportedVisit is a page visit along with its analytics row.
+type exportedVisit struct {
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Site        *string
+	URL         string
+	Referrer    string
+	Country     string
+	UserAgent   string
+	IPHash      string
+	Source      string
+	IsBot       bool
+	BotScore    int
+	DwellTime   int
+	ActiveTime  int
+	ScrollDepth int
+}
+
+// visits queries the page visits matching f with their analytics rows.
+func (s *ExportService) visits(f types.StatsFilter) *gorm.DB {
+	return scopeVisits(s.DB.Table("page_visits pv"), "pv", f).
+		Select(`pv.created_at, pv.updated_at, sites.domain as site, a.url, a.referrer, a.country, a.user_agent,
+			a.ip_hash, a.source, a.is_bot, a.bot_score, pv.dwell_time, pv.active_time, pv.scroll_depth`).
+		Joins("JOIN analytics a ON pv.analytics_id = a.id").
+		Joins("LEFT JOIN sites ON sites.id = pv.site_id")
+}
+
+// stream calls fn with each row of query, scanned into a T.
+func stream[T any](db, query *gorm.DB, fn func(*T) error) error {
+	rows, err := query.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row T
+		if err := db.ScanRows(rows, &row); err != nil {
+			return err
+		}
+		if err := fn(&row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *ExportService) pageviews(out export.Writer, f types.StatsFilter) error {
+	query := s.visits(f).Order("pv.created_at, pv.id")
+	return stream(s.DB, query, func(v *exportedVisit) error {
+		row := []any{v.CreatedAt}
+		if s.VisitorSalt != nil {
+			row = append(row, s.visitor(v.IPHash))
+		}
+		return out.Write(append(row, nullable(v.Site), v.URL, v.Referrer, v.Country, v.UserAgent, v.Source,
+			v.IsBot, int64(v.BotScore), int64(v.DwellTime), int64(v.ActiveTime), int64(v.ScrollDepth)))
+	})
+}
+
+// exportedSession gathers a visitor's page visits on a site until they
+// stay away for longer than SessionWindow, as bot scoring does.
+type exportedSession struct {
+	ipHash   string
+	site     *string
+	start    time.Time
+	end      time.Time
+	views    int64
+	entry    string
+	exit     string
+	referrer string
+	country  string
+	source   string
+	bot      bool
+}
+
+func (s *ExportService) sessions(out export.Writer, f types.StatsFilter) error {
+	key := s.VisitorSalt
+	if key == nil {
+		// Sessions still need names that don't give the visitor away.
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+	}
+
+	write := func(ses *exportedSession) error {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(ses.ipHash + "|" + strconv.FormatInt(ses.start.UnixNano(), 10)))
+		row := []any{hex.EncodeToString(mac.Sum(nil)[:16])}
+		if s.VisitorSalt != nil {
+			row = append(row, s.visitor(ses.ipHash))
+		}
+		return out.Write(append(row, nullable(ses.site), ses.start, ses.end, int64(ses.end.Sub(ses.start).Seconds()),
+			ses.views, ses.entry, ses.exit, ses.referrer, ses.country, ses.source, ses.bot))
+	}
+
+	var current *exportedSession
+	query := s.visits(f).Order("a.ip_hash, pv.site_id, pv.created_at, pv.id")
+	err := stream(s.DB, query, func(v *exportedVisit) error {
+		if current != nil && (current.ipHash != v.IPHash || nullable(current.site) != nullable(v.Site) ||
+			v.CreatedAt.Sub(current.end) > SessionWindow) {
+			if err := write(current); err != nil {
+				return err
+			}
+			current = nil
+		}
+		if current == nil {
+			current = &exportedSession{
+				ipHash:   v.IPHash,
+				site:     v.Site,
+				start:    v.CreatedAt,
+				entry:    v.URL,
+				referrer: v.Referrer,
+				country:  v.Country,
+				source:   v.Source,
+			}
+		}
+		current.views++
+		current.end = maxTime(current.end, maxTime(v.CreatedAt, v.UpdatedAt))
+		current.exit = v.URL
+		current.bot = current.bot || v.IsBot
+		return nil
+	})
+	if err != nil || current == nil {
+		return err
+	}
+	return write(current)
+}
+
+type exportedEvent struct {
+	CreatedAt time.Time
+	Site      *string
+	URL       string
+	IPHash    string
+	Name      string
+	Props     string
+}
+
+func (s *ExportService) events(out export.Writer, f types.StatsFilter) error {
+	query := scope(s.DB.Table("custom_events"), "custom_events", f).
+		Select("custom_events.created_at, sites.domain as site, custom_events.url, custom_events.ip_hash, custom_events.name, custom_events.props").
+		Joins("LEFT JOIN sites ON sites.id = custom_events.site_id").
+		Order("custom_events.created_at, custom_events.id")
+	return stream(s.DB, query, func(e *exportedEvent) error {
+		row := []any{e.CreatedAt}
+		if s.VisitorSalt != nil {
+			row = append(row, s.visitor(e.IPHash))
+		}
+		var props any
+		if e.Props != "" {
+			props = e.Props
+		}
+		return out.Write(append(row, nullable(e.Site), e.URL, e.Name, props))
+	})
+}
+
+// visitor salts a stored visitor hash again with VisitorSalt.
+func (s *ExportService) visitor(ipHash string) string {
+	mac := hmac.New(sha256.New, s.VisitorSalt)
+	mac.Write([]byte(ipHash))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// nullable turns a nullable string column into an export value.
+func nullable(s *string) any {
+	if s == nil {
+		return nil
+	}
+	return *s
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/export"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+func exportCSV(t *testing.T, exports *ExportService, dataset string, f types.StatsFilter) [][]string {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, exports.Export(&buf, export.CSV, dataset, f))
+	records, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	return records
+}
+
+func TestExportService(t *testing.T) {
+	db := newEventTestDB(t)
+	site, err := NewSiteService(db).Add("Example", "example.com")
+	require.NoError(t, err)
+
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	visits := []struct {
+		ipHash string
+		url    string
+		at     time.Time
+	}{
+		{"reader", "https://example.com/", start},
+		{"reader", "https://example.com/about", start.Add(2 * time.Minute)},
+		// back after a long break, in a new session
+		{"reader", "https://example.com/blog", start.Add(3 * time.Hour)},
+		{"other", "https://example.com/", start.Add(time.Hour)},
+		// out of the range
+		{"other", "https://example.com/old", start.AddDate(0, -1, 0)},
+	}
+	for _, v := range visits {
+		a := addVisit(t, db, v.ipHash, v.url, v.at, 20, 10, 50)
+		require.NoError(t, db.Model(&a).UpdateColumn("site_id", site.ID).Error)
+		require.NoError(t, db.Model(&models.PageVisit{}).Where("analytics_id = ?", a.ID).UpdateColumn("site_id", site.ID).Error)
+	}
+	require.NoError(t, db.Create(&models.CustomEvent{SiteID: &site.ID, URL: "https://example.com/", IPHash: "reader", Name: "signup", CreatedAt: start}).Error)
+
+	f := types.StatsFilter{SiteID: &site.ID, From: start.Truncate(24 * time.Hour), To: start.AddDate(0, 0, 1)}
+	exports := NewExportService(db)
+
+	views := exportCSV(t, exports, ExportPageviews, f)
+	require.Len(t, views, 5)
+	assert.Equal(t, []string{"time", "site", "url", "referrer", "country", "user_agent", "source", "is_bot", "bot_score", "dwell_time", "active_time", "scroll_depth"}, views[0])
+	assert.Equal(t, []string{"2024-03-01T09:00:00Z", "example.com", "https://example.com/", "", "", "Mozilla/5.0", "script", "false", "0", "20", "10", "50"}, views[1])
+	assert.NotContains(t, strings.Join(views[1], ","), "reader", "visitors are left out")
+
+	sessions := exportCSV(t, exports, ExportSessions, f)
+	require.Len(t, sessions, 4, "other has one session in range, reader two")
+	assert.Equal(t, "pageviews", sessions[0][5])
+	var pages []string
+	for _, s := range sessions[1:] {
+		pages = append(pages, s[5]+" "+s[6]+" "+s[7])
+	}
+	assert.ElementsMatch(t, []string{
+		"1 https://example.com/ https://example.com/",
+		"2 https://example.com/ https://example.com/about",
+		"1 https://example.com/blog https://example.com/blog",
+	}, pages)
+
+	events := exportCSV(t, exports, ExportEvents, f)
+	require.Len(t, events, 2)
+	assert.Equal(t, []string{"2024-03-01T09:00:00Z", "example.com", "https://example.com/", "signup", ""}, events[1])
+
+	top := exportCSV(t, exports, ExportPages, f)
+	assert.Equal(t, []string{"https://example.com/", "2", "20", "50"}, top[1])
+
+	// Salted visitor IDs match within an export but not the stored hashes.
+	exports.VisitorSalt = []byte("salt")
+	views = exportCSV(t, exports, ExportPageviews, f)
+	assert.Equal(t, "visitor", views[0][1])
+	assert.Equal(t, views[1][1], views[2][1])
+	assert.NotEqual(t, views[1][1], views[3][1])
+	assert.NotEqual(t, models.HashIP("reader"), views[1][1])
+	assert.NotEqual(t, "reader", views[1][1])
+
+	_, err = exports.Columns("visitors")
+	assert.ErrorIs(t, err, ErrUnknownDataset)
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/webbesoft/doorman/internal/metrics"
 	"github.com/webbesoft/doorman/internal/models"
 	"gorm.io/gorm"
 )
@@ -38,7 +39,10 @@ func NewGeoService(db *gorm.DB) *GeoService {
 	}
 }
 
-func getGeoData(ip string) (*GeoData, error) {
+// getGeoData is a variable so tests can stub the upstream lookup
+var getGeoData = lookupGeoData
+
+func lookupGeoData(ip string) (*GeoData, error) {
 	url := fmt.Sprintf("http://ip-api.com/json/%s?fields=status,country,regionName,city", ip)
 
 	client := &http.Client{Timeout: 2 * time.Second}
@@ -62,7 +66,7 @@ func getGeoData(ip string) (*GeoData, error) {
 
 func (g *GeoService) GetGeoDataCached(ip, ipHash string) *GeoData {
 	if !isPublicIP(net.ParseIP(ip)) {
-		return &GeoData{}
+		return nil
 	}
 
 	g.geoCacheMux.RLock()
@@ -91,8 +95,11 @@ func (g *GeoService) GetGeoDataCached(ip, ipHash string) *GeoData {
 		return geo
 	}
 
+	start := time.Now()
 	geo, err := g.getGeoFunc(ip)
+	metrics.GeoLookupDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.GeoLookupErrors.Inc()
 		return nil
 	}
 
@@ -20,7 +20,7 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
 	assert.NoError(t, err)
 
-	err = db.AutoMigrate(&models.Analytics{}, &models.PageVisit{})
+	err = db.AutoMigrate(&models.Analytics{}, &models.PageVisit{}, &models.ImportedStat{})
 	assert.NoError(t, err)
 	return db
 }
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+// Reasons an event is refused by IngestLimiter, as recorded in the
+// rejected events counter.
+const (
+	RejectVisitorRate = "visitor_rate"
+	RejectGlobalRate  = "global_rate"
+)
+
+// IngestLimiter rate-limits tracking events with token buckets: one per
+// visitor and one shared by all of them. Buckets are kept in memory, so
+// every replica enforces the limits on its own.
+type IngestLimiter struct {
+	Config config.IngestConfig
+	Now    func() time.Time
+
+	mu        sync.Mutex
+	global    *rate.Limiter
+	visitors  map[string]*visitorBucket
+	lastSweep time.Time
+}
+
+type visitorBucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+func NewIngestLimiter(cfg config.IngestConfig) *IngestLimiter {
+	l := &IngestLimiter{Config: cfg, Now: time.Now, visitors: map[string]*visitorBucket{}}
+	if cfg.GlobalRate > 0 {
+		l.global = rate.NewLimiter(rate.Limit(cfg.GlobalRate), cfg.GlobalBurst)
+	}
+	return l
+}
+
+// Allow reports whether an event from visitor may be accepted and, if
+// not, which limit it ran into. A nil limiter allows everything.
+func (l *IngestLimiter) Allow(visitor string) (bool, string) {
+	if l == nil {
+		return true, ""
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.Now()
+	if l.Config.VisitorRate > 0 {
+		l.sweep(now)
+		b, ok := l.visitors[visitor]
+		if !ok {
+			b = &visitorBucket{limiter: rate.NewLimiter(rate.Limit(l.Config.VisitorRate), l.Config.VisitorBurst)}
+			l.visitors[visitor] = b
+		}
+		b.seen = now
+		// A visitor over its own limit doesn't use up the shared bucket.
+		if !b.limiter.AllowN(now, 1) {
+			return false, RejectVisitorRate
+		}
+	}
+	if l.global != nil && !l.global.AllowN(now, 1) {
+		return false, RejectGlobalRate
+	}
+	return true, ""
+}
+
+// sweep forgets visitors whose bucket has refilled completely, since a
+// new bucket behaves the same. It runs at most once a minute.
+func (l *IngestLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(float64(l.Config.VisitorBurst) / l.Config.VisitorRate * float64(time.Second))
+	for key, b := range l.visitors {
+		if now.Sub(b.seen) > refill {
+			delete(l.visitors, key)
+		}
+	}
+}
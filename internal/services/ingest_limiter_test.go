@@ -0,0 +1,48 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/webbesoft/doorman/internal/config"
+)
+
+func TestIngestLimiter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := NewIngestLimiter(config.IngestConfig{VisitorRate: 1, VisitorBurst: 3, GlobalRate: 10, GlobalBurst: 5})
+	l.Now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.Allow("alice")
+		assert.True(t, ok)
+	}
+	ok, reason := l.Allow("alice")
+	assert.False(t, ok)
+	assert.Equal(t, RejectVisitorRate, reason)
+
+	// Other visitors have their own bucket but share the global one, which
+	// alice's rejected event didn't touch.
+	ok, _ = l.Allow("bob")
+	assert.True(t, ok)
+	ok, _ = l.Allow("carol")
+	assert.True(t, ok)
+	ok, reason = l.Allow("dave")
+	assert.False(t, ok)
+	assert.Equal(t, RejectGlobalRate, reason)
+
+	// Buckets refill over time.
+	now = now.Add(2 * time.Second)
+	ok, _ = l.Allow("alice")
+	assert.True(t, ok)
+
+	// Idle visitors are forgotten once their bucket would be full again.
+	now = now.Add(time.Hour)
+	l.Allow("erin")
+	assert.Len(t, l.visitors, 1)
+
+	var unlimited *IngestLimiter
+	ok, _ = unlimited.Allow("anyone")
+	assert.True(t, ok)
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+var (
+	ErrSSODenied      = errors.New("your account isn't allowed to sign in to Doorman")
+	ErrSSONonce       = errors.New("ID token nonce doesn't match the login request")
+	ErrSSONoIDToken   = errors.New("provider didn't return an ID token")
+	ErrSSOUnavailable = errors.New("SSO provider is unavailable")
+)
+
+// OIDCIdentity is what Doorman takes from a verified ID token.
+type OIDCIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Groups            []string
+}
+
+// Username is the Doorman username for the identity: the verified email,
+// then the preferred username, then the subject.
+func (id *OIDCIdentity) Username() string {
+	if id.Email != "" && id.EmailVerified {
+		return strings.ToLower(id.Email)
+	}
+	if id.PreferredUsername != "" {
+		return id.PreferredUsername
+	}
+	return id.Subject
+}
+
+// OIDCService signs users in through an OpenID Connect provider. The
+// discovery document is fetched on first use, so Doorman still starts
+// while the provider is down.
+type OIDCService struct {
+	Config config.OIDCConfig
+	// HTTPClient is used for discovery, token and key requests.
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewOIDCService(cfg config.OIDCConfig) *OIDCService {
+	return &OIDCService{Config: cfg, HTTPClient: http.DefaultClient}
+}
+
+func (s *OIDCService) context(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, s.HTTPClient)
+}
+
+func (s *OIDCService) discover(ctx context.Context) (*oidc.Provider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.provider == nil {
+		provider, err := oidc.NewProvider(s.context(ctx), s.Config.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSSOUnavailable, err)
+		}
+		s.provider = provider
+	}
+	return s.provider, nil
+}
+
+func (s *OIDCService) oauth2Config(provider *oidc.Provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     s.Config.ClientID,
+		ClientSecret: s.Config.ClientSecret,
+		RedirectURL:  s.Config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       s.Config.Scopes,
+	}
+}
+
+// AuthCodeURL returns the provider URL to send the browser to. state,
+// nonce and verifier must be kept in the session for Exchange.
+func (s *OIDCService) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	provider, err := s.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	return s.oauth2Config(provider).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Exchange redeems the authorization code and verifies the ID token that
+// comes with it.
+func (s *OIDCService) Exchange(ctx context.Context, code, nonce, verifier string) (*OIDCIdentity, error) {
+	provider, err := s.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = s.context(ctx)
+	token, err := s.oauth2Config(provider).Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrSSONoIDToken
+	}
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: s.Config.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("verify ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, ErrSSONonce
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("read ID token claims: %w", err)
+	}
+	var all map[string]interface{}
+	if err := idToken.Claims(&all); err != nil {
+		return nil, fmt.Errorf("read ID token claims: %w", err)
+	}
+
+	return &OIDCIdentity{
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Groups:            stringsClaim(all[s.Config.GroupsClaim]),
+	}, nil
+}
+
+// Role checks the identity against the allowed domains and groups and
+// returns the role it maps to.
+func (s *OIDCService) Role(id *OIDCIdentity) (string, error) {
+	allowed := false
+	if id.EmailVerified {
+		if _, domain, ok := strings.Cut(strings.ToLower(id.Email), "@"); ok {
+			allowed = slices.ContainsFunc(s.Config.AllowedDomains, func(d string) bool {
+				return strings.EqualFold(d, domain)
+			})
+		}
+	}
+	if !allowed && inAnyGroup(id.Groups, s.Config.AllowedGroups) {
+		allowed = true
+	}
+	if !allowed {
+		return "", ErrSSODenied
+	}
+
+	switch {
+	case inAnyGroup(id.Groups, s.Config.OwnerGroups):
+		return models.RoleOwner, nil
+	case inAnyGroup(id.Groups, s.Config.AdminGroups):
+		return models.RoleAdmin, nil
+	default:
+		return s.Config.DefaultRole, nil
+	}
+}
+
+// SyncsRoles reports whether the provider's groups decide roles on every
+// sign-in rather than only for new users.
+func (s *OIDCService) SyncsRoles() bool {
+	return len(s.Config.OwnerGroups)+len(s.Config.AdminGroups) > 0
+}
+
+func inAnyGroup(groups, wanted []string) bool {
+	for _, g := range wanted {
+		if slices.Contains(groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// stringsClaim reads a claim that providers send as either a list or a
+// single string.
+func stringsClaim(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/oidctest"
+)
+
+func newTestOIDC(t *testing.T) (*OIDCService, *oidctest.Server) {
+	t.Helper()
+	idp := oidctest.NewServer(t, "doorman")
+
+	cfg := config.Default().OIDC
+	cfg.Issuer = idp.URL
+	cfg.ClientID = "doorman"
+	cfg.ClientSecret = "secret"
+	cfg.RedirectURL = "http://doorman.test/login/oidc/callback"
+	cfg.AllowedDomains = []string{"example.com"}
+	cfg.AllowedGroups = []string{"analytics"}
+	cfg.AdminGroups = []string{"analytics-admins"}
+
+	return NewOIDCService(cfg), idp
+}
+
+// signIn runs the authorization code flow against the mock provider.
+func signIn(t *testing.T, s *OIDCService, idp *oidctest.Server, nonce string) (*OIDCIdentity, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	authURL, err := s.AuthCodeURL(ctx, "state", "nonce", "verifier-verifier-verifier-verifier-verifier")
+	require.NoError(t, err)
+
+	callback, err := idp.Authorize(authURL)
+	require.NoError(t, err)
+	assert.Equal(t, "state", callback.Query().Get("state"))
+
+	return s.Exchange(ctx, callback.Query().Get("code"), nonce, "verifier-verifier-verifier-verifier-verifier")
+}
+
+func TestOIDCService_Exchange(t *testing.T) {
+	s, idp := newTestOIDC(t)
+
+	idp.SetClaims(map[string]interface{}{
+		"sub":            "user-1",
+		"email":          "Alice@Example.com",
+		"email_verified": true,
+		"groups":         []string{"analytics", "analytics-admins"},
+	})
+	id, err := signIn(t, s, idp, "nonce")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", id.Subject)
+	assert.Equal(t, "alice@example.com", id.Username())
+	assert.Equal(t, []string{"analytics", "analytics-admins"}, id.Groups)
+
+	role, err := s.Role(id)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, role)
+
+	_, err = signIn(t, s, idp, "other-nonce")
+	assert.ErrorIs(t, err, ErrSSONonce)
+
+	// A code can only be redeemed with the PKCE verifier it was issued for.
+	authURL, err := s.AuthCodeURL(context.Background(), "state", "nonce", "verifier-verifier-verifier-verifier-verifier")
+	require.NoError(t, err)
+	callback, err := idp.Authorize(authURL)
+	require.NoError(t, err)
+	_, err = s.Exchange(context.Background(), callback.Query().Get("code"), "nonce", "wrong-verifier-wrong-verifier-wrong-verifier")
+	assert.Error(t, err)
+}
+
+func TestOIDCService_Role(t *testing.T) {
+	s, _ := newTestOIDC(t)
+
+	tests := []struct {
+		name string
+		id   OIDCIdentity
+		role string
+		err  error
+	}{
+		{"verified domain", OIDCIdentity{Email: "bob@example.com", EmailVerified: true}, models.RoleViewer, nil},
+		{"unverified domain", OIDCIdentity{Email: "bob@example.com"}, "", ErrSSODenied},
+		{"lookalike domain", OIDCIdentity{Email: "bob@example.com.evil", EmailVerified: true}, "", ErrSSODenied},
+		{"allowed group", OIDCIdentity{Email: "bob@other.org", Groups: []string{"analytics"}}, models.RoleViewer, nil},
+		{"admin group still needs access", OIDCIdentity{Groups: []string{"analytics-admins"}}, "", ErrSSODenied},
+		{"admin group", OIDCIdentity{Groups: []string{"analytics", "analytics-admins"}}, models.RoleAdmin, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role, err := s.Role(&tt.id)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.role, role)
+		})
+	}
+}
+
+func TestUserService_ProvisionOIDC(t *testing.T) {
+	db := newUserTestDB(t)
+	users := NewUserService(db)
+
+	owner, err := users.Create("owner", "password1", models.RoleOwner)
+	require.NoError(t, err)
+
+	// First sign-in creates the user without a usable password.
+	alice := &OIDCIdentity{Subject: "sub-alice", Email: "alice@example.com", EmailVerified: true}
+	created, err := users.ProvisionOIDC(alice, models.RoleViewer, false)
+	require.NoError(t, err)
+	assert.Equal(t, "alice@example.com", created.Username)
+	assert.False(t, models.CheckPasswordHash("", created.Password))
+
+	// Later sign-ins find the same user; roles follow the provider only
+	// when syncing.
+	again, err := users.ProvisionOIDC(alice, models.RoleAdmin, false)
+	require.NoError(t, err)
+	assert.Equal(t, created.ID, again.ID)
+	assert.Equal(t, models.RoleViewer, again.Role)
+	_, err = users.ProvisionOIDC(alice, models.RoleAdmin, true)
+	require.NoError(t, err)
+	synced, err := users.Get(created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleAdmin, synced.Role)
+
+	// A pending invite for the verified email is linked and completed.
+	invited, _, err := users.Invite(owner, "bob@example.com", models.RoleViewer, nil)
+	require.NoError(t, err)
+	bob := &OIDCIdentity{Subject: "sub-bob", Email: "bob@example.com", EmailVerified: true}
+	linked, err := users.ProvisionOIDC(bob, models.RoleViewer, false)
+	require.NoError(t, err)
+	assert.Equal(t, invited.ID, linked.ID)
+	linked, err = users.Get(linked.ID)
+	require.NoError(t, err)
+	assert.False(t, linked.InvitePending())
+
+	// A username that isn't a verified email never takes over a local user.
+	mallory := &OIDCIdentity{Subject: "sub-mallory", PreferredUsername: "owner"}
+	_, err = users.ProvisionOIDC(mallory, models.RoleViewer, false)
+	assert.ErrorIs(t, err, ErrUsernameTaken)
+
+	// Syncing never demotes the last owner.
+	require.NoError(t, db.Model(owner).Update("oidc_subject", "sub-owner").Error)
+	_, err = users.ProvisionOIDC(&OIDCIdentity{Subject: "sub-owner"}, models.RoleViewer, true)
+	require.NoError(t, err)
+	owner, err = users.Get(owner.ID)
+	require.NoError(t, err)
+	assert.Equal(t, models.RoleOwner, owner.Role)
+}
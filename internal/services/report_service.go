@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/mailer"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("report schedule not found")
+	ErrInvalidFrequency = errors.New("frequency must be weekly or monthly")
+	ErrMailDisabled     = errors.New("email isn't set up; set mail.host to send reports")
+)
+
+const (
+	// reportRetry is how long a report that couldn't be sent waits
+	// before it's tried again.
+	reportRetry = time.Hour
+	// reportTopLimit is how many pages and referrers a report lists.
+	reportTopLimit = 10
+)
+
+// ReportRenderer renders a report as an email without a recipient.
+type ReportRenderer func(ctx context.Context, report types.EmailReport) (mailer.Message, error)
+
+// ReportService manages scheduled email reports and sends them.
+type ReportService struct {
+	DB *gorm.DB
+	// Mailer is nil when email isn't set up.
+	Mailer mailer.Mailer
+	Render ReportRenderer
+	// BaseURL is where the dashboard is reached, for links in reports.
+	BaseURL string
+}
+
+func NewReportService(db *gorm.DB, m mailer.Mailer, render ReportRenderer, baseURL string) *ReportService {
+	return &ReportService{DB: db, Mailer: m, Render: render, BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// ReportPeriod returns the last whole week, Monday to Sunday, or calendar
+// month before now, in UTC. to is exclusive.
+func ReportPeriod(frequency string, now time.Time) (from, to time.Time) {
+	now = now.UTC()
+	if frequency == models.ReportMonthly {
+		to = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return to.AddDate(0, -1, 0), to
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	to = today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	return to.AddDate(0, 0, -7), to
+}
+
+// nextReportRun is when the period after the one now is in ends, which is
+// when its report is due.
+func nextReportRun(frequency string, now time.Time) time.Time {
+	_, to := ReportPeriod(frequency, now)
+	if frequency == models.ReportMonthly {
+		return to.AddDate(0, 1, 0)
+	}
+	return to.AddDate(0, 0, 7)
+}
+
+// List returns every schedule with its site.
+func (s *ReportService) List() ([]models.ReportSchedule, error) {
+	var schedules []models.ReportSchedule
+	err := s.DB.Preload("Site").Order("site_id, email").Find(&schedules).Error
+	return schedules, err
+}
+
+// Add schedules reports on siteID for email. The first is sent when the
+// current week or month ends.
+func (s *ReportService) Add(siteID uint, email, frequency string) (*models.ReportSchedule, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return nil, errors.New("email address is invalid")
+	}
+	if frequency != models.ReportWeekly && frequency != models.ReportMonthly {
+		return nil, ErrInvalidFrequency
+	}
+	if err := s.DB.First(&models.Site{}, siteID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSiteNotFound
+		}
+		return nil, err
+	}
+
+	var count int64
+	s.DB.Model(&models.ReportSchedule{}).Where("site_id = ? AND email = ?", siteID, addr.Address).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("%s already gets reports for this site", addr.Address)
+	}
+
+	schedule := &models.ReportSchedule{
+		SiteID:    siteID,
+		Email:     addr.Address,
+		Frequency: frequency,
+		NextRunAt: nextReportRun(frequency, time.Now()),
+	}
+	if err := s.DB.Create(schedule).Error; err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// Delete stops a schedule.
+func (s *ReportService) Delete(id uint) error {
+	res := s.DB.Delete(&models.ReportSchedule{}, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// Build gathers the report on site for the last period of frequency
+// before now.
+func (s *ReportService) Build(site models.Site, frequency string, now time.Time) (types.EmailReport, error) {
+	from, to := ReportPeriod(frequency, now)
+	report := types.EmailReport{Site: site.Name, Frequency: frequency, From: from, To: to}
+	if s.BaseURL != "" {
+		report.DashboardURL = s.BaseURL + "/dashboard?site=" + strconv.FormatUint(uint64(site.ID), 10)
+	}
+
+	stats := NewStatsService(s.DB)
+	f := types.StatsFilter{SiteID: &site.ID, From: from, To: to}
+	prev := types.StatsFilter{SiteID: &site.ID, From: from.AddDate(0, 0, -7), To: from}
+	if frequency == models.ReportMonthly {
+		prev.From = from.AddDate(0, -1, 0)
+	}
+
+	var errs []error
+	var err error
+	report.Current, err = stats.Overview(f)
+	errs = append(errs, err)
+	report.Previous, err = stats.Overview(prev)
+	errs = append(errs, err)
+	report.TopPages, err = stats.TopPages(f, reportTopLimit)
+	errs = append(errs, err)
+	report.TopReferrers, err = stats.TopReferrers(f, reportTopLimit)
+	errs = append(errs, err)
+
+	return report, errors.Join(errs...)
+}
+
+// send renders report and mails it to email.
+func (s *ReportService) send(ctx context.Context, email string, report types.EmailReport) error {
+	if s.Mailer == nil {
+		return ErrMailDisabled
+	}
+
+	msg, err := s.Render(ctx, report)
+	if err != nil {
+		return err
+	}
+	msg.To = email
+	return s.Mailer.Send(ctx, msg)
+}
+
+// SendTest sends the report of schedule id for the last period right
+// away, marked as a test. The schedule itself is left as it is.
+func (s *ReportService) SendTest(ctx context.Context, id uint) error {
+	if s.Mailer == nil {
+		return ErrMailDisabled
+	}
+
+	var schedule models.ReportSchedule
+	if err := s.DB.Preload("Site").First(&schedule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrScheduleNotFound
+		}
+		return err
+	}
+	if schedule.Site == nil {
+		return ErrSiteNotFound
+	}
+
+	report, err := s.Build(*schedule.Site, schedule.Frequency, time.Now())
+	if err != nil {
+		return err
+	}
+	report.Test = true
+	return s.send(ctx, schedule.Email, report)
+}
+
+// SendDue sends every report due by now and schedules the next. Reports
+// that fail are tried again after reportRetry, with the failure kept on
+// the schedule. A report covers the period that ended at its NextRunAt,
+// however late it's sent.
+func (s *ReportService) SendDue(ctx context.Context, now time.Time) (int, error) {
+	var due []models.ReportSchedule
+	err := s.DB.Preload("Site").
+		Where("next_run_at <= ? AND (retry_at IS NULL OR retry_at <= ?)", now, now).
+		Order("id").
+		Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+
+	// Recipients of the same report share its figures.
+	type key struct {
+		site      uint
+		frequency string
+		period    time.Time
+	}
+	reports := map[key]types.EmailReport{}
+	build := func(schedule models.ReportSchedule) (types.EmailReport, error) {
+		if schedule.Site == nil {
+			return types.EmailReport{}, ErrSiteNotFound
+		}
+		_, to := ReportPeriod(schedule.Frequency, schedule.NextRunAt)
+		k := key{schedule.SiteID, schedule.Frequency, to}
+		if report, ok := reports[k]; ok {
+			return report, nil
+		}
+		report, err := s.Build(*schedule.Site, schedule.Frequency, schedule.NextRunAt)
+		if err == nil {
+			reports[k] = report
+		}
+		return report, err
+	}
+
+	sent := 0
+	var errs []error
+	for _, schedule := range due {
+		report, err := build(schedule)
+		if err == nil {
+			err = s.send(ctx, schedule.Email, report)
+		}
+
+		updates := map[string]interface{}{
+			"last_sent_at": now,
+			"last_error":   "",
+			"next_run_at":  nextReportRun(schedule.Frequency, now),
+			"retry_at":     nil,
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("report to %s: %w", schedule.Email, err))
+			updates = map[string]interface{}{"last_error": err.Error(), "retry_at": now.Add(reportRetry)}
+		} else {
+			sent++
+		}
+		if err := s.DB.Model(&schedule).Updates(updates).Error; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return sent, errors.Join(errs...)
+}
+
+// StartReportRoutine sends due reports every cfg.ReportInterval.
+func StartReportRoutine(db *gorm.DB, m mailer.Mailer, render ReportRenderer, cfg config.MailConfig) {
+	reports := NewReportService(db, m, render, cfg.BaseURL)
+	ticker := time.NewTicker(cfg.ReportInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sent, err := reports.SendDue(context.Background(), time.Now())
+		if sent > 0 {
+			log.Printf("Sent %d scheduled reports", sent)
+		}
+		if err != nil {
+			log.Printf("Scheduled reports failed: %v", err)
+		}
+	}
+}
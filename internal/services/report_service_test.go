@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/mailer"
+	"github.com/webbesoft/doorman/internal/mailtest"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+func TestReportPeriod(t *testing.T) {
+	wednesday := time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC)
+	from, to := ReportPeriod(models.ReportWeekly, wednesday)
+	assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), to)
+	assert.Equal(t, time.Date(2026, 10, 26, 0, 0, 0, 0, time.UTC), nextReportRun(models.ReportWeekly, wednesday))
+
+	// Sunday is still part of the running week.
+	from, _ = ReportPeriod(models.ReportWeekly, time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC))
+	assert.Equal(t, time.Date(2026, 10, 5, 0, 0, 0, 0, time.UTC), from)
+
+	from, to = ReportPeriod(models.ReportMonthly, wednesday)
+	assert.Equal(t, time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), to)
+	assert.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), nextReportRun(models.ReportMonthly, wednesday))
+}
+
+func TestReportService(t *testing.T) {
+	db := newEventTestDB(t)
+	server := mailtest.NewServer(t)
+	m, err := mailer.NewSMTP(server.Config())
+	require.NoError(t, err)
+	var rendered []types.EmailReport
+	render := func(_ context.Context, r types.EmailReport) (mailer.Message, error) {
+		rendered = append(rendered, r)
+		return mailer.Message{Subject: "Report for " + r.Site, Text: "report"}, nil
+	}
+	reports := NewReportService(db, m, render, "https://doorman.example.com/")
+
+	site, err := NewSiteService(db).Add("Blog", "blog.example.com")
+	require.NoError(t, err)
+	visits := []struct {
+		url, ip, referrer string
+		day               int
+	}{
+		{"https://blog.example.com/pricing", "ip1", "https://news.example.org/", 13},
+		{"https://blog.example.com/pricing", "ip2", "", 14},
+		{"https://blog.example.com/", "ip1", "", 18},
+		{"https://blog.example.com/", "ip3", "", 7},
+		{"https://blog.example.com/", "ip3", "", 20},
+	}
+	for _, v := range visits {
+		at := time.Date(2026, 10, v.day, 9, 0, 0, 0, time.UTC)
+		a := models.Analytics{SiteID: &site.ID, URL: v.url, Referrer: v.referrer, IPHash: v.ip, CreatedAt: at}
+		require.NoError(t, db.Create(&a).Error)
+		require.NoError(t, db.Create(&models.PageVisit{AnalyticsID: a.ID, SiteID: &site.ID, URL: v.url, IPHash: v.ip, CreatedAt: at}).Error)
+	}
+
+	_, err = reports.Add(site.ID, "not an address", models.ReportWeekly)
+	assert.Error(t, err)
+	_, err = reports.Add(site.ID, "ada@example.org", "daily")
+	assert.ErrorIs(t, err, ErrInvalidFrequency)
+	_, err = reports.Add(site.ID+1, "ada@example.org", models.ReportWeekly)
+	assert.ErrorIs(t, err, ErrSiteNotFound)
+
+	schedule, err := reports.Add(site.ID, "Ada <ada@example.org>", models.ReportWeekly)
+	require.NoError(t, err)
+	assert.Equal(t, "ada@example.org", schedule.Email)
+	assert.True(t, schedule.NextRunAt.After(time.Now()))
+	_, err = reports.Add(site.ID, "ada@example.org", models.ReportMonthly)
+	assert.ErrorContains(t, err, "already gets reports")
+
+	now := time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, db.Model(schedule).Update("next_run_at", now.Add(-time.Minute)).Error)
+
+	sent, err := reports.SendDue(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+
+	msgs := server.Messages()
+	require.Len(t, msgs, 1)
+	assert.Equal(t, []string{"ada@example.org"}, msgs[0].To)
+	assert.Equal(t, "Report for Blog", msgs[0].Header("Subject"))
+	require.Len(t, rendered, 1)
+	report := rendered[0]
+	assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), report.From)
+	assert.Equal(t, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), report.To)
+	assert.Equal(t, int64(2), report.Current.UniqueVisitors)
+	assert.Equal(t, int64(1), report.Previous.UniqueVisitors)
+	assert.Equal(t, int64(3), report.Current.TotalPageVisits)
+	assert.Equal(t, int64(1), report.Previous.TotalPageVisits)
+	assert.Equal(t, "https://blog.example.com/pricing", report.TopPages[0].URL)
+	assert.Equal(t, int64(2), report.TopPages[0].Visits)
+	assert.Contains(t, report.TopReferrers, types.TopReferrer{Referrer: "https://news.example.org/", Count: 1})
+	assert.Equal(t, "https://doorman.example.com/dashboard?site=1", report.DashboardURL)
+
+	var stored models.ReportSchedule
+	require.NoError(t, db.First(&stored, schedule.ID).Error)
+	assert.Equal(t, time.Date(2026, 10, 26, 0, 0, 0, 0, time.UTC), stored.NextRunAt.UTC())
+	require.NotNil(t, stored.LastSentAt)
+	assert.Empty(t, stored.LastError)
+
+	sent, err = reports.SendDue(context.Background(), now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent, "nothing is due until next week")
+
+	// A refused report is tried again later, for the period that was due
+	// even once the next one has started.
+	server.Reject("mailbox full")
+	require.NoError(t, db.Model(schedule).Update("next_run_at", now).Error)
+	_, err = reports.SendDue(context.Background(), now)
+	assert.ErrorContains(t, err, "mailbox full")
+	require.NoError(t, db.First(&stored, schedule.ID).Error)
+	assert.Contains(t, stored.LastError, "mailbox full")
+	assert.Equal(t, now, stored.NextRunAt.UTC())
+	require.NotNil(t, stored.RetryAt)
+	assert.Equal(t, now.Add(reportRetry), stored.RetryAt.UTC())
+	sent, err = reports.SendDue(context.Background(), now.Add(reportRetry/2))
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent, "nothing is sent before the retry")
+
+	server.Reject("")
+	nextWeek := now.AddDate(0, 0, 7)
+	sent, err = reports.SendDue(context.Background(), nextWeek)
+	require.NoError(t, err)
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, time.Date(2026, 10, 12, 0, 0, 0, 0, time.UTC), rendered[len(rendered)-1].From)
+	stored = models.ReportSchedule{}
+	require.NoError(t, db.First(&stored, schedule.ID).Error)
+	assert.Nil(t, stored.RetryAt)
+	assert.Empty(t, stored.LastError)
+	assert.Equal(t, time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC), stored.NextRunAt.UTC())
+
+	require.NoError(t, reports.SendTest(context.Background(), schedule.ID))
+	assert.Len(t, server.Messages(), 3)
+	assert.True(t, rendered[len(rendered)-1].Test)
+	assert.ErrorIs(t, reports.SendTest(context.Background(), schedule.ID+1), ErrScheduleNotFound)
+
+	assert.ErrorIs(t, NewReportService(db, nil, render, "").SendTest(context.Background(), schedule.ID), ErrMailDisabled)
+
+	require.NoError(t, reports.Delete(schedule.ID))
+	assert.ErrorIs(t, reports.Delete(schedule.ID), ErrScheduleNotFound)
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type SessionService struct {
+	DB *gorm.DB
+}
+
+func NewSessionService(db *gorm.DB) *SessionService {
+	return &SessionService{DB: db}
+}
+
+// ListForUser returns the user's unexpired sessions, most recent first.
+func (s *SessionService) ListForUser(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := s.DB.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke ends one of the user's sessions.
+func (s *SessionService) Revoke(userID, sessionID uint) error {
+	res := s.DB.Where("id = ? AND user_id = ?", sessionID, userID).Delete(&models.Session{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAll ends every session of the user except keep, which may be zero.
+func (s *SessionService) RevokeAll(userID, keep uint) (int64, error) {
+	res := s.DB.Where("user_id = ? AND id != ?", userID, keep).Delete(&models.Session{})
+	return res.RowsAffected, res.Error
+}
+
+// PruneExpired deletes sessions past their idle or absolute deadline.
+func (s *SessionService) PruneExpired() (int64, error) {
+	res := s.DB.Where("expires_at <= ?", time.Now()).Delete(&models.Session{})
+	return res.RowsAffected, res.Error
+}
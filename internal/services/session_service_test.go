@@ -0,0 +1,67 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func TestSessionService(t *testing.T) {
+	db := newUserTestDB(t)
+	users := NewUserService(db)
+	sessions := NewSessionService(db)
+
+	alice, err := users.Create("alice", "password1", models.RoleAdmin)
+	require.NoError(t, err)
+	bob, err := users.Create("bob", "password1", models.RoleViewer)
+	require.NoError(t, err)
+
+	newSession := func(userID uint, expiresAt time.Time) uint {
+		row := models.Session{
+			TokenHash:  models.HashToken(fmt.Sprintf("token-%d-%d", userID, expiresAt.UnixNano())),
+			UserID:     &userID,
+			LastSeenAt: time.Now(),
+			ExpiresAt:  expiresAt,
+		}
+		require.NoError(t, db.Create(&row).Error)
+		return row.ID
+	}
+
+	later := time.Now().Add(time.Hour)
+	current := newSession(alice.ID, later)
+	other := newSession(alice.ID, later.Add(time.Second))
+	newSession(alice.ID, time.Now().Add(-time.Minute))
+	bobs := newSession(bob.ID, later)
+
+	list, err := sessions.ListForUser(alice.ID)
+	require.NoError(t, err)
+	assert.Len(t, list, 2, "expired sessions aren't listed")
+
+	// A user can only revoke their own sessions.
+	assert.ErrorIs(t, sessions.Revoke(alice.ID, bobs), ErrSessionNotFound)
+	assert.NoError(t, sessions.Revoke(alice.ID, other))
+
+	pruned, err := sessions.PruneExpired()
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, pruned)
+
+	// Changing the password keeps only the session it was changed from.
+	newSession(alice.ID, later.Add(2*time.Second))
+	assert.ErrorIs(t, users.ChangePassword(alice, "wrong", "password2", current), ErrWrongPassword)
+	require.NoError(t, users.ChangePassword(alice, "password1", "password2", current))
+	list, err = sessions.ListForUser(alice.ID)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, current, list[0].ID)
+
+	// Disabling a user signs them out everywhere.
+	require.NoError(t, users.SetDisabled(alice, bob.ID, true))
+	list, err = sessions.ListForUser(bob.ID)
+	require.NoError(t, err)
+	assert.Empty(t, list)
+}
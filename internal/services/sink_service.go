@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/metrics"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+	"github.com/webbesoft/doorman/internal/webhook"
+)
+
+// sinkEvent names sink requests in the X-Doorman-Event header.
+const sinkEvent = "events.batch"
+
+// EventSink forwards accepted tracking events to the configured endpoints
+// in batches. A batch an endpoint doesn't take after every attempt is kept
+// as a dead letter for Replay.
+type EventSink struct {
+	DB     *gorm.DB
+	Client *http.Client
+	cfg    config.SinkConfig
+	queue  chan types.SinkEvent
+}
+
+func NewEventSink(db *gorm.DB, cfg config.SinkConfig) *EventSink {
+	return &EventSink{
+		DB:     db,
+		Client: &http.Client{Timeout: webhookTimeout},
+		cfg:    cfg,
+		queue:  make(chan types.SinkEvent, cfg.QueueSize),
+	}
+}
+
+// sinkPayload is the body of every sink request.
+type sinkPayload struct {
+	Events []types.SinkEvent `json:"events"`
+}
+
+// Enqueue queues events for Run without waiting. Events that don't fit in
+// the queue are dropped and counted.
+func (s *EventSink) Enqueue(events ...types.SinkEvent) {
+	for i, ev := range events {
+		select {
+		case s.queue <- ev:
+		default:
+			metrics.SinkEvents.WithLabelValues("dropped").Add(float64(len(events) - i))
+			return
+		}
+	}
+}
+
+// Run sends queued events until ctx is done, then keeps what's left as
+// dead letters. A batch being sent when ctx is done is sent to the end.
+func (s *EventSink) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]types.SinkEvent, 0, s.cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.Deliver(context.Background(), batch); err != nil {
+			log.Printf("Event sink: %v", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev := <-s.queue:
+			batch = append(batch, ev)
+			if len(batch) >= s.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			if len(batch) > 0 {
+				s.deadLetter(batch, errors.New("sink stopped"))
+			}
+			return
+		}
+	}
+}
+
+// Deliver sends events to every endpoint at once as one batch, keeping a
+// dead letter for each endpoint that doesn't take it.
+func (s *EventSink) Deliver(ctx context.Context, events []types.SinkEvent) error {
+	body, err := json.Marshal(sinkPayload{Events: events})
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(s.cfg.URLs))
+	var wg sync.WaitGroup
+	for i, url := range s.cfg.URLs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempts, err := s.send(ctx, url, body)
+			if err == nil {
+				metrics.SinkEvents.WithLabelValues("delivered").Add(float64(len(events)))
+				return
+			}
+			errs[i] = fmt.Errorf("%s: %w", url, err)
+			if err := s.store(url, body, len(events), attempts, err); err != nil {
+				errs[i] = errors.Join(errs[i], fmt.Errorf("store dead letter: %w", err))
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// deadLetter keeps events for every endpoint without sending them.
+func (s *EventSink) deadLetter(events []types.SinkEvent, reason error) {
+	body, err := json.Marshal(sinkPayload{Events: events})
+	for _, url := range s.cfg.URLs {
+		if err != nil {
+			break
+		}
+		err = s.store(url, body, len(events), 0, reason)
+	}
+	if err != nil {
+		log.Printf("Event sink: dropped %d events: %v", len(events), err)
+	}
+}
+
+// store keeps body as a dead letter for url.
+func (s *EventSink) store(url string, body []byte, events, attempts int, reason error) error {
+	metrics.SinkEvents.WithLabelValues("dead_letter").Add(float64(events))
+	return s.DB.Create(&models.SinkDeadLetter{
+		URL:      url,
+		Payload:  string(body),
+		Events:   events,
+		Attempts: attempts,
+		Error:    reason.Error(),
+	}).Error
+}
+
+// send posts body to url, trying again with growing pauses while the
+// failure looks temporary, and returns how many attempts were made.
+func (s *EventSink) send(ctx context.Context, url string, body []byte) (int, error) {
+	backoff := s.cfg.RetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := webhook.Post(ctx, s.Client, url, s.cfg.Secret, sinkEvent, body)
+		if err == nil || attempt >= s.cfg.MaxAttempts || !retryable(err) {
+			return attempt, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable reports whether a failed request may succeed when made again:
+// anything but a 4xx response other than 408 and 429.
+func retryable(err error) bool {
+	var status *webhook.StatusError
+	if errors.As(err, &status) {
+		return status.Code >= 500 || status.Code == http.StatusRequestTimeout || status.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// DeadLetters lists the batches waiting to be replayed, oldest first.
+func (s *EventSink) DeadLetters() ([]models.SinkDeadLetter, error) {
+	var letters []models.SinkDeadLetter
+	err := s.DB.Omit("payload").Order("id ASC").Find(&letters).Error
+	return letters, err
+}
+
+// Replay sends up to limit dead letters again, oldest first, to the
+// endpoint each was meant for, and deletes those that are taken. A limit
+// of 0 replays them all. Batches that fail again stay for the next replay.
+func (s *EventSink) Replay(ctx context.Context, limit int) (delivered, failed int, err error) {
+	var letters []models.SinkDeadLetter
+	query := s.DB.Order("id ASC")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	if err := query.Find(&letters).Error; err != nil {
+		return 0, 0, err
+	}
+
+	for _, letter := range letters {
+		attempts, sendErr := s.send(ctx, letter.URL, []byte(letter.Payload))
+		if sendErr != nil {
+			failed++
+			err = s.DB.Model(&letter).Updates(map[string]interface{}{
+				"attempts": letter.Attempts + attempts,
+				"error":    sendErr.Error(),
+			}).Error
+		} else {
+			delivered++
+			metrics.SinkEvents.WithLabelValues("replayed").Add(float64(letter.Events))
+			err = s.DB.Delete(&letter).Error
+		}
+		if err != nil {
+			return delivered, failed, err
+		}
+	}
+	return delivered, failed, nil
+}
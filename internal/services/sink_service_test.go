@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/ingest"
+	"github.com/webbesoft/doorman/internal/metrics"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+	"github.com/webbesoft/doorman/internal/webhook"
+)
+
+func TestEventService_Accepted(t *testing.T) {
+	db := newEventTestDB(t)
+	var accepted []types.SinkEvent
+	events := NewEventService(db, nil, 0)
+	events.Accepted = func(ev types.SinkEvent) { accepted = append(accepted, ev) }
+
+	human := Visitor{IPHash: "human", UserAgent: "Mozilla/5.0", Country: "NL", Source: models.SourceServer}
+	require.NoError(t, events.Record(human, &ingest.Event{Type: ingest.TypePageview, URL: "https://example.com/", Referrer: "https://ref.example/"}))
+	require.NoError(t, events.Record(human, &ingest.Event{Type: ingest.TypeCustom, URL: "https://example.com/", Name: "signup", Props: map[string]string{"plan": "pro"}}))
+
+	crawler := Visitor{IPHash: "crawler", UserAgent: "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"}
+	require.NoError(t, events.Record(crawler, &ingest.Event{Type: ingest.TypePageview, URL: "https://example.com/"}))
+	require.NoError(t, events.Record(crawler, &ingest.Event{Type: ingest.TypeCustom, URL: "https://example.com/", Name: "signup"}))
+
+	require.Len(t, accepted, 2, "the crawler's events are left out")
+	view, custom := accepted[0], accepted[1]
+	assert.Len(t, view.ID, 32)
+	assert.NotEqual(t, view.ID, custom.ID)
+	assert.Equal(t, ingest.TypePageview, view.Type)
+	assert.Equal(t, "human", view.Visitor)
+	assert.Equal(t, "NL", view.Country)
+	assert.Equal(t, models.SourceServer, view.Source)
+	assert.Equal(t, "https://ref.example/", view.Referrer)
+	assert.Equal(t, "signup", custom.Name)
+	assert.Equal(t, map[string]string{"plan": "pro"}, custom.Props)
+}
+
+func TestEventService_AcceptedPerSite(t *testing.T) {
+	db := newEventTestDB(t)
+	sites := NewSiteService(db)
+	_, err := sites.Add("Blog", "blog.example.com")
+	require.NoError(t, err)
+	shop, err := sites.Add("Shop", "shop.example.com")
+	require.NoError(t, err)
+	var accepted []types.SinkEvent
+	events := NewEventService(db, nil, 0)
+	events.Accepted = func(ev types.SinkEvent) { accepted = append(accepted, ev) }
+
+	// A visitor flagged on one site isn't held against them on another.
+	crawler := Visitor{IPHash: "crawler", UserAgent: "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)"}
+	require.NoError(t, events.Record(crawler, &ingest.Event{Type: ingest.TypePageview, URL: "https://blog.example.com/"}))
+	require.NoError(t, events.Record(crawler, &ingest.Event{Type: ingest.TypeCustom, URL: "https://blog.example.com/", Name: "signup"}))
+	require.NoError(t, events.Record(crawler, &ingest.Event{Type: ingest.TypeCustom, URL: "https://shop.example.com/", Name: "signup"}))
+
+	require.Len(t, accepted, 1)
+	assert.Equal(t, shop.ID, *accepted[0].SiteID)
+}
+
+// sinkReceiver answers requests with the status codes in statuses, one
+// per request, then 204, and records the payloads it got.
+type sinkReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	payloads []sinkPayload
+	got      chan struct{}
+}
+
+func newSinkReceiver(t *testing.T, statuses ...int) (*sinkReceiver, *httptest.Server) {
+	t.Helper()
+	r := &sinkReceiver{statuses: statuses, got: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var p sinkPayload
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		status := http.StatusNoContent
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		if status < 300 {
+			r.payloads = append(r.payloads, p)
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+		r.got <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	return r, srv
+}
+
+func (r *sinkReceiver) events() []types.SinkEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []types.SinkEvent
+	for _, p := range r.payloads {
+		events = append(events, p.Events...)
+	}
+	return events
+}
+
+func testSinkConfig(urls ...string) config.SinkConfig {
+	cfg := config.Default().Sink
+	cfg.URLs = urls
+	cfg.Secret = "sink-secret"
+	cfg.RetryBackoff = time.Millisecond
+	cfg.MaxAttempts = 3
+	return cfg
+}
+
+func sinkEvents(n int) []types.SinkEvent {
+	events := make([]types.SinkEvent, n)
+	for i := range events {
+		events[i] = types.SinkEvent{ID: fmt.Sprintf("ev%d", i), Type: ingest.TypePageview, URL: "https://example.com/", Visitor: "v"}
+	}
+	return events
+}
+
+func TestEventSink_Deliver(t *testing.T) {
+	db := newEventTestDB(t)
+	var signature string
+	signed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(webhook.SignatureHeader)
+		assert.Equal(t, "events.batch", r.Header.Get(webhook.EventHeader))
+	}))
+	defer signed.Close()
+	flaky, flakySrv := newSinkReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	down, downSrv := newSinkReceiver(t, 500, 500, 500)
+	refusing, refusingSrv := newSinkReceiver(t, http.StatusBadRequest)
+
+	sink := NewEventSink(db, testSinkConfig(signed.URL, flakySrv.URL, downSrv.URL, refusingSrv.URL))
+	err := sink.Deliver(context.Background(), sinkEvents(2))
+	assert.ErrorContains(t, err, downSrv.URL)
+	assert.ErrorContains(t, err, refusingSrv.URL)
+
+	assert.NotEmpty(t, signature)
+	assert.Len(t, flaky.events(), 2, "temporary failures are retried")
+	assert.Len(t, flaky.got, 3)
+	assert.Len(t, down.got, 3, "gives up after max_attempts")
+	assert.Len(t, refusing.got, 1, "4xx responses aren't retried")
+
+	letters, err := sink.DeadLetters()
+	require.NoError(t, err)
+	require.Len(t, letters, 2)
+	if letters[0].URL != downSrv.URL {
+		letters[0], letters[1] = letters[1], letters[0]
+	}
+	assert.Equal(t, downSrv.URL, letters[0].URL)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Equal(t, 2, letters[0].Events)
+	assert.Contains(t, letters[0].Error, "500")
+	assert.Empty(t, letters[0].Payload, "listings leave the payload out")
+	assert.Equal(t, refusingSrv.URL, letters[1].URL)
+	assert.Equal(t, 1, letters[1].Attempts)
+
+	// Once an endpoint is back, replaying sends it the same batch. The
+	// one still refusing keeps its dead letter.
+	refusing.mu.Lock()
+	refusing.statuses = []int{http.StatusBadRequest}
+	refusing.mu.Unlock()
+	delivered, failed, err := sink.Replay(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, []string{"ev0", "ev1"}, []string{down.events()[0].ID, down.events()[1].ID})
+	letters, err = sink.DeadLetters()
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	assert.Equal(t, refusingSrv.URL, letters[0].URL)
+	assert.Equal(t, 2, letters[0].Attempts)
+
+	delivered, _, err = sink.Replay(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, delivered)
+	letters, err = sink.DeadLetters()
+	require.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestEventSink_Run(t *testing.T) {
+	db := newEventTestDB(t)
+	receiver, srv := newSinkReceiver(t)
+	cfg := testSinkConfig(srv.URL)
+	cfg.BatchSize = 2
+	cfg.QueueSize = 3
+	cfg.FlushInterval = time.Hour
+	sink := NewEventSink(db, cfg)
+
+	dropped := testutil.ToFloat64(metrics.SinkEvents.WithLabelValues("dropped"))
+	sink.Enqueue(sinkEvents(4)...)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.SinkEvents.WithLabelValues("dropped"))-dropped, "what doesn't fit in the queue is counted")
+	var letters []models.SinkDeadLetter
+	require.NoError(t, db.Find(&letters).Error)
+	assert.Empty(t, letters)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sink.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-receiver.got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a full batch to be sent")
+	}
+	assert.Len(t, receiver.events(), 2)
+
+	// The half batch still queued is kept when the sink stops.
+	cancel()
+	<-done
+	require.NoError(t, db.Find(&letters).Error)
+	require.Len(t, letters, 1)
+	assert.Equal(t, "sink stopped", letters[0].Error)
+	assert.Contains(t, letters[0].Payload, `"id":"ev2"`)
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+var ErrSiteNotFound = errors.New("site not found")
+
+type SiteService struct {
+	DB *gorm.DB
+}
+
+func NewSiteService(db *gorm.DB) *SiteService {
+	return &SiteService{DB: db}
+}
+
+// NormalizeDomain reduces a domain or URL to the host form sites are
+// stored under: lower case, no scheme, port or leading "www.".
+func NormalizeDomain(raw string) string {
+	raw = strings.TrimSpace(strings.ToLower(raw))
+	if strings.Contains(raw, "://") {
+		if u, err := url.Parse(raw); err == nil {
+			raw = u.Host
+		}
+	}
+	if host, _, ok := strings.Cut(raw, "/"); ok {
+		raw = host
+	}
+	if i := strings.LastIndex(raw, ":"); i != -1 && !strings.Contains(raw[i:], "]") {
+		raw = raw[:i]
+	}
+	return strings.TrimPrefix(raw, "www.")
+}
+
+func (s *SiteService) Add(name, domain string) (*models.Site, error) {
+	domain = NormalizeDomain(domain)
+	if domain == "" {
+		return nil, errors.New("domain is required")
+	}
+	if name == "" {
+		name = domain
+	}
+
+	var count int64
+	s.DB.Model(&models.Site{}).Where("domain = ?", domain).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("site %s already exists", domain)
+	}
+
+	site := &models.Site{Name: name, Domain: domain}
+	if err := s.DB.Create(site).Error; err != nil {
+		return nil, err
+	}
+	return site, nil
+}
+
+func (s *SiteService) List() ([]models.Site, error) {
+	var sites []models.Site
+	err := s.DB.Order("domain").Find(&sites).Error
+	return sites, err
+}
+
+// Any reports whether at least one site is configured.
+func (s *SiteService) Any() (bool, error) {
+	var count int64
+	err := s.DB.Model(&models.Site{}).Limit(1).Count(&count).Error
+	return count > 0, err
+}
+
+// Find looks a site up by domain or numeric ID.
+func (s *SiteService) Find(ref string) (*models.Site, error) {
+	var site models.Site
+	err := s.DB.Where("domain = ?", NormalizeDomain(ref)).First(&site).Error
+	if id, perr := strconv.ParseUint(ref, 10, 64); perr == nil && errors.Is(err, gorm.ErrRecordNotFound) {
+		err = s.DB.Where("id = ?", id).First(&site).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrSiteNotFound, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
+
+// ForURL returns the site whose domain matches the URL host, or nil.
+func (s *SiteService) ForURL(rawURL string) (*models.Site, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, nil
+	}
+
+	var site models.Site
+	err = s.DB.Where("domain = ?", NormalizeDomain(u.Host)).First(&site).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
@@ -0,0 +1,51 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func TestNormalizeDomain(t *testing.T) {
+	cases := map[string]string{
+		"example.com":                    "example.com",
+		"WWW.Example.com":                "example.com",
+		"https://www.example.com/blog/":  "example.com",
+		"blog.example.com:8080":          "blog.example.com",
+		"http://localhost:3000/path?q=1": "localhost",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, NormalizeDomain(in), in)
+	}
+}
+
+func TestSiteService_ForURL(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.AutoMigrate(&models.Site{}))
+
+	sites := NewSiteService(db)
+	site, err := sites.Add("", "https://www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com", site.Name)
+
+	_, err = sites.Add("dupe", "example.com")
+	assert.Error(t, err)
+
+	found, err := sites.ForURL("https://www.example.com/posts/1")
+	assert.NoError(t, err)
+	assert.NotNil(t, found)
+	assert.Equal(t, site.ID, found.ID)
+
+	found, err = sites.ForURL("https://other.org/")
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+
+	found, err = sites.ForURL("/relative-path")
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+type StatsService struct {
+	DB *gorm.DB
+}
+
+func NewStatsService(db *gorm.DB) *StatsService {
+	return &StatsService{DB: db}
+}
+
+// scope applies the filter's site and period to a query on table (or its
+// alias)
+func scope(db *gorm.DB, table string, f types.StatsFilter) *gorm.DB {
+	if f.SiteID != nil {
+		db = db.Where(table+".site_id = ?", *f.SiteID)
+	}
+	if !f.From.IsZero() {
+		db = db.Where(table+".created_at >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		db = db.Where(table+".created_at < ?", f.To)
+	}
+	return db
+}
+
+// scopeAnalytics applies the whole filter to a query on analytics
+func scopeAnalytics(db *gorm.DB, table string, f types.StatsFilter) *gorm.DB {
+	db = scope(db, table, f)
+	switch f.Bots {
+	case types.ExcludeBots:
+		db = db.Where(table+".is_bot = ?", false)
+	case types.OnlyBots:
+		db = db.Where(table+".is_bot = ?", true)
+	}
+	return db
+}
+
+// scopeVisits applies the whole filter to a query on page_visits, whose
+// bot flag lives on their analytics row
+func scopeVisits(db *gorm.DB, table string, f types.StatsFilter) *gorm.DB {
+	db = scope(db, table, f)
+	switch f.Bots {
+	case types.ExcludeBots:
+		db = db.Where(table+".analytics_id NOT IN (SELECT id FROM analytics WHERE is_bot = ?)", true)
+	case types.OnlyBots:
+		db = db.Where(table+".analytics_id IN (SELECT id FROM analytics WHERE is_bot = ?)", true)
+	}
+	return db
+}
+
+// imported queries the figures of kind imported from other tools for the
+// filter's site and period. They count as human traffic, so they're left
+// out when only bots are asked for.
+func (s *StatsService) imported(f types.StatsFilter, kind string) *gorm.DB {
+	db := s.DB.Model(&models.ImportedStat{}).Where("imported_stats.kind = ?", kind)
+	if f.SiteID != nil {
+		db = db.Where("imported_stats.site_id = ?", *f.SiteID)
+	}
+	if !f.From.IsZero() {
+		db = db.Where("imported_stats.date >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		db = db.Where("imported_stats.date < ?", f.To)
+	}
+	if f.Bots == types.OnlyBots {
+		db = db.Where("1 = 0")
+	}
+	return db
+}
+
+func (s *StatsService) Overview(f types.StatsFilter) (types.DashboardMetrics, error) {
+	var metrics types.DashboardMetrics
+	var errs []error
+
+	pageVisits := func() *gorm.DB { return scopeVisits(s.DB.Model(&models.PageVisit{}), "page_visits", f) }
+	analytics := func() *gorm.DB { return scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", f) }
+
+	errs = append(errs, pageVisits().Count(&metrics.TotalPageVisits).Error)
+
+	errs = append(errs, analytics().Count(&metrics.TotalAnalytics).Error)
+
+	errs = append(errs, analytics().
+		Distinct("ip_hash").
+		Count(&metrics.UniqueVisitors).Error)
+
+	var avgMetrics struct {
+		AvgDwellTime   float64
+		AvgScrollDepth float64
+	}
+	errs = append(errs, pageVisits().
+		Select("AVG(dwell_time) as avg_dwell_time, AVG(scroll_depth) as avg_scroll_depth").
+		Where("dwell_time > 0").
+		Scan(&avgMetrics).Error)
+
+	metrics.AvgDwellTime = avgMetrics.AvgDwellTime
+	metrics.AvgScrollDepth = avgMetrics.AvgScrollDepth
+
+	var imported struct {
+		Visitors  int64
+		Pageviews int64
+	}
+	errs = append(errs, s.imported(f, models.ImportedTotal).
+		Select("COALESCE(SUM(visitors), 0) as visitors, COALESCE(SUM(pageviews), 0) as pageviews").
+		Scan(&imported).Error)
+	metrics.TotalPageVisits += imported.Pageviews
+	metrics.TotalAnalytics += imported.Pageviews
+	metrics.UniqueVisitors += imported.Visitors
+
+	// Bot percentage, of all traffic whatever f.Bots says
+	var total, botCount int64
+	errs = append(errs, scope(s.DB.Model(&models.Analytics{}), "analytics", f).
+		Count(&total).Error)
+	errs = append(errs, scope(s.DB.Model(&models.Analytics{}), "analytics", f).
+		Where("is_bot = ?", true).
+		Count(&botCount).Error)
+
+	if total > 0 {
+		metrics.BotPercentage = float64(botCount) / float64(total) * 100
+	}
+
+	return metrics, errors.Join(errs...)
+}
+
+func (s *StatsService) TopPages(f types.StatsFilter, limit int) ([]types.TopPage, error) {
+	var topPages []types.TopPage
+
+	tracked := scopeVisits(s.DB.Model(&models.PageVisit{}), "page_visits", f).
+		Select("url, COUNT(*) as visits, SUM(dwell_time) as dwell, SUM(scroll_depth) as scroll, COUNT(*) as tracked").
+		Where("url != ''").
+		Group("url")
+	imported := s.imported(f, models.ImportedPage).
+		Select("value as url, SUM(pageviews) as visits, 0 as dwell, 0 as scroll, 0 as tracked").
+		Group("value")
+
+	err := s.DB.Table("(?) as pages", s.DB.Raw("? UNION ALL ?", tracked, imported)).
+		Select(`
+			url,
+			SUM(visits) as visits,
+			COALESCE(1.0 * SUM(dwell) / NULLIF(SUM(tracked), 0), 0) as avg_dwell_time,
+			COALESCE(1.0 * SUM(scroll) / NULLIF(SUM(tracked), 0), 0) as avg_scroll
+		`).
+		Group("url").
+		Order("visits DESC").
+		Limit(limit).
+		Scan(&topPages).Error
+
+	return topPages, err
+}
+
+func (s *StatsService) TopReferrers(f types.StatsFilter, limit int) ([]types.TopReferrer, error) {
+	var topReferrers []types.TopReferrer
+
+	tracked := scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", f).
+		Select("COALESCE(NULLIF(referrer, ''), 'Direct') as referrer, COUNT(*) as count").
+		Group("referrer")
+	imported := s.imported(f, models.ImportedReferrer).
+		Select("COALESCE(NULLIF(value, ''), 'Direct') as referrer, SUM(pageviews) as count").
+		Group("value")
+
+	err := s.DB.Table("(?) as referrers", s.DB.Raw("? UNION ALL ?", tracked, imported)).
+		Select("referrer, SUM(count) as count").
+		Group("referrer").
+		Order("count DESC").
+		Limit(limit).
+		Scan(&topReferrers).Error
+
+	return topReferrers, err
+}
+
+func (s *StatsService) TopCountries(f types.StatsFilter, limit int) ([]types.CountryStats, error) {
+	var topCountries []types.CountryStats
+
+	tracked := scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", f).
+		Select("COALESCE(NULLIF(country, ''), 'Unknown') as country, COUNT(*) as count").
+		Group("country")
+	imported := s.imported(f, models.ImportedCountry).
+		Select("COALESCE(NULLIF(value, ''), 'Unknown') as country, SUM(pageviews) as count").
+		Group("value")
+
+	err := s.DB.Table("(?) as countries", s.DB.Raw("? UNION ALL ?", tracked, imported)).
+		Select("country, SUM(count) as count").
+		Group("country").
+		Order("count DESC").
+		Limit(limit).
+		Scan(&topCountries).Error
+
+	return topCountries, err
+}
+
+func (s *StatsService) DailyStats(f types.StatsFilter) ([]types.DailyStats, error) {
+	var dailyStats []types.DailyStats
+
+	tracked := scopeVisits(s.DB.Table("page_visits pv"), "pv", f).
+		Select(`
+			DATE(pv.created_at) as date,
+			COUNT(DISTINCT pv.id) as page_visits,
+			COUNT(DISTINCT a.ip_hash) as unique_users,
+			SUM(pv.dwell_time) as dwell,
+			COUNT(DISTINCT pv.id) as tracked
+		`).
+		Joins("JOIN analytics a ON pv.analytics_id = a.id").
+		Group("DATE(pv.created_at)")
+	imported := s.imported(f, models.ImportedTotal).
+		Select("DATE(date) as date, SUM(pageviews) as page_visits, SUM(visitors) as unique_users, 0 as dwell, 0 as tracked").
+		Group("DATE(date)")
+
+	err := s.DB.Table("(?) as days", s.DB.Raw("? UNION ALL ?", tracked, imported)).
+		Select(`
+			date,
+			SUM(page_visits) as page_visits,
+			SUM(unique_users) as unique_users,
+			COALESCE(1.0 * SUM(dwell) / NULLIF(SUM(tracked), 0), 0) as avg_dwell_time
+		`).
+		Group("date").
+		Order("date ASC").
+		Scan(&dailyStats).Error
+
+	return dailyStats, err
+}
+
+// BotRuleHits counts the visits each bot detection rule matched, most
+// frequent first.
+func (s *StatsService) BotRuleHits(f types.StatsFilter) ([]types.BotRuleStats, error) {
+	var rules []types.BotRuleStats
+
+	err := scope(s.DB.Model(&models.BotRuleHit{}), "bot_rule_hits", f).
+		Select("rule, COUNT(*) as hits").
+		Group("rule").
+		Order("hits DESC, rule ASC").
+		Scan(&rules).Error
+
+	return rules, err
+}
+
+// BotReasons counts bot visits by the rules that flagged them, most
+// frequent first. f.Bots is ignored.
+func (s *StatsService) BotReasons(f types.StatsFilter, limit int) ([]types.BotReasonStats, error) {
+	var reasons []types.BotReasonStats
+
+	f.Bots = types.OnlyBots
+	err := scopeAnalytics(s.DB.Model(&models.Analytics{}), "analytics", f).
+		Select("COALESCE(NULLIF(bot_reason, ''), 'Unknown') as reason, COUNT(*) as count").
+		Group("bot_reason").
+		Order("count DESC, reason ASC").
+		Limit(limit).
+		Scan(&reasons).Error
+
+	return reasons, err
+}
+
+// Report gathers every breakdown for the filter in one value
+func (s *StatsService) Report(f types.StatsFilter, limit int) (types.StatsReport, error) {
+	report := types.StatsReport{From: f.From, To: f.To}
+	var errs []error
+	var err error
+
+	report.Metrics, err = s.Overview(f)
+	errs = append(errs, err)
+	report.TopPages, err = s.TopPages(f, limit)
+	errs = append(errs, err)
+	report.TopReferrers, err = s.TopReferrers(f, limit)
+	errs = append(errs, err)
+	report.TopCountries, err = s.TopCountries(f, limit)
+	errs = append(errs, err)
+	report.Daily, err = s.DailyStats(f)
+	errs = append(errs, err)
+
+	return report, errors.Join(errs...)
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+func TestStatsService_Filter(t *testing.T) {
+	db := setupTestDB(t)
+	stats := NewStatsService(db)
+
+	siteA, siteB := uint(1), uint(2)
+	now := time.Now()
+	visits := []struct {
+		site    *uint
+		url     string
+		ip      string
+		created time.Time
+	}{
+		{&siteA, "https://a.com/", "ip1", now},
+		{&siteA, "https://a.com/about", "ip2", now},
+		{&siteA, "https://a.com/", "ip3", now.AddDate(0, 0, -40)},
+		{&siteB, "https://b.com/", "ip1", now},
+	}
+	for _, v := range visits {
+		a := models.Analytics{SiteID: v.site, URL: v.url, IPHash: v.ip, CreatedAt: v.created}
+		assert.NoError(t, db.Create(&a).Error)
+		assert.NoError(t, db.Create(&models.PageVisit{AnalyticsID: a.ID, SiteID: v.site, URL: v.url, IPHash: v.ip, DwellTime: 10, CreatedAt: v.created}).Error)
+	}
+
+	all, err := stats.Overview(types.StatsFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), all.TotalPageVisits)
+	assert.Equal(t, int64(3), all.UniqueVisitors)
+
+	recentA := types.StatsFilter{SiteID: &siteA, From: now.AddDate(0, 0, -30)}
+	metrics, err := stats.Overview(recentA)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), metrics.TotalPageVisits)
+
+	pages, err := stats.TopPages(recentA, 10)
+	assert.NoError(t, err)
+	assert.Len(t, pages, 2)
+
+	daily, err := stats.DailyStats(recentA)
+	assert.NoError(t, err)
+	assert.Len(t, daily, 1)
+	assert.Equal(t, int64(2), daily[0].PageVisits)
+}
+
+func TestStatsService_Bots(t *testing.T) {
+	db := setupTestDB(t)
+	stats := NewStatsService(db)
+
+	visits := []models.Analytics{
+		{URL: "https://a.com/", IPHash: "ip1", Country: "NL"},
+		{URL: "https://a.com/", IPHash: "ip2", Country: "NL"},
+		{URL: "https://a.com/feed", IPHash: "crawler", Country: "US", IsBot: true, BotReason: "crawler:bingbot,generic_bot"},
+		{URL: "https://a.com/", IPHash: "idle", Country: "US", IsBot: true, BotReason: "datacenter_ip,no_active_time"},
+	}
+	for _, a := range visits {
+		assert.NoError(t, db.Create(&a).Error)
+		assert.NoError(t, db.Create(&models.PageVisit{AnalyticsID: a.ID, URL: a.URL, IPHash: a.IPHash, DwellTime: 10}).Error)
+	}
+
+	humans, err := stats.Overview(types.StatsFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), humans.TotalPageVisits, "bots are left out by default")
+	assert.Equal(t, int64(2), humans.UniqueVisitors)
+	assert.Equal(t, 50.0, humans.BotPercentage, "the bot share counts everything")
+
+	pages, err := stats.TopPages(types.StatsFilter{}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.TopPage{{URL: "https://a.com/", Visits: 2, AvgDwellTime: 10}}, pages)
+
+	countries, err := stats.TopCountries(types.StatsFilter{}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.CountryStats{{Country: "NL", Count: 2}}, countries)
+
+	daily, err := stats.DailyStats(types.StatsFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), daily[0].PageVisits)
+
+	everyone, err := stats.Overview(types.StatsFilter{Bots: types.IncludeBots})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), everyone.TotalPageVisits)
+
+	botPages, err := stats.TopPages(types.StatsFilter{Bots: types.OnlyBots}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, botPages, 2)
+
+	reasons, err := stats.BotReasons(types.StatsFilter{}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.BotReasonStats{
+		{Reason: "crawler:bingbot,generic_bot", Count: 1},
+		{Reason: "datacenter_ip,no_active_time", Count: 1},
+	}, reasons)
+}
+
+func TestStatsService_BotRuleHits(t *testing.T) {
+	db := newEventTestDB(t)
+	stats := NewStatsService(db)
+
+	siteA, siteB := uint(1), uint(2)
+	hits := []models.BotRuleHit{
+		{AnalyticsID: 1, SiteID: &siteA, Rule: "generic_bot"},
+		{AnalyticsID: 1, SiteID: &siteA, Rule: "datacenter_ip"},
+		{AnalyticsID: 2, SiteID: &siteA, Rule: "datacenter_ip"},
+		{AnalyticsID: 3, SiteID: &siteB, Rule: "datacenter_ip"},
+	}
+	assert.NoError(t, db.Create(&hits).Error)
+
+	rules, err := stats.BotRuleHits(types.StatsFilter{SiteID: &siteA})
+	assert.NoError(t, err)
+	assert.Equal(t, []types.BotRuleStats{{Rule: "datacenter_ip", Hits: 2}, {Rule: "generic_bot", Hits: 1}}, rules)
+}
+
+func TestStatsService_TopPagesAverages(t *testing.T) {
+	db := setupTestDB(t)
+	stats := NewStatsService(db)
+
+	for i, v := range []struct{ dwell, scroll int }{{10, 50}, {15, 75}} {
+		a := models.Analytics{URL: "https://a.com/", IPHash: fmt.Sprintf("ip%d", i)}
+		assert.NoError(t, db.Create(&a).Error)
+		assert.NoError(t, db.Create(&models.PageVisit{AnalyticsID: a.ID, URL: a.URL, IPHash: a.IPHash, DwellTime: v.dwell, ScrollDepth: v.scroll}).Error)
+	}
+
+	pages, err := stats.TopPages(types.StatsFilter{}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.TopPage{{URL: "https://a.com/", Visits: 2, AvgDwellTime: 12.5, AvgScroll: 62.5}}, pages)
+}
+
+func TestStatsService_Imported(t *testing.T) {
+	db := setupTestDB(t)
+	stats := NewStatsService(db)
+
+	site := uint(1)
+	now := time.Now().UTC()
+	a := models.Analytics{SiteID: &site, URL: "https://a.com/", IPHash: "ip1", Referrer: "https://ref.example/", Country: "Germany", CreatedAt: now}
+	assert.NoError(t, db.Create(&a).Error)
+	assert.NoError(t, db.Create(&models.PageVisit{AnalyticsID: a.ID, SiteID: &site, URL: a.URL, IPHash: "ip1", DwellTime: 30, CreatedAt: now}).Error)
+
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -10)
+	imported := []models.ImportedStat{
+		{Kind: models.ImportedTotal, Visitors: 40, Pageviews: 100},
+		{Kind: models.ImportedPage, Value: "https://a.com/", Visitors: 30, Pageviews: 60},
+		{Kind: models.ImportedPage, Value: "https://a.com/old", Visitors: 10, Pageviews: 40},
+		{Kind: models.ImportedReferrer, Value: "", Pageviews: 70},
+		{Kind: models.ImportedReferrer, Value: "https://ref.example/", Pageviews: 30},
+		{Kind: models.ImportedCountry, Value: "Germany", Pageviews: 100},
+	}
+	for _, s := range imported {
+		s.SiteID, s.Source, s.Date = site, "ga", day
+		assert.NoError(t, db.Create(&s).Error)
+	}
+
+	f := types.StatsFilter{SiteID: &site, From: now.AddDate(0, 0, -30)}
+	metrics, err := stats.Overview(f)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), metrics.TotalPageVisits)
+	assert.Equal(t, int64(41), metrics.UniqueVisitors)
+
+	pages, err := stats.TopPages(f, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.TopPage{
+		{URL: "https://a.com/", Visits: 61, AvgDwellTime: 30},
+		{URL: "https://a.com/old", Visits: 40},
+	}, pages, "dwell time averages only tracked visits")
+
+	referrers, err := stats.TopReferrers(f, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.TopReferrer{{Referrer: "Direct", Count: 70}, {Referrer: "https://ref.example/", Count: 31}}, referrers)
+
+	countries, err := stats.TopCountries(f, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []types.CountryStats{{Country: "Germany", Count: 101}}, countries)
+
+	daily, err := stats.DailyStats(f)
+	assert.NoError(t, err)
+	assert.Len(t, daily, 2)
+	assert.Equal(t, int64(100), daily[0].PageVisits)
+	assert.Equal(t, int64(1), daily[1].PageVisits)
+	assert.Equal(t, 30.0, daily[1].AvgDwellTime)
+
+	// Days before the period are left out, and imports count as people.
+	metrics, err = stats.Overview(types.StatsFilter{SiteID: &site, From: now.AddDate(0, 0, -5)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), metrics.TotalPageVisits)
+	metrics, err = stats.Overview(types.StatsFilter{SiteID: &site, Bots: types.OnlyBots})
+	assert.NoError(t, err)
+	assert.Zero(t, metrics.TotalPageVisits)
+}
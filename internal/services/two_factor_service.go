@@ -0,0 +1,293 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/boombuler/barcode/qr"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+const (
+	RecoveryCodeCount = 10
+	totpPeriod        = 30
+	totpIssuer        = "Doorman"
+)
+
+var (
+	ErrInvalidCode         = errors.New("invalid authentication code")
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotStarted = errors.New("start two-factor setup first")
+)
+
+type TwoFactorService struct {
+	DB *gorm.DB
+	// Now is the clock used to check codes; tests replace it.
+	Now func() time.Time
+}
+
+func NewTwoFactorService(db *gorm.DB) *TwoFactorService {
+	return &TwoFactorService{DB: db, Now: time.Now}
+}
+
+// Enroll generates a new secret for the user. Two-factor login isn't
+// required until Confirm succeeds with a code from that secret.
+func (s *TwoFactorService) Enroll(user *models.User) (*otp.Key, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: user.Username,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	secret := key.Secret()
+	if err := s.DB.Model(user).Update("totp_secret", secret).Error; err != nil {
+		return nil, err
+	}
+	user.TOTPSecret = &secret
+
+	return key, nil
+}
+
+// PendingKey rebuilds the key of an enrollment that hasn't been confirmed
+// yet, so the QR code can be shown again after a wrong code.
+func (s *TwoFactorService) PendingKey(user *models.User) (*otp.Key, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == nil {
+		return nil, ErrTwoFactorNotStarted
+	}
+
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + user.Username,
+		RawQuery: url.Values{
+			"secret":    {*user.TOTPSecret},
+			"issuer":    {totpIssuer},
+			"period":    {fmt.Sprint(totpPeriod)},
+			"digits":    {otp.DigitsSix.String()},
+			"algorithm": {otp.AlgorithmSHA1.String()},
+		}.Encode(),
+	}
+	return otp.NewKeyFromURL(u.String())
+}
+
+// Confirm enables two-factor login once the user proves their authenticator
+// works, and returns freshly generated recovery codes.
+func (s *TwoFactorService) Confirm(user *models.User, code string) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == nil {
+		return nil, ErrTwoFactorNotStarted
+	}
+
+	step, ok := s.matchStep(*user.TOTPSecret, code, 0)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	var codes []string
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		now := s.Now()
+		if err := tx.Model(user).Updates(map[string]interface{}{
+			"totp_enabled_at": now,
+			"totp_last_step":  step,
+		}).Error; err != nil {
+			return err
+		}
+		user.TOTPEnabledAt = &now
+		user.TOTPLastStep = step
+
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Verify checks a TOTP code or an unused recovery code for the second login
+// step. Each TOTP code and recovery code is accepted only once.
+func (s *TwoFactorService) Verify(user *models.User, code string) error {
+	if !user.TwoFactorEnabled() || user.TOTPSecret == nil {
+		return ErrInvalidCode
+	}
+
+	if step, ok := s.matchStep(*user.TOTPSecret, code, user.TOTPLastStep); ok {
+		// Conditional update so two concurrent logins can't both use the step.
+		res := s.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	res := s.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		Update("used_at", s.Now())
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// RemainingRecoveryCodes counts the user's unused recovery codes.
+func (s *TwoFactorService) RemainingRecoveryCodes(user *models.User) (int64, error) {
+	var count int64
+	err := s.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Count(&count).Error
+	return count, err
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes.
+func (s *TwoFactorService) RegenerateRecoveryCodes(user *models.User) ([]string, error) {
+	if !user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorNotStarted
+	}
+
+	var codes []string
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// Disable removes the user's secret and recovery codes.
+func (s *TwoFactorService) Disable(userID uint) error {
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":     nil,
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error
+	})
+}
+
+// Reset disables two-factor login for target on behalf of actor, for users
+// who have lost their authenticator and recovery codes.
+func (s *TwoFactorService) Reset(actor *models.User, targetID uint) error {
+	if _, err := NewUserService(s.DB).manageable(actor, targetID); err != nil {
+		return err
+	}
+	return s.Disable(targetID)
+}
+
+// matchStep returns the time step whose code matches, allowing one step of
+// clock drift either way. Steps at or before after are rejected.
+func (s *TwoFactorService) matchStep(secret, code string, after int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != int(otp.DigitsSix) {
+		return 0, false
+	}
+
+	current := s.Now().Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step <= after {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+		codes[i] = raw[:4] + "-" + raw[4:]
+
+		if err := tx.Create(&models.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(codes[i])}).Error; err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode normalizes case and dashes so codes can be typed loosely.
+// Codes carry 40 random bits, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	return models.HashToken(code)
+}
+
+// QRCodeSVG renders content as an SVG QR code, for showing otpauth:// URLs
+// during enrollment.
+func QRCodeSVG(content string) (string, error) {
+	code, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return "", err
+	}
+
+	bounds := code.Bounds()
+	size := bounds.Dx()
+	const quiet = 4
+
+	var path strings.Builder
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			r, _, _, _ := code.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			if r == 0 {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+quiet, y+quiet)
+			}
+		}
+	}
+
+	total := size + 2*quiet
+	return fmt.Sprintf(
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges"><rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		total, total, path.String(),
+	), nil
+}
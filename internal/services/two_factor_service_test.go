@@ -0,0 +1,87 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func TestTwoFactorService(t *testing.T) {
+	db := newUserTestDB(t)
+	require.NoError(t, db.AutoMigrate(&models.RecoveryCode{}))
+
+	users := NewUserService(db)
+	user, err := users.Create("alice", "password1", models.RoleViewer)
+	require.NoError(t, err)
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	twoFactor := NewTwoFactorService(db)
+	twoFactor.Now = func() time.Time { return now }
+
+	key, err := twoFactor.Enroll(user)
+	require.NoError(t, err)
+	assert.False(t, user.TwoFactorEnabled(), "not enabled until confirmed")
+
+	pending, err := twoFactor.PendingKey(user)
+	require.NoError(t, err)
+	assert.Equal(t, key.Secret(), pending.Secret())
+
+	_, err = twoFactor.Confirm(user, "000000")
+	assert.ErrorIs(t, err, ErrInvalidCode)
+
+	code, err := totp.GenerateCode(key.Secret(), now)
+	require.NoError(t, err)
+	recovery, err := twoFactor.Confirm(user, code)
+	require.NoError(t, err)
+	assert.Len(t, recovery, RecoveryCodeCount)
+	assert.True(t, user.TwoFactorEnabled())
+
+	// The code used to confirm can't be replayed to log in.
+	assert.ErrorIs(t, twoFactor.Verify(user, code), ErrInvalidCode)
+
+	now = now.Add(30 * time.Second)
+	next, err := totp.GenerateCode(key.Secret(), now)
+	require.NoError(t, err)
+	assert.NoError(t, twoFactor.Verify(user, next))
+	assert.ErrorIs(t, twoFactor.Verify(user, next), ErrInvalidCode)
+
+	// Recovery codes work once, regardless of case.
+	assert.NoError(t, twoFactor.Verify(user, "  "+recovery[0]+" "))
+	assert.ErrorIs(t, twoFactor.Verify(user, recovery[0]), ErrInvalidCode)
+	remaining, err := twoFactor.RemainingRecoveryCodes(user)
+	require.NoError(t, err)
+	assert.EqualValues(t, RecoveryCodeCount-1, remaining)
+
+	var stored models.RecoveryCode
+	require.NoError(t, db.First(&stored).Error)
+	assert.NotContains(t, recovery, stored.CodeHash, "codes are stored hashed")
+
+	// Only admins can reset someone else's 2FA.
+	other, err := users.Create("bob", "password1", models.RoleViewer)
+	require.NoError(t, err)
+	assert.ErrorIs(t, twoFactor.Reset(other, user.ID), ErrForbidden)
+
+	admin, err := users.Create("carol", "password1", models.RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, twoFactor.Reset(admin, user.ID))
+
+	reset, err := users.Get(user.ID)
+	require.NoError(t, err)
+	assert.False(t, reset.TwoFactorEnabled())
+	assert.Nil(t, reset.TOTPSecret)
+	remaining, err = twoFactor.RemainingRecoveryCodes(reset)
+	require.NoError(t, err)
+	assert.Zero(t, remaining)
+}
+
+func TestQRCodeSVG(t *testing.T) {
+	svg, err := QRCodeSVG("otpauth://totp/Doorman:alice?secret=JBSWY3DPEHPK3PXP&issuer=Doorman")
+	require.NoError(t, err)
+	assert.Contains(t, svg, "<svg")
+	assert.Contains(t, svg, `<path fill="#000" d="M`)
+}
@@ -0,0 +1,478 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+const (
+	MinPasswordLength = 8
+	InviteValidFor    = 7 * 24 * time.Hour
+)
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrWeakPassword   = fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	ErrWrongPassword  = errors.New("current password is incorrect")
+	ErrLastUser       = errors.New("can't delete the last user")
+	ErrLastOwner      = errors.New("there must be at least one active owner")
+	ErrInvalidRole    = errors.New("role must be owner, admin or viewer")
+	ErrForbidden      = errors.New("you don't have permission to do that")
+	ErrInviteInvalid  = errors.New("invite link is invalid or has expired")
+	ErrCannotTargetMe = errors.New("you can't do that to your own account")
+	ErrUsernameTaken  = errors.New("a local user with that username already exists")
+)
+
+type UserService struct {
+	DB *gorm.DB
+}
+
+func NewUserService(db *gorm.DB) *UserService {
+	return &UserService{DB: db}
+}
+
+func (s *UserService) Create(username, password, role string) (*models.User, error) {
+	if len(password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	hash, err := models.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{Username: username, Password: hash, Role: role}
+	if err := s.insert(user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Invite creates a user without a password and returns the one-time token
+// they use to set one.
+func (s *UserService) Invite(actor *models.User, username, role string, siteIDs []uint) (*models.User, string, error) {
+	if !actor.CanManageUsers() || !actor.HasRole(role) {
+		return nil, "", ErrForbidden
+	}
+
+	token, hash, err := newInviteToken()
+	if err != nil {
+		return nil, "", err
+	}
+	expires := time.Now().Add(InviteValidFor)
+
+	user := &models.User{
+		Username:        username,
+		Role:            role,
+		InviteTokenHash: &hash,
+		InviteExpiresAt: &expires,
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := (&UserService{DB: tx}).insert(user); err != nil {
+			return err
+		}
+		return (&UserService{DB: tx}).replaceGrants(user.ID, siteIDs)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return user, token, nil
+}
+
+// FindInvite returns the user a pending invite token belongs to.
+func (s *UserService) FindInvite(token string) (*models.User, error) {
+	var user models.User
+	err := s.DB.Where("invite_token_hash = ? AND invite_expires_at > ?", hashInviteToken(token), time.Now()).
+		First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInviteInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AcceptInvite sets the invited user's password and clears the token.
+func (s *UserService) AcceptInvite(token, password string) (*models.User, error) {
+	if len(password) < MinPasswordLength {
+		return nil, ErrWeakPassword
+	}
+
+	user, err := s.FindInvite(token)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := models.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.Model(user).Updates(map[string]interface{}{
+		"password":          hash,
+		"invite_token_hash": nil,
+		"invite_expires_at": nil,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ProvisionOIDC returns the user linked to the SSO identity, creating it
+// with role on first sign-in. A local user or pending invite whose
+// username is the identity's verified email is linked rather than
+// duplicated; callers still ask users with 2FA for their code. With
+// syncRole the user's role is set to role every time, except that the
+// last owner is never demoted.
+func (s *UserService) ProvisionOIDC(id *OIDCIdentity, role string, syncRole bool) (*models.User, error) {
+	var user models.User
+	err := s.DB.Where("oidc_subject = ?", id.Subject).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s.linkOIDC(id, role)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if syncRole && user.Role != role && s.ensureOwnerRemains(&user, role) == nil {
+		if err := s.DB.Model(&user).Update("role", role).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
+func (s *UserService) linkOIDC(id *OIDCIdentity, role string) (*models.User, error) {
+	username := id.Username()
+	subject := id.Subject
+
+	var existing models.User
+	err := s.DB.Where("username = ?", username).First(&existing).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user := &models.User{Username: username, Role: role, OIDCSubject: &subject}
+		if err := s.insert(user); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Only a verified email proves the person at the provider owns the
+	// local account.
+	if existing.OIDCSubject != nil || !id.EmailVerified || username != strings.ToLower(id.Email) {
+		return nil, ErrUsernameTaken
+	}
+
+	err = s.DB.Model(&existing).Updates(map[string]interface{}{
+		"oidc_subject":      subject,
+		"invite_token_hash": nil,
+		"invite_expires_at": nil,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return &existing, nil
+}
+
+// ProvisionProxyUser returns the user an authenticating proxy vouches for,
+// creating it with role if needed. A pending invite is completed, since
+// the proxy has already verified who the user is.
+func (s *UserService) ProvisionProxyUser(username, role string) (*models.User, error) {
+	var user models.User
+	err := s.DB.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user = models.User{Username: username, Role: role}
+		if err := s.insert(&user); err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if user.InvitePending() {
+		err := s.DB.Model(&user).Updates(map[string]interface{}{
+			"invite_token_hash": nil,
+			"invite_expires_at": nil,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+		user.InviteTokenHash, user.InviteExpiresAt = nil, nil
+	}
+	return &user, nil
+}
+
+func (s *UserService) insert(user *models.User) error {
+	if user.Username == "" {
+		return errors.New("username is required")
+	}
+	if !models.ValidRole(user.Role) {
+		return ErrInvalidRole
+	}
+
+	var count int64
+	s.DB.Model(&models.User{}).Where("username = ?", user.Username).Count(&count)
+	if count > 0 {
+		return fmt.Errorf("user %s already exists", user.Username)
+	}
+
+	return s.DB.Create(user).Error
+}
+
+func (s *UserService) List() ([]models.User, error) {
+	var users []models.User
+	err := s.DB.Preload("SiteGrants.Site").Order("username").Find(&users).Error
+	return users, err
+}
+
+func (s *UserService) Find(username string) (*models.User, error) {
+	var user models.User
+	err := s.DB.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *UserService) Get(id uint) (*models.User, error) {
+	var user models.User
+	err := s.DB.First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *UserService) ResetPassword(username, password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+
+	user, err := s.Find(username)
+	if err != nil {
+		return err
+	}
+
+	return s.setPassword(user, password, 0)
+}
+
+// ChangePassword sets a new password after checking the current one and
+// signs the user out everywhere except the session keep.
+func (s *UserService) ChangePassword(user *models.User, current, password string, keep uint) error {
+	if !models.CheckPasswordHash(current, user.Password) {
+		return ErrWrongPassword
+	}
+	if len(password) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+	return s.setPassword(user, password, keep)
+}
+
+func (s *UserService) setPassword(user *models.User, password string, keepSession uint) error {
+	hash, err := models.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("password", hash).Error; err != nil {
+			return err
+		}
+		_, err := NewSessionService(tx).RevokeAll(user.ID, keepSession)
+		return err
+	})
+}
+
+func (s *UserService) Delete(username string) error {
+	user, err := s.Find(username)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	s.DB.Model(&models.User{}).Count(&count)
+	if count <= 1 {
+		return ErrLastUser
+	}
+	if err := s.ensureOwnerRemains(user, ""); err != nil {
+		return err
+	}
+
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := NewSessionService(tx).RevokeAll(user.ID, 0); err != nil {
+			return err
+		}
+		return tx.Delete(user).Error
+	})
+}
+
+// DeleteAs deletes target on behalf of actor.
+func (s *UserService) DeleteAs(actor *models.User, targetID uint) error {
+	target, err := s.manageable(actor, targetID)
+	if err != nil {
+		return err
+	}
+	return s.Delete(target.Username)
+}
+
+// SetDisabled disables or re-enables target on behalf of actor.
+func (s *UserService) SetDisabled(actor *models.User, targetID uint, disabled bool) error {
+	target, err := s.manageable(actor, targetID)
+	if err != nil {
+		return err
+	}
+	if !disabled {
+		return s.DB.Model(target).Update("disabled", false).Error
+	}
+
+	if err := s.ensureOwnerRemains(target, ""); err != nil {
+		return err
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(target).Update("disabled", true).Error; err != nil {
+			return err
+		}
+		_, err := NewSessionService(tx).RevokeAll(target.ID, 0)
+		return err
+	})
+}
+
+// SetRole changes target's role on behalf of actor.
+func (s *UserService) SetRole(actor *models.User, targetID uint, role string) error {
+	if !models.ValidRole(role) {
+		return ErrInvalidRole
+	}
+	if !actor.HasRole(role) {
+		return ErrForbidden
+	}
+
+	target, err := s.manageable(actor, targetID)
+	if err != nil {
+		return err
+	}
+	if err := s.ensureOwnerRemains(target, role); err != nil {
+		return err
+	}
+	return s.DB.Model(target).Update("role", role).Error
+}
+
+// SetGrants replaces the sites target may view on behalf of actor.
+func (s *UserService) SetGrants(actor *models.User, targetID uint, siteIDs []uint) error {
+	if _, err := s.manageable(actor, targetID); err != nil {
+		return err
+	}
+	return s.DB.Transaction(func(tx *gorm.DB) error {
+		return (&UserService{DB: tx}).replaceGrants(targetID, siteIDs)
+	})
+}
+
+func (s *UserService) replaceGrants(userID uint, siteIDs []uint) error {
+	if err := s.DB.Where("user_id = ?", userID).Delete(&models.SiteGrant{}).Error; err != nil {
+		return err
+	}
+	for _, siteID := range siteIDs {
+		if err := s.DB.Create(&models.SiteGrant{UserID: userID, SiteID: siteID}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllowedSites returns the sites the user may view.
+func (s *UserService) AllowedSites(user *models.User) ([]models.Site, error) {
+	var sites []models.Site
+	query := s.DB.Order("domain")
+	if !user.SeesAllSites() {
+		query = query.Where("id IN (?)", s.DB.Model(&models.SiteGrant{}).Select("site_id").Where("user_id = ?", user.ID))
+	}
+	err := query.Find(&sites).Error
+	return sites, err
+}
+
+// CanViewSite reports whether the user may view the site. A nil site
+// means all sites, which requires SeesAllSites.
+func (s *UserService) CanViewSite(user *models.User, siteID *uint) bool {
+	if user.SeesAllSites() {
+		return true
+	}
+	if siteID == nil {
+		return false
+	}
+
+	var count int64
+	s.DB.Model(&models.SiteGrant{}).Where("user_id = ? AND site_id = ?", user.ID, *siteID).Count(&count)
+	return count > 0
+}
+
+// manageable loads target and checks actor may change it. Admins can
+// manage admins and viewers; only owners can manage owners.
+func (s *UserService) manageable(actor *models.User, targetID uint) (*models.User, error) {
+	if !actor.CanManageUsers() {
+		return nil, ErrForbidden
+	}
+	if actor.ID == targetID {
+		return nil, ErrCannotTargetMe
+	}
+
+	target, err := s.Get(targetID)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.HasRole(target.Role) {
+		return nil, ErrForbidden
+	}
+	return target, nil
+}
+
+// ensureOwnerRemains fails if removing target's ownership (by deleting,
+// disabling or changing to newRole) would leave no active owner.
+func (s *UserService) ensureOwnerRemains(target *models.User, newRole string) error {
+	if target.Role != models.RoleOwner || newRole == models.RoleOwner {
+		return nil
+	}
+
+	var owners int64
+	s.DB.Model(&models.User{}).
+		Where("role = ? AND disabled = ? AND id != ?", models.RoleOwner, false, target.ID).
+		Count(&owners)
+	if owners == 0 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+func newInviteToken() (token, hash string, err error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(buf)
+	return token, hashInviteToken(token), nil
+}
+
+func hashInviteToken(token string) string {
+	return models.HashToken(token)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/database"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func newUserTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "users.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.User{}, &models.Site{}, &models.SiteGrant{}, &models.Session{}))
+	return db
+}
+
+func TestUserService_RoleRules(t *testing.T) {
+	users := NewUserService(newUserTestDB(t))
+
+	owner, err := users.Create("owner", "password1", models.RoleOwner)
+	require.NoError(t, err)
+	admin, err := users.Create("admin", "password1", models.RoleAdmin)
+	require.NoError(t, err)
+	viewer, err := users.Create("viewer", "password1", models.RoleViewer)
+	require.NoError(t, err)
+
+	_, err = users.Create("nobody", "password1", "superuser")
+	assert.ErrorIs(t, err, ErrInvalidRole)
+
+	// Viewers can't manage anyone, admins can't touch owners or promote to owner.
+	assert.ErrorIs(t, users.SetDisabled(viewer, admin.ID, true), ErrForbidden)
+	assert.ErrorIs(t, users.SetDisabled(admin, owner.ID, true), ErrForbidden)
+	assert.ErrorIs(t, users.SetRole(admin, viewer.ID, models.RoleOwner), ErrForbidden)
+	assert.NoError(t, users.SetRole(admin, viewer.ID, models.RoleAdmin))
+
+	// Nobody can act on themselves, and the last owner can't be demoted.
+	assert.ErrorIs(t, users.DeleteAs(owner, owner.ID), ErrCannotTargetMe)
+	second, err := users.Create("owner2", "password1", models.RoleOwner)
+	require.NoError(t, err)
+	assert.NoError(t, users.SetRole(owner, second.ID, models.RoleAdmin))
+	assert.ErrorIs(t, users.Delete("owner"), ErrLastOwner)
+
+	assert.NoError(t, users.SetDisabled(admin, viewer.ID, true))
+	disabled, err := users.Get(viewer.ID)
+	require.NoError(t, err)
+	assert.True(t, disabled.Disabled)
+}
+
+func TestUserService_Invite(t *testing.T) {
+	db := newUserTestDB(t)
+	users := NewUserService(db)
+
+	admin, err := users.Create("admin", "password1", models.RoleAdmin)
+	require.NoError(t, err)
+	site, err := NewSiteService(db).Add("", "example.com")
+	require.NoError(t, err)
+
+	_, _, err = users.Invite(admin, "boss", models.RoleOwner, nil)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	invited, token, err := users.Invite(admin, "guest", models.RoleViewer, []uint{site.ID})
+	require.NoError(t, err)
+	assert.True(t, invited.InvitePending())
+	assert.NotContains(t, *invited.InviteTokenHash, token)
+
+	_, err = users.AcceptInvite("wrong", "password1")
+	assert.ErrorIs(t, err, ErrInviteInvalid)
+
+	accepted, err := users.AcceptInvite(token, "password1")
+	require.NoError(t, err)
+	assert.Equal(t, "guest", accepted.Username)
+
+	_, err = users.AcceptInvite(token, "password1")
+	assert.ErrorIs(t, err, ErrInviteInvalid, "tokens are single use")
+
+	guest, err := users.Get(invited.ID)
+	require.NoError(t, err)
+	assert.False(t, guest.InvitePending())
+	assert.True(t, models.CheckPasswordHash("password1", guest.Password))
+
+	other := uint(site.ID + 1)
+	assert.True(t, users.CanViewSite(guest, &site.ID))
+	assert.False(t, users.CanViewSite(guest, &other))
+	assert.False(t, users.CanViewSite(guest, nil), "viewers can't see all sites at once")
+	assert.True(t, users.CanViewSite(admin, nil))
+
+	allowed, err := users.AllowedSites(guest)
+	require.NoError(t, err)
+	assert.Len(t, allowed, 1)
+}
+
+func TestUserService_DeleteCascades(t *testing.T) {
+	db, err := database.Open(config.DatabaseConfig{Provider: "sqlite", Path: filepath.Join(t.TempDir(), "doorman.db")})
+	require.NoError(t, err)
+	_, err = database.MigrateUp(db)
+	require.NoError(t, err)
+
+	users := NewUserService(db)
+	_, err = users.Create("owner", "password1", models.RoleOwner)
+	require.NoError(t, err)
+	viewer, err := users.Create("viewer", "password1", models.RoleViewer)
+	require.NoError(t, err)
+	site, err := NewSiteService(db).Add("Blog", "blog.example.com")
+	require.NoError(t, err)
+	other, err := NewSiteService(db).Add("Shop", "shop.example.com")
+	require.NoError(t, err)
+	require.NoError(t, db.Create(&[]models.SiteGrant{{UserID: viewer.ID, SiteID: site.ID}, {UserID: viewer.ID, SiteID: other.ID}}).Error)
+	require.NoError(t, db.Create(&models.RecoveryCode{UserID: viewer.ID, CodeHash: "code"}).Error)
+	require.NoError(t, db.Create(&models.APIKey{Name: "ci", Prefix: "dm_", KeyHash: "key", SiteID: &other.ID}).Error)
+
+	// SQLite only honours ON DELETE CASCADE with foreign keys turned on.
+	require.NoError(t, db.Delete(other).Error)
+	count := func(model any) int64 {
+		var n int64
+		require.NoError(t, db.Model(model).Count(&n).Error)
+		return n
+	}
+	assert.Equal(t, int64(1), count(&models.SiteGrant{}), "a deleted site's grants go with it")
+	assert.Zero(t, count(&models.APIKey{}), "a deleted site's API keys go with it")
+
+	require.NoError(t, users.Delete("viewer"))
+	assert.Zero(t, count(&models.SiteGrant{}))
+	assert.Zero(t, count(&models.RecoveryCode{}))
+}
@@ -0,0 +1,218 @@
+// Package sessionstore keeps dashboard sessions in the database so they can
+// expire, be listed and be revoked. It implements gorilla/sessions.Store,
+// so handlers keep using session.Get.
+package sessionstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+// touchInterval limits how often a session's last-seen time is written.
+const touchInterval = time.Minute
+
+type Store struct {
+	DB      *gorm.DB
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+
+	// IPExtractor returns the client IP recorded with new sessions.
+	IPExtractor func(*http.Request) string
+	Now         func() time.Time
+}
+
+// New returns a store whose cookies are signed with cfg.Secret.
+func New(db *gorm.DB, cfg config.SessionConfig) *Store {
+	codec := securecookie.New([]byte(cfg.Secret), nil)
+	codec.MaxAge(int(cfg.AbsoluteTimeout.Seconds()))
+
+	return &Store{
+		DB:     db,
+		Codecs: []securecookie.Codec{codec},
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   int(cfg.AbsoluteTimeout.Seconds()),
+			HttpOnly: true,
+			Secure:   cfg.CookieSecure,
+			SameSite: cfg.SameSite(),
+		},
+		IdleTimeout:     cfg.IdleTimeout,
+		AbsoluteTimeout: cfg.AbsoluteTimeout,
+		IPExtractor:     func(r *http.Request) string { return r.RemoteAddr },
+		Now:             time.Now,
+	}
+}
+
+// Get returns the session for name, cached per request.
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New loads the session referenced by the request's cookie. A missing,
+// forged, expired or revoked session yields a new empty one.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var token string
+	if err := securecookie.DecodeMulti(name, cookie.Value, &token, s.Codecs...); err != nil {
+		return session, nil
+	}
+
+	now := s.Now()
+	var row models.Session
+	err = s.DB.Where("token_hash = ? AND expires_at > ?", models.HashToken(token), now).First(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return session, nil
+	}
+	if err != nil {
+		return session, err
+	}
+
+	if err := decodeValues(row.Data, session.Values); err != nil {
+		return session, nil
+	}
+	session.ID = strconv.FormatUint(uint64(row.ID), 10)
+	session.IsNew = false
+
+	if now.Sub(row.LastSeenAt) >= touchInterval {
+		s.DB.Model(&row).Updates(map[string]interface{}{
+			"last_seen_at": now,
+			"expires_at":   s.expiry(row.CreatedAt, now),
+		})
+	}
+
+	return session, nil
+}
+
+// Save persists the session. A negative MaxAge deletes it.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.DB.Delete(&models.Session{}, session.ID).Error; err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	data, err := encodeValues(session.Values)
+	if err != nil {
+		return err
+	}
+
+	var userID *uint
+	if id, ok := session.Values["user_id"].(uint); ok {
+		userID = &id
+	}
+
+	if session.ID != "" {
+		return s.DB.Model(&models.Session{}).Where("id = ?", session.ID).Updates(map[string]interface{}{
+			"data":    data,
+			"user_id": userID,
+		}).Error
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	now := s.Now()
+	row := models.Session{
+		TokenHash:  models.HashToken(token),
+		UserID:     userID,
+		Data:       data,
+		IPHash:     models.HashIP(s.IPExtractor(r)),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  s.expiry(now, now),
+	}
+	if err := s.DB.Create(&row).Error; err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), token, s.Codecs...)
+	if err != nil {
+		return err
+	}
+
+	session.ID = strconv.FormatUint(uint64(row.ID), 10)
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Renew replaces the session with a fresh one carrying the same values.
+// Call it on login so a session ID planted before authentication is
+// never promoted.
+func Renew(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if store, ok := session.Store().(*Store); ok && session.ID != "" {
+		if err := store.DB.Delete(&models.Session{}, session.ID).Error; err != nil {
+			return err
+		}
+		session.ID = ""
+	}
+	return session.Save(r, w)
+}
+
+func (s *Store) expiry(created, lastSeen time.Time) time.Time {
+	idle := lastSeen.Add(s.IdleTimeout)
+	absolute := created.Add(s.AbsoluteTimeout)
+	if idle.Before(absolute) {
+		return idle
+	}
+	return absolute
+}
+
+func newToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func encodeValues(values map[interface{}]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeValues(data string, values map[interface{}]interface{}) error {
+	if data == "" {
+		return nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(raw)).Decode(&values)
+}
@@ -0,0 +1,136 @@
+package sessionstore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+
+	"github.com/webbesoft/doorman/internal/config"
+	"github.com/webbesoft/doorman/internal/models"
+)
+
+func newTestStore(t *testing.T) (*Store, *time.Time) {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "sessions.db")), &gorm.Config{})
+	require.NoError(t, err)
+	require.NoError(t, db.AutoMigrate(&models.Session{}))
+
+	store := New(db, config.SessionConfig{
+		Secret:          "test-secret-test-secret-test-secret",
+		IdleTimeout:     time.Hour,
+		AbsoluteTimeout: 3 * time.Hour,
+		CookieSameSite:  "lax",
+	})
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.Now = func() time.Time { return now }
+	return store, &now
+}
+
+// request returns a request carrying the cookies set on rec, if any.
+func request(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if rec != nil {
+		for _, c := range rec.Result().Cookies() {
+			r.AddCookie(c)
+		}
+	}
+	return r
+}
+
+func TestStore_RoundTrip(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	sess, err := store.New(request(nil), "session")
+	require.NoError(t, err)
+	assert.True(t, sess.IsNew)
+	sess.Values["user_id"] = uint(7)
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, sess.Save(request(nil), rec))
+	require.NotEmpty(t, sess.ID)
+
+	var row models.Session
+	require.NoError(t, store.DB.First(&row).Error)
+	require.NotNil(t, row.UserID)
+	assert.EqualValues(t, 7, *row.UserID)
+	assert.NotContains(t, rec.Header().Get("Set-Cookie"), row.TokenHash, "only the token hash is stored")
+
+	loaded, err := store.New(request(rec), "session")
+	require.NoError(t, err)
+	assert.False(t, loaded.IsNew)
+	assert.Equal(t, sess.ID, loaded.ID)
+	assert.Equal(t, uint(7), loaded.Values["user_id"])
+}
+
+func TestStore_Expiry(t *testing.T) {
+	store, now := newTestStore(t)
+
+	sess, _ := store.New(request(nil), "session")
+	sess.Values["user_id"] = uint(1)
+	rec := httptest.NewRecorder()
+	require.NoError(t, sess.Save(request(nil), rec))
+
+	// Activity within the idle timeout keeps the session alive...
+	for i := 0; i < 2; i++ {
+		*now = now.Add(50 * time.Minute)
+		loaded, err := store.New(request(rec), "session")
+		require.NoError(t, err)
+		assert.False(t, loaded.IsNew)
+	}
+
+	// ...but not past the absolute timeout.
+	*now = now.Add(50 * time.Minute)
+	loaded, _ := store.New(request(rec), "session")
+	assert.False(t, loaded.IsNew)
+	*now = now.Add(50 * time.Minute)
+	loaded, _ = store.New(request(rec), "session")
+	assert.True(t, loaded.IsNew, "absolute timeout")
+
+	// A fresh session idles out after an hour without requests.
+	sess, _ = store.New(request(nil), "session")
+	rec = httptest.NewRecorder()
+	require.NoError(t, sess.Save(request(nil), rec))
+	*now = now.Add(61 * time.Minute)
+	loaded, _ = store.New(request(rec), "session")
+	assert.True(t, loaded.IsNew, "idle timeout")
+}
+
+func TestStore_RenewAndRevoke(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	// A session that exists before login is replaced, not promoted.
+	sess, _ := store.New(request(nil), "session")
+	sess.Values["pending_user_id"] = uint(1)
+	before := httptest.NewRecorder()
+	require.NoError(t, sess.Save(request(nil), before))
+	planted := sess.ID
+
+	sess, _ = store.New(request(before), "session")
+	sess.Values["user_id"] = uint(1)
+	after := httptest.NewRecorder()
+	require.NoError(t, Renew(request(before), after, sess))
+	assert.NotEqual(t, planted, sess.ID)
+
+	stale, _ := store.New(request(before), "session")
+	assert.True(t, stale.IsNew, "the pre-login session is gone")
+
+	// Deleting the row signs the session out on its next request.
+	require.NoError(t, store.DB.Delete(&models.Session{}, sess.ID).Error)
+	revoked, _ := store.New(request(after), "session")
+	assert.True(t, revoked.IsNew)
+	assert.Empty(t, revoked.Values)
+
+	// Tampered cookies are ignored.
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "forged"})
+	forged, err := store.New(r, "session")
+	require.NoError(t, err)
+	assert.True(t, forged.IsNew)
+}
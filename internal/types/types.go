@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type DashboardMetrics struct {
 	TotalPageVisits int64
 	UniqueVisitors  int64
@@ -12,8 +14,8 @@ type DashboardMetrics struct {
 type TopPage struct {
 	URL          string
 	Visits       int64
-	AvgDwellTime int
-	AvgScroll    int
+	AvgDwellTime float64
+	AvgScroll    float64
 }
 
 type TopReferrer struct {
@@ -32,3 +34,101 @@ type CountryStats struct {
 	Country string
 	Count   int64
 }
+
+// BotRuleStats is how many visits a bot detection rule matched. Kind and
+// Weight are empty for rules that are no longer configured.
+type BotRuleStats struct {
+	Rule   string
+	Kind   string
+	Weight int
+	Hits   int64
+}
+
+// CrawlerStats is how many visits came from a known crawler.
+type CrawlerStats struct {
+	Name   string
+	Visits int64
+}
+
+// BotReasonStats is how many bot visits were flagged for the same set of
+// rules, as stored in Analytics.BotReason.
+type BotReasonStats struct {
+	Reason string
+	Count  int64
+}
+
+// BotFilter selects visits by whether they were flagged as bots.
+type BotFilter int
+
+const (
+	ExcludeBots BotFilter = iota
+	IncludeBots
+	OnlyBots
+)
+
+// StatsFilter narrows dashboard and report queries. Zero values mean no
+// restriction, except that bots are left out unless Bots says otherwise.
+type StatsFilter struct {
+	SiteID *uint
+	From   time.Time
+	To     time.Time
+	Bots   BotFilter
+}
+
+type StatsReport struct {
+	From         time.Time
+	To           time.Time
+	Metrics      DashboardMetrics
+	TopPages     []TopPage
+	TopReferrers []TopReferrer
+	TopCountries []CountryStats
+	Daily        []DailyStats
+}
+
+// EmailReport is a site's summary for the week or month from From to To
+// (exclusive), compared with the period of the same length before it.
+type EmailReport struct {
+	Site         string
+	Frequency    string
+	From         time.Time
+	To           time.Time
+	Current      DashboardMetrics
+	Previous     DashboardMetrics
+	TopPages     []TopPage
+	TopReferrers []TopReferrer
+	// DashboardURL links to the site's dashboard; it's empty when
+	// Doorman's address isn't configured.
+	DashboardURL string
+	// Test marks reports sent from the "Send test report" button.
+	Test bool
+}
+
+// SinkEvent is an accepted tracking event as the event sink forwards it.
+// Visitor is the visitor's hashed IP, as stored.
+type SinkEvent struct {
+	// ID is unique to the event, so receivers can skip events they get
+	// twice after a replay.
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	At          time.Time         `json:"at"`
+	SiteID      *uint             `json:"site_id"`
+	Source      string            `json:"source"`
+	Visitor     string            `json:"visitor"`
+	Country     string            `json:"country,omitempty"`
+	UserAgent   string            `json:"user_agent,omitempty"`
+	URL         string            `json:"url"`
+	Referrer    string            `json:"referrer,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	Props       map[string]string `json:"props,omitempty"`
+	DwellTime   int               `json:"dwell_time,omitempty"`
+	ActiveTime  int               `json:"active_time,omitempty"`
+	ScrollDepth int               `json:"scroll_depth,omitempty"`
+}
+
+// TwoFactorSetup is shown while a user enrolls an authenticator app.
+type TwoFactorSetup struct {
+	// QRCode is an inline SVG of the otpauth:// URL.
+	QRCode string
+	// Secret is the base32 key for manual entry.
+	Secret string
+}
@@ -0,0 +1,58 @@
+package webhook
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned for webhooks on loopback, link-local or
+// private addresses when those aren't allowed.
+var ErrPrivateAddress = errors.New("webhook address is loopback, link-local or private")
+
+// Private reports whether ip is a loopback, link-local, private or
+// unspecified address, which a webhook shouldn't reach inside the network
+// Doorman runs in.
+func Private(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified()
+}
+
+// CheckHost returns ErrPrivateAddress when host, the host of a webhook
+// URL, is a private address or a name for the local machine. Other names
+// are only known once resolved, so PublicClient checks them when it
+// connects.
+func CheckHost(host string) error {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return ErrPrivateAddress
+	}
+	if ip := net.ParseIP(host); ip != nil && Private(ip) {
+		return ErrPrivateAddress
+	}
+	return nil
+}
+
+// PublicClient returns a client that refuses to connect to private
+// addresses, whatever names resolve to them.
+func PublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || Private(ip) {
+				return ErrPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
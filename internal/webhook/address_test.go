@@ -0,0 +1,47 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckHost(t *testing.T) {
+	for host, private := range map[string]bool{
+		"hooks.example.com":   false,
+		"93.184.215.14":       false,
+		"2606:4700::1111":     false,
+		"localhost":           true,
+		"app.localhost.":      true,
+		"127.0.0.1":           true,
+		"10.1.2.3":            true,
+		"192.168.1.1":         true,
+		"169.254.169.254":     true,
+		"0.0.0.0":             true,
+		"::1":                 true,
+		"fd00::1":             true,
+		"fe80::1":             true,
+		"HOOKS.EXAMPLE.COM.":  false,
+		"172.16.0.1":          true,
+		"172.32.0.1":          false,
+		"100.64.0.1":          false,
+		"::ffff:192.168.0.10": true,
+	} {
+		if err := CheckHost(host); (err != nil) != private {
+			t.Errorf("CheckHost(%q) = %v, want private %v", host, err, private)
+		}
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	err := Post(context.Background(), PublicClient(time.Second), srv.URL, "secret", "alert.test", []byte(`{}`))
+	if !errors.Is(err, ErrPrivateAddress) {
+		t.Fatalf("expected the loopback server to be refused, got %v", err)
+	}
+}
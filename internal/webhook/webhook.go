@@ -0,0 +1,108 @@
+// Package webhook posts JSON to HTTP endpoints. Requests are signed with
+// an HMAC of their body so receivers can tell they came from Doorman.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries the signature made by Sign.
+const SignatureHeader = "X-Doorman-Signature"
+
+// EventHeader names what a request is about, such as alert.firing.
+const EventHeader = "X-Doorman-Event"
+
+var ErrBadSignature = errors.New("webhook signature is invalid")
+
+// StatusError is returned for responses outside the 2xx range.
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("webhook returned %d", e.Code)
+	}
+	return fmt.Sprintf("webhook returned %d: %s", e.Code, e.Body)
+}
+
+// Sign returns the signature of body sent at t:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">".
+// Including the time lets receivers reject old requests played again.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks a signature made by Sign that is at most tolerance old.
+func Verify(secret, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	var ts, sum string
+	for _, part := range strings.Split(signature, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sum = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return ErrBadSignature
+	}
+	want, err := hex.DecodeString(sum)
+	if err != nil || !hmac.Equal(want, mac(secret, ts, body)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Post sends body to url as JSON, signed with secret, and fails unless
+// the response is 2xx.
+func Post(ctx context.Context, client *http.Client, url, secret, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Doorman-Webhook/1")
+	req.Header.Set(EventHeader, event)
+	req.Header.Set(SignatureHeader, Sign(secret, time.Now(), body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// A little of the response helps tell why a receiver refused.
+	snippet, _ := io.ReadAll(io.LimitReader(res.Body, 256))
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StatusError{Code: res.StatusCode, Body: strings.TrimSpace(string(snippet))}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"type":"alert.firing"}`)
+	at := time.Unix(1760000000, 0)
+	sig := Sign("secret", at, body)
+	if sig != "t=1760000000,v1=997c45a5b76fcbaccaf93b82ac895b97fd8f2ee8d4d780a5b88b403269e4643e" {
+		t.Fatalf("unexpected signature %q", sig)
+	}
+
+	if err := Verify("secret", sig, body, at.Add(time.Minute), 5*time.Minute); err != nil {
+		t.Fatalf("expected the signature to verify: %v", err)
+	}
+	for name, check := range map[string]error{
+		"wrong secret": Verify("other", sig, body, at, 5*time.Minute),
+		"changed body": Verify("secret", sig, []byte(`{}`), at, 5*time.Minute),
+		"too old":      Verify("secret", sig, body, at.Add(time.Hour), 5*time.Minute),
+		"malformed":    Verify("secret", "v1=abc", body, at, 5*time.Minute),
+	} {
+		if !errors.Is(check, ErrBadSignature) {
+			t.Errorf("%s: expected ErrBadSignature, got %v", name, check)
+		}
+	}
+}
+
+func TestPost(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, "nope")
+	}))
+	defer srv.Close()
+
+	payload := []byte(`{"text":"hello"}`)
+	if err := Post(context.Background(), srv.Client(), srv.URL, "secret", "alert.test", payload); err != nil {
+		t.Fatalf("post failed: %v", err)
+	}
+	if got.Header.Get(EventHeader) != "alert.test" || got.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected headers %v", got.Header)
+	}
+	if err := Verify("secret", got.Header.Get(SignatureHeader), body, time.Now(), time.Minute); err != nil {
+		t.Fatalf("expected a valid signature: %v", err)
+	}
+
+	status = http.StatusBadGateway
+	err := Post(context.Background(), srv.Client(), srv.URL, "secret", "alert.test", payload)
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.Code != http.StatusBadGateway || serr.Body != "nope" {
+		t.Fatalf("expected a status error, got %v", err)
+	}
+}
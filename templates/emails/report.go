@@ -0,0 +1,97 @@
+package emails
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/webbesoft/doorman/internal/mailer"
+	"github.com/webbesoft/doorman/internal/models"
+	"github.com/webbesoft/doorman/internal/types"
+)
+
+// ReportSubject is the subject line of a report email.
+func ReportSubject(r types.EmailReport) string {
+	subject := fmt.Sprintf("%s report for %s: %s", title(r.Frequency), r.Site, period(r))
+	if r.Test {
+		subject = "[Test] " + subject
+	}
+	return subject
+}
+
+// RenderReport renders r as a report email, leaving the recipient to the
+// caller.
+func RenderReport(ctx context.Context, r types.EmailReport) (mailer.Message, error) {
+	var text, html strings.Builder
+	if err := ReportText(r).Render(ctx, &text); err != nil {
+		return mailer.Message{}, err
+	}
+	if err := ReportHTML(r).Render(ctx, &html); err != nil {
+		return mailer.Message{}, err
+	}
+	return mailer.Message{
+		Subject: ReportSubject(r),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+func title(frequency string) string {
+	if frequency == models.ReportMonthly {
+		return "Monthly"
+	}
+	return "Weekly"
+}
+
+func unit(frequency string) string {
+	if frequency == models.ReportMonthly {
+		return "month"
+	}
+	return "week"
+}
+
+// period names the report's days, such as "12 Oct – 18 Oct 2026" or
+// "October 2026".
+func period(r types.EmailReport) string {
+	if r.Frequency == models.ReportMonthly {
+		return r.From.Format("January 2006")
+	}
+	last := r.To.AddDate(0, 0, -1)
+	return r.From.Format("2 Jan") + " – " + last.Format("2 Jan 2006")
+}
+
+// count formats n with thousands separators.
+func count(n int64) string {
+	s := strconv.FormatInt(n, 10)
+	if n < 0 {
+		return "-" + count(-n)
+	}
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// change describes how cur differs from prev in percent.
+func change(cur, prev int64) string {
+	switch {
+	case prev == 0 && cur == 0:
+		return "no change"
+	case prev == 0:
+		return "new"
+	case cur == prev:
+		return "no change"
+	}
+	return fmt.Sprintf("%+.0f%%", float64(cur-prev)/float64(prev)*100)
+}
+
+// pagePath shortens a page URL to its path, as the site is already known.
+func pagePath(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	return u.RequestURI()
+}